@@ -0,0 +1,538 @@
+package main
+
+// Bitmap commands, working on the bits of string values.
+// Bits are numbered from the most significant bit of the first byte, like in Redis
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "setbit", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).setbitCommand,
+			Group: "bitmap", Summary: "Sets or clears the bit at offset of the string value. Creates the key if it doesn't exist.", Since: "2.2.0", Complexity: "O(1)"},
+		&Command{Name: "getbit", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getbitCommand,
+			Group: "bitmap", Summary: "Returns a bit value by offset.", Since: "2.2.0", Complexity: "O(1)"},
+		&Command{Name: "bitcount", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).bitcountCommand,
+			Group: "bitmap", Summary: "Counts the number of set bits (population counting) in a string.", Since: "2.6.0", Complexity: "O(N)"},
+		&Command{Name: "bitpos", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).bitposCommand,
+			Group: "bitmap", Summary: "Finds the first set (1) or clear (0) bit in a string.", Since: "2.8.7", Complexity: "O(N)"},
+		&Command{Name: "bitop", Arity: -4, Flags: FlagWrite, FirstKey: 2, LastKey: -1, Step: 1, Handler: (*Server).bitopCommand,
+			Group: "bitmap", Summary: "Performs bitwise operations on multiple strings, and stores the result.", Since: "2.6.0", Complexity: "O(N)"},
+		&Command{Name: "bitfield", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).bitfieldCommand,
+			Group: "bitmap", Summary: "Performs arbitrary bitfield integer operations on strings.", Since: "3.2.0", Complexity: "O(1) for each subcommand specified"},
+		&Command{Name: "bitfield_ro", Arity: -2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).bitfieldCommand,
+			Group: "bitmap", Summary: "Performs arbitrary read-only bitfield integer operations on strings.", Since: "6.0.0", Complexity: "O(1) for each subcommand specified"},
+	)
+}
+
+var errBitOffset = fmt.Errorf("bit offset is not an integer or out of range")
+
+// parseBitOffset parses the offset of a bit, or of a field of the given width.
+// With hash set the offset is "#N": the N-th field of the width
+func (s *Server) parseBitOffset(arg string, hash bool, width int64) (int64, error) {
+	if hash {
+		if !strings.HasPrefix(arg, "#") {
+			return 0, errBitOffset
+		}
+		arg = arg[1:]
+	}
+	offset, err := parseInt(arg)
+	if err != nil || offset < 0 {
+		return 0, errBitOffset
+	}
+	if hash {
+		if offset > math.MaxInt64/width {
+			return 0, errBitOffset
+		}
+		offset *= width
+	}
+	if offset>>3 >= s.limits.MaxBulkLen {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+// getBit returns the bit at the offset, bits past the end of the string are 0
+func getBit(value []byte, offset int64) byte {
+	if offset>>3 >= int64(len(value)) {
+		return 0
+	}
+	return value[offset>>3] >> (7 - offset&7) & 1
+}
+
+// setBit sets the bit at the offset, the value must be long enough
+func setBit(value []byte, offset int64, bit byte) {
+	mask := byte(1) << (7 - offset&7)
+	if bit == 1 {
+		value[offset>>3] |= mask
+		return
+	}
+	value[offset>>3] &^= mask
+}
+
+// grow pads the value with zero bytes to hold the bit at the offset. The value is only reallocated
+// if its capacity is exceeded, with spare room like append, so growing bit by bit is amortized O(1)
+func grow(value []byte, offset int64) []byte {
+	if need := int(offset>>3) + 1; need > len(value) {
+		value = append(value, make([]byte, need-len(value))...)
+	}
+	return value
+}
+
+// SETBIT key offset value
+func (s *Server) setbitCommand(c *Client, args []string) error {
+	offset, err := s.parseBitOffset(args[2], false, 1)
+	if err != nil {
+		return err
+	}
+	if args[3] != "0" && args[3] != "1" {
+		return fmt.Errorf("bit is not an integer or out of range")
+	}
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+
+	// the bit is flipped in place
+	value := grow(old, offset)
+	bit := getBit(value, offset)
+	setBit(value, offset, args[3][0]-'0')
+	if e == nil || len(value) != len(old) {
+		s.setString(args[1], value, e)
+	}
+	c.w.WriteInteger(int64(bit))
+	return nil
+}
+
+// GETBIT key offset
+func (s *Server) getbitCommand(c *Client, args []string) error {
+	offset, err := s.parseBitOffset(args[2], false, 1)
+	if err != nil {
+		return err
+	}
+	value, _, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(getBit(value, offset)))
+	return nil
+}
+
+// bitRange converts the start and end of BITCOUNT and BITPOS to the first and the last bit,
+// negative offsets count from the end. The unit is a byte unless bit is set
+func bitRange(start, end, length int64, bit bool) (int64, int64) {
+	if bit {
+		length *= 8
+	}
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = max(length+end, 0)
+	}
+	end = min(end, length-1)
+	if !bit {
+		start, end = start*8, end*8+7
+	}
+	return start, end
+}
+
+// parseBitUnit parses the BYTE | BIT option, returns true for BIT
+func parseBitUnit(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "BYTE":
+		return false, nil
+	case "BIT":
+		return true, nil
+	}
+	return false, errSyntax
+}
+
+// BITCOUNT key [start end [BYTE | BIT]]
+func (s *Server) bitcountCommand(c *Client, args []string) error {
+	var start, end int64
+	var bit, ranged bool
+	switch len(args) {
+	case 2:
+	case 4, 5:
+		var err error
+		if start, err = parseInt(args[2]); err != nil {
+			return err
+		}
+		if end, err = parseInt(args[3]); err != nil {
+			return err
+		}
+		if len(args) == 5 {
+			if bit, err = parseBitUnit(args[4]); err != nil {
+				return err
+			}
+		}
+		ranged = true
+	default:
+		return errSyntax
+	}
+
+	value, _, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	if !ranged {
+		start, end = 0, -1
+	}
+	if start < 0 && end < 0 && start > end {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	first, last := bitRange(start, end, int64(len(value)), bit)
+	c.w.WriteInteger(countBits(value, first, last))
+	return nil
+}
+
+// countBits counts the set bits between the first and the last bit, both included
+func countBits(value []byte, first, last int64) int64 {
+	count := int64(0)
+	for first <= last {
+		// whole bytes at once
+		if first&7 == 0 && first+7 <= last {
+			count += int64(bits.OnesCount8(value[first>>3]))
+			first += 8
+			continue
+		}
+		count += int64(getBit(value, first))
+		first++
+	}
+	return count
+}
+
+// BITPOS key bit [start [end [BYTE | BIT]]]
+// Looking for 0 without an end, the string is considered padded with zeros on the right
+func (s *Server) bitposCommand(c *Client, args []string) error {
+	if args[2] != "0" && args[2] != "1" {
+		return fmt.Errorf("The bit argument must be 1 or 0.")
+	}
+	bit := args[2][0] - '0'
+	start, end := int64(0), int64(-1)
+	var unitBit bool
+	var err error
+	if len(args) > 6 {
+		return errSyntax
+	}
+	if len(args) >= 4 {
+		if start, err = parseInt(args[3]); err != nil {
+			return err
+		}
+	}
+	if len(args) >= 5 {
+		if end, err = parseInt(args[4]); err != nil {
+			return err
+		}
+	}
+	if len(args) == 6 {
+		if unitBit, err = parseBitUnit(args[5]); err != nil {
+			return err
+		}
+	}
+
+	value, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		c.w.WriteInteger(-int64(bit))
+		return nil
+	}
+
+	first, last := bitRange(start, end, int64(len(value)), unitBit)
+	if first > last {
+		c.w.WriteInteger(-1)
+		return nil
+	}
+	pos := findBit(value, bit, first, last)
+	if pos == -1 && bit == 0 && len(args) < 5 {
+		pos = last + 1
+	}
+	c.w.WriteInteger(pos)
+	return nil
+}
+
+// findBit returns the position of the first bit of the value between the first and the last bit,
+// both included, -1 if there is none
+func findBit(value []byte, bit byte, first, last int64) int64 {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for first <= last {
+		// whole bytes without the bit at once
+		if first&7 == 0 && first+7 <= last && value[first>>3] == skip {
+			first += 8
+			continue
+		}
+		if getBit(value, first) == bit {
+			return first
+		}
+		first++
+	}
+	return -1
+}
+
+// BITOP <AND | OR | XOR | NOT> destkey key [key ...]
+// Missing keys are empty strings, shorter strings are padded with zeros
+func (s *Server) bitopCommand(c *Client, args []string) error {
+	op := strings.ToUpper(args[1])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 4 {
+			return fmt.Errorf("BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return errSyntax
+	}
+
+	sources := make([][]byte, 0, len(args)-3)
+	length := 0
+	for _, key := range args[3:] {
+		value, _, err := s.getString(key)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, value)
+		length = max(length, len(value))
+	}
+
+	res := make([]byte, length)
+	for i := range res {
+		var b byte
+		for j, src := range sources {
+			var sb byte
+			if i < len(src) {
+				sb = src[i]
+			}
+			switch {
+			case op == "NOT":
+				b = ^sb
+			case j == 0:
+				b = sb
+			case op == "AND":
+				b &= sb
+			case op == "OR":
+				b |= sb
+			case op == "XOR":
+				b ^= sb
+			}
+		}
+		res[i] = b
+	}
+
+	dest := args[2]
+	if length == 0 {
+		s.storage.Del(dest)
+	} else {
+		s.storage.Set(dest, res, time.Time{})
+	}
+	c.w.WriteInteger(int64(length))
+	return nil
+}
+
+// bitfieldOp is a GET, SET or INCRBY subcommand of BITFIELD
+type bitfieldOp struct {
+	name     string
+	signed   bool
+	width    int64
+	offset   int64
+	value    int64  // value of SET, increment of INCRBY
+	overflow string // WRAP, SAT or FAIL, set by the OVERFLOW before the subcommand
+}
+
+// parseBitfieldType parses a type like i16 or u8, u64 is not supported as replies are signed
+func parseBitfieldType(arg string) (bool, int64, error) {
+	err := fmt.Errorf("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u' && arg[0] != 'I' && arg[0] != 'U') {
+		return false, 0, err
+	}
+	signed := arg[0] == 'i' || arg[0] == 'I'
+	width, perr := parseInt(arg[1:])
+	if perr != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, err
+	}
+	return signed, width, nil
+}
+
+// BITFIELD key [GET encoding offset | [OVERFLOW <WRAP | SAT | FAIL>] <SET encoding offset value | INCRBY encoding offset increment> ...],
+// BITFIELD_RO key [GET encoding offset ...]
+func (s *Server) bitfieldCommand(c *Client, args []string) error {
+	readonly := strings.ToLower(args[0]) == "bitfield_ro"
+	ops := []bitfieldOp{}
+	overflow := "WRAP"
+	writes := false
+
+	for i := 2; i < len(args); i++ {
+		name := strings.ToUpper(args[i])
+		remaining := len(args) - i - 1
+		switch {
+		case name == "OVERFLOW" && remaining >= 1:
+			overflow = strings.ToUpper(args[i+1])
+			if overflow != "WRAP" && overflow != "SAT" && overflow != "FAIL" {
+				return fmt.Errorf("Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		case name == "GET" && remaining >= 2:
+		case (name == "SET" || name == "INCRBY") && remaining >= 3:
+		default:
+			return errSyntax
+		}
+
+		op := bitfieldOp{name: name, overflow: overflow}
+		var err error
+		if op.signed, op.width, err = parseBitfieldType(args[i+1]); err != nil {
+			return err
+		}
+		hash := strings.HasPrefix(args[i+2], "#")
+		if op.offset, err = s.parseBitOffset(args[i+2], hash, op.width); err != nil {
+			return err
+		}
+		i += 2
+		if name != "GET" {
+			if readonly {
+				return fmt.Errorf("BITFIELD_RO only supports the GET subcommand")
+			}
+			if op.value, err = parseInt(args[i+1]); err != nil {
+				return err
+			}
+			writes = true
+			i++
+		}
+		ops = append(ops, op)
+	}
+
+	// fields are changed in place, the key is only stored again if it grew or is new
+	value, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	size := len(value)
+	if writes {
+		for _, op := range ops {
+			if op.name != "GET" {
+				value = grow(value, op.offset+op.width-1)
+			}
+		}
+	} else {
+		c.rewriteCommand()
+	}
+
+	c.w.WriteArrayHeader(len(ops))
+	for _, op := range ops {
+		old := getField(value, op.offset, op.width)
+		if op.signed {
+			// sign extension
+			old = uint64(int64(old<<(64-op.width)) >> (64 - op.width))
+		}
+		if op.name == "GET" {
+			c.w.WriteInteger(int64(old))
+			continue
+		}
+
+		var res uint64
+		var ok bool
+		switch {
+		case op.signed && op.name == "SET":
+			var v int64
+			v, ok = overflowSigned(op.value, 0, op.width, op.overflow)
+			res = uint64(v)
+		case op.signed:
+			var v int64
+			v, ok = overflowSigned(int64(old), op.value, op.width, op.overflow)
+			res = uint64(v)
+		case op.name == "SET":
+			res, ok = overflowUnsigned(uint64(op.value), 0, op.width, op.overflow)
+		default:
+			res, ok = overflowUnsigned(old, op.value, op.width, op.overflow)
+		}
+		if !ok {
+			c.w.WriteNull()
+			continue
+		}
+		setField(value, op.offset, op.width, res)
+		if op.name == "SET" {
+			c.w.WriteInteger(int64(old))
+		} else {
+			c.w.WriteInteger(int64(res))
+		}
+	}
+
+	if writes && (e == nil || len(value) != size) {
+		s.setString(args[1], value, e)
+	}
+	return nil
+}
+
+// getField reads the unsigned field of the width at the offset
+func getField(value []byte, offset, width int64) uint64 {
+	res := uint64(0)
+	for i := range width {
+		res = res<<1 | uint64(getBit(value, offset+i))
+	}
+	return res
+}
+
+// setField writes the lowest bits of the field of the width at the offset, the value must be long enough
+func setField(value []byte, offset, width int64, field uint64) {
+	for i := range width {
+		setBit(value, offset+i, byte(field>>(width-1-i)&1))
+	}
+}
+
+// overflowUnsigned adds the increment to the value of an unsigned field of the width,
+// handling an overflow by the mode. Returns false if the mode is FAIL and the result overflows
+func overflowUnsigned(value uint64, incr, width int64, mode string) (uint64, bool) {
+	limit := uint64(1)<<width - 1
+	wrapped := (value + uint64(incr)) & limit
+	var saturated uint64
+	switch {
+	case value > limit || (incr > 0 && uint64(incr) > limit-value):
+		saturated = limit
+	case incr < 0 && uint64(-incr) > value:
+		saturated = 0
+	default:
+		return wrapped, true
+	}
+	switch mode {
+	case "FAIL":
+		return 0, false
+	case "SAT":
+		return saturated, true
+	}
+	return wrapped, true
+}
+
+// overflowSigned adds the increment to the value of a signed field of the width,
+// handling an overflow by the mode. Returns false if the mode is FAIL and the result overflows
+func overflowSigned(value, incr, width int64, mode string) (int64, bool) {
+	limit := int64(uint64(1)<<(width-1) - 1)
+	shift := 64 - width
+	wrapped := int64((uint64(value)+uint64(incr))<<shift) >> shift
+	var saturated int64
+	switch {
+	case value > limit || (incr > 0 && value > limit-incr):
+		saturated = limit
+	case value < -limit-1 || (incr < 0 && value < -limit-1-incr):
+		saturated = -limit - 1
+	default:
+		return wrapped, true
+	}
+	switch mode {
+	case "FAIL":
+		return 0, false
+	case "SAT":
+		return saturated, true
+	}
+	return wrapped, true
+}
@@ -0,0 +1,203 @@
+package main
+
+// Blocking commands: clients waiting for keys to get data, served in the order they blocked
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+// waiter is a client blocked by a command until one of the keys gets data or the deadline passes
+type waiter struct {
+	client   *Client
+	cmd      *Command
+	args     []string
+	keys     []string
+	typ      string        // type of the values the command waits for, as reported by TYPE
+	deadline time.Time     // zero to wait forever
+	done     chan struct{} // closed once the command is executed again for the client
+}
+
+// parseTimeout parses the timeout of a blocking command in seconds into a deadline, zero to wait forever
+func parseTimeout(arg string, now time.Time) (time.Time, error) {
+	timeout, err := parseFloat(arg)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timeout is not a float or out of range")
+	}
+	if timeout < 0 {
+		return time.Time{}, fmt.Errorf("timeout is negative")
+	}
+	if timeout > math.MaxInt64/float64(time.Second) {
+		return time.Time{}, fmt.Errorf("timeout is out of range")
+	}
+	if timeout == 0 {
+		return time.Time{}, nil
+	}
+	return now.Add(time.Duration(timeout * float64(time.Second))), nil
+}
+
+// block blocks the client on the keys, the command is executed again once one of them gets a value of the type.
+// Nothing is replied until then. The connection to the master never blocks, it gets a null reply,
+// just like a client whose timeout has passed. A client blocked again, after the keys got values
+// taken by other clients first, keeps the deadline it blocked with the first time
+func (s *Server) block(c *Client, args []string, typ string, keys []string, deadline time.Time) error {
+	c.rewriteCommand()
+	if c.master || c.conn == nil {
+		c.w.WriteNullArray()
+		return nil
+	}
+	if c.served != nil {
+		deadline = c.served.deadline
+	}
+
+	cmd, _ := lookupCommand(args[0])
+	w := &waiter{client: c, cmd: cmd, args: args, keys: keys, typ: typ, deadline: deadline, done: make(chan struct{})}
+	if s.blocked == nil {
+		s.blocked = map[string][]*waiter{}
+	}
+	for _, key := range keys {
+		s.blocked[key] = append(s.blocked[key], w)
+	}
+	c.waiter = w
+	log.Printf("[DEBUG] [%s] client %d blocked on %q", s.role, c.id, keys)
+	return nil
+}
+
+// unblock removes the waiter from the queues of its keys, the execution lock must be held
+func (s *Server) unblock(w *waiter) {
+	for _, key := range w.keys {
+		queue := s.blocked[key]
+		for i, other := range queue {
+			if other == w {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.blocked, key)
+			continue
+		}
+		s.blocked[key] = queue
+	}
+	if w.client.waiter == w {
+		w.client.waiter = nil
+	}
+}
+
+// signalKeys marks the keys as ready if clients are blocked on them, the execution lock must be held
+func (s *Server) signalKeys(keys []string) {
+	for _, key := range keys {
+		if len(s.blocked[key]) > 0 {
+			s.readyKeys = append(s.readyKeys, key)
+		}
+	}
+}
+
+// serveBlocked executes the commands of the clients blocked on the ready keys, first blocked first served,
+// while the keys hold values of the types they wait for. Commands served this way may make more keys ready.
+// The execution lock must be held
+func (s *Server) serveBlocked() {
+	for len(s.readyKeys) > 0 {
+		key := s.readyKeys[0]
+		s.readyKeys = s.readyKeys[1:]
+		for {
+			e, ok := s.storage.lookup(key)
+			if !ok {
+				break
+			}
+			var next *waiter
+			for _, w := range s.blocked[key] {
+				if w.typ == typeName(e.value) {
+					next = w
+					break
+				}
+			}
+			if next == nil {
+				break
+			}
+			s.unblock(next)
+			next.client.served = next
+			s.call(next.cmd, next.client, next.args)
+			next.client.served = nil
+			close(next.done)
+		}
+	}
+}
+
+// waitUnblocked waits until the blocked client is served or its deadline passes,
+// its replies are written but not flushed. An error is returned if the client disconnects meanwhile
+func (s *Server) waitUnblocked(c *Client, reader *resp.Reader) error {
+	// most of the time the command is served right away, nothing to watch then
+	s.lock.Lock()
+	blocked := c.waiter != nil
+	s.lock.Unlock()
+	if !blocked {
+		return nil
+	}
+
+	// the connection is watched for a disconnection, unless there is more input already
+	var watch chan error
+	if reader.Buffered() == 0 {
+		watch = make(chan error, 1)
+		go func() {
+			watch <- reader.Wait()
+		}()
+		defer func() {
+			if watch == nil {
+				return
+			}
+			// interrupt the watch, the reader must be left alone before reading the next command
+			c.conn.SetReadDeadline(time.Now())
+			<-watch
+			c.conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	for {
+		s.lock.Lock()
+		w := c.waiter
+		s.lock.Unlock()
+		if w == nil {
+			return nil
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !w.deadline.IsZero() {
+			timer = time.NewTimer(time.Until(w.deadline))
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-w.done:
+			// the command may have blocked the client again
+		case <-timeout:
+			s.lock.Lock()
+			if c.waiter == w {
+				s.unblock(w)
+				c.w.WriteNullArray()
+			}
+			s.lock.Unlock()
+		case err = <-watch:
+			// no error means more input: the client is alive, no need to watch anymore
+			watch = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			s.lock.Lock()
+			if c.waiter == w {
+				s.unblock(w)
+			}
+			s.lock.Unlock()
+			return err
+		}
+	}
+}
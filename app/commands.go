@@ -0,0 +1,348 @@
+package main
+
+// Command table: every command is registered once with its arity, flags and key positions,
+// dispatch, arity checks, read-only replicas and propagation are driven by the table
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// CommandFlag describes the behavior of a command
+type CommandFlag int
+
+const (
+	FlagWrite       CommandFlag = 1 << iota // may modify the dataset, propagated to replicas
+	FlagReadonly                            // only reads the dataset
+	FlagAdmin                               // server administration and replication
+	FlagFast                                // O(1) or O(log N), never blocks the server for long
+	FlagNoscript                            // not allowed in scripts
+	FlagBlocking                            // may block the client until keys get data
+	FlagMovableKeys                         // key positions depend on the arguments, e.g. on a numkeys argument
+)
+
+// commandFlagNames are the flag names in the order Redis reports them
+var commandFlagNames = []struct {
+	flag CommandFlag
+	name string
+}{
+	{FlagWrite, "write"},
+	{FlagReadonly, "readonly"},
+	{FlagAdmin, "admin"},
+	{FlagNoscript, "noscript"},
+	{FlagBlocking, "blocking"},
+	{FlagFast, "fast"},
+	{FlagMovableKeys, "movablekeys"},
+}
+
+// Names returns the names of the flags that are set
+func (f CommandFlag) Names() []string {
+	names := []string{}
+	for _, fn := range commandFlagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// Command is an entry of the command table
+type Command struct {
+	Name     string      // lowercase name
+	Arity    int         // number of arguments including the name, negative means at least -Arity
+	Flags    CommandFlag // behavior of the command
+	FirstKey int         // position of the first key argument, 0 if there are no keys
+	LastKey  int         // position of the last key argument, negative counts from the end
+	Step     int         // step between the key arguments
+
+	// documentation reported by COMMAND DOCS
+	Group      string // connection, server, string, ...
+	Summary    string
+	Since      string // version of Redis the command appeared in
+	Complexity string
+
+	// Handler executes the command and writes the reply.
+	// Errors returned are written to the client as error replies
+	Handler func(s *Server, c *Client, args []string) error
+}
+
+// commandTable is the registry of the commands by lowercase name
+var commandTable = map[string]*Command{}
+
+// registerCommands adds commands to the table, called from init of the files implementing them
+func registerCommands(cmds ...*Command) {
+	for _, cmd := range cmds {
+		if _, ok := commandTable[cmd.Name]; ok {
+			panic("command registered twice: " + cmd.Name)
+		}
+		commandTable[cmd.Name] = cmd
+	}
+}
+
+// lookupCommand finds a command by its case-insensitive name
+func lookupCommand(name string) (*Command, bool) {
+	cmd, ok := commandTable[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// checkArity tells if the number of arguments suits the command
+func (cmd *Command) checkArity(argc int) bool {
+	if cmd.Arity < 0 {
+		return argc >= -cmd.Arity
+	}
+	return argc == cmd.Arity
+}
+
+// handleCommand looks the command up, checks it and executes it.
+// Write commands executed successfully are propagated to replicas
+func (s *Server) handleCommand(args []string, client *Client) error {
+	log.Printf("[DEBUG] [%s] %s command: %q", s.role, strings.ToUpper(args[0]), args)
+
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		var sb strings.Builder
+		for _, arg := range args[1:] {
+			fmt.Fprintf(&sb, "'%s' ", arg)
+		}
+		return s.replyError(client, fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", args[0], sb.String()))
+	}
+	if !cmd.checkArity(len(args)) {
+		return s.replyError(client, fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.Name))
+	}
+	if cmd.Flags&FlagWrite != 0 && s.role == RoleSlave && !client.master {
+		return s.replyError(client, fmt.Errorf("READONLY You can't write against a read only replica."))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.call(cmd, client, args)
+	// the command may have fed keys clients are blocked on
+	s.serveBlocked()
+	s.propagateExpired()
+	return err
+}
+
+// call executes the command and propagates it, the execution lock must be held.
+// Keys expired on access are propagated first, whatever the command does
+func (s *Server) call(cmd *Command, client *Client, args []string) error {
+	client.rewritten, client.rewrite = false, nil
+	s.storage.SetExpireMode(s.expireMode(client))
+	err := cmd.Handler(s, client, args)
+	s.propagateExpired()
+	if err != nil {
+		return s.replyError(client, err)
+	}
+	if cmd.Flags&FlagWrite == 0 {
+		return nil
+	}
+
+	if s.role == RoleMaster {
+		if !client.rewritten {
+			client.rewrite = [][]string{args}
+		}
+		for _, cmd := range client.rewrite {
+			s.propagate(cmd)
+		}
+	}
+	s.signalKeys(cmd.keys(args))
+	return nil
+}
+
+// keys returns the key arguments of the command, as told by its key specification
+func (cmd *Command) keys(args []string) []string {
+	if cmd.FirstKey == 0 {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	keys := []string{}
+	for i := cmd.FirstKey; i <= last && i < len(args); i += max(cmd.Step, 1) {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// rewriteCommand replaces the command being executed with the given ones for propagation,
+// e.g. to make it deterministic. Nothing is propagated if no commands are given
+func (c *Client) rewriteCommand(cmds ...[]string) {
+	c.rewritten = true
+	c.rewrite = cmds
+}
+
+// errorCodes are the codes error messages may start with, the rest get the generic ERR code
+var errorCodes = []string{"ERR", "WRONGTYPE", "NOPROTO", "WRONGPASS", "READONLY"}
+
+// replyError writes the error reply, prefixed with the ERR code unless it has its own.
+// Error replies are a single line, so line breaks are replaced with spaces
+func (s *Server) replyError(client *Client, err error) error {
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	if code, _, _ := strings.Cut(msg, " "); !slices.Contains(errorCodes, code) {
+		msg = "ERR " + msg
+	}
+	client.w.WriteError(msg)
+	return err
+}
+
+func init() {
+	registerCommands(
+		&Command{Name: "command", Arity: -1, Handler: (*Server).commandCommand,
+			Group: "server", Summary: "Returns detailed information about all commands.", Since: "2.8.13", Complexity: "O(N) where N is the total number of Redis commands"},
+	)
+}
+
+// sortedCommands returns the commands of the table sorted by name
+func sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(commandTable))
+	for _, cmd := range commandTable {
+		cmds = append(cmds, cmd)
+	}
+	slices.SortFunc(cmds, func(a, b *Command) int { return strings.Compare(a.Name, b.Name) })
+	return cmds
+}
+
+// COMMAND [COUNT | LIST | INFO [command-name ...] | DOCS [command-name ...]]
+func (s *Server) commandCommand(c *Client, args []string) error {
+	if len(args) == 1 {
+		cmds := sortedCommands()
+		c.w.WriteArrayHeader(len(cmds))
+		for _, cmd := range cmds {
+			writeCommandInfo(c, cmd)
+		}
+		return nil
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "COUNT":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'command|count' command")
+		}
+		c.w.WriteInteger(int64(len(commandTable)))
+
+	case "LIST":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'command|list' command")
+		}
+		cmds := sortedCommands()
+		c.w.WriteArrayHeader(len(cmds))
+		for _, cmd := range cmds {
+			c.w.WriteBulkString(cmd.Name)
+		}
+
+	case "INFO":
+		// all the commands if none are given, null for the unknown ones
+		if len(args) == 2 {
+			return s.commandCommand(c, args[:1])
+		}
+		c.w.WriteArrayHeader(len(args) - 2)
+		for _, name := range args[2:] {
+			cmd, ok := lookupCommand(name)
+			if !ok {
+				c.w.WriteNullArray()
+				continue
+			}
+			writeCommandInfo(c, cmd)
+		}
+
+	case "DOCS":
+		// all the commands if none are given, the unknown ones are skipped
+		cmds := sortedCommands()
+		if len(args) > 2 {
+			cmds = cmds[:0]
+			for _, name := range args[2:] {
+				if cmd, ok := lookupCommand(name); ok {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+		c.w.WriteMapHeader(len(cmds))
+		for _, cmd := range cmds {
+			c.w.WriteBulkString(cmd.Name)
+			writeCommandDocs(c, cmd)
+		}
+
+	default:
+		return fmt.Errorf("unknown subcommand '%s'. Try COMMAND HELP.", args[1])
+	}
+	return nil
+}
+
+// writeCommandInfo writes the reply of COMMAND INFO for a single command:
+// name, arity, flags, first key, last key, step, ACL categories, tips, key specs and subcommands
+func writeCommandInfo(c *Client, cmd *Command) {
+	w := c.w
+	w.WriteArrayHeader(10)
+	w.WriteBulkString(cmd.Name)
+	w.WriteInteger(int64(cmd.Arity))
+
+	flags := cmd.Flags.Names()
+	w.WriteSetHeader(len(flags))
+	for _, flag := range flags {
+		w.WriteSimpleString(flag)
+	}
+
+	w.WriteInteger(int64(cmd.FirstKey))
+	w.WriteInteger(int64(cmd.LastKey))
+	w.WriteInteger(int64(cmd.Step))
+
+	categories := cmd.aclCategories()
+	w.WriteSetHeader(len(categories))
+	for _, category := range categories {
+		w.WriteSimpleString(category)
+	}
+
+	// no tips, key specs and subcommands: the key positions above are enough to find the keys,
+	// except for movablekeys commands, whose keys are found by parsing their arguments
+	w.WriteArrayHeader(0)
+	w.WriteArrayHeader(0)
+	w.WriteArrayHeader(0)
+}
+
+// aclCategories derives the ACL categories of the command from its flags and group
+func (cmd *Command) aclCategories() []string {
+	categories := []string{}
+	if cmd.Flags&FlagWrite != 0 {
+		categories = append(categories, "@write")
+	}
+	if cmd.Flags&FlagReadonly != 0 {
+		categories = append(categories, "@read")
+	}
+	if cmd.Flags&FlagAdmin != 0 {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if cmd.Flags&FlagFast != 0 {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+	// there is no ACL category for the server group, admin commands are in @admin
+	switch cmd.Group {
+	case "", "server":
+	case "generic":
+		categories = append(categories, "@keyspace")
+	default:
+		categories = append(categories, "@"+cmd.Group)
+	}
+	if cmd.Flags&FlagBlocking != 0 {
+		categories = append(categories, "@blocking")
+	}
+	return categories
+}
+
+// writeCommandDocs writes the documentation map of a single command
+func writeCommandDocs(c *Client, cmd *Command) {
+	w := c.w
+	w.WriteMapHeader(4)
+	w.WriteBulkString("summary")
+	w.WriteBulkString(cmd.Summary)
+	w.WriteBulkString("since")
+	w.WriteBulkString(cmd.Since)
+	w.WriteBulkString("group")
+	w.WriteBulkString(cmd.Group)
+	w.WriteBulkString("complexity")
+	w.WriteBulkString(cmd.Complexity)
+}
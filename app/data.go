@@ -1,110 +1,11 @@
 package main
 
-// Methods specific to data handling: reading, parsing, constructing, writing
-// Redis protocol data
+// Methods specific to data handling: constructing data sent to replicas
 
 import (
-	"bufio"
 	"encoding/base64"
-	"fmt"
-	"strings"
 )
 
-// readArray reads an array from the reader and returns as a slice of strings
-func (s *Server) readArray(reader *bufio.Reader) ([]string, error) {
-	result := []string{}
-
-	// Parse the header to get the number of elements in the array
-	arrLen := 0
-	header, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	header = strings.Trim(header, "\r\n")
-
-	fmt.Sscanf(header, "%d", &arrLen)
-	// log.Printf("[DEBUG] array length parsed: %d", arrLen)
-
-	for i := 0; i < arrLen; i++ {
-		// Read the header of the element ($<element length>)
-		data, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		data = strings.Trim(data, "\r\n")
-		elementLen := 0
-		fmt.Sscanf(data, string(TypeBulkString)+"%d", &elementLen)
-
-		// Read the element data
-		data, err = reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		data = strings.Trim(data, "\r\n")
-
-		if len(data) != elementLen {
-			return nil, fmt.Errorf("error reading element: expected %d bytes, got %d",
-				elementLen, len(data))
-		}
-
-		result = append(result, data)
-	}
-
-	return result, nil
-}
-
-// RESPSimpleError returns a simple error response
-func (s *Server) RESPSimpleError(data string) string {
-	return fmt.Sprintf("%c%s\r\n", TypeSimpleError, data)
-}
-
-// readSimpleError reads a simple error from the reader
-func (s *Server) readSimpleError(reader *bufio.Reader) (string, error) {
-	data, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
-	data = strings.Trim(data, "\r\n")
-	return data, nil
-}
-
-// RESPSimpleString returns a simple string response
-func (s *Server) RESPSimpleString(data string) string {
-	return fmt.Sprintf("%c%s\r\n", TypeSimpleString, data)
-}
-
-// readSimpleString reads a simple string from the reader
-func (s *Server) readSimpleString(reader *bufio.Reader) (string, error) {
-	data, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
-	data = strings.Trim(data, "\r\n")
-	return data, nil
-}
-
-// RESPBulkString returns a bulk string response
-func (s *Server) RESPBulkString(data string) string {
-	if data == "" {
-		return fmt.Sprintf("%c\r\n\r\n", TypeBulkString)
-	}
-	return fmt.Sprintf("%c%d\r\n%s\r\n", TypeBulkString, len(data), data)
-}
-
-// nullBulkString returns a null bulk string response
-func (s *Server) nullBulkString() string {
-	return fmt.Sprintf("%c-1\r\n", TypeBulkString)
-}
-
-// RESPArray returns an array response
-func (s *Server) RESPArray(arr []string) string {
-	result := fmt.Sprintf("%c%d\r\n", TypeArray, len(arr))
-	for _, v := range arr {
-		result += s.RESPBulkString(v)
-	}
-	return result
-}
-
 // makeRDBFile returns a RDB file response
 func (s *Server) makeRDBFile() (int, []byte, error) {
 	// hardcode file content for now
@@ -0,0 +1,175 @@
+package main
+
+// Hash table that can be scanned with a cursor while it changes, like the dict of Redis
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+)
+
+// dictMinSize is the smallest number of buckets
+const dictMinSize = 4
+
+// dict is a hash table of string keys with chaining, the number of buckets is a power of two.
+// It grows when there are more keys than buckets and shrinks when there are 8 times less.
+// Not safe for concurrent use
+type dict[V any] struct {
+	seed  maphash.Seed
+	table []*dictEntry[V]
+	used  int
+}
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+	next  *dictEntry[V]
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{
+		seed:  maphash.MakeSeed(),
+		table: make([]*dictEntry[V], dictMinSize),
+	}
+}
+
+func (d *dict[V]) bucket(key string) uint64 {
+	return maphash.String(d.seed, key) & uint64(len(d.table)-1)
+}
+
+// Len returns the number of keys
+func (d *dict[V]) Len() int {
+	return d.used
+}
+
+// Get returns the value of the key
+func (d *dict[V]) Get(key string) (V, bool) {
+	for e := d.table[d.bucket(key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	var none V
+	return none, false
+}
+
+// Set stores the value under the key, returns true if the key is new
+func (d *dict[V]) Set(key string, value V) bool {
+	idx := d.bucket(key)
+	for e := d.table[idx]; e != nil; e = e.next {
+		if e.key == key {
+			e.value = value
+			return false
+		}
+	}
+	d.table[idx] = &dictEntry[V]{key: key, value: value, next: d.table[idx]}
+	d.used++
+	if d.used > len(d.table) {
+		d.resize(len(d.table) * 2)
+	}
+	return true
+}
+
+// Delete deletes the key, returns false if there was no such key
+func (d *dict[V]) Delete(key string) bool {
+	idx := d.bucket(key)
+	for prev, e := (*dictEntry[V])(nil), d.table[idx]; e != nil; prev, e = e, e.next {
+		if e.key != key {
+			continue
+		}
+		if prev == nil {
+			d.table[idx] = e.next
+		} else {
+			prev.next = e.next
+		}
+		d.used--
+		if len(d.table) > dictMinSize && d.used < len(d.table)/8 {
+			d.resize(len(d.table) / 2)
+		}
+		return true
+	}
+	return false
+}
+
+// resize moves all the keys to a table of the given number of buckets
+func (d *dict[V]) resize(size int) {
+	old := d.table
+	d.table = make([]*dictEntry[V], size)
+	for _, e := range old {
+		for e != nil {
+			next := e.next
+			idx := d.bucket(e.key)
+			e.next = d.table[idx]
+			d.table[idx] = e
+			e = next
+		}
+	}
+}
+
+// Scan calls fn for the keys of the bucket at the cursor and returns the cursor of the next bucket,
+// 0 when all the buckets are visited. Starting from 0, every key present for the whole scan
+// is visited at least once, even if the table is resized between the calls, some may be visited twice.
+// The cursor counts in reverse binary: the high bits are incremented first, so buckets visited
+// before a resize are the same buckets the keys are split to or merged from after it
+func (d *dict[V]) Scan(cursor uint64, fn func(key string, value V)) uint64 {
+	mask := uint64(len(d.table) - 1)
+	for e := d.table[cursor&mask]; e != nil; e = e.next {
+		fn(e.key, e.value)
+	}
+
+	// increment the reversed cursor, the bits above the mask are set to be carried away
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// ScanCount scans the buckets starting from the cursor until fn is called for at least count keys,
+// and returns the cursor to continue from, 0 when all the buckets are visited.
+// Empty buckets are visited too, they are limited as well
+func (d *dict[V]) ScanCount(cursor uint64, count int, fn func(key string, value V)) uint64 {
+	seen := 0
+	for maxIterations := count * 10; maxIterations > 0 && seen < count; maxIterations-- {
+		cursor = d.Scan(cursor, func(key string, value V) {
+			fn(key, value)
+			seen++
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	return cursor
+}
+
+// RandomKey returns a random key, keys in shorter chains are a bit more likely
+func (d *dict[V]) RandomKey() (string, V, bool) {
+	if d.used == 0 {
+		var none V
+		return "", none, false
+	}
+	// the table is at least 1/8 full, so a non empty bucket is found soon
+	var head *dictEntry[V]
+	for head == nil {
+		head = d.table[rand.Intn(len(d.table))]
+	}
+	n := 0
+	for e := head; e != nil; e = e.next {
+		n++
+	}
+	e := head
+	for range rand.Intn(n) {
+		e = e.next
+	}
+	return e.key, e.value, true
+}
+
+// Range calls fn for all the keys until fn returns false, the dict must not be changed meanwhile
+func (d *dict[V]) Range(fn func(key string, value V) bool) {
+	for _, e := range d.table {
+		for ; e != nil; e = e.next {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+// Expiration commands: setting, reading and removing the deadlines of keys
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "expire", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).expireCommand,
+			Group: "generic", Summary: "Sets the expiration time of a key in seconds.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "pexpire", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).expireCommand,
+			Group: "generic", Summary: "Sets the expiration time of a key in milliseconds.", Since: "2.6.0", Complexity: "O(1)"},
+		&Command{Name: "expireat", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).expireCommand,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp.", Since: "1.2.0", Complexity: "O(1)"},
+		&Command{Name: "pexpireat", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).expireCommand,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.", Since: "2.6.0", Complexity: "O(1)"},
+		&Command{Name: "ttl", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).ttlCommand,
+			Group: "generic", Summary: "Returns the expiration time in seconds of a key.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "pttl", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).ttlCommand,
+			Group: "generic", Summary: "Returns the expiration time in milliseconds of a key.", Since: "2.6.0", Complexity: "O(1)"},
+		&Command{Name: "expiretime", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).ttlCommand,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp.", Since: "7.0.0", Complexity: "O(1)"},
+		&Command{Name: "pexpiretime", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).ttlCommand,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix milliseconds timestamp.", Since: "7.0.0", Complexity: "O(1)"},
+		&Command{Name: "persist", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).persistCommand,
+			Group: "generic", Summary: "Removes the expiration time of a key.", Since: "2.2.0", Complexity: "O(1)"},
+	)
+}
+
+// EXPIRE key seconds [NX | XX | GT | LT], PEXPIRE key milliseconds [NX | XX | GT | LT],
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT], PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+// Replicas get PEXPIREAT, or DEL if the deadline has already passed
+func (s *Server) expireCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	key := args[1]
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return fmt.Errorf("Unsupported option %s", arg)
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return fmt.Errorf("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return fmt.Errorf("GT and LT options at the same time are not compatible")
+	}
+
+	when, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	invalid := fmt.Errorf("invalid expire time in '%s' command", name)
+	if name == "expire" || name == "expireat" {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return invalid
+		}
+		when *= 1000
+	}
+	now := time.Now()
+	if name == "expire" || name == "pexpire" {
+		if when > math.MaxInt64-now.UnixMilli() {
+			return invalid
+		}
+		when += now.UnixMilli()
+	}
+	expireAt := time.UnixMilli(when)
+
+	current, err := s.storage.ExpireAt(key)
+	if err != nil {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	if !expireAllowed(nx, xx, gt, lt, current, expireAt) {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+
+	// a deadline in the past deletes the key right away, except on replicas:
+	// the deadline from the master is kept as is, whatever the clock of the replica says
+	if !expireAt.After(now) && !c.master {
+		s.storage.Del(key)
+		c.rewriteCommand([]string{"DEL", key})
+		c.w.WriteInteger(1)
+		return nil
+	}
+
+	s.storage.SetExpireAt(key, expireAt)
+	c.rewriteCommand([]string{"PEXPIREAT", key, strconv.FormatInt(when, 10)})
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// expireAllowed tells if the NX, XX, GT and LT conditions allow replacing the current deadline, zero if there is none.
+// Keys without a deadline live forever: they are never less than any deadline
+func expireAllowed(nx, xx, gt, lt bool, current, expireAt time.Time) bool {
+	return !((nx && !current.IsZero()) || (xx && current.IsZero()) ||
+		(gt && (current.IsZero() || !expireAt.After(current))) ||
+		(lt && !current.IsZero() && !expireAt.Before(current)))
+}
+
+// TTL key, PTTL key, EXPIRETIME key, PEXPIRETIME key
+// -2 if the key doesn't exist, -1 if it has no deadline
+func (s *Server) ttlCommand(c *Client, args []string) error {
+	expireAt, err := s.storage.ExpireAt(args[1])
+	switch {
+	case err != nil:
+		c.w.WriteInteger(-2)
+		return nil
+	case expireAt.IsZero():
+		c.w.WriteInteger(-1)
+		return nil
+	}
+
+	c.w.WriteInteger(ttlValue(strings.ToLower(args[0]), expireAt))
+	return nil
+}
+
+// ttlValue returns the deadline as reported by TTL, PTTL, EXPIRETIME or PEXPIRETIME, by the name of the command
+func ttlValue(name string, expireAt time.Time) int64 {
+	switch name {
+	case "ttl":
+		// rounded to the closest second, like in Redis
+		return (max(time.Until(expireAt).Milliseconds(), 0) + 500) / 1000
+	case "pttl":
+		return max(time.Until(expireAt).Milliseconds(), 0)
+	case "expiretime":
+		return expireAt.Unix()
+	}
+	return expireAt.UnixMilli()
+}
+
+// PERSIST key
+func (s *Server) persistCommand(c *Client, args []string) error {
+	expireAt, err := s.storage.ExpireAt(args[1])
+	if err != nil || expireAt.IsZero() {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	s.storage.SetExpireAt(args[1], time.Time{})
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// expireMode tells how the lookups of the command of the client treat expired keys and fields:
+// the master deletes them, replicas wait for the master to do it and show its commands everything
+func (s *Server) expireMode(c *Client) expireMode {
+	switch {
+	case s.role == RoleMaster:
+		return expireDelete
+	case c.master:
+		return expireKeep
+	}
+	return expireHide
+}
+
+// propagateExpired propagates the keys and fields deleted by lookups because of their deadlines,
+// as DEL and HDEL like the active expiration does. The execution lock must be held
+func (s *Server) propagateExpired() {
+	for _, f := range s.storage.TakeExpired() {
+		if f.fields == nil {
+			s.propagate([]string{"DEL", f.key})
+			continue
+		}
+		s.propagate(append([]string{"HDEL", f.key}, f.fields...))
+	}
+}
+
+// Active expiration, like activeExpireCycle of Redis
+const (
+	activeExpireKeysPerLoop     = 20 // keys sampled at once
+	activeExpireAcceptableStale = 10 // % of expired keys in a sample, the cycle goes on while there are more
+	activeExpireCyclePerc       = 25 // % of the period between cycles a cycle may take
+)
+
+// activeExpire runs the active expiration cycle hz times per second
+func (s *Server) activeExpire() {
+	ticker := time.NewTicker(time.Second / time.Duration(s.hz))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.activeExpireCycle()
+	}
+}
+
+// activeExpireCycle deletes expired keys that are never looked up. Keys with deadlines are sampled,
+// and sampling goes on while many of the sampled keys are expired, until the time limit is reached.
+// Hashes with field deadlines are sampled along, a hash with expired fields counts as an expired key.
+// The deleted keys are propagated as DEL and the fields as HDEL, replicas don't expire actively and wait for them
+func (s *Server) activeExpireCycle() {
+	if s.role != RoleMaster {
+		return
+	}
+	start := time.Now()
+	timeLimit := time.Second / time.Duration(s.hz) * activeExpireCyclePerc / 100
+
+	sampledTotal, expiredTotal := 0, 0
+	for {
+		// commands are not blocked for longer than a single sample
+		s.lock.Lock()
+		now := time.Now()
+		sampled, expiredKeys := s.storage.ExpireSample(activeExpireKeysPerLoop, now)
+		for _, key := range expiredKeys {
+			s.propagate([]string{"DEL", key})
+		}
+		sampledHashes, expiredFields := s.storage.ExpireFieldsSample(activeExpireKeysPerLoop, now)
+		for _, f := range expiredFields {
+			s.propagate(append([]string{"HDEL", f.key}, f.fields...))
+		}
+		s.lock.Unlock()
+
+		sampled += sampledHashes
+		expired := len(expiredKeys) + len(expiredFields)
+		sampledTotal += sampled
+		expiredTotal += expired
+		if sampled == 0 || expired*100/sampled <= activeExpireAcceptableStale {
+			break
+		}
+		if time.Since(start) > timeLimit {
+			s.lock.Lock()
+			s.expireStats.timeCapReached++
+			s.lock.Unlock()
+			break
+		}
+	}
+
+	if sampledTotal > 0 {
+		current := float64(expiredTotal) / float64(sampledTotal)
+		s.lock.Lock()
+		s.expireStats.stalePerc = current*0.05 + s.expireStats.stalePerc*0.95
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+// Glob-style pattern matching of Redis, used by KEYS, SCAN and friends
+
+// globMatch tells if the string matches the glob pattern:
+// * matches any sequence, ? any single character, [abc] [^abc] [a-z] a character of the class,
+// \ escapes the next character. It works on bytes, just like Redis
+func globMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return globMatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+// globMatchImpl is stringmatchlen_impl of Redis. Once a * failed to match the rest of the string
+// at some position, longer matches can't succeed either, skipLongerMatches stops trying them,
+// so the matching is polynomial rather than exponential in the number of stars
+func globMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// protection against abusive patterns
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true // match
+			}
+			for len(str) > 0 {
+				if globMatchImpl(pattern[1:], str, nocase, skipLongerMatches, nesting+1) {
+					return true // match
+				}
+				if *skipLongerMatches {
+					return false // no match
+				}
+				str = str[1:]
+			}
+			*skipLongerMatches = true
+			return false // no match
+
+		case '?':
+			str = str[1:]
+
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					c := str[0]
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[0], str[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// the class is not closed, the last character is the end of the pattern
+				pattern = " "
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false // no match
+			}
+			str = str[1:]
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if !equalByte(pattern[0], str[0], nocase) {
+				return false // no match
+			}
+			str = str[1:]
+		}
+
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
@@ -0,0 +1,266 @@
+package main
+
+// Hash: the hash value type, a compact listpack while it's small and a dict once it grows, like in Redis
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Default limits of the listpack encoding of hashes, hash-max-listpack-entries and hash-max-listpack-value
+const (
+	hashMaxListpackEntries = 128
+	hashMaxListpackValue   = 64
+)
+
+// hash is a map of fields to values. Small hashes keep their fields in a slice, in insertion order,
+// searched linearly. A hash is converted to a dict once it has more than maxEntries fields,
+// or a field or a value longer than maxValue bytes, and is never converted back.
+// Fields may have deadlines, expired fields are deleted by Expire. Not safe for concurrent use
+type hash struct {
+	listpack []hashField
+	dict     *dict[hashField] // nil while the listpack encoding is used
+
+	volatile     int       // number of fields with deadlines
+	nextExpireAt time.Time // no field expires before, zero if no field has a deadline
+
+	maxEntries, maxValue int
+}
+
+// hashField is a field with its value and its deadline, zero if the field never expires
+type hashField struct {
+	field, value string
+	expireAt     time.Time
+}
+
+func newHash(maxEntries, maxValue int) *hash {
+	return &hash{maxEntries: maxEntries, maxValue: maxValue}
+}
+
+// Encoding returns the name of the encoding, as reported by OBJECT ENCODING in Redis
+func (h *hash) Encoding() string {
+	if h.dict != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+// Len returns the number of fields
+func (h *hash) Len() int {
+	if h.dict != nil {
+		return h.dict.Len()
+	}
+	return len(h.listpack)
+}
+
+// find returns the index of the field in the listpack, -1 if there is no such field
+func (h *hash) find(field string) int {
+	for i, f := range h.listpack {
+		if f.field == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the value of the field
+func (h *hash) Get(field string) (string, bool) {
+	f, ok := h.get(field)
+	return f.value, ok
+}
+
+// get returns the field with its value and deadline
+func (h *hash) get(field string) (hashField, bool) {
+	if h.dict != nil {
+		return h.dict.Get(field)
+	}
+	if i := h.find(field); i >= 0 {
+		return h.listpack[i], true
+	}
+	return hashField{}, false
+}
+
+// put stores the field, replacing the existing one
+func (h *hash) put(f hashField) bool {
+	if h.dict != nil {
+		return h.dict.Set(f.field, f)
+	}
+	if i := h.find(f.field); i >= 0 {
+		h.listpack[i] = f
+		return false
+	}
+	h.listpack = append(h.listpack, f)
+	if len(h.listpack) > h.maxEntries {
+		h.convert()
+	}
+	return true
+}
+
+// Set sets the field to the value, returns true if the field is new.
+// The deadline of the field is removed, unless keepTTL is set
+func (h *hash) Set(field, value string, keepTTL bool) bool {
+	if h.dict == nil && (len(field) > h.maxValue || len(value) > h.maxValue) {
+		h.convert()
+	}
+	old, ok := h.get(field)
+	f := hashField{field: field, value: value}
+	switch {
+	case keepTTL:
+		f.expireAt = old.expireAt
+	case ok && !old.expireAt.IsZero():
+		if h.volatile--; h.volatile == 0 {
+			h.nextExpireAt = time.Time{}
+		}
+	}
+	return h.put(f)
+}
+
+// ExpireAt returns the deadline of the field, zero if the field never expires
+func (h *hash) ExpireAt(field string) (time.Time, bool) {
+	f, ok := h.get(field)
+	return f.expireAt, ok
+}
+
+// SetExpireAt sets the deadline of the field, zero removes it. Returns false if there is no such field
+func (h *hash) SetExpireAt(field string, expireAt time.Time) bool {
+	f, ok := h.get(field)
+	if !ok {
+		return false
+	}
+	switch {
+	case f.expireAt.IsZero() && !expireAt.IsZero():
+		h.volatile++
+	case !f.expireAt.IsZero() && expireAt.IsZero():
+		h.volatile--
+	}
+	if !expireAt.IsZero() && (h.nextExpireAt.IsZero() || expireAt.Before(h.nextExpireAt)) {
+		h.nextExpireAt = expireAt
+	}
+	if h.volatile == 0 {
+		h.nextExpireAt = time.Time{}
+	}
+	f.expireAt = expireAt
+	h.put(f)
+	return true
+}
+
+// Expiring tells if some fields may be expired by now
+func (h *hash) Expiring(now time.Time) bool {
+	return h.volatile > 0 && !now.Before(h.nextExpireAt)
+}
+
+// Expire deletes the fields expired by now and returns them.
+// All the fields are looked at, but only once the earliest deadline has passed
+func (h *hash) Expire(now time.Time) []string {
+	if !h.Expiring(now) {
+		return nil
+	}
+	expired := []string{}
+	next := time.Time{}
+	h.rangeFields(func(f hashField) bool {
+		switch {
+		case f.expireAt.IsZero():
+		case !now.Before(f.expireAt):
+			expired = append(expired, f.field)
+		case next.IsZero() || f.expireAt.Before(next):
+			next = f.expireAt
+		}
+		return true
+	})
+	for _, field := range expired {
+		h.Delete(field)
+	}
+	h.nextExpireAt = next
+	return expired
+}
+
+// Delete deletes the field, returns false if there was no such field
+func (h *hash) Delete(field string) bool {
+	f, ok := h.get(field)
+	if !ok {
+		return false
+	}
+	if !f.expireAt.IsZero() {
+		if h.volatile--; h.volatile == 0 {
+			h.nextExpireAt = time.Time{}
+		}
+	}
+	if h.dict != nil {
+		return h.dict.Delete(field)
+	}
+	i := h.find(field)
+	h.listpack = append(h.listpack[:i], h.listpack[i+1:]...)
+	return true
+}
+
+// convert moves the fields to a dict
+func (h *hash) convert() {
+	h.dict = newDict[hashField]()
+	for _, f := range h.listpack {
+		h.dict.Set(f.field, f)
+	}
+	h.listpack = nil
+}
+
+// Range calls fn for all the fields until fn returns false, the hash must not be changed meanwhile
+func (h *hash) Range(fn func(field, value string) bool) {
+	h.rangeFields(func(f hashField) bool {
+		return fn(f.field, f.value)
+	})
+}
+
+// rangeFields calls fn for all the fields with their deadlines until fn returns false
+func (h *hash) rangeFields(fn func(f hashField) bool) {
+	if h.dict != nil {
+		h.dict.Range(func(_ string, f hashField) bool {
+			return fn(f)
+		})
+		return
+	}
+	for _, f := range h.listpack {
+		if !fn(f) {
+			return
+		}
+	}
+}
+
+// Scan calls fn for the fields starting from the cursor, until there are at least count of them,
+// and returns the cursor to continue from, 0 when the scan is complete.
+// A listpack is small, it is returned whole at once, like in Redis
+func (h *hash) Scan(cursor uint64, count int, fn func(field, value string)) uint64 {
+	if h.dict == nil {
+		for _, f := range h.listpack {
+			fn(f.field, f.value)
+		}
+		return 0
+	}
+	return h.dict.ScanCount(cursor, count, func(_ string, f hashField) {
+		fn(f.field, f.value)
+	})
+}
+
+// Random returns a random field with its value, the hash must not be empty
+func (h *hash) Random() (string, string) {
+	if h.dict != nil {
+		_, f, _ := h.dict.RandomKey()
+		return f.field, f.value
+	}
+	f := h.listpack[rand.Intn(len(h.listpack))]
+	return f.field, f.value
+}
+
+// Copy returns a deep copy of the hash
+func (h *hash) Copy() *hash {
+	res := newHash(h.maxEntries, h.maxValue)
+	res.volatile, res.nextExpireAt = h.volatile, h.nextExpireAt
+	if h.dict == nil {
+		res.listpack = append([]hashField{}, h.listpack...)
+		return res
+	}
+	res.dict = newDict[hashField]()
+	h.dict.Range(func(field string, f hashField) bool {
+		res.dict.Set(field, f)
+		return true
+	})
+	return res
+}
@@ -0,0 +1,666 @@
+package main
+
+// Hash commands
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "hset", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hsetCommand,
+			Group: "hash", Summary: "Creates or modifies the value of a field in a hash.", Since: "2.0.0", Complexity: "O(1) for each field/value pair added, so O(N) to add N field/value pairs when the command is called with multiple field/value pairs."},
+		&Command{Name: "hmset", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hsetCommand,
+			Group: "hash", Summary: "Sets the values of multiple fields.", Since: "2.0.0", Complexity: "O(N) where N is the number of fields being set."},
+		&Command{Name: "hsetnx", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hsetnxCommand,
+			Group: "hash", Summary: "Sets the value of a field in a hash only when the field doesn't exist.", Since: "2.0.0", Complexity: "O(1)"},
+		&Command{Name: "hget", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hgetCommand,
+			Group: "hash", Summary: "Returns the value of a field in a hash.", Since: "2.0.0", Complexity: "O(1)"},
+		&Command{Name: "hmget", Arity: -3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hmgetCommand,
+			Group: "hash", Summary: "Returns the values of all fields in a hash.", Since: "2.0.0", Complexity: "O(N) where N is the number of fields being requested."},
+		&Command{Name: "hdel", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hdelCommand,
+			Group: "hash", Summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.", Since: "2.0.0", Complexity: "O(N) where N is the number of fields to be removed."},
+		&Command{Name: "hlen", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hlenCommand,
+			Group: "hash", Summary: "Returns the number of fields in a hash.", Since: "2.0.0", Complexity: "O(1)"},
+		&Command{Name: "hstrlen", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hstrlenCommand,
+			Group: "hash", Summary: "Returns the length of the value of a field.", Since: "3.2.0", Complexity: "O(1)"},
+		&Command{Name: "hexists", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hexistsCommand,
+			Group: "hash", Summary: "Determines whether a field exists in a hash.", Since: "2.0.0", Complexity: "O(1)"},
+		&Command{Name: "hkeys", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hgetallCommand,
+			Group: "hash", Summary: "Returns all fields in a hash.", Since: "2.0.0", Complexity: "O(N) where N is the size of the hash."},
+		&Command{Name: "hvals", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hgetallCommand,
+			Group: "hash", Summary: "Returns all values in a hash.", Since: "2.0.0", Complexity: "O(N) where N is the size of the hash."},
+		&Command{Name: "hgetall", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hgetallCommand,
+			Group: "hash", Summary: "Returns all fields and values in a hash.", Since: "2.0.0", Complexity: "O(N) where N is the size of the hash."},
+		&Command{Name: "hincrby", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hincrbyCommand,
+			Group: "hash", Summary: "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist.", Since: "2.0.0", Complexity: "O(1)"},
+		&Command{Name: "hincrbyfloat", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hincrbyfloatCommand,
+			Group: "hash", Summary: "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.", Since: "2.6.0", Complexity: "O(1)"},
+		&Command{Name: "hscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hscanCommand,
+			Group: "hash", Summary: "Iterates over fields and values of a hash.", Since: "2.8.0", Complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection."},
+		&Command{Name: "hrandfield", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hrandfieldCommand,
+			Group: "hash", Summary: "Returns one or more random fields from a hash.", Since: "6.2.0", Complexity: "O(N) where N is the number of fields returned"},
+		&Command{Name: "hexpire", Arity: -6, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hexpireCommand,
+			Group: "hash", Summary: "Set expiry for hash field using relative time to expire (seconds)", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hpexpire", Arity: -6, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hexpireCommand,
+			Group: "hash", Summary: "Set expiry for hash field using relative time to expire (milliseconds)", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hexpireat", Arity: -6, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hexpireCommand,
+			Group: "hash", Summary: "Set expiry for hash field using an absolute Unix timestamp (seconds)", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hpexpireat", Arity: -6, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hexpireCommand,
+			Group: "hash", Summary: "Set expiry for hash field using an absolute Unix timestamp (milliseconds)", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "httl", Arity: -5, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).httlCommand,
+			Group: "hash", Summary: "Returns the TTL in seconds of a hash field.", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hpttl", Arity: -5, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).httlCommand,
+			Group: "hash", Summary: "Returns the TTL in milliseconds of a hash field.", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hexpiretime", Arity: -5, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).httlCommand,
+			Group: "hash", Summary: "Returns the expiration time of a hash field as a Unix timestamp, in seconds.", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hpexpiretime", Arity: -5, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).httlCommand,
+			Group: "hash", Summary: "Returns the expiration time of a hash field as a Unix timestamp, in msec.", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+		&Command{Name: "hpersist", Arity: -5, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).hpersistCommand,
+			Group: "hash", Summary: "Removes the expiration time for each specified field", Since: "7.4.0", Complexity: "O(N) where N is the number of specified fields"},
+	)
+}
+
+// getHash returns the hash of the key, nil if there is no such key.
+// Hashes are changed in place, commands are executed one at a time
+func (s *Server) getHash(key string) (*hash, error) {
+	e, ok := s.storage.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	h, ok := e.value.(*hash)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return h, nil
+}
+
+// getOrCreateHash returns the hash of the key, storing a new empty one if there is no such key.
+// The caller must not leave the new hash empty
+func (s *Server) getOrCreateHash(key string) (*hash, error) {
+	h, err := s.getHash(key)
+	if err != nil || h != nil {
+		return h, err
+	}
+	h = newHash(s.hashMaxListpackEntries, s.hashMaxListpackValue)
+	s.storage.Set(key, h, time.Time{})
+	return h, nil
+}
+
+// deleteEmptyHash deletes the key of the hash if the hash is empty, keys never hold empty hashes
+func (s *Server) deleteEmptyHash(key string, h *hash) {
+	if h.Len() == 0 {
+		s.storage.Del(key)
+	}
+}
+
+// HSET key field value [field value ...], HMSET key field value [field value ...]
+// HSET returns the number of new fields, HMSET returns OK
+func (s *Server) hsetCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	if len(args)%2 != 0 {
+		return fmt.Errorf("wrong number of arguments for '%s' command", name)
+	}
+	h, err := s.getOrCreateHash(args[1])
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for i := 2; i < len(args); i += 2 {
+		if h.Set(args[i], args[i+1], false) {
+			added++
+		}
+	}
+	if name == "hmset" {
+		c.w.WriteSimpleString("OK")
+		return nil
+	}
+	c.w.WriteInteger(int64(added))
+	return nil
+}
+
+// HSETNX key field value
+func (s *Server) hsetnxCommand(c *Client, args []string) error {
+	h, err := s.getOrCreateHash(args[1])
+	if err != nil {
+		return err
+	}
+	if _, ok := h.Get(args[2]); ok {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	h.Set(args[2], args[3], false)
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// HGET key field
+func (s *Server) hgetCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		c.w.WriteNull()
+		return nil
+	}
+	value, ok := h.Get(args[2])
+	if !ok {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// HMGET key field [field ...]
+// Missing fields are null
+func (s *Server) hmgetCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteArrayHeader(len(args) - 2)
+	for _, field := range args[2:] {
+		if h == nil {
+			c.w.WriteNull()
+			continue
+		}
+		value, ok := h.Get(field)
+		if !ok {
+			c.w.WriteNull()
+			continue
+		}
+		c.w.WriteBulkString(value)
+	}
+	return nil
+}
+
+// HDEL key field [field ...]
+func (s *Server) hdelCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	if h != nil {
+		for _, field := range args[2:] {
+			if h.Delete(field) {
+				deleted++
+			}
+		}
+		s.deleteEmptyHash(args[1], h)
+	}
+	if deleted == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(deleted))
+	return nil
+}
+
+// HLEN key
+func (s *Server) hlenCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	c.w.WriteInteger(int64(h.Len()))
+	return nil
+}
+
+// HSTRLEN key field
+func (s *Server) hstrlenCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	value, _ := h.Get(args[2])
+	c.w.WriteInteger(int64(len(value)))
+	return nil
+}
+
+// HEXISTS key field
+func (s *Server) hexistsCommand(c *Client, args []string) error {
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	if _, ok := h.Get(args[2]); !ok {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// HGETALL key, HKEYS key, HVALS key
+// HGETALL replies with a map, RESP2 clients get a flat array of fields and values
+func (s *Server) hgetallCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if h != nil {
+		n = h.Len()
+	}
+	if name == "hgetall" {
+		c.w.WriteMapHeader(n)
+	} else {
+		c.w.WriteArrayHeader(n)
+	}
+	if h == nil {
+		return nil
+	}
+	h.Range(func(field, value string) bool {
+		if name != "hvals" {
+			c.w.WriteBulkString(field)
+		}
+		if name != "hkeys" {
+			c.w.WriteBulkString(value)
+		}
+		return true
+	})
+	return nil
+}
+
+// HINCRBY key field increment
+func (s *Server) hincrbyCommand(c *Client, args []string) error {
+	incr, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	n := int64(0)
+	if h != nil {
+		if old, ok := h.Get(args[2]); ok {
+			if n, err = parseInt(old); err != nil {
+				return fmt.Errorf("hash value is not an integer")
+			}
+		}
+	}
+	if (incr < 0 && n < math.MinInt64-incr) || (incr > 0 && n > math.MaxInt64-incr) {
+		return fmt.Errorf("increment or decrement would overflow")
+	}
+	n += incr
+
+	if h == nil {
+		h, _ = s.getOrCreateHash(args[1])
+	}
+	h.Set(args[2], strconv.FormatInt(n, 10), true)
+	c.w.WriteInteger(n)
+	return nil
+}
+
+// HINCRBYFLOAT key field increment
+// Replicas get HSET with the result, so they don't depend on their floating point rounding
+func (s *Server) hincrbyfloatCommand(c *Client, args []string) error {
+	incr, err := parseFloat(args[3])
+	if err != nil {
+		return err
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	f := 0.0
+	if h != nil {
+		if old, ok := h.Get(args[2]); ok {
+			if f, err = parseFloat(old); err != nil {
+				return fmt.Errorf("hash value is not a float")
+			}
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("increment would produce NaN or Infinity")
+	}
+
+	value := formatFloat(f)
+	if h == nil {
+		h, _ = s.getOrCreateHash(args[1])
+	}
+	h.Set(args[2], value, true)
+	// HSET removes the deadline of the field, it is set again
+	cmds := [][]string{{"HSET", args[1], args[2], value}}
+	if expireAt, _ := h.ExpireAt(args[2]); !expireAt.IsZero() {
+		cmds = append(cmds, []string{"HPEXPIREAT", args[1], strconv.FormatInt(expireAt.UnixMilli(), 10), "FIELDS", "1", args[2]})
+	}
+	c.rewriteCommand(cmds...)
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *Server) hscanCommand(c *Client, args []string) error {
+	cursor, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern, count, _, err := parseScanOptions(args[3:], false)
+	if err != nil {
+		return err
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+
+	pairs := []string{}
+	if h != nil {
+		cursor = h.Scan(cursor, count, func(field, value string) {
+			if pattern == "*" || globMatch(pattern, field, false) {
+				pairs = append(pairs, field, value)
+			}
+		})
+	} else {
+		cursor = 0
+	}
+
+	c.w.WriteArrayHeader(2)
+	c.w.WriteBulkString(strconv.FormatUint(cursor, 10))
+	c.w.WriteArray(pairs)
+	return nil
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+// A positive count returns distinct fields, up to the size of the hash,
+// a negative count returns exactly -count fields, possibly repeated.
+// With values RESP3 clients get an array of pairs, RESP2 clients a flat array
+func (s *Server) hrandfieldCommand(c *Client, args []string) error {
+	if len(args) > 4 || (len(args) == 4 && strings.ToUpper(args[3]) != "WITHVALUES") {
+		return errSyntax
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if h == nil {
+			c.w.WriteNull()
+			return nil
+		}
+		field, _ := h.Random()
+		c.w.WriteBulkString(field)
+		return nil
+	}
+
+	count, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	withValues := len(args) == 4
+	if count == math.MinInt64 || (withValues && count < -math.MaxInt64/2) {
+		return fmt.Errorf("value is out of range")
+	}
+	if h == nil || count == 0 {
+		c.w.WriteArray([]string{})
+		return nil
+	}
+
+	var pairs []hashField
+	switch {
+	case count < 0:
+		for range -count {
+			field, value := h.Random()
+			pairs = append(pairs, hashField{field: field, value: value})
+		}
+	case count >= int64(h.Len()):
+		h.Range(func(field, value string) bool {
+			pairs = append(pairs, hashField{field: field, value: value})
+			return true
+		})
+	case count*3 > int64(h.Len()):
+		// a large part of the hash: shuffle the beginning of all the fields
+		h.Range(func(field, value string) bool {
+			pairs = append(pairs, hashField{field: field, value: value})
+			return true
+		})
+		for i := range int(count) {
+			j := i + rand.Intn(len(pairs)-i)
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		}
+		pairs = pairs[:count]
+	default:
+		// a small part of the hash: random fields until enough distinct ones
+		seen := map[string]bool{}
+		for int64(len(pairs)) < count {
+			field, value := h.Random()
+			if !seen[field] {
+				seen[field] = true
+				pairs = append(pairs, hashField{field: field, value: value})
+			}
+		}
+	}
+
+	n := len(pairs)
+	if withValues && c.proto < resp.RESP3 {
+		n *= 2
+	}
+	c.w.WriteArrayHeader(n)
+	for _, p := range pairs {
+		if withValues && c.proto >= resp.RESP3 {
+			c.w.WriteArrayHeader(2)
+		}
+		c.w.WriteBulkString(p.field)
+		if withValues {
+			c.w.WriteBulkString(p.value)
+		}
+	}
+	return nil
+}
+
+// hashMaxExpireAt is the latest deadline of a field in milliseconds, 2^48-1 like in Redis
+const hashMaxExpireAt = 1<<48 - 1
+
+// parseFields parses the FIELDS numfields field [field ...] argument of the field expiration commands
+func parseFields(args []string) ([]string, error) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, fmt.Errorf("Mandatory argument FIELDS is missing or not at the right position")
+	}
+	n, err := parseInt(args[1])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("Parameter `numFields` should be greater than 0")
+	}
+	if n != int64(len(args)-2) {
+		return nil, fmt.Errorf("The `numfields` parameter must match the number of arguments")
+	}
+	return args[2:], nil
+}
+
+// HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...],
+// HPEXPIRE key milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...],
+// HEXPIREAT key unix-time-seconds [NX | XX | GT | LT] FIELDS numfields field [field ...],
+// HPEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+// Replies for each field: -2 if there is no such field, 0 if the condition is not met,
+// 1 if the deadline is set, 2 if the field is deleted because the deadline has passed.
+// Replicas get HPEXPIREAT for the deadlines set and HDEL for the fields deleted
+func (s *Server) hexpireCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	key := args[1]
+
+	when, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	var nx, xx, gt, lt bool
+	i := 3
+	switch strings.ToUpper(args[i]) {
+	case "NX":
+		nx = true
+	case "XX":
+		xx = true
+	case "GT":
+		gt = true
+	case "LT":
+		lt = true
+	default:
+		i--
+	}
+	fields, err := parseFields(args[i+1:])
+	if err != nil {
+		return err
+	}
+
+	invalid := fmt.Errorf("invalid expire time in '%s' command", name)
+	if when < 0 || when > hashMaxExpireAt {
+		return invalid
+	}
+	if name == "hexpire" || name == "hexpireat" {
+		if when > hashMaxExpireAt/1000 {
+			return invalid
+		}
+		when *= 1000
+	}
+	now := time.Now()
+	if name == "hexpire" || name == "hpexpire" {
+		when += now.UnixMilli()
+		if when > hashMaxExpireAt {
+			return invalid
+		}
+	}
+	expireAt := time.UnixMilli(when)
+
+	h, err := s.getHash(key)
+	if err != nil {
+		return err
+	}
+	c.w.WriteArrayHeader(len(fields))
+	if h == nil {
+		c.rewriteCommand()
+		for range fields {
+			c.w.WriteInteger(-2)
+		}
+		return nil
+	}
+
+	var set, deleted []string
+	for _, field := range fields {
+		current, ok := h.ExpireAt(field)
+		switch {
+		case !ok:
+			c.w.WriteInteger(-2)
+		case !expireAllowed(nx, xx, gt, lt, current, expireAt):
+			c.w.WriteInteger(0)
+		case !expireAt.After(now) && !c.master:
+			// a deadline in the past deletes the field right away, except on replicas, like for keys
+			h.Delete(field)
+			deleted = append(deleted, field)
+			c.w.WriteInteger(2)
+		default:
+			h.SetExpireAt(field, expireAt)
+			set = append(set, field)
+			c.w.WriteInteger(1)
+		}
+	}
+
+	cmds := [][]string{}
+	if len(deleted) > 0 {
+		cmds = append(cmds, append([]string{"HDEL", key}, deleted...))
+		s.deleteEmptyHash(key, h)
+	}
+	if len(set) > 0 {
+		cmds = append(cmds, append([]string{"HPEXPIREAT", key, strconv.FormatInt(when, 10), "FIELDS", strconv.Itoa(len(set))}, set...))
+		s.storage.WatchFields(key)
+	}
+	c.rewriteCommand(cmds...)
+	return nil
+}
+
+// HTTL key FIELDS numfields field [field ...], HPTTL key FIELDS numfields field [field ...],
+// HEXPIRETIME key FIELDS numfields field [field ...], HPEXPIRETIME key FIELDS numfields field [field ...]
+// Replies for each field like TTL and the others for keys: -2 if there is no such field, -1 if it has no deadline
+func (s *Server) httlCommand(c *Client, args []string) error {
+	fields, err := parseFields(args[2:])
+	if err != nil {
+		return err
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+
+	c.w.WriteArrayHeader(len(fields))
+	for _, field := range fields {
+		var expireAt time.Time
+		ok := false
+		if h != nil {
+			expireAt, ok = h.ExpireAt(field)
+		}
+		switch {
+		case !ok:
+			c.w.WriteInteger(-2)
+		case expireAt.IsZero():
+			c.w.WriteInteger(-1)
+		default:
+			// the name of the command for keys, without the leading H
+			c.w.WriteInteger(ttlValue(strings.ToLower(args[0])[1:], expireAt))
+		}
+	}
+	return nil
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+// Replies for each field: -2 if there is no such field, -1 if it has no deadline, 1 if the deadline is removed
+func (s *Server) hpersistCommand(c *Client, args []string) error {
+	fields, err := parseFields(args[2:])
+	if err != nil {
+		return err
+	}
+	h, err := s.getHash(args[1])
+	if err != nil {
+		return err
+	}
+
+	var persisted []string
+	c.w.WriteArrayHeader(len(fields))
+	for _, field := range fields {
+		var expireAt time.Time
+		ok := false
+		if h != nil {
+			expireAt, ok = h.ExpireAt(field)
+		}
+		switch {
+		case !ok:
+			c.w.WriteInteger(-2)
+		case expireAt.IsZero():
+			c.w.WriteInteger(-1)
+		default:
+			h.SetExpireAt(field, time.Time{})
+			persisted = append(persisted, field)
+			c.w.WriteInteger(1)
+		}
+	}
+
+	if len(persisted) == 0 {
+		c.rewriteCommand()
+		return nil
+	}
+	c.rewriteCommand(append([]string{"HPERSIST", args[1], "FIELDS", strconv.Itoa(len(persisted))}, persisted...))
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+// Generic keyspace commands, working with keys of any type
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "del", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).delCommand,
+			Group: "generic", Summary: "Deletes one or more keys.", Since: "1.0.0", Complexity: "O(N) where N is the number of keys that will be removed."},
+		&Command{Name: "unlink", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).delCommand,
+			Group: "generic", Summary: "Asynchronously deletes one or more keys.", Since: "4.0.0", Complexity: "O(1) for each key removed regardless of its size."},
+		&Command{Name: "exists", Arity: -2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).existsCommand,
+			Group: "generic", Summary: "Determines whether one or more keys exist.", Since: "1.0.0", Complexity: "O(N) where N is the number of keys to check."},
+		&Command{Name: "touch", Arity: -2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).existsCommand,
+			Group: "generic", Summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed.", Since: "3.2.1", Complexity: "O(N) where N is the number of keys that will be touched."},
+		&Command{Name: "type", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).typeCommand,
+			Group: "generic", Summary: "Determines the type of value stored at a key.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "rename", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).renameCommand,
+			Group: "generic", Summary: "Renames a key and overwrites the destination.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "renamenx", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).renameCommand,
+			Group: "generic", Summary: "Renames a key only when the target key name doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "copy", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).copyCommand,
+			Group: "generic", Summary: "Copies the value of a key to a new key.", Since: "6.2.0", Complexity: "O(N) worst case for collections, where N is the number of nested items. O(1) for string values."},
+		&Command{Name: "keys", Arity: 2, Flags: FlagReadonly, Handler: (*Server).keysCommand,
+			Group: "generic", Summary: "Returns all key names that match a pattern.", Since: "1.0.0", Complexity: "O(N) with N being the number of keys in the database, under the assumption that the key names in the database and the given pattern have limited length."},
+		&Command{Name: "scan", Arity: -2, Flags: FlagReadonly, Handler: (*Server).scanCommand,
+			Group: "generic", Summary: "Iterates over the key names in the database.", Since: "2.8.0", Complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection."},
+		&Command{Name: "randomkey", Arity: 1, Flags: FlagReadonly, Handler: (*Server).randomkeyCommand,
+			Group: "generic", Summary: "Returns a random key name from the database.", Since: "1.0.0", Complexity: "O(1)"},
+	)
+}
+
+// DEL key [key ...], UNLINK key [key ...]
+func (s *Server) delCommand(c *Client, args []string) error {
+	deleted := 0
+	for _, key := range args[1:] {
+		if s.storage.Del(key) {
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(deleted))
+	return nil
+}
+
+// EXISTS key [key ...], TOUCH key [key ...]
+// Keys mentioned several times are counted several times by EXISTS, just like in Redis
+func (s *Server) existsCommand(c *Client, args []string) error {
+	count := 0
+	for _, key := range args[1:] {
+		if s.storage.Exists(key) {
+			count++
+		}
+	}
+	c.w.WriteInteger(int64(count))
+	return nil
+}
+
+// TYPE key
+func (s *Server) typeCommand(c *Client, args []string) error {
+	e, ok := s.storage.lookup(args[1])
+	if !ok {
+		c.w.WriteSimpleString("none")
+		return nil
+	}
+	c.w.WriteSimpleString(typeName(e.value))
+	return nil
+}
+
+// RENAME key newkey, RENAMENX key newkey
+// The value keeps its expiration deadline
+func (s *Server) renameCommand(c *Client, args []string) error {
+	key, newKey := args[1], args[2]
+	nx := strings.ToLower(args[0]) == "renamenx"
+
+	if !s.storage.Exists(key) {
+		return fmt.Errorf("no such key")
+	}
+	if nx && s.storage.Exists(newKey) {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+
+	if key != newKey {
+		s.storage.Rename(key, newKey)
+	}
+	if nx {
+		c.w.WriteInteger(1)
+		return nil
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+// The copy keeps the expiration deadline of the source
+func (s *Server) copyCommand(c *Client, args []string) error {
+	src, dst := args[1], args[2]
+	replace := false
+	for i := 3; i < len(args); i++ {
+		switch {
+		case strings.ToUpper(args[i]) == "REPLACE":
+			replace = true
+		case strings.ToUpper(args[i]) == "DB" && i+1 < len(args):
+			db, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return errNotInteger
+			}
+			// there is a single database
+			if db != 0 {
+				return fmt.Errorf("DB index is out of range")
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if src == dst {
+		return fmt.Errorf("source and destination objects are the same")
+	}
+
+	e, ok := s.storage.lookup(src)
+	if !ok || (!replace && s.storage.Exists(dst)) {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	s.storage.Set(dst, copyValue(e.value), e.expireAt)
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// RANDOMKEY
+func (s *Server) randomkeyCommand(c *Client, args []string) error {
+	key, ok := s.storage.RandomKey()
+	if !ok {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulkString(key)
+	return nil
+}
+
+// KEYS pattern
+func (s *Server) keysCommand(c *Client, args []string) error {
+	pattern := args[1]
+	keys := []string{}
+	for cursor := uint64(0); ; {
+		var batch []string
+		batch, cursor = s.storage.Scan(cursor, 1000)
+		for _, key := range batch {
+			if pattern == "*" || globMatch(pattern, key, false) {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	c.w.WriteArray(keys)
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (s *Server) scanCommand(c *Client, args []string) error {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern, count, typ, err := parseScanOptions(args[2:], true)
+	if err != nil {
+		return err
+	}
+
+	keys, cursor := s.storage.Scan(cursor, count)
+	matched := keys[:0]
+	for _, key := range keys {
+		if pattern != "*" && !globMatch(pattern, key, false) {
+			continue
+		}
+		if typ != "" {
+			// the key may be gone by now
+			e, ok := s.storage.lookup(key)
+			if !ok || !strings.EqualFold(typeName(e.value), typ) {
+				continue
+			}
+		}
+		matched = append(matched, key)
+	}
+
+	c.w.WriteArrayHeader(2)
+	c.w.WriteBulkString(strconv.FormatUint(cursor, 10))
+	c.w.WriteArray(matched)
+	return nil
+}
+
+// parseScanOptions parses the options of SCAN and the scans of collections: [MATCH pattern] [COUNT count],
+// and [TYPE type] if withType is set
+func parseScanOptions(args []string, withType bool) (pattern string, count int, typ string, err error) {
+	pattern, count = "*", 10
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "", 0, "", errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return "", 0, "", errNotInteger
+			}
+			if count < 1 {
+				return "", 0, "", errSyntax
+			}
+		case "TYPE":
+			if !withType {
+				return "", 0, "", errSyntax
+			}
+			typ = args[i+1]
+		default:
+			return "", 0, "", errSyntax
+		}
+	}
+	return pattern, count, typ, nil
+}
@@ -0,0 +1,470 @@
+package main
+
+// List commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "lpush", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).pushCommand,
+			Group: "list", Summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0", Complexity: "O(1) for each element added, so O(N) to add N elements when the command is called with multiple arguments."},
+		&Command{Name: "rpush", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).pushCommand,
+			Group: "list", Summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0", Complexity: "O(1) for each element added, so O(N) to add N elements when the command is called with multiple arguments."},
+		&Command{Name: "lpushx", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).pushCommand,
+			Group: "list", Summary: "Prepends one or more elements to a list only when the list exists.", Since: "2.2.0", Complexity: "O(1) for each element added, so O(N) to add N elements when the command is called with multiple arguments."},
+		&Command{Name: "rpushx", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).pushCommand,
+			Group: "list", Summary: "Appends an element to a list only when the list exists.", Since: "2.2.0", Complexity: "O(1) for each element added, so O(N) to add N elements when the command is called with multiple arguments."},
+		&Command{Name: "lpop", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).popCommand,
+			Group: "list", Summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.", Since: "1.0.0", Complexity: "O(N) where N is the number of elements returned"},
+		&Command{Name: "rpop", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).popCommand,
+			Group: "list", Summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.", Since: "1.0.0", Complexity: "O(N) where N is the number of elements returned"},
+		&Command{Name: "llen", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).llenCommand,
+			Group: "list", Summary: "Returns the length of a list.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "lrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).lrangeCommand,
+			Group: "list", Summary: "Returns a range of elements from a list.", Since: "1.0.0", Complexity: "O(S+N) where S is the distance of start offset from HEAD for small lists, from nearest end (HEAD or TAIL) for large lists; and N is the number of elements in the specified range."},
+		&Command{Name: "lindex", Arity: 3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).lindexCommand,
+			Group: "list", Summary: "Returns an element from a list by its index.", Since: "1.0.0", Complexity: "O(N) where N is the number of elements to traverse to get to the element at index. This makes asking for the first or the last element of the list O(1)."},
+		&Command{Name: "lset", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).lsetCommand,
+			Group: "list", Summary: "Sets the value of an element in a list by its index.", Since: "1.0.0", Complexity: "O(N) where N is the length of the list. Setting either the first or the last element of the list is O(1)."},
+		&Command{Name: "lrem", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).lremCommand,
+			Group: "list", Summary: "Removes elements from a list. Deletes the list if the last element was removed.", Since: "1.0.0", Complexity: "O(N+M) where N is the length of the list and M is the number of elements removed."},
+		&Command{Name: "ltrim", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).ltrimCommand,
+			Group: "list", Summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed.", Since: "1.0.0", Complexity: "O(N) where N is the number of elements to be removed by the operation."},
+		&Command{Name: "linsert", Arity: 5, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).linsertCommand,
+			Group: "list", Summary: "Inserts an element before or after another element in a list.", Since: "2.2.0", Complexity: "O(N) where N is the number of elements to traverse before seeing the value pivot. This means that inserting somewhere on the left end on the list (head) can be considered O(1) and inserting somewhere on the right end (tail) is O(N)."},
+		&Command{Name: "lmove", Arity: 5, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).lmoveCommand,
+			Group: "list", Summary: "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.", Since: "6.2.0", Complexity: "O(1)"},
+		&Command{Name: "rpoplpush", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).lmoveCommand,
+			Group: "list", Summary: "Returns the last element of a list after removing and pushing it to another list. Deletes the list if the last element was popped.", Since: "1.2.0", Complexity: "O(1)"},
+		&Command{Name: "blpop", Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, Step: 1, Handler: (*Server).bpopCommand,
+			Group: "list", Summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.", Since: "2.0.0", Complexity: "O(N) where N is the number of provided keys."},
+		&Command{Name: "brpop", Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, Step: 1, Handler: (*Server).bpopCommand,
+			Group: "list", Summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.", Since: "2.0.0", Complexity: "O(N) where N is the number of provided keys."},
+		&Command{Name: "blmove", Arity: 6, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).blmoveCommand,
+			Group: "list", Summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise. Deletes the list if the last element was moved.", Since: "6.2.0", Complexity: "O(1)"},
+		&Command{Name: "brpoplpush", Arity: 4, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).blmoveCommand,
+			Group: "list", Summary: "Pops an element from a list, pushes it to another list and returns it. Block until an element is available otherwise. Deletes the list if the last element was popped.", Since: "2.2.0", Complexity: "O(1)"},
+	)
+}
+
+// getList returns the list of the key, nil if there is no such key.
+// Lists are changed in place, commands are executed one at a time
+func (s *Server) getList(key string) (*quicklist, error) {
+	e, ok := s.storage.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	list, ok := e.value.(*quicklist)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return list, nil
+}
+
+// listRange converts the start and the end of a range to indexes of the list of the length,
+// negative indexes count from the tail. Returns start > end if the range is empty
+func listRange(start, end int64, length int) (int, int) {
+	n := int64(length)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end += n
+	}
+	end = min(end, n-1)
+	if start > end {
+		return 0, -1
+	}
+	return int(start), int(end)
+}
+
+// LPUSH key element [element ...], RPUSH key element [element ...],
+// LPUSHX key element [element ...], RPUSHX key element [element ...]
+func (s *Server) pushCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		if name == "lpushx" || name == "rpushx" {
+			c.rewriteCommand()
+			c.w.WriteInteger(0)
+			return nil
+		}
+		list = newQuicklist()
+		s.storage.Set(args[1], list, time.Time{})
+	}
+
+	for _, value := range args[2:] {
+		if name == "lpush" || name == "lpushx" {
+			list.PushFront(value)
+		} else {
+			list.PushBack(value)
+		}
+	}
+	c.w.WriteInteger(int64(list.Len()))
+	return nil
+}
+
+// LPOP key [count], RPOP key [count]
+// Without count a single element is returned, with count an array
+func (s *Server) popCommand(c *Client, args []string) error {
+	left := strings.ToLower(args[0]) == "lpop"
+	count := int64(-1)
+	switch len(args) {
+	case 2:
+	case 3:
+		var err error
+		if count, err = parseInt(args[2]); err != nil || count < 0 {
+			return fmt.Errorf("value is out of range, must be positive")
+		}
+	default:
+		return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(args[0]))
+	}
+
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.rewriteCommand()
+		if count < 0 {
+			c.w.WriteNull()
+			return nil
+		}
+		c.w.WriteNullArray()
+		return nil
+	}
+
+	pop := list.PopBack
+	if left {
+		pop = list.PopFront
+	}
+	if count < 0 {
+		value, _ := pop()
+		s.deleteEmptyList(args[1], list)
+		c.w.WriteBulkString(value)
+		return nil
+	}
+	values := []string{}
+	for range min(count, int64(list.Len())) {
+		value, _ := pop()
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		c.rewriteCommand()
+	}
+	s.deleteEmptyList(args[1], list)
+	c.w.WriteArray(values)
+	return nil
+}
+
+// deleteEmptyList deletes the key of the list if the list is empty, keys never hold empty lists
+func (s *Server) deleteEmptyList(key string, list *quicklist) {
+	if list.Len() == 0 {
+		s.storage.Del(key)
+	}
+}
+
+// LLEN key
+func (s *Server) llenCommand(c *Client, args []string) error {
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	c.w.WriteInteger(int64(list.Len()))
+	return nil
+}
+
+// LRANGE key start stop
+func (s *Server) lrangeCommand(c *Client, args []string) error {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	end, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.w.WriteArray([]string{})
+		return nil
+	}
+
+	from, to := listRange(start, end, list.Len())
+	c.w.WriteArrayHeader(to - from + 1)
+	list.Range(from, to, func(value string) bool {
+		c.w.WriteBulkString(value)
+		return true
+	})
+	return nil
+}
+
+// LINDEX key index
+func (s *Server) lindexCommand(c *Client, args []string) error {
+	index, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.w.WriteNull()
+		return nil
+	}
+	value, ok := list.Index(int(index))
+	if !ok {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// LSET key index element
+func (s *Server) lsetCommand(c *Client, args []string) error {
+	index, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		return fmt.Errorf("no such key")
+	}
+	if !list.Set(int(index), args[3]) {
+		return fmt.Errorf("index out of range")
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// LREM key count element
+func (s *Server) lremCommand(c *Client, args []string) error {
+	count, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	removed := 0
+	if list != nil {
+		removed = list.Remove(args[3], int(count))
+		s.deleteEmptyList(args[1], list)
+	}
+	if removed == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(removed))
+	return nil
+}
+
+// LTRIM key start stop
+func (s *Server) ltrimCommand(c *Client, args []string) error {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	end, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.rewriteCommand()
+		c.w.WriteSimpleString("OK")
+		return nil
+	}
+	list.Trim(listRange(start, end, list.Len()))
+	s.deleteEmptyList(args[1], list)
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// LINSERT key <BEFORE | AFTER> pivot element
+// Returns the new length, -1 if the pivot is not found, 0 if the key doesn't exist
+func (s *Server) linsertCommand(c *Client, args []string) error {
+	where := strings.ToUpper(args[2])
+	if where != "BEFORE" && where != "AFTER" {
+		return errSyntax
+	}
+	list, err := s.getList(args[1])
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+
+	index, found := 0, false
+	list.Range(0, list.Len()-1, func(value string) bool {
+		if value == args[3] {
+			found = true
+			return false
+		}
+		index++
+		return true
+	})
+	if !found {
+		c.rewriteCommand()
+		c.w.WriteInteger(-1)
+		return nil
+	}
+	if where == "AFTER" {
+		index++
+	}
+	list.Insert(index, args[4])
+	c.w.WriteInteger(int64(list.Len()))
+	return nil
+}
+
+// parseMoveDirections parses the <LEFT | RIGHT> <LEFT | RIGHT> arguments of LMOVE and BLMOVE
+func parseMoveDirections(from, to string) (string, string, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		return "", "", errSyntax
+	}
+	return from, to, nil
+}
+
+// LMOVE source destination <LEFT | RIGHT> <LEFT | RIGHT>, RPOPLPUSH source destination
+func (s *Server) lmoveCommand(c *Client, args []string) error {
+	from, to := "RIGHT", "LEFT"
+	if len(args) == 5 {
+		var err error
+		if from, to, err = parseMoveDirections(args[3], args[4]); err != nil {
+			return err
+		}
+	}
+
+	value, ok, err := s.listMove(args[1], args[2], from == "LEFT", to == "LEFT")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.rewriteCommand()
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// listMove pops an element from the source list and pushes it to the destination list,
+// the lists may be the same. Returns false if the source doesn't exist
+func (s *Server) listMove(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	srcList, err := s.getList(src)
+	if err != nil || srcList == nil {
+		return "", false, err
+	}
+	// the destination must be checked before anything is changed
+	dstList, err := s.getList(dst)
+	if err != nil {
+		return "", false, err
+	}
+
+	var value string
+	if fromLeft {
+		value, _ = srcList.PopFront()
+	} else {
+		value, _ = srcList.PopBack()
+	}
+	if dstList == nil {
+		// the source is not empty yet even if it is the same key
+		dstList = newQuicklist()
+		s.storage.Set(dst, dstList, time.Time{})
+	}
+	if toLeft {
+		dstList.PushFront(value)
+	} else {
+		dstList.PushBack(value)
+	}
+	s.deleteEmptyList(src, srcList)
+	return value, true, nil
+}
+
+// BLPOP key [key ...] timeout, BRPOP key [key ...] timeout
+// Pops from the first non empty list, or blocks until one of the lists gets elements.
+// Replicas get the pop, LPOP or RPOP, never the blocking command
+func (s *Server) bpopCommand(c *Client, args []string) error {
+	left := strings.ToLower(args[0]) == "blpop"
+	keys := args[1 : len(args)-1]
+	deadline, err := parseTimeout(args[len(args)-1], time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		list, err := s.getList(key)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			continue
+		}
+
+		var value string
+		if left {
+			value, _ = list.PopFront()
+			c.rewriteCommand([]string{"LPOP", key})
+		} else {
+			value, _ = list.PopBack()
+			c.rewriteCommand([]string{"RPOP", key})
+		}
+		s.deleteEmptyList(key, list)
+		c.w.WriteArray([]string{key, value})
+		return nil
+	}
+	return s.block(c, args, "list", keys, deadline)
+}
+
+// BLMOVE source destination <LEFT | RIGHT> <LEFT | RIGHT> timeout, BRPOPLPUSH source destination timeout
+// Replicas get LMOVE, never the blocking command
+func (s *Server) blmoveCommand(c *Client, args []string) error {
+	from, to := "RIGHT", "LEFT"
+	if len(args) == 6 {
+		var err error
+		if from, to, err = parseMoveDirections(args[3], args[4]); err != nil {
+			return err
+		}
+	}
+	deadline, err := parseTimeout(args[len(args)-1], time.Now())
+	if err != nil {
+		return err
+	}
+
+	value, ok, err := s.listMove(args[1], args[2], from == "LEFT", to == "LEFT")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.block(c, args, "list", args[1:2], deadline)
+	}
+	c.rewriteCommand([]string{"LMOVE", args[1], args[2], from, to})
+	c.w.WriteBulkString(value)
+	return nil
+}
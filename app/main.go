@@ -14,6 +14,18 @@ import (
 var Options struct {
 	Port      int    `long:"port" short:"p" env:"PORT" description:"redis port" default:"6379"`
 	ReplicaOf string `long:"replicaof" short:"r" env:"REPLICA_OF" description:"master connection credentials: <ip> <port>" default:""`
+
+	ProtoMaxBulkLen        int64 `long:"proto-max-bulk-len" env:"PROTO_MAX_BULK_LEN" description:"max size of a single bulk string in bytes" default:"536870912"`
+	MaxMultibulkLen        int64 `long:"max-multibulk-len" env:"MAX_MULTIBULK_LEN" description:"max number of arguments of a single command" default:"1048576"`
+	ClientQueryBufferLimit int64 `long:"client-query-buffer-limit" env:"CLIENT_QUERY_BUFFER_LIMIT" description:"max size of a single command in bytes" default:"1073741824"`
+
+	HashMaxListpackEntries int `long:"hash-max-listpack-entries" env:"HASH_MAX_LISTPACK_ENTRIES" description:"max number of fields of a hash in the compact encoding" default:"128"`
+	HashMaxListpackValue   int `long:"hash-max-listpack-value" env:"HASH_MAX_LISTPACK_VALUE" description:"max size of a field or a value of a hash in the compact encoding" default:"64"`
+	SetMaxIntsetEntries    int `long:"set-max-intset-entries" env:"SET_MAX_INTSET_ENTRIES" description:"max number of members of a set of integers in the compact encoding" default:"512"`
+	ZsetMaxListpackEntries int `long:"zset-max-listpack-entries" env:"ZSET_MAX_LISTPACK_ENTRIES" description:"max number of members of a sorted set in the compact encoding" default:"128"`
+	ZsetMaxListpackValue   int `long:"zset-max-listpack-value" env:"ZSET_MAX_LISTPACK_VALUE" description:"max size of a member of a sorted set in the compact encoding" default:"64"`
+
+	Hz int `long:"hz" env:"HZ" description:"frequency of background tasks like active expiration, 1-500 times per second" default:"10"`
 }
 
 func main() {
@@ -30,8 +42,28 @@ func main() {
 	logOpts = append(logOpts, lgr.Debug)
 	lgr.SetupStdLogger(logOpts...)
 
+	// A limit of 0 or less would reject every command
+	limits := map[string]int64{
+		"proto-max-bulk-len":        Options.ProtoMaxBulkLen,
+		"max-multibulk-len":         Options.MaxMultibulkLen,
+		"client-query-buffer-limit": Options.ClientQueryBufferLimit,
+	}
+	for name, limit := range limits {
+		if limit <= 0 {
+			log.Fatalf("[ERROR] invalid %s option: %d, must be positive", name, limit)
+		}
+	}
+
 	bind := net.JoinHostPort("0.0.0.0", strconv.Itoa(Options.Port))
-	s := NewServer(bind)
+	s := NewServer(bind,
+		WithProtoMaxBulkLen(Options.ProtoMaxBulkLen),
+		WithMaxMultibulkLen(Options.MaxMultibulkLen),
+		WithClientQueryBufferLimit(Options.ClientQueryBufferLimit),
+		WithHashMaxListpack(Options.HashMaxListpackEntries, Options.HashMaxListpackValue),
+		WithSetMaxIntsetEntries(Options.SetMaxIntsetEntries),
+		WithZsetMaxListpack(Options.ZsetMaxListpackEntries, Options.ZsetMaxListpackValue),
+		WithHz(Options.Hz),
+	)
 
 	// Start the server
 	if Options.ReplicaOf != "" {
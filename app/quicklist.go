@@ -0,0 +1,293 @@
+package main
+
+// Quicklist: the list value type, a doubly linked list of packed chunks of elements, like in Redis
+
+// Limits of a quicklist node, a full node is split before inserting into it
+const (
+	quicklistNodeMaxEntries = 128
+	quicklistNodeMaxBytes   = 8 * 1024
+)
+
+// quicklist is a list of strings. Elements are kept in chunks, so pushing and popping at the ends is cheap,
+// and access by index skips whole chunks. Not safe for concurrent use
+type quicklist struct {
+	head, tail *quicklistNode
+	len        int
+}
+
+// quicklistNode is a chunk of consecutive elements, never empty
+type quicklistNode struct {
+	prev, next *quicklistNode
+	entries    []string
+	bytes      int
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+// full tells if the node can't take one more element of the given size
+func (n *quicklistNode) full(size int) bool {
+	return len(n.entries) >= quicklistNodeMaxEntries || (len(n.entries) > 0 && n.bytes+size > quicklistNodeMaxBytes)
+}
+
+// Len returns the number of elements
+func (ql *quicklist) Len() int {
+	return ql.len
+}
+
+// insertNode links the node after the given one, at the head if after is nil
+func (ql *quicklist) insertNode(n, after *quicklistNode) {
+	n.prev = after
+	if after == nil {
+		n.next = ql.head
+		ql.head = n
+	} else {
+		n.next = after.next
+		after.next = n
+	}
+	if n.next == nil {
+		ql.tail = n
+	} else {
+		n.next.prev = n
+	}
+}
+
+// unlinkNode removes the node from the list
+func (ql *quicklist) unlinkNode(n *quicklistNode) {
+	if n.prev == nil {
+		ql.head = n.next
+	} else {
+		n.prev.next = n.next
+	}
+	if n.next == nil {
+		ql.tail = n.prev
+	} else {
+		n.next.prev = n.prev
+	}
+}
+
+// PushFront adds the value at the head
+func (ql *quicklist) PushFront(value string) {
+	if ql.head == nil || ql.head.full(len(value)) {
+		ql.insertNode(&quicklistNode{}, nil)
+	}
+	n := ql.head
+	n.entries = append([]string{value}, n.entries...)
+	n.bytes += len(value)
+	ql.len++
+}
+
+// PushBack adds the value at the tail
+func (ql *quicklist) PushBack(value string) {
+	if ql.tail == nil || ql.tail.full(len(value)) {
+		ql.insertNode(&quicklistNode{}, ql.tail)
+	}
+	n := ql.tail
+	n.entries = append(n.entries, value)
+	n.bytes += len(value)
+	ql.len++
+}
+
+// PopFront removes and returns the value at the head
+func (ql *quicklist) PopFront() (string, bool) {
+	if ql.len == 0 {
+		return "", false
+	}
+	value := ql.head.entries[0]
+	ql.removeAt(ql.head, 0)
+	return value, true
+}
+
+// PopBack removes and returns the value at the tail
+func (ql *quicklist) PopBack() (string, bool) {
+	if ql.len == 0 {
+		return "", false
+	}
+	value := ql.tail.entries[len(ql.tail.entries)-1]
+	ql.removeAt(ql.tail, len(ql.tail.entries)-1)
+	return value, true
+}
+
+// removeAt removes the element at the offset of the node, and the node if it gets empty
+func (ql *quicklist) removeAt(n *quicklistNode, offset int) {
+	n.bytes -= len(n.entries[offset])
+	if offset == 0 {
+		n.entries = n.entries[1:]
+	} else {
+		n.entries = append(n.entries[:offset], n.entries[offset+1:]...)
+	}
+	ql.len--
+	if len(n.entries) == 0 {
+		ql.unlinkNode(n)
+	}
+}
+
+// find returns the node of the element at the index and the offset of the element in the node.
+// The index must be in range, the walk starts from the closest end
+func (ql *quicklist) find(index int) (*quicklistNode, int) {
+	if index < ql.len/2 {
+		for n := ql.head; ; n = n.next {
+			if index < len(n.entries) {
+				return n, index
+			}
+			index -= len(n.entries)
+		}
+	}
+	index = ql.len - 1 - index // from the tail
+	for n := ql.tail; ; n = n.prev {
+		if index < len(n.entries) {
+			return n, len(n.entries) - 1 - index
+		}
+		index -= len(n.entries)
+	}
+}
+
+// Index returns the element at the index, negative indexes count from the tail
+func (ql *quicklist) Index(index int) (string, bool) {
+	if index < 0 {
+		index += ql.len
+	}
+	if index < 0 || index >= ql.len {
+		return "", false
+	}
+	n, offset := ql.find(index)
+	return n.entries[offset], true
+}
+
+// Set replaces the element at the index, negative indexes count from the tail.
+// Returns false if the index is out of range
+func (ql *quicklist) Set(index int, value string) bool {
+	if index < 0 {
+		index += ql.len
+	}
+	if index < 0 || index >= ql.len {
+		return false
+	}
+	n, offset := ql.find(index)
+	n.bytes += len(value) - len(n.entries[offset])
+	n.entries[offset] = value
+	return true
+}
+
+// Insert inserts the value before the element at the index, index Len() appends it
+func (ql *quicklist) Insert(index int, value string) {
+	switch index {
+	case 0:
+		ql.PushFront(value)
+		return
+	case ql.len:
+		ql.PushBack(value)
+		return
+	}
+
+	n, offset := ql.find(index)
+	if n.full(len(value)) && len(n.entries) == 1 {
+		// a single big element, the value gets its own node before it
+		ql.insertNode(&quicklistNode{entries: []string{value}, bytes: len(value)}, n.prev)
+		ql.len++
+		return
+	}
+	if n.full(len(value)) {
+		// split the node in halves
+		half := len(n.entries) / 2
+		right := &quicklistNode{entries: append([]string{}, n.entries[half:]...)}
+		for _, e := range right.entries {
+			right.bytes += len(e)
+		}
+		n.entries = n.entries[:half:half]
+		n.bytes -= right.bytes
+		ql.insertNode(right, n)
+		if offset >= half {
+			n, offset = right, offset-half
+		}
+	}
+	n.entries = append(n.entries, "")
+	copy(n.entries[offset+1:], n.entries[offset:])
+	n.entries[offset] = value
+	n.bytes += len(value)
+	ql.len++
+}
+
+// Range calls fn for the elements from start to end, both included and in range, until fn returns false
+func (ql *quicklist) Range(start, end int, fn func(value string) bool) {
+	if start > end {
+		return
+	}
+	n, offset := ql.find(start)
+	for i := start; i <= end; i++ {
+		if !fn(n.entries[offset]) {
+			return
+		}
+		if offset++; offset == len(n.entries) {
+			n, offset = n.next, 0
+		}
+	}
+}
+
+// Trim keeps only the elements from start to end, both included and in range.
+// Everything is removed if start > end
+func (ql *quicklist) Trim(start, end int) {
+	if start > end {
+		*ql = quicklist{}
+		return
+	}
+	for range start {
+		ql.PopFront()
+	}
+	for range ql.len - (end - start + 1) {
+		ql.PopBack()
+	}
+}
+
+// Remove removes up to count elements equal to the value, all of them if count is 0,
+// from the head, or from the tail if count is negative. Returns the number of elements removed
+func (ql *quicklist) Remove(value string, count int) int {
+	removed := 0
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	if count >= 0 {
+		for n := ql.head; n != nil; {
+			next := n.next
+			for i := 0; i < len(n.entries); {
+				if n.entries[i] != value {
+					i++
+					continue
+				}
+				// the node may be unlinked when its last element is removed, next is kept
+				ql.removeAt(n, i)
+				if removed++; removed == limit {
+					return removed
+				}
+			}
+			n = next
+		}
+		return removed
+	}
+	for n := ql.tail; n != nil; {
+		prev := n.prev
+		for i := len(n.entries) - 1; i >= 0; i-- {
+			if n.entries[i] != value {
+				continue
+			}
+			ql.removeAt(n, i)
+			if removed++; removed == limit {
+				return removed
+			}
+		}
+		n = prev
+	}
+	return removed
+}
+
+// Copy returns a deep copy of the list
+func (ql *quicklist) Copy() *quicklist {
+	res := newQuicklist()
+	for n := ql.head; n != nil; n = n.next {
+		res.insertNode(&quicklistNode{entries: append([]string{}, n.entries...), bytes: n.bytes}, res.tail)
+	}
+	res.len = ql.len
+	return res
+}
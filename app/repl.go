@@ -3,14 +3,16 @@ package main
 // Methods specific to replication handling
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"slices"
 	"strconv"
 	"strings"
-	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
 )
 
 // AsSlaveOf sets the server as a slave of the given master
@@ -25,17 +27,17 @@ func (s *Server) AsSlaveOf(masterAddr string) error {
 		log.Fatalf("[ERROR] error connecting to master: %e", err)
 	}
 
-	reader := bufio.NewReader(s.masterConn)
+	reader := resp.NewReader(s.masterConn)
 
 	// Send PING command
-	s.masterConn.Write([]byte(s.RESPArray([]string{"PING"})))
-	typeResponse, args, err := s.readInput(reader)
+	s.masterConn.Write(resp.AppendCommand(nil, []string{"PING"}))
+	reply, err := reader.ReadValue()
 	if err != nil {
 		log.Printf("[ERROR] error reading response from master: %e", err)
 		return err
 	}
-	if typeResponse != TypeSimpleString || args[0] != "PONG" {
-		err = fmt.Errorf("error connecting to master: invalid response (%v)", args)
+	if reply.Type != resp.TypeSimpleString || reply.Str != "PONG" {
+		err = fmt.Errorf("error connecting to master: invalid response (%v)", reply)
 		log.Printf("[ERROR] %e", err)
 		return err
 	}
@@ -47,46 +49,41 @@ func (s *Server) AsSlaveOf(masterAddr string) error {
 		log.Printf("[ERROR] error parsing server address: %e", err)
 		return err
 	}
-	s.masterConn.Write([]byte(s.RESPArray([]string{"REPLCONF", "listening-port", port})))
-	typeResponse, args, err = s.readInput(reader)
+	s.masterConn.Write(resp.AppendCommand(nil, []string{"REPLCONF", "listening-port", port}))
+	reply, err = reader.ReadValue()
 	if err != nil {
 		log.Printf("[ERROR] error reading response from master: %e", err)
 		return err
 	}
-	if typeResponse != TypeSimpleString || args[0] != "OK" {
-		err = fmt.Errorf("error connecting to master: invalid response (%v)", args)
+	if reply.Type != resp.TypeSimpleString || reply.Str != "OK" {
+		err = fmt.Errorf("error connecting to master: invalid response (%v)", reply)
 		log.Printf("[ERROR] %e", err)
 		return err
 	}
 
 	// Send REPLCONF capa psync2
-	s.masterConn.Write([]byte(s.RESPArray([]string{"REPLCONF", "capa", "psync2"})))
-	typeResponse, args, err = s.readInput(reader)
+	s.masterConn.Write(resp.AppendCommand(nil, []string{"REPLCONF", "capa", "psync2"}))
+	reply, err = reader.ReadValue()
 	if err != nil {
 		log.Printf("[ERROR] error reading response from master: %e", err)
 		return err
 	}
-	if typeResponse != TypeSimpleString || args[0] != "OK" {
-		err = fmt.Errorf("error connecting to master: invalid response (%v)", args)
+	if reply.Type != resp.TypeSimpleString || reply.Str != "OK" {
+		err = fmt.Errorf("error connecting to master: invalid response (%v)", reply)
 		log.Printf("[ERROR] %e", err)
 		return err
 	}
 
 	// Send PSYNC ? -1 to ask for a full synchronization
-	s.masterConn.Write([]byte(s.RESPArray([]string{"PSYNC", "?", "-1"})))
-	typeResponse, args, err = s.readInput(reader)
+	s.masterConn.Write(resp.AppendCommand(nil, []string{"PSYNC", "?", "-1"}))
+	reply, err = reader.ReadValue()
 	if err != nil {
 		log.Printf("[ERROR] error reading response from master: %e", err)
 		return err
 	}
-	if len(args) != 1 {
-		err = fmt.Errorf("error connecting to master: invalid response (%v)", args)
-		log.Printf("[ERROR] %e", err)
-		return err
-	}
-	args = strings.Split(args[0], " ") // FULLRESYNC <replid> <offset>
-	if typeResponse != TypeSimpleString || args[0] != "FULLRESYNC" {
-		err = fmt.Errorf("error connecting to master: invalid response (%v)", args)
+	args := strings.Split(reply.Str, " ") // FULLRESYNC <replid> <offset>
+	if reply.Type != resp.TypeSimpleString || len(args) != 3 || args[0] != "FULLRESYNC" {
+		err = fmt.Errorf("error connecting to master: invalid response (%v)", reply)
 		log.Printf("[ERROR] %e", err)
 		return err
 	}
@@ -95,26 +92,12 @@ func (s *Server) AsSlaveOf(masterAddr string) error {
 	// Start the synchronization process
 	// read out $<length>\r\n<bulk data>
 	// there's no \r\n at the end of the bulk data
-	reader.ReadByte() // $
-	strLength, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("[ERROR] error reading length of bulk data: %e", err)
-		return err
-	}
-	strLength = strings.Trim(strLength, "\r\n")
-	length, err := strconv.Atoi(strLength)
-	if err != nil {
-		log.Printf("[ERROR] error parsing length of bulk data: %e", err)
-		return err
-	}
-	log.Printf("[DEBUG] length of bulk data: %d", length)
-	buf := make([]byte, length)
-	n, err := reader.Read(buf)
+	rdb, err := reader.ReadRawBulk()
 	if err != nil {
 		log.Printf("[ERROR] error reading bulk data: %e", err)
 		return err
 	}
-	log.Printf("[DEBUG] %d bytes read from master", n)
+	log.Printf("[DEBUG] %d bytes read from master", len(rdb))
 
 	go s.handleReplication(s.masterConn, reader)
 
@@ -122,16 +105,24 @@ func (s *Server) AsSlaveOf(masterAddr string) error {
 }
 
 // handleReplication reads the input from the master and handles the replication
-// reusing the same connection and reader
-func (s *Server) handleReplication(connection net.Conn, reader *bufio.Reader) error {
+// reusing the same connection and reader. Commands go through the command table
+// as if sent by a client, but the master gets no replies
+func (s *Server) handleReplication(connection net.Conn, reader *resp.Reader) error {
+	master := &Client{
+		id:     s.lastClientId.Add(1),
+		conn:   connection,
+		w:      resp.NewWriter(io.Discard),
+		proto:  resp.RESP2,
+		master: true,
+	}
 	for {
 		// Read the input
-		typeResponse, args, err := s.readInput(reader)
-		log.Printf("[DEBUG] [repl] handleReplication input parsed, %c:%v:%e, &%v",
-			typeResponse, args, err, connection)
+		args, err := reader.ReadCommand()
+		log.Printf("[DEBUG] [repl] handleReplication input parsed, %q:%v, &%v",
+			args, err, connection)
 
 		if err != nil {
-			if err.Error() == "EOF" {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				log.Printf("[DEBUG] (EOF) reached, %v", connection)
 				connection.Close()
 				return nil
@@ -140,94 +131,104 @@ func (s *Server) handleReplication(connection net.Conn, reader *bufio.Reader) er
 			return err
 		}
 
-		switch typeResponse {
-		case TypeArray:
-			err = s.handleReplCommand(args, connection)
-			if err != nil {
-				log.Printf("[ERROR] [repl] error handling command: %e", err)
-			}
-			continue
-		case TypeSimpleError:
-			log.Printf("[DEBUG] [repl] simple error received: %v", args)
-			continue
-		case TypeSimpleString:
-			log.Printf("[DEBUG] [repl] simple string received: %v", args)
-			continue
-		default:
-			log.Printf("[DEBUG] [repl], invalid command: %v", args)
+		if len(args) == 0 {
 			continue
 		}
+		err = s.handleCommand(args, master)
+		if err != nil {
+			log.Printf("[ERROR] [repl] error handling command: %e", err)
+		}
 
+		// every command received from the master counts, including the failed ones
+		s.replOffset += resp.CommandLen(args)
+		log.Printf("[DEBUG] [%s] replOffset: %d", s.role, s.replOffset)
 	}
 }
 
-// handleReplCommand handles the replication commands over the connection to the master.
-// SET happens silently without propagation, no response is sent back to the master.
-// Implements REPLCONF GETACK * and so on
-func (s *Server) handleReplCommand(args []string, connection net.Conn) error {
-	var err error
-
-	switch strings.ToUpper(args[0]) {
-
-	case "PING":
-		log.Printf("[DEBUG] [%s] PING command: %v", s.role, args)
-
-		s.replOffset += len(s.RESPArray(args))
-		log.Printf("[DEBUG] [%s] replOffset: %d", s.role, s.replOffset)
-
-	case "SET":
-		log.Printf("[DEBUG] [%s] SET command: %v", s.role, args)
-
-		if len(args) < 3 {
-			err = fmt.Errorf("wrong number of arguments for 'set' command")
-			return err
-		}
+func init() {
+	registerCommands(
+		&Command{Name: "replconf", Arity: -1, Flags: FlagAdmin | FlagNoscript, Handler: (*Server).replconfCommand,
+			Group: "server", Summary: "An internal command for configuring the replication stream.", Since: "3.0.0", Complexity: "O(1)"},
+		&Command{Name: "psync", Arity: -3, Flags: FlagAdmin | FlagNoscript, Handler: (*Server).psyncCommand,
+			Group: "server", Summary: "An internal command used in replication.", Since: "2.8.0", Complexity: "O(1)"},
+	)
+}
 
-		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
-			exp, err := strconv.Atoi(args[4])
-			if err != nil {
-				err = fmt.Errorf("error parsing expiration: %w", err)
-				log.Printf("[ERROR] %e", err)
-				return err
-			}
-			// Set with expiration
-			log.Printf("[DEBUG] [%s] Setting key %s with value %s and expiration %s\n",
-				s.role, args[1], args[2], args[4])
-			s.storage.Set(args[1], args[2], time.Millisecond*time.Duration(exp))
-			return nil
+// REPLCONF <option> <value> [<option> <value> ...]
+// Replicas configure themselves with listening-port and capa, and report their offset with ACK.
+// The master asks a replica for its offset with GETACK *
+func (s *Server) replconfCommand(c *Client, args []string) error {
+	if len(args) == 3 && strings.ToUpper(args[1]) == "GETACK" {
+		if c.master {
+			// REPLCONF ACK <offset>, sent directly since the master gets no replies
+			c.conn.Write(resp.AppendCommand(nil, []string{"REPLCONF", "ACK", strconv.Itoa(s.replOffset)}))
 		}
-		// Set without expiration
-		log.Printf("[DEBUG] [%s] Setting key %s with value %s\n", s.role, args[1], args[2])
-
-		s.storage.Set(args[1], args[2], 0)
-
-		s.replOffset += len(s.RESPArray(args))
-		log.Printf("[DEBUG] [%s] replOffset: %d", s.role, s.replOffset)
-
-	case "REPLCONF":
+		return nil
+	}
 
-		log.Printf("[DEBUG] [%s] REPLCONF command: %v", s.role, args)
+	if s.role != RoleMaster {
+		return fmt.Errorf("REPLCONF command is only valid for master servers")
+	}
 
-		if len(args) < 3 {
-			err = fmt.Errorf("wrong number of arguments for 'replconf' command")
-			return err
+	replAddr := c.conn.RemoteAddr().String()
+	if len(args) == 3 && strings.ToUpper(args[1]) == "ACK" {
+		offset, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("error parsing offset: %w", err)
 		}
 
-		// REPLCONF GETACK *
-		if strings.ToUpper(args[1]) == "GETACK" && args[2] == "*" {
-			// REPLCONF ACK <offset>
-			connection.Write([]byte(s.RESPArray([]string{"REPLCONF", "ACK", strconv.Itoa(s.replOffset)})))
+		s.mx.Lock()
+		if repl, ok := s.replicas[replAddr]; ok {
+			repl.offset = offset
+			s.replicas[replAddr] = repl
 		}
+		s.mx.Unlock()
+		return nil
+	}
 
-		s.replOffset += len(s.RESPArray(args))
-		log.Printf("[DEBUG] [%s] replOffset: %d", s.role, s.replOffset)
-
-	default:
-		connection.Write([]byte(s.RESPSimpleError("unknown command")))
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	// replAddr is a temp session ID, since handshake is a single connection
+	if err := s.replConf(replAddr, args); err != nil {
+		return err
 	}
+	if repl, ok := s.replicas[replAddr]; ok {
+		repl.conn = c.conn
+		s.replicas[replAddr] = repl
+	}
+	c.w.WriteSimpleString("OK")
 	return nil
 }
 
+// PSYNC replicationid offset
+func (s *Server) psyncCommand(c *Client, args []string) error {
+	if err := s.psyncConfig(args); err != nil {
+		return err
+	}
+	_, rdbData, err := s.makeRDBFile()
+	if err != nil {
+		log.Printf("[ERROR] error generating RDB data: %e", err)
+		return err
+	}
+	c.w.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d", s.replId, s.replOffset))
+
+	// handshake is complete, replace temp session ID with the actual replica address
+	s.mx.Lock()
+	replAddr := c.conn.RemoteAddr().String()
+	if repl, ok := s.replicas[replAddr]; ok {
+		s.replicas[net.JoinHostPort(repl.Addr, strconv.Itoa(repl.Port))] = repl
+		delete(s.replicas, replAddr)
+	}
+	s.mx.Unlock()
+
+	// start the replication
+	// Send RDB data
+	c.w.WriteRawBulk(rdbData)
+	// the replica connection is written directly by propagate from now on,
+	// everything buffered must go before that
+	return c.w.Flush()
+}
+
 func (s *Server) psyncConfig(args []string) error {
 	if len(args) < 3 {
 		err := fmt.Errorf("wrong number of arguments for 'psync' command")
@@ -280,10 +281,11 @@ func (s *Server) replConf(replAddr string, args []string) error {
 
 // primitive function to propagate a command to all replicas
 func (s *Server) propagate(args []string) error {
+	cmd := resp.AppendCommand(nil, args)
 
 	for ra, repl := range s.replicas {
 		log.Printf("[DEBUG] -> Propagating to %s, args: %v", ra, args)
-		n, err := repl.conn.Write([]byte(s.RESPArray(args)))
+		n, err := repl.conn.Write(cmd)
 		if err != nil {
 			log.Printf("[ERROR] error writing to replica %s: %e, trying to reconnect", ra, err)
 			// try to reconnect
@@ -294,7 +296,7 @@ func (s *Server) propagate(args []string) error {
 			}
 			repl.conn = conn
 			s.replicas[ra] = repl
-			n, err = repl.conn.Write([]byte(s.RESPArray(args)))
+			n, err = repl.conn.Write(cmd)
 			if err != nil {
 				log.Printf("[ERROR] error writing to reconnected replica %s: %e", ra, err)
 				continue
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"github.com/parMaster/mcache"
+	"github.com/codecrafters-io/redis-starter-go/resp"
 )
 
+// RedisVersion is the version of Redis the server is compatible with
+const RedisVersion = "7.2.0"
+
 // Server roles
 const (
 	RoleMaster = "master"
@@ -29,9 +33,27 @@ type Replica struct {
 	capabilities []string
 }
 
+// Client is a state of a single client connection
+type Client struct {
+	id    int64
+	conn  net.Conn
+	w     *resp.Writer // replies are buffered here until flushed
+	proto int          // protocol version, negotiated with HELLO
+	name  string
+
+	master bool // the connection to the master of a replica, replies are not sent
+
+	waiter *waiter // set while the client is blocked, guarded by the execution lock
+	served *waiter // set while the command of the blocked client is executed again, guarded by the execution lock
+
+	// replication of the current command, see rewriteCommand
+	rewritten bool
+	rewrite   [][]string
+}
+
 type Server struct {
 	Addr         string
-	storage      *mcache.Cache[string]
+	storage      *Storage
 	role         string
 	replId       string
 	replOffset   int
@@ -39,19 +61,65 @@ type Server struct {
 	capabilities []string
 	masterConn   net.Conn
 	mx           sync.Mutex
-}
+	lastClientId atomic.Int64
+
+	// commands are executed one at a time, like in Redis,
+	// so each of them is atomic with respect to the other clients
+	lock sync.Mutex
+	// clients blocked on keys in the order they blocked, and keys that got data for them, guarded by lock
+	blocked   map[string][]*waiter
+	readyKeys []string
+
+	// background tasks run hz times per second
+	hz int
+	// active expiration stats, guarded by lock
+	expireStats struct {
+		stalePerc      float64 // running average of the share of expired keys among the sampled ones
+		timeCapReached int64   // cycles stopped because they ran out of time
+	}
 
-func NewServer(addr string) *Server {
-	store := mcache.NewCache[string]()
+	// limits of the listpack encoding of new hashes
+	hashMaxListpackEntries int
+	hashMaxListpackValue   int
+	// limit of the intset encoding of new sets
+	setMaxIntsetEntries int
+	// limits of the listpack encoding of new sorted sets
+	zsetMaxListpackEntries int
+	zsetMaxListpackValue   int
+
+	// protocol safety limits
+	limits resp.Limits
+	// disconnections caused by exceeding the limits, by the name of the limit
+	limitDisconnections map[string]*atomic.Int64
+}
 
+func NewServer(addr string, options ...func(*Server)) *Server {
 	server := &Server{
 		Addr:         addr,
-		storage:      store,
+		storage:      NewStorage(),
 		role:         RoleMaster,
 		replOffset:   0,
 		capabilities: []string{"psync2", "eof"},
 		replicas:     make(map[string]Replica),
 		mx:           sync.Mutex{},
+		hz:           10,
+
+		hashMaxListpackEntries: hashMaxListpackEntries,
+		hashMaxListpackValue:   hashMaxListpackValue,
+		setMaxIntsetEntries:    setMaxIntsetEntries,
+		zsetMaxListpackEntries: zsetMaxListpackEntries,
+		zsetMaxListpackValue:   zsetMaxListpackValue,
+
+		limits: resp.DefaultLimits,
+		limitDisconnections: map[string]*atomic.Int64{
+			resp.LimitProtoMaxBulkLen:        {},
+			resp.LimitMaxMultibulkLen:        {},
+			resp.LimitClientQueryBufferLimit: {},
+		},
+	}
+
+	for _, option := range options {
+		option(server)
 	}
 
 	// Generate a 40-character long replication ID
@@ -63,11 +131,66 @@ func NewServer(addr string) *Server {
 	return server
 }
 
+// WithProtoMaxBulkLen is a functional option for setting the maximum size of a single bulk string
+func WithProtoMaxBulkLen(n int64) func(*Server) {
+	return func(s *Server) {
+		s.limits.MaxBulkLen = n
+	}
+}
+
+// WithMaxMultibulkLen is a functional option for setting the maximum number of arguments of a command
+func WithMaxMultibulkLen(n int64) func(*Server) {
+	return func(s *Server) {
+		s.limits.MaxMultibulkLen = n
+	}
+}
+
+// WithClientQueryBufferLimit is a functional option for setting the maximum size of a single command
+func WithClientQueryBufferLimit(n int64) func(*Server) {
+	return func(s *Server) {
+		s.limits.MaxQueryLen = n
+	}
+}
+
+// WithHz is a functional option for setting the frequency of background tasks, clamped to 1-500 like in Redis
+func WithHz(hz int) func(*Server) {
+	return func(s *Server) {
+		s.hz = min(max(hz, 1), 500)
+	}
+}
+
+// WithHashMaxListpack is a functional option for setting the limits of the compact encoding of hashes:
+// hashes with more fields, or with longer fields or values, are converted to hash tables
+func WithHashMaxListpack(entries, value int) func(*Server) {
+	return func(s *Server) {
+		s.hashMaxListpackEntries = entries
+		s.hashMaxListpackValue = value
+	}
+}
+
+// WithSetMaxIntsetEntries is a functional option for setting the limit of the compact encoding of sets of integers:
+// sets with more members are converted to hash tables
+func WithSetMaxIntsetEntries(n int) func(*Server) {
+	return func(s *Server) {
+		s.setMaxIntsetEntries = n
+	}
+}
+
+// WithZsetMaxListpack is a functional option for setting the limits of the compact encoding of sorted sets:
+// sorted sets with more members, or with longer members, are converted to skiplists
+func WithZsetMaxListpack(entries, value int) func(*Server) {
+	return func(s *Server) {
+		s.zsetMaxListpackEntries = entries
+		s.zsetMaxListpackValue = value
+	}
+}
+
 func (s *Server) ListenAndServe() error {
 	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
+	go s.activeExpire()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -79,254 +202,194 @@ func (s *Server) ListenAndServe() error {
 	}
 }
 
-// Response Data types
-const (
-	TypeSimpleString = '+'
-	TypeSimpleError  = '-'
-	TypeInteger      = ':'
-	TypeBulkString   = '$'
-	TypeArray        = '*'
-)
-
-// handleConnection will read data from the connection
+// handleConnection will read data from the connection.
+// Replies are buffered and flushed once all the pipelined commands
+// already received are handled, so a pipeline costs a few writes, not one per command
 func (s *Server) handleConnection(connection net.Conn, silent bool) error {
-	reader := bufio.NewReader(connection)
+	reader := resp.NewReader(connection, resp.WithLimits(s.limits))
+	client := &Client{
+		id:    s.lastClientId.Add(1),
+		conn:  connection,
+		w:     resp.NewWriter(connection),
+		proto: resp.RESP2,
+	}
 	for {
 		// Read the input
-		typeResponse, args, err := s.readInput(reader)
-		log.Printf("[DEBUG] [%s] handleConnection input parsed, %c:%v:%e, &%v",
-			s.role, typeResponse, args, err, connection)
+		args, err := reader.ReadCommand()
+		log.Printf("[DEBUG] [%s] handleConnection input parsed, %q:%v, &%v",
+			s.role, args, err, connection)
 
 		if err != nil {
-			if err.Error() == "EOF" {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				log.Printf("[DEBUG] (EOF) reached, %v", connection)
+				client.w.Flush()
 				connection.Close()
 				return nil
 			}
+			var limitErr resp.LimitError
+			if errors.As(err, &limitErr) {
+				log.Printf("[WARN] [%s] client %d exceeded %s, closing %v", s.role, client.id, limitErr.Limit, connection)
+				s.limitDisconnections[limitErr.Limit].Add(1)
+			}
+			var protoErr resp.ProtocolError
+			if errors.As(err, &protoErr) {
+				log.Printf("[DEBUG] [%s] handleConnection protocol error: %v, closing %v", s.role, err, connection)
+				if !silent {
+					client.w.WriteError("ERR " + err.Error())
+				}
+				client.w.Flush()
+				connection.Close()
+				return err
+			}
 			log.Printf("[DEBUG] [%s] handleConnection error reading input, %v", s.role, connection)
+			client.w.Flush()
 			return err
 		}
 
-		// Check the type of response
-		switch typeResponse {
-		case TypeArray:
-			// Handle the command
-			err = s.handleCommand(args, connection)
+		// Null and empty commands are ignored, just like Redis does
+		if len(args) > 0 {
+			// replies of a blocked client are written by the client serving it,
+			// so the replies before are sent first
+			cmd, ok := lookupCommand(args[0])
+			blocking := ok && cmd.Flags&FlagBlocking != 0
+			if blocking {
+				client.w.Flush()
+			}
+
+			err = s.handleCommand(args, client)
 			if err != nil {
 				log.Printf("[ERROR] error handling command: %e", err)
 			}
-			continue
-		case TypeSimpleError:
-			log.Printf("[DEBUG] [%s] simple error received: %v", s.role, args)
-			continue
-		case TypeSimpleString:
-			log.Printf("[DEBUG] [%s] simple string received: %v", s.role, args)
-			continue
-		default:
-			log.Printf("[DEBUG] [%s], invalid command: %v", s.role, args)
-			if !silent {
-				connection.Write([]byte(s.RESPSimpleError("invalid command")))
+
+			if blocking {
+				if err := s.waitUnblocked(client, reader); err != nil {
+					log.Printf("[DEBUG] [%s] blocked client %d disconnected: %v", s.role, client.id, err)
+					connection.Close()
+					return nil
+				}
 			}
-			continue
 		}
 
-	}
-}
-
-func (s *Server) readInput(reader *bufio.Reader) (typeResponse rune, args []string, err error) {
-	cmd, err := reader.ReadByte()
-	if err != nil {
-		if err.Error() == "EOF" {
-			log.Printf("[INFO] Connection closed (EOF)")
-			return TypeSimpleError, nil, err
-		} else {
-			err = fmt.Errorf("error reading data: %w", err)
-			log.Printf("[DEBUG] %s", err)
-			return TypeSimpleError, nil, err
+		// nothing else is pipelined, time to send the replies
+		if reader.Buffered() == 0 {
+			client.w.Flush()
 		}
 	}
+}
 
-	// log.Printf("[DEBUG] readInput cmd: %c", cmd)
-	switch cmd {
-	case TypeArray:
-		args, err := s.readArray(reader)
-		if err != nil {
-			log.Printf("[ERROR] error reading array: %e", err)
-		}
-		log.Printf("[DEBUG] Array: %v", args)
-
-		if len(args) == 0 {
-			return TypeSimpleError, nil, fmt.Errorf("empty array")
-		}
-
-		return TypeArray, args, nil
-
-	case TypeSimpleString:
-		data, err := s.readSimpleString(reader)
-		if err != nil {
-			log.Printf("[ERROR] error reading simple string: %e", err)
-		}
-		log.Printf("[DEBUG] Simple string: %s", data)
+func init() {
+	registerCommands(
+		&Command{Name: "ping", Arity: -1, Flags: FlagFast, Handler: (*Server).pingCommand,
+			Group: "connection", Summary: "Returns the server's liveliness response.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "echo", Arity: 2, Flags: FlagFast, Handler: (*Server).echoCommand,
+			Group: "connection", Summary: "Returns the given string.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "info", Arity: -1, Handler: (*Server).infoCommand,
+			Group: "server", Summary: "Returns information and statistics about the server.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "hello", Arity: -1, Flags: FlagFast | FlagNoscript, Handler: (*Server).helloCommand,
+			Group: "connection", Summary: "Handshakes with the Redis server.", Since: "6.0.0", Complexity: "O(1)"},
+	)
+}
 
-		return TypeSimpleString, []string{data}, nil
-	case TypeSimpleError:
-		data, err := s.readSimpleError(reader)
-		if err != nil {
-			log.Printf("[ERROR] error reading simple error: %e", err)
-		}
-		log.Printf("[DEBUG] Simple error: %s", data)
-		return TypeSimpleError, []string{data}, nil
+// PING [message]
+func (s *Server) pingCommand(c *Client, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for 'ping' command")
 	}
-
-	return TypeSimpleError, nil, fmt.Errorf("\"%c\" type not supported", cmd)
+	if len(args) == 2 {
+		c.w.WriteBulkString(args[1])
+		return nil
+	}
+	c.w.WriteSimpleString("PONG")
+	return nil
 }
 
-func (s *Server) handleCommand(args []string, connection net.Conn) error {
-	var err error
-
-	switch strings.ToUpper(args[0]) {
-	case "PING":
-		log.Printf("[DEBUG] [%s] PING command: %v", s.role, args)
-		connection.Write([]byte(s.RESPSimpleString("PONG")))
-
-	case "ECHO":
-		log.Printf("[DEBUG] [%s] ECHO command: %v", s.role, args)
-		if len(args) < 2 {
-			err = fmt.Errorf("wrong number of arguments for 'echo' command")
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
-		connection.Write([]byte(s.RESPBulkString(args[1])))
-
-	case "SET":
-		log.Printf("[DEBUG] [%s] SET command: %v", s.role, args)
+// ECHO message
+func (s *Server) echoCommand(c *Client, args []string) error {
+	c.w.WriteBulkString(args[1])
+	return nil
+}
 
-		if len(args) < 3 {
-			err = fmt.Errorf("wrong number of arguments for 'set' command")
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
+// INFO [section ...]
+func (s *Server) infoCommand(c *Client, args []string) error {
+	info := s.getInfo()
+	c.w.WriteVerbatimString("txt", strings.Join(info, "\r\n"))
+	log.Printf("[DEBUG] INFO command: %v", info)
+	return nil
+}
 
-		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
-			exp, err := strconv.Atoi(args[4])
-			if err != nil {
-				err = fmt.Errorf("error parsing expiration: %w", err)
-				connection.Write([]byte(s.RESPSimpleError(err.Error())))
-				log.Printf("[ERROR] %e", err)
-				return err
-			}
-			// Set with expiration
-			log.Printf("[DEBUG] [%s] Setting key %s with value %s and expiration %s\n",
-				s.role, args[1], args[2], args[4])
-			s.storage.Set(args[1], args[2], time.Millisecond*time.Duration(exp))
-			connection.Write([]byte(s.RESPSimpleString("OK")))
-			s.propagate(args)
-
-			return nil
-		}
-		// Set without expiration
-		log.Printf("[DEBUG] [%s] Setting key %s with value %s\n", s.role, args[1], args[2])
-
-		s.storage.Set(args[1], args[2], 0)
-		connection.Write([]byte(s.RESPSimpleString("OK")))
-		s.propagate(args)
-
-	case "GET":
-		log.Printf("[DEBUG] [%s] GET command: %v", s.role, args)
-		if len(args) != 2 {
-			err = fmt.Errorf("wrong number of arguments for 'get' command")
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
-		value, err := s.storage.Get(args[1])
-		if err != nil {
-			connection.Write([]byte(s.nullBulkString()))
-			return nil
-		}
-		connection.Write([]byte(s.RESPBulkString(value)))
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *Server) helloCommand(c *Client, args []string) error {
+	if err := s.hello(args, c); err != nil {
+		return err
+	}
+	s.writeHello(c)
+	return nil
+}
 
-	case "INFO":
-		info := s.getInfo()
-		connection.Write([]byte(s.RESPBulkString(strings.Join(info, "\r\n"))))
-		log.Printf("[DEBUG] INFO command: %v", info)
+// hello negotiates the protocol version and sets up the client:
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *Server) hello(args []string, client *Client) error {
+	if len(args) == 1 {
+		return nil
+	}
 
-	case "REPLCONF":
-		if s.role != RoleMaster {
-			err = fmt.Errorf("REPLCONF command is only valid for master servers")
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
+	proto, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("ERR Protocol version is not an integer or out of range")
+	}
+	if proto != resp.RESP2 && proto != resp.RESP3 {
+		return fmt.Errorf("NOPROTO unsupported protocol version")
+	}
 
-		if len(args) == 3 && strings.ToUpper(args[1]) == "ACK" {
-			log.Printf("[DEBUG] [%s] REPLCONF command: %v", s.role, args)
-			offset, err := strconv.Atoi(args[2])
-			if err != nil {
-				err = fmt.Errorf("error parsing offset: %w", err)
-				connection.Write([]byte(s.RESPSimpleError(err.Error())))
-				log.Printf("[ERROR] %e", err)
-				return err
+	name, setName := "", false
+	for i := 2; i < len(args); i++ {
+		switch {
+		case strings.ToUpper(args[i]) == "AUTH" && i+2 < len(args):
+			// there is no ACL, "default" is the only user and it has no password
+			if args[i+1] != "default" {
+				return fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
 			}
-
-			s.mx.Lock()
-			if repl, ok := s.replicas[connection.RemoteAddr().String()]; ok {
-				repl.offset = offset
-				s.replicas[connection.RemoteAddr().String()] = repl
+			i += 2
+		case strings.ToUpper(args[i]) == "SETNAME" && i+1 < len(args):
+			name, setName = args[i+1], true
+			if strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) {
+				return fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
 			}
-			s.mx.Unlock()
-			return nil
-		}
-
-		s.mx.Lock()
-		// replAddr is a temp session ID, since handshake is a single connection
-		replAddr := connection.RemoteAddr().String()
-		err = s.replConf(replAddr, args)
-		if err != nil {
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
-
-		if repl, ok := s.replicas[replAddr]; ok {
-			repl.conn = connection
-			s.replicas[replAddr] = repl
-		}
-		s.mx.Unlock()
-
-		connection.Write([]byte(s.RESPSimpleString("OK")))
-
-	case "PSYNC":
-		err = s.psyncConfig(args)
-		if err != nil {
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
-		}
-		connection.Write([]byte(s.RESPSimpleString(fmt.Sprintf("FULLRESYNC %s %d", s.replId, s.replOffset))))
-
-		// handshake is complete, replace temp session ID with the actual replica address
-		s.mx.Lock()
-		replAddr := connection.RemoteAddr().String()
-		if repl, ok := s.replicas[replAddr]; ok {
-			s.replicas[net.JoinHostPort(repl.Addr, strconv.Itoa(repl.Port))] = repl
-			delete(s.replicas, replAddr)
-		}
-		s.mx.Unlock()
-
-		// start the replication
-		// Send RDB data
-		rdbLen, rdbData, err := s.makeRDBFile()
-		if err != nil {
-			log.Printf("[ERROR] error generating RDB data: %e", err)
-			connection.Write([]byte(s.RESPSimpleError(err.Error())))
-			return err
+			i++
+		default:
+			return fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
 		}
-		connection.Write([]byte(fmt.Sprintf("%c%d\r\n", TypeBulkString, rdbLen)))
-		connection.Write(rdbData)
+	}
 
-	default:
-		connection.Write([]byte(s.RESPSimpleString("ERR unknown command")))
+	// options are applied only when all of them are valid
+	client.proto = proto
+	client.w.SetProto(proto)
+	if setName {
+		client.name = name
 	}
 	return nil
 }
 
+// writeHello writes the server info map as a reply to HELLO
+func (s *Server) writeHello(client *Client) {
+	w := client.w
+	w.WriteMapHeader(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("redis")
+	w.WriteBulkString("version")
+	w.WriteBulkString(RedisVersion)
+	w.WriteBulkString("proto")
+	w.WriteInteger(int64(client.proto))
+	w.WriteBulkString("id")
+	w.WriteInteger(client.id)
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString(s.role)
+	w.WriteBulkString("modules")
+	w.WriteArrayHeader(0)
+}
+
 func (s *Server) getInfo() []string {
 	info := []string{}
 	info = append(info, "Replication")
@@ -335,5 +398,15 @@ func (s *Server) getInfo() []string {
 		info = append(info, fmt.Sprintf("master_replid:%s", s.replId))
 		info = append(info, fmt.Sprintf("master_repl_offset:%d", s.replOffset))
 	}
+	info = append(info, "")
+	info = append(info, "Stats")
+	for _, limit := range []string{resp.LimitProtoMaxBulkLen, resp.LimitMaxMultibulkLen, resp.LimitClientQueryBufferLimit} {
+		name := strings.ReplaceAll(limit, "-", "_") + "_disconnections"
+		info = append(info, fmt.Sprintf("%s:%d", name, s.limitDisconnections[limit].Load()))
+	}
+	info = append(info, fmt.Sprintf("expired_keys:%d", s.storage.expired.Load()))
+	info = append(info, fmt.Sprintf("expired_subkeys:%d", s.storage.expiredFields.Load()))
+	info = append(info, fmt.Sprintf("expired_stale_perc:%.2f", s.expireStats.stalePerc*100))
+	info = append(info, fmt.Sprintf("expired_time_cap_reached_count:%d", s.expireStats.timeCapReached))
 	return info
 }
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/client"
+	"github.com/codecrafters-io/redis-starter-go/resp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -158,24 +170,2636 @@ func TestWithExpiration(t *testing.T) {
 	assert.Equal(t, "$-1\r\n", string(buf[:n]))
 }
 
+// Values containing \r\n and binary data are stored as is
+func Test_SetGetBinary(t *testing.T) {
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+
+	value := "a\r\nb\x00\xff\r\n"
+	_, err = conn.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nbin\r\n$8\r\n" + value + "\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", string(buf[:n]))
+
+	_, err = conn.Write([]byte("*2\r\n$3\r\nGET\r\n$3\r\nbin\r\n"))
+	assert.Nil(t, err)
+
+	buf = make([]byte, 1024)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$8\r\n"+value+"\r\n", string(buf[:n]))
+}
+
+// Malformed request gets a protocol error and the connection is closed
+func Test_ProtocolError(t *testing.T) {
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte("*1\r\n$x\r\nPING\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", string(buf[:n]))
+
+	_, err = conn.Read(buf)
+	assert.Error(t, err)
+}
+
 func TestInfo(t *testing.T) {
 
-	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte("*1\r\n$4\r\nINFO\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+
+	info := string(buf[:n])
+	infos := strings.Split(info, "\r\n")
+	assert.Equal(t, "Replication", infos[1])
+	assert.Equal(t, "role:master", infos[2])
+	assert.Equal(t, "master_replid:", infos[3][:14])
+
+}
+
+// HELLO switches protocol of a single connection
+func Test_Hello(t *testing.T) {
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+	conn2, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte("*4\r\n$5\r\nHELLO\r\n$1\r\n3\r\n$7\r\nSETNAME\r\n$4\r\ntest\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n"))
+	assert.Contains(t, string(buf[:n]), "$5\r\nproto\r\n:3\r\n")
+
+	_, err = conn.Write([]byte("*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"))
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "_\r\n", string(buf[:n]))
+
+	// the other connection is still RESP2
+	_, err = conn2.Write([]byte("*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"))
+	assert.Nil(t, err)
+	n, err = conn2.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$-1\r\n", string(buf[:n]))
+
+	_, err = conn2.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n4\r\n"))
+	assert.Nil(t, err)
+	n, err = conn2.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", string(buf[:n]))
+
+	_, err = conn.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n2\r\n"))
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "*14\r\n$6\r\nserver\r\n"))
+}
+
+// Inline commands, the way telnet and nc send them
+func Test_Inline(t *testing.T) {
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte("PING\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+PONG\r\n", string(buf[:n]))
+
+	_, err = conn.Write([]byte("echo \"hello\\x20world\"\n"))
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$11\r\nhello world\r\n", string(buf[:n]))
+
+	_, err = conn.Write([]byte("ECHO 'unbalanced\r\n"))
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: unbalanced quotes in request\r\n", string(buf[:n]))
+
+	_, err = conn.Read(buf)
+	assert.Error(t, err)
+}
+
+// The client package talks to the server with the same codec
+func Test_Client(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379", PoolSize: 2})
+	defer c.Close()
+	ctx := context.Background()
+
+	pong, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	assert.Nil(t, c.Set(ctx, "client", "a\r\nb", 0))
+	v, err := c.Get(ctx, "client")
+	assert.Nil(t, err)
+	assert.Equal(t, "a\r\nb", v)
+
+	_, err = c.Get(ctx, "client-missing")
+	assert.Equal(t, client.Nil, err)
+
+	replies, err := c.Pipeline().Do("ECHO", "one").Do("ECHO", "two").Exec(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "two", replies[1].Str)
+
+	info, err := c.Info(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, info, "role:master")
+
+	c3 := client.New(client.Options{Addr: "0.0.0.0:6379", Protocol: resp.RESP3})
+	defer c3.Close()
+	reply, err := c3.Do(ctx, "GET", "client-missing")
+	assert.Nil(t, err)
+	assert.Equal(t, byte(resp.TypeNull), reply.Type)
+}
+
+// Arity and unknown commands are checked by the command table
+func Test_CommandTable(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Do(ctx, "GET")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'get' command"), err)
+	_, err = c.Do(ctx, "get", "a", "b")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'get' command"), err)
+	_, err = c.Do(ctx, "SET", "k")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'set' command"), err)
+	_, err = c.Do(ctx, "SET", "k", "v", "PX")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "NOPE", "a", "b\r\n")
+	assert.Equal(t, client.Error("ERR unknown command 'NOPE', with args beginning with: 'a' 'b  ' "), err)
+
+	pong, err := c.Do(ctx, "ping", "hi")
+	assert.Nil(t, err)
+	assert.Equal(t, "hi", pong.Str)
+}
+
+// COMMAND reports the command table
+func Test_Command(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	count, err := c.CommandCount(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(commandTable)), count)
+
+	names, err := c.CommandList(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, names, "get")
+	assert.Contains(t, names, "command")
+
+	all, err := c.Do(ctx, "COMMAND")
+	assert.Nil(t, err)
+	assert.Equal(t, int(count), len(all.Elems))
+
+	info, err := c.Do(ctx, "COMMAND", "INFO", "set", "nope")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(info.Elems))
+	set := info.Elems[0].Elems
+	assert.Equal(t, 10, len(set))
+	assert.Equal(t, "set", set[0].Str)
+	assert.Equal(t, int64(-3), set[1].Int)
+	assert.Equal(t, "write", set[2].Elems[0].Str)
+	assert.Equal(t, []int64{1, 1, 1}, []int64{set[3].Int, set[4].Int, set[5].Int})
+	assert.True(t, info.Elems[1].Null)
+
+	// keys given after numkeys can't be found by their positions
+	info, err = c.Do(ctx, "COMMAND", "INFO", "zunionstore")
+	assert.Nil(t, err)
+	zunionstore := info.Elems[0].Elems
+	flags, _ := client.Strings(zunionstore[2])
+	assert.Equal(t, []string{"write", "movablekeys"}, flags)
+	assert.Equal(t, []int64{1, 1, 1}, []int64{zunionstore[3].Int, zunionstore[4].Int, zunionstore[5].Int})
+	info, _ = c.Do(ctx, "COMMAND", "INFO", "sintercard")
+	flags, _ = client.Strings(info.Elems[0].Elems[2])
+	assert.Equal(t, []string{"readonly", "movablekeys"}, flags)
+
+	docs, err := c.Do(ctx, "COMMAND", "DOCS", "GET", "nope")
+	assert.Nil(t, err)
+	flat, err := client.Strings(docs.Elems[1])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(docs.Elems))
+	assert.Equal(t, "get", docs.Elems[0].Str)
+	assert.Equal(t, []string{"summary", "Returns the string value of a key.", "since", "1.0.0", "group", "string", "complexity", "O(1)"}, flat)
+
+	_, err = c.Do(ctx, "COMMAND", "NOPE")
+	assert.Equal(t, client.Error("ERR unknown subcommand 'NOPE'. Try COMMAND HELP."), err)
+}
+
+// SET options in any order, conflicts and replies
+func Test_SetOptions(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Do(ctx, "SET", "opt", "1", "ex", "100")
+	assert.Nil(t, err)
+	expireAt, err := s.storage.ExpireAt("opt")
+	assert.Nil(t, err)
+	assert.InDelta(t, time.Now().Add(100*time.Second).UnixMilli(), expireAt.UnixMilli(), 1000)
+
+	// NX and XX
+	_, err = c.SetWithArgs(ctx, "opt", "2", client.SetArgs{Mode: "NX"})
+	assert.Equal(t, client.Nil, err)
+	_, err = c.SetWithArgs(ctx, "opt-missing", "2", client.SetArgs{Mode: "XX"})
+	assert.Equal(t, client.Nil, err)
+	old, err := c.SetWithArgs(ctx, "opt", "2", client.SetArgs{Mode: "XX", Get: true, KeepTTL: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", old)
+	keptAt, err := s.storage.ExpireAt("opt")
+	assert.Nil(t, err)
+	assert.Equal(t, expireAt, keptAt)
+
+	// GET of the existing key without setting it
+	v, err := c.Do(ctx, "SET", "opt", "3", "GET", "NX")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", v.Str)
+
+	// the expiration is dropped without KEEPTTL
+	_, err = c.Do(ctx, "SET", "opt", "4")
+	assert.Nil(t, err)
+	expireAt, err = s.storage.ExpireAt("opt")
+	assert.Nil(t, err)
+	assert.True(t, expireAt.IsZero())
+
+	at := time.Now().Add(time.Hour).UnixMilli()
+	_, err = c.Do(ctx, "SET", "opt", "5", "PXAT", strconv.FormatInt(at, 10))
+	assert.Nil(t, err)
+	expireAt, err = s.storage.ExpireAt("opt")
+	assert.Nil(t, err)
+	assert.Equal(t, at, expireAt.UnixMilli())
+
+	tbl := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"NX", "XX"}, "ERR syntax error"},
+		{[]string{"EX", "10", "PX", "10"}, "ERR syntax error"},
+		{[]string{"KEEPTTL", "EX", "10"}, "ERR syntax error"},
+		{[]string{"EX"}, "ERR syntax error"},
+		{[]string{"FOO"}, "ERR syntax error"},
+		{[]string{"EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"PX", "-5"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"EX", "9223372036854775807"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"EX", "ten"}, "ERR value is not an integer or out of range"},
+	}
+	for _, tt := range tbl {
+		_, err = c.Do(ctx, append([]string{"SET", "opt", "x"}, tt.args...)...)
+		assert.Equal(t, client.Error(tt.err), err, tt.args)
+	}
+	v1, err := c.Get(ctx, "opt")
+	assert.Nil(t, err)
+	assert.Equal(t, "5", v1)
+}
+
+func Test_StringCommands(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "counter", "float", "str", "padded")
+
+	n, err := c.Incr(ctx, "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = c.IncrBy(ctx, "counter", 41)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), n)
+	n, err = c.DecrBy(ctx, "counter", 50)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-8), n)
+	n, err = c.Decr(ctx, "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-9), n)
+
+	// the deadline is kept
+	assert.Nil(t, c.Set(ctx, "counter", strconv.FormatInt(math.MaxInt64, 10), time.Hour))
+	_, err = c.Incr(ctx, "counter")
+	assert.Equal(t, client.Error("ERR increment or decrement would overflow"), err)
+	n, err = c.Decr(ctx, "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(math.MaxInt64-1), n)
+	ttl, err := c.TTL(ctx, "counter")
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Minute)
+	_, err = c.DecrBy(ctx, "counter", math.MinInt64)
+	assert.Equal(t, client.Error("ERR decrement would overflow"), err)
+
+	for _, value := range []string{"abc", " 1", "+1", "01", "1.5", ""} {
+		assert.Nil(t, c.Set(ctx, "str", value, 0))
+		_, err = c.Incr(ctx, "str")
+		assert.Equal(t, client.Error("ERR value is not an integer or out of range"), err, value)
+	}
+	_, err = c.Do(ctx, "INCRBY", "counter", "x")
+	assert.Equal(t, client.Error("ERR value is not an integer or out of range"), err)
+
+	f, err := c.IncrByFloat(ctx, "float", 10.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10.5, f)
+	v, err := c.Do(ctx, "INCRBYFLOAT", "float", "0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.6", v.Str)
+	_, err = c.Do(ctx, "INCRBYFLOAT", "float", "1e308")
+	assert.Nil(t, err)
+	_, err = c.Do(ctx, "INCRBYFLOAT", "float", "1e308")
+	assert.Equal(t, client.Error("ERR increment would produce NaN or Infinity"), err)
+	_, err = c.Do(ctx, "INCRBYFLOAT", "float", "nan")
+	assert.Equal(t, client.Error("ERR value is not a valid float"), err)
+
+	assert.Nil(t, c.Set(ctx, "str", "Hello", 0))
+	n, err = c.Append(ctx, "str", " World")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+	n, err = c.StrLen(ctx, "str")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+	n, err = c.StrLen(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	for _, tt := range []struct {
+		start, end int64
+		expected   string
+	}{
+		{0, 4, "Hello"}, {-5, -1, "World"}, {0, -1, "Hello World"}, {6, 100, "World"},
+		{-100, 2, "Hel"}, {5, 3, ""}, {-1, -5, ""}, {20, 30, ""},
+	} {
+		sub, err := c.GetRange(ctx, "str", tt.start, tt.end)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, sub, "%d %d", tt.start, tt.end)
+	}
+
+	n, err = c.SetRange(ctx, "str", 6, "Redis")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+	v2, _ := c.Get(ctx, "str")
+	assert.Equal(t, "Hello Redis", v2)
+	n, err = c.SetRange(ctx, "padded", 3, "x")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	v2, _ = c.Get(ctx, "padded")
+	assert.Equal(t, "\x00\x00\x00x", v2)
+	n, err = c.SetRange(ctx, "missing", 3, "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	_, err = c.SetRange(ctx, "str", -1, "x")
+	assert.Equal(t, client.Error("ERR offset is out of range"), err)
+	_, err = c.SetRange(ctx, "str", 1<<40, "x")
+	assert.Equal(t, client.Error("ERR string exceeds maximum allowed size (proto-max-bulk-len)"), err)
+}
+
+// Increments from many connections are not lost
+// APPEND and SETRANGE change the value in place, appends only reallocate it now and then
+func Test_AppendInPlace(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	buffer := func(key string) *byte {
+		e, _ := s.storage.data.Get(key)
+		return &e.value.([]byte)[0]
+	}
+
+	buffers := map[*byte]bool{}
+	for range 10000 {
+		assert.Nil(t, s.handleCommand([]string{"APPEND", "log", "x"}, c))
+		buffers[buffer("log")] = true
+	}
+	assert.Less(t, len(buffers), 50)
+
+	buf := buffer("log")
+	assert.Nil(t, s.handleCommand([]string{"SETRANGE", "log", "1", "abc"}, c))
+	assert.Same(t, buf, buffer("log"))
+	v, _ := s.storage.Get("log")
+	assert.Equal(t, 10000, len(v))
+	assert.Equal(t, "xabcx", v[:5])
+
+	// copies don't share the spare room
+	assert.Nil(t, s.handleCommand([]string{"COPY", "log", "log-copy"}, c))
+	assert.Nil(t, s.handleCommand([]string{"APPEND", "log", "y"}, c))
+	assert.Nil(t, s.handleCommand([]string{"APPEND", "log-copy", "z"}, c))
+	v, _ = s.storage.Get("log")
+	assert.Equal(t, "xy", v[9999:])
+	v, _ = s.storage.Get("log-copy")
+	assert.Equal(t, "xz", v[9999:])
+}
+
+func Test_IncrConcurrent(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379", PoolSize: 20})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "concurrent")
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_, err := c.Incr(ctx, "concurrent")
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := c.Get(ctx, "concurrent")
+	assert.Nil(t, err)
+	assert.Equal(t, "2000", v)
+}
+
+func Test_MultiKey(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "mk1", "mk2", "mk3")
+
+	assert.Nil(t, c.MSet(ctx, "mk1", "v1", "mk2", "v2"))
+	values, err := c.MGet(ctx, "mk1", "mk-missing", "mk2")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(values))
+	assert.Equal(t, "v1", *values[0])
+	assert.Nil(t, values[1])
+	assert.Equal(t, "v2", *values[2])
+	_, err = c.Do(ctx, "MSET", "mk1", "v1", "mk2")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'mset' command"), err)
+
+	// all or nothing
+	ok, err := c.MSetNX(ctx, "mk3", "v3", "mk1", "v1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	n, _ := c.Exists(ctx, "mk3")
+	assert.Equal(t, int64(0), n)
+	ok, err = c.MSetNX(ctx, "mk3", "v3")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	v, err := c.GetSet(ctx, "mk3", "new")
+	assert.Nil(t, err)
+	assert.Equal(t, "v3", v)
+	_, err = c.GetSet(ctx, "mk-missing", "new")
+	assert.Equal(t, client.Nil, err)
+	c.Del(ctx, "mk-missing")
+
+	v, err = c.GetEx(ctx, "mk3", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", v)
+	ttl, _ := c.TTL(ctx, "mk3")
+	assert.Greater(t, ttl, time.Minute)
+	_, err = c.GetEx(ctx, "mk3", 0)
+	assert.Nil(t, err)
+	ttl, _ = c.TTL(ctx, "mk3")
+	assert.Equal(t, time.Duration(-1), ttl)
+	_, err = c.Do(ctx, "GETEX", "mk3", "EX", "0")
+	assert.Equal(t, client.Error("ERR invalid expire time in 'getex' command"), err)
+	_, err = c.Do(ctx, "GETEX", "mk3", "PERSIST", "EX", "10")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+
+	v, err = c.GetDel(ctx, "mk3")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", v)
+	_, err = c.GetDel(ctx, "mk3")
+	assert.Equal(t, client.Nil, err)
+}
+
+// Readers never see a half applied MSET
+func Test_MSetAtomic(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379", PoolSize: 4})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "atomic1", "atomic2")
+	assert.Nil(t, c.MSet(ctx, "atomic1", "0", "atomic2", "0"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 300 {
+			assert.Nil(t, c.MSet(ctx, "atomic1", strconv.Itoa(i), "atomic2", strconv.Itoa(i)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		values, err := c.MGet(ctx, "atomic1", "atomic2")
+		assert.Nil(t, err)
+		assert.Equal(t, *values[0], *values[1])
+	}
+}
+
+func Test_Bitmaps(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "bits", "bits2", "bitdest", "bitfield")
+
+	n, err := c.SetBit(ctx, "bits", 7, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = c.SetBit(ctx, "bits", 7, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	v, _ := c.Get(ctx, "bits")
+	assert.Equal(t, "\x00", v)
+	n, err = c.GetBit(ctx, "bits", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	_, err = c.SetBit(ctx, "bits", -1, 1)
+	assert.Equal(t, client.Error("ERR bit offset is not an integer or out of range"), err)
+	_, err = c.SetBit(ctx, "bits", 1, 2)
+	assert.Equal(t, client.Error("ERR bit is not an integer or out of range"), err)
+
+	assert.Nil(t, c.Set(ctx, "bits", "foobar", 0))
+	for _, tt := range []struct {
+		start, end int64
+		unit       string
+		expected   int64
+	}{
+		{0, -1, "", 26}, {0, 0, "", 4}, {1, 1, "BYTE", 6}, {5, 30, "BIT", 17}, {-1, -2, "", 0},
+	} {
+		n, err = c.BitCountRange(ctx, "bits", tt.start, tt.end, tt.unit)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, n, "%d %d %s", tt.start, tt.end, tt.unit)
+	}
+	_, err = c.Do(ctx, "BITCOUNT", "bits", "0")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+
+	// BITPOS
+	assert.Nil(t, c.Set(ctx, "bits", "\xff\xf0\x00", 0))
+	n, _ = c.BitPos(ctx, "bits", 0)
+	assert.Equal(t, int64(12), n)
+	assert.Nil(t, c.Set(ctx, "bits", "\x00\xff\xf0", 0))
+	for _, tt := range []struct {
+		args     []string
+		expected int64
+	}{
+		{[]string{"1", "0"}, 8}, {[]string{"1", "2"}, 16}, {[]string{"1", "2", "-1", "BYTE"}, 16},
+		{[]string{"1", "7", "15", "BIT"}, 8}, {[]string{"1", "7", "-3", "BIT"}, 8},
+	} {
+		v, err := c.Do(ctx, append([]string{"BITPOS", "bits"}, tt.args...)...)
+		assert.Nil(t, err)
+		n, _ = client.Int(v)
+		assert.Equal(t, tt.expected, n, tt.args)
+	}
+	assert.Nil(t, c.Set(ctx, "bits", "\xff\xff\xff", 0))
+	n, _ = c.BitPos(ctx, "bits", 0)
+	assert.Equal(t, int64(24), n)
+	n, _ = c.BitPos(ctx, "bits", 0, 0, -1)
+	assert.Equal(t, int64(-1), n)
+	n, _ = c.BitPos(ctx, "bits-missing", 1)
+	assert.Equal(t, int64(-1), n)
+	n, _ = c.BitPos(ctx, "bits-missing", 0)
+	assert.Equal(t, int64(0), n)
+
+	// BITOP
+	assert.Nil(t, c.MSet(ctx, "bits", "foobar", "bits2", "abcdef"))
+	n, err = c.BitOp(ctx, "AND", "bitdest", "bits", "bits2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	v, _ = c.Get(ctx, "bitdest")
+	assert.Equal(t, "`bc`ab", v)
+	n, err = c.BitOp(ctx, "OR", "bitdest", "bits", "bits-missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	v, _ = c.Get(ctx, "bitdest")
+	assert.Equal(t, "foobar", v)
+	n, err = c.BitOp(ctx, "NOT", "bitdest", "bits2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	v, _ = c.Get(ctx, "bitdest")
+	assert.Equal(t, "\x9e\x9d\x9c\x9b\x9a\x99", v)
+	_, err = c.BitOp(ctx, "NOT", "bitdest", "bits", "bits2")
+	assert.Equal(t, client.Error("ERR BITOP NOT must be called with a single source key."), err)
+	n, _ = c.BitOp(ctx, "XOR", "bitdest", "bits-missing")
+	assert.Equal(t, int64(0), n)
+	n, _ = c.Exists(ctx, "bitdest")
+	assert.Equal(t, int64(0), n)
+}
+
+func Test_BitField(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "bitfield")
+
+	ints := func(values []*int64, err error) []any {
+		assert.Nil(t, err)
+		res := []any{}
+		for _, v := range values {
+			if v == nil {
+				res = append(res, nil)
+				continue
+			}
+			res = append(res, *v)
+		}
+		return res
+	}
+
+	// GET doesn't create the key
+	assert.Equal(t, []any{int64(0)}, ints(c.BitField(ctx, "bitfield", "GET", "u8", "0")))
+	n, _ := c.Exists(ctx, "bitfield")
+	assert.Equal(t, int64(0), n)
+
+	assert.Equal(t, []any{int64(1), int64(0)}, ints(c.BitField(ctx, "bitfield", "INCRBY", "i5", "100", "1", "GET", "u4", "0")))
+
+	// overflow modes
+	// WRAP by default, then SAT
+	for _, expected := range [][]any{{int64(1), int64(1)}, {int64(2), int64(2)}, {int64(3), int64(3)}, {int64(0), int64(3)}} {
+		assert.Equal(t, expected,
+			ints(c.BitField(ctx, "bitfield", "INCRBY", "u2", "200", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "202", "1")))
+	}
+	assert.Equal(t, []any{nil}, ints(c.BitField(ctx, "bitfield", "OVERFLOW", "FAIL", "INCRBY", "u2", "202", "1")))
+	assert.Equal(t, []any{int64(0), int64(0)}, ints(c.BitField(ctx, "bitfield", "INCRBY", "u2", "202", "-3", "OVERFLOW", "SAT", "INCRBY", "u2", "202", "-1")))
+
+	assert.Equal(t, []any{int64(0), int64(-128), int64(127)}, ints(c.BitField(ctx, "bitfield",
+		"SET", "i8", "#40", "127", "INCRBY", "i8", "#40", "1", "OVERFLOW", "SAT", "INCRBY", "i8", "#40", "1000")))
+	assert.Equal(t, []any{int64(127), int64(-56), int64(200)}, ints(c.BitField(ctx, "bitfield",
+		"SET", "i8", "#40", "200", "GET", "i8", "#40", "GET", "u8", "#40")))
+	assert.Equal(t, []any{int64(0), int64(math.MinInt64)}, ints(c.BitField(ctx, "bitfield",
+		"SET", "i64", "#10", strconv.FormatInt(math.MaxInt64, 10), "INCRBY", "i64", "#10", "1")))
+	assert.Equal(t, []any{int64(0), nil}, ints(c.BitField(ctx, "bitfield",
+		"OVERFLOW", "FAIL", "SET", "u8", "#20", "255", "SET", "u8", "#20", "256")))
+
+	_, err := c.BitField(ctx, "bitfield", "GET", "u64", "0")
+	assert.Equal(t, client.Error("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."), err)
+	_, err = c.BitField(ctx, "bitfield", "OVERFLOW", "NONE")
+	assert.Equal(t, client.Error("ERR Invalid OVERFLOW type specified"), err)
+	_, err = c.BitField(ctx, "bitfield", "GET", "u8")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "BITFIELD_RO", "bitfield", "SET", "u8", "0", "1")
+	assert.Equal(t, client.Error("ERR BITFIELD_RO only supports the GET subcommand"), err)
+	v, err := c.Do(ctx, "BITFIELD_RO", "bitfield", "GET", "u8", "#20")
+	assert.Nil(t, err)
+	values, _ := client.Strings(v)
+	assert.Equal(t, []string{"255"}, values)
+}
+
+// Bits of a string are changed in place, big bitmaps are not copied on every write
+func Test_BitmapInPlace(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	buffer := func(key string) *byte {
+		e, _ := s.storage.data.Get(key)
+		return &e.value.([]byte)[0]
+	}
+
+	assert.Nil(t, s.handleCommand([]string{"SETBIT", "dau", "8000000", "1"}, c))
+	buf := buffer("dau")
+	assert.Nil(t, s.handleCommand([]string{"SETBIT", "dau", "42", "1"}, c))
+	assert.Nil(t, s.handleCommand([]string{"BITFIELD", "dau", "SET", "u8", "#3", "255", "INCRBY", "i5", "100", "1"}, c))
+	assert.Same(t, buf, buffer("dau"))
+	v, _ := s.storage.Get("dau")
+	assert.Equal(t, 1000001, len(v))
+	assert.Equal(t, "\x00\x00\x00\xff\x00\x20", v[:6])
+
+	// copies don't share the buffer
+	assert.Nil(t, s.handleCommand([]string{"COPY", "dau", "dau-copy"}, c))
+	assert.Nil(t, s.handleCommand([]string{"SETBIT", "dau", "0", "1"}, c))
+	v, _ = s.storage.Get("dau-copy")
+	assert.Equal(t, byte(0), v[0])
+}
+
+func Test_Lists(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "list", "list2", "list-copy", "str")
+
+	n, err := c.RPush(ctx, "list", "b", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = c.LPush(ctx, "list", "a", "z")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	values, err := c.LRange(ctx, "list", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"z", "a", "b", "c"}, values)
+	values, _ = c.LRange(ctx, "list", -3, 1)
+	assert.Equal(t, []string{"a"}, values)
+	values, _ = c.LRange(ctx, "list", 5, 10)
+	assert.Equal(t, []string{}, values)
+	_, err = c.Do(ctx, "LPUSHX", "list-missing", "a") // LPUSHX doesn't create keys
+	assert.Nil(t, err)
+	n, _ = c.Exists(ctx, "list-missing")
+	assert.Equal(t, int64(0), n)
+
+	typ, _ := c.Type(ctx, "list")
+	assert.Equal(t, "list", typ)
+	v, err := c.LIndex(ctx, "list", -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "c", v)
+	_, err = c.LIndex(ctx, "list", 4)
+	assert.Equal(t, client.Nil, err)
+
+	assert.Nil(t, c.LSet(ctx, "list", 0, "y"))
+	assert.Equal(t, client.Error("ERR index out of range"), c.LSet(ctx, "list", 4, "y"))
+	assert.Equal(t, client.Error("ERR no such key"), c.LSet(ctx, "list-missing", 0, "y"))
+
+	n, err = c.LInsert(ctx, "list", "AFTER", "a", "a2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+	n, _ = c.LInsert(ctx, "list", "BEFORE", "missing", "x")
+	assert.Equal(t, int64(-1), n)
+	values, _ = c.LRange(ctx, "list", 0, -1)
+	assert.Equal(t, []string{"y", "a", "a2", "b", "c"}, values)
+
+	v, err = c.LPop(ctx, "list")
+	assert.Nil(t, err)
+	assert.Equal(t, "y", v)
+	values, err = c.RPopCount(ctx, "list", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "b"}, values)
+	_, err = c.LPopCount(ctx, "list-missing", 2)
+	assert.Equal(t, client.Nil, err)
+	_, err = c.Do(ctx, "LPOP", "list", "-1")
+	assert.Equal(t, client.Error("ERR value is out of range, must be positive"), err)
+
+	// LMOVE and rotation
+	v, err = c.LMove(ctx, "list", "list2", "LEFT", "RIGHT")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", v)
+	v, err = c.LMove(ctx, "list", "list", "RIGHT", "LEFT")
+	assert.Nil(t, err)
+	assert.Equal(t, "a2", v)
+	v, err = c.LMove(ctx, "list", "list2", "RIGHT", "LEFT")
+	assert.Nil(t, err)
+	assert.Equal(t, "a2", v)
+	n, _ = c.Exists(ctx, "list")
+	assert.Equal(t, int64(0), n)
+	_, err = c.LMove(ctx, "list", "list2", "RIGHT", "LEFT")
+	assert.Equal(t, client.Nil, err)
+
+	// LREM, LTRIM
+	c.RPush(ctx, "list", "x", "a", "x", "b", "x", "c", "x")
+	n, err = c.LRem(ctx, "list", -2, "x")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, _ = c.LRem(ctx, "list", 1, "x")
+	assert.Equal(t, int64(1), n)
+	values, _ = c.LRange(ctx, "list", 0, -1)
+	assert.Equal(t, []string{"a", "x", "b", "c"}, values)
+	assert.Nil(t, c.LTrim(ctx, "list", 1, -2))
+	values, _ = c.LRange(ctx, "list", 0, -1)
+	assert.Equal(t, []string{"x", "b"}, values)
+
+	// copies are independent
+	ok, _ := c.Copy(ctx, "list", "list-copy", false)
+	assert.True(t, ok)
+	c.RPush(ctx, "list-copy", "more")
+	n, _ = c.LLen(ctx, "list")
+	assert.Equal(t, int64(2), n)
+
+	assert.Nil(t, c.LTrim(ctx, "list", 5, 10))
+	n, _ = c.Exists(ctx, "list")
+	assert.Equal(t, int64(0), n)
+
+	// WRONGTYPE both ways
+	assert.Nil(t, c.Set(ctx, "str", "v", 0))
+	wrongType := client.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	_, err = c.LPush(ctx, "str", "a")
+	assert.Equal(t, wrongType, err)
+	_, err = c.LMove(ctx, "list2", "str", "LEFT", "LEFT")
+	assert.Equal(t, wrongType, err)
+	n, _ = c.LLen(ctx, "list2")
+	assert.Equal(t, int64(2), n)
+	_, err = c.Get(ctx, "list2")
+	assert.Equal(t, wrongType, err)
+	_, err = c.Incr(ctx, "list2")
+	assert.Equal(t, wrongType, err)
+}
+
+// The quicklist behaves like a slice across many nodes
+func Test_Quicklist(t *testing.T) {
+
+	ql := newQuicklist()
+	ref := []string{}
+	check := func() {
+		assert.Equal(t, len(ref), ql.Len())
+		values := []string{}
+		ql.Range(0, ql.Len()-1, func(v string) bool {
+			values = append(values, v)
+			return true
+		})
+		assert.Equal(t, ref, values)
+	}
+
+	for i := range 1000 {
+		v := strconv.Itoa(i % 10)
+		switch i % 3 {
+		case 0:
+			ql.PushFront(v)
+			ref = append([]string{v}, ref...)
+		case 1:
+			ql.PushBack(v)
+			ref = append(ref, v)
+		case 2:
+			idx := i % (len(ref) + 1)
+			ql.Insert(idx, v)
+			ref = append(ref[:idx], append([]string{v}, ref[idx:]...)...)
+		}
+	}
+	check()
+	assert.Greater(t, func() int {
+		n := 0
+		for node := ql.head; node != nil; node = node.next {
+			n++
+		}
+		return n
+	}(), 8)
+
+	for i := range ref {
+		v, ok := ql.Index(i)
+		assert.True(t, ok)
+		assert.Equal(t, ref[i], v)
+	}
+	assert.True(t, ql.Set(-1, "last"))
+	ref[len(ref)-1] = "last"
+
+	assert.Equal(t, 100, ql.Remove("5", 0))
+	refRemoved := []string{}
+	for _, v := range ref {
+		if v != "5" {
+			refRemoved = append(refRemoved, v)
+		}
+	}
+	ref = refRemoved
+	check()
+
+	ql.Trim(100, 599)
+	ref = ref[100:600]
+	check()
+
+	cp := ql.Copy()
+	for ql.Len() > 0 {
+		ql.PopBack()
+	}
+	assert.Nil(t, ql.head)
+	assert.Nil(t, ql.tail)
+	assert.Equal(t, 500, cp.Len())
+
+	// big elements get nodes of their own
+	big := newQuicklist()
+	big.PushBack(strings.Repeat("x", 10000))
+	big.Insert(0, "small")
+	big.Insert(1, strings.Repeat("y", 10000))
+	v, _ := big.Index(1)
+	assert.Equal(t, 10000, len(v))
+	v, _ = big.Index(0)
+	assert.Equal(t, "small", v)
+}
+
+func Test_BlockingPop(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379", PoolSize: 10})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "jobs", "jobs2", "moved")
+
+	// data is there already
+	c.RPush(ctx, "jobs", "ready")
+	values, err := c.BLPop(ctx, time.Second, "jobs-missing", "jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"jobs", "ready"}, values)
+
+	// timeout
+	start := time.Now()
+	_, err = c.BRPop(ctx, 100*time.Millisecond, "jobs")
+	assert.Equal(t, client.Nil, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	_, err = c.Do(ctx, "BLPOP", "jobs", "-1")
+	assert.Equal(t, client.Error("ERR timeout is negative"), err)
+	_, err = c.Do(ctx, "BLPOP", "jobs", "x")
+	assert.Equal(t, client.Error("ERR timeout is not a float or out of range"), err)
+
+	// clients are served in the order they blocked
+	results := make([]chan []string, 3)
+	for i := range results {
+		results[i] = make(chan []string, 1)
+		go func() {
+			values, err := c.BLPop(ctx, 0, "jobs2", "jobs")
+			assert.Nil(t, err)
+			results[i] <- values
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	n, err := c.RPush(ctx, "jobs", "a", "b", "c", "d")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	for i, expected := range []string{"a", "b", "c"} {
+		assert.Equal(t, []string{"jobs", expected}, <-results[i])
+	}
+	v, _ := c.LPop(ctx, "jobs")
+	assert.Equal(t, "d", v)
+
+	// BLMOVE
+	moved := make(chan string, 1)
+	go func() {
+		v, err := c.BLMove(ctx, "jobs", "moved", "LEFT", "RIGHT", 0)
+		assert.Nil(t, err)
+		moved <- v
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.LPush(ctx, "jobs", "m")
+	assert.Equal(t, "m", <-moved)
+	values, _ = c.LRange(ctx, "moved", 0, -1)
+	assert.Equal(t, []string{"m"}, values)
+
+	// a value of another type doesn't unblock
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := c.BLPop(ctx, 300*time.Millisecond, "jobs")
+		blocked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, c.Set(ctx, "jobs", "string", 0))
+	assert.Equal(t, client.Nil, <-blocked)
+}
+
+// Disconnected clients are not served
+func Test_BlockingDisconnect(t *testing.T) {
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("*2\r\n$4\r\nPING\r\n$1\r\nx\r\n*3\r\n$5\r\nBLPOP\r\n$6\r\ngone:q\r\n$1\r\n0\r\n"))
+	assert.Nil(t, err)
+	// the reply before the blocking command is sent
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$1\r\nx\r\n", string(buf[:n]))
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "gone:q")
+	c.RPush(ctx, "gone:q", "job")
+	l, err := c.LLen(ctx, "gone:q")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), l)
+
+	// the client blocked stays usable after a timeout
+	values, err := c.BLPop(ctx, 50*time.Millisecond, "gone:missing")
+	assert.Equal(t, client.Nil, err)
+	assert.Nil(t, values)
+	pong, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+}
+
+// A client served but blocked again keeps the deadline it blocked with, the timeout is not restarted
+func Test_BlockAgain(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c := &Client{conn: conn, w: resp.NewWriter(io.Discard)}
+
+	for _, args := range [][]string{{"BLPOP", "q", "1"}, {"BZPOPMIN", "z", "1"}} {
+		assert.Nil(t, s.handleCommand(args, c))
+		w := c.waiter
+		assert.NotNil(t, w)
+		time.Sleep(10 * time.Millisecond)
+
+		// the key has no data for the client anymore when the command is executed again
+		s.lock.Lock()
+		s.unblock(w)
+		c.served = w
+		assert.Nil(t, s.call(w.cmd, c, w.args))
+		c.served = nil
+		assert.NotNil(t, c.waiter)
+		assert.Equal(t, w.deadline, c.waiter.deadline)
+		s.unblock(c.waiter)
+		s.lock.Unlock()
+	}
+}
+
+// The connection to the master never blocks, it gets the reply of a timeout
+func TestMasterNeverBlocks(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	buf := &strings.Builder{}
+	master := &Client{conn: conn, w: resp.NewWriter(buf), master: true}
+
+	assert.Nil(t, s.handleCommand([]string{"BLPOP", "q", "0"}, master))
+	assert.Nil(t, master.waiter)
+	assert.Nil(t, s.handleCommand([]string{"BZPOPMIN", "z", "0"}, master))
+	assert.Nil(t, master.waiter)
+	assert.Equal(t, 0, len(s.blocked))
+	master.w.Flush()
+	assert.Equal(t, "*-1\r\n*-1\r\n", buf.String())
+}
+
+func Test_Hashes(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "session", "session-copy", "big", "str")
+
+	n, err := c.HSet(ctx, "session", "user", "alice", "visits", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, _ = c.HSet(ctx, "session", "user", "bob", "lang", "en")
+	assert.Equal(t, int64(1), n)
+	_, err = c.Do(ctx, "HSET", "session", "odd")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'hset' command"), err)
+	typ, _ := c.Type(ctx, "session")
+	assert.Equal(t, "hash", typ)
+
+	v, err := c.HGet(ctx, "session", "user")
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", v)
+	_, err = c.HGet(ctx, "session", "missing")
+	assert.Equal(t, client.Nil, err)
+	values, err := c.HMGet(ctx, "session", "lang", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, "en", *values[0])
+	assert.Nil(t, values[1])
+	all, err := c.HGetAll(ctx, "session")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"user": "bob", "visits": "1", "lang": "en"}, all)
+	keys, _ := c.HKeys(ctx, "session")
+	assert.ElementsMatch(t, []string{"user", "visits", "lang"}, keys)
+	vals, _ := c.HVals(ctx, "session")
+	assert.ElementsMatch(t, []string{"bob", "1", "en"}, vals)
+	all, err = c.HGetAll(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{}, all)
+
+	n, _ = c.HLen(ctx, "session")
+	assert.Equal(t, int64(3), n)
+	n, _ = c.HStrLen(ctx, "session", "user")
+	assert.Equal(t, int64(3), n)
+	ok, _ := c.HExists(ctx, "session", "lang")
+	assert.True(t, ok)
+	ok, _ = c.HSetNX(ctx, "session", "lang", "fr")
+	assert.False(t, ok)
+	ok, _ = c.HSetNX(ctx, "session", "theme", "dark")
+	assert.True(t, ok)
+
+	// increments
+	n, err = c.HIncrBy(ctx, "session", "visits", 41)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), n)
+	_, err = c.HIncrBy(ctx, "session", "user", 1)
+	assert.Equal(t, client.Error("ERR hash value is not an integer"), err)
+	c.HSet(ctx, "session", "max", strconv.FormatInt(math.MaxInt64, 10))
+	_, err = c.HIncrBy(ctx, "session", "max", 1)
+	assert.Equal(t, client.Error("ERR increment or decrement would overflow"), err)
+	f, err := c.HIncrByFloat(ctx, "session", "score", 2.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, f)
+	f, _ = c.HIncrByFloat(ctx, "session", "score", -0.25)
+	assert.Equal(t, 2.25, f)
+	_, err = c.HIncrByFloat(ctx, "session", "user", 1)
+	assert.Equal(t, client.Error("ERR hash value is not a float"), err)
+	_, err = c.HIncrBy(ctx, "counters", "x", 1) // increments create the hash
+	assert.Nil(t, err)
+	n, _ = c.HDel(ctx, "counters", "x", "y")
+	assert.Equal(t, int64(1), n)
+	n, _ = c.Exists(ctx, "counters")
+	assert.Equal(t, int64(0), n)
+
+	// random fields
+	fields, err := c.HRandField(ctx, "session", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(fields))
+	seen := map[string]bool{}
+	for _, field := range fields {
+		assert.NotContains(t, seen, field)
+		seen[field] = true
+	}
+	fields, _ = c.HRandField(ctx, "session", 100)
+	assert.Equal(t, 6, len(fields))
+	fields, _ = c.HRandField(ctx, "session", -20)
+	assert.Equal(t, 20, len(fields))
+	res, err := c.Do(ctx, "HRANDFIELD", "session", "-2", "WITHVALUES")
 	assert.Nil(t, err)
+	pairs, _ := client.Strings(res)
+	assert.Equal(t, 4, len(pairs))
+	v, _ = c.HGet(ctx, "session", pairs[0])
+	assert.Equal(t, pairs[1], v)
+	res, _ = c.Do(ctx, "HRANDFIELD", "missing")
+	_, err = client.String(res)
+	assert.Equal(t, client.Nil, err)
+	fields, err = c.HRandField(ctx, "missing", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, fields)
 
-	_, err = conn.Write([]byte("*1\r\n$4\r\nINFO\r\n"))
+	// a big hash is scanned in parts, every field is returned
+	for i := range 500 {
+		c.HSet(ctx, "big", "f"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	scanned := map[string]string{}
+	calls := 0
+	for cursor := uint64(0); ; {
+		var pairs []string
+		pairs, cursor, err = c.HScan(ctx, "big", cursor, client.ScanArgs{Match: "f*", Count: 50})
+		assert.Nil(t, err)
+		for i := 0; i < len(pairs); i += 2 {
+			scanned[pairs[i]] = pairs[i+1]
+		}
+		calls++
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, 500, len(scanned))
+	assert.Equal(t, "123", scanned["f123"])
+	assert.Greater(t, calls, 1)
+	pairs, cursor, err := c.HScan(ctx, "session", 0, client.ScanArgs{Match: "l*"})
 	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), cursor)
+	assert.Equal(t, []string{"lang", "en"}, pairs)
+
+	// copies are independent
+	ok, _ = c.Copy(ctx, "session", "session-copy", false)
+	assert.True(t, ok)
+	c.HDel(ctx, "session-copy", "user")
+	ok, _ = c.HExists(ctx, "session", "user")
+	assert.True(t, ok)
+
+	// WRONGTYPE both ways
+	assert.Nil(t, c.Set(ctx, "str", "v", 0))
+	wrongType := client.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	_, err = c.HSet(ctx, "str", "f", "v")
+	assert.Equal(t, wrongType, err)
+	_, err = c.HGetAll(ctx, "str")
+	assert.Equal(t, wrongType, err)
+	_, err = c.Get(ctx, "session")
+	assert.Equal(t, wrongType, err)
+	_, err = c.LPush(ctx, "session", "a")
+	assert.Equal(t, wrongType, err)
+}
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+// Hashes are converted to a dict past the limits of the listpack encoding
+func Test_Hash(t *testing.T) {
+
+	h := newHash(4, 8)
+	for i := range 4 {
+		assert.True(t, h.Set("f"+strconv.Itoa(i), "v", false))
+	}
+	assert.False(t, h.Set("f0", "v0", false))
+	assert.Equal(t, "listpack", h.Encoding())
+	// fields keep their insertion order in a listpack
+	fields := []string{}
+	h.Range(func(field, value string) bool {
+		fields = append(fields, field)
+		return true
+	})
+	assert.Equal(t, []string{"f0", "f1", "f2", "f3"}, fields)
+
+	assert.True(t, h.Set("f4", "v", false))
+	assert.Equal(t, "hashtable", h.Encoding())
+	assert.Equal(t, 5, h.Len())
+	v, ok := h.Get("f0")
+	assert.True(t, ok)
+	assert.Equal(t, "v0", v)
+	// never converted back
+	assert.True(t, h.Delete("f4"))
+	assert.False(t, h.Delete("f4"))
+	assert.Equal(t, "hashtable", h.Encoding())
+
+	h = newHash(4, 8)
+	h.Set("f", "too long a value", false)
+	assert.Equal(t, "hashtable", h.Encoding())
+	h = newHash(4, 8)
+	h.Set("too long a field", "v", false)
+	assert.Equal(t, "hashtable", h.Encoding())
+
+	h = newHash(4, 8)
+	h.Set("a", "1", false)
+	h.Set("b", "2", false)
+	cp := h.Copy()
+	cp.Set("a", "changed", false)
+	v, _ = h.Get("a")
+	assert.Equal(t, "1", v)
+	assert.True(t, h.Delete("a"))
+	field, value := h.Random()
+	assert.Equal(t, "b", field)
+	assert.Equal(t, "2", value)
+
+	s := NewServer("0.0.0.0:6389", WithHashMaxListpack(2, 64))
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	assert.Nil(t, s.handleCommand([]string{"HSET", "h", "a", "1", "b", "2"}, c))
+	h, _ = s.getHash("h")
+	assert.Equal(t, "listpack", h.Encoding())
+	assert.Nil(t, s.handleCommand([]string{"HSET", "h", "c", "3"}, c))
+	assert.Equal(t, "hashtable", h.Encoding())
+}
+
+func Test_HashFieldExpire(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "flags", "flags-short")
+
+	c.HSet(ctx, "flags", "beta", "on", "dark", "off", "counter", "1", "keep", "v")
+	res, err := c.HExpire(ctx, "flags", 100*time.Millisecond, "", "beta", "dark", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 1, -2}, res)
+	res, _ = c.HExpire(ctx, "flags", time.Hour, "NX", "beta", "counter")
+	assert.Equal(t, []int64{0, 1}, res)
+	res, _ = c.HExpire(ctx, "flags", time.Minute, "GT", "counter")
+	assert.Equal(t, []int64{0}, res)
+	res, _ = c.HExpire(ctx, "missing", time.Minute, "", "a", "b")
+	assert.Equal(t, []int64{-2, -2}, res)
+
+	ttls, err := c.HTTL(ctx, "flags", "beta", "counter", "keep", "missing")
+	assert.Nil(t, err)
+	assert.Greater(t, ttls[0], time.Duration(0))
+	assert.LessOrEqual(t, ttls[0], 100*time.Millisecond)
+	assert.Greater(t, ttls[1], 59*time.Minute)
+	assert.Equal(t, []time.Duration{-1, -2}, ttls[2:])
+	v, err := c.Do(ctx, "HTTL", "flags", "FIELDS", "1", "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3600), v.Elems[0].Int)
+	v, _ = c.Do(ctx, "HEXPIRETIME", "flags", "FIELDS", "1", "counter")
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), v.Elems[0].Int, 1)
+
+	// increments keep the deadline, HSET removes it
+	c.HIncrBy(ctx, "flags", "counter", 1)
+	ttls, _ = c.HTTL(ctx, "flags", "counter")
+	assert.Greater(t, ttls[0], time.Duration(0))
+	c.HSet(ctx, "flags", "counter", "5")
+	ttls, _ = c.HTTL(ctx, "flags", "counter")
+	assert.Equal(t, time.Duration(-1), ttls[0])
+
+	res, err = c.HPersist(ctx, "flags", "dark", "dark", "keep", "missing")
 	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, -1, -1, -2}, res)
+
+	// a deadline in the past deletes the field
+	res, _ = c.HExpireAt(ctx, "flags", time.Now().Add(-time.Second), "", "keep")
+	assert.Equal(t, []int64{2}, res)
+	ok, _ := c.HExists(ctx, "flags", "keep")
+	assert.False(t, ok)
+
+	// expired fields are gone, the hash is deleted with its last field
+	c.HSet(ctx, "flags-short", "only", "v")
+	c.HExpire(ctx, "flags-short", 50*time.Millisecond, "", "only")
+	time.Sleep(150 * time.Millisecond)
+	_, err = c.HGet(ctx, "flags", "beta")
+	assert.Equal(t, client.Nil, err)
+	all, _ := c.HGetAll(ctx, "flags")
+	assert.Equal(t, map[string]string{"dark": "off", "counter": "5"}, all)
+	n, _ := c.Exists(ctx, "flags-short")
+	assert.Equal(t, int64(0), n)
+
+	_, err = c.Do(ctx, "HEXPIRE", "flags", "10", "XX", "dark")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'hexpire' command"), err)
+	_, err = c.Do(ctx, "HEXPIRE", "flags", "10", "NX", "NOFIELDS", "1", "dark")
+	assert.Equal(t, client.Error("ERR Mandatory argument FIELDS is missing or not at the right position"), err)
+	_, err = c.Do(ctx, "HEXPIRE", "flags", "10", "FIELDS", "0", "dark")
+	assert.Equal(t, client.Error("ERR Parameter `numFields` should be greater than 0"), err)
+	_, err = c.Do(ctx, "HTTL", "flags", "FIELDS", "2", "dark")
+	assert.Equal(t, client.Error("ERR The `numfields` parameter must match the number of arguments"), err)
+	_, err = c.Do(ctx, "HEXPIRE", "flags", "-1", "FIELDS", "1", "dark")
+	assert.Equal(t, client.Error("ERR invalid expire time in 'hexpire' command"), err)
+}
 
-	info := string(buf[:n])
-	infos := strings.Split(info, "\r\n")
-	assert.Equal(t, "Replication", infos[1])
-	assert.Equal(t, "role:master", infos[2])
-	assert.Equal(t, "master_replid:", infos[3][:14])
+// Fields deadlines are tracked by the hash, expired fields are deleted once the earliest deadline passes
+func Test_HashExpire(t *testing.T) {
+
+	now := time.Now()
+	for _, h := range []*hash{newHash(128, 64), newHash(0, 64)} {
+		for i := range 10 {
+			h.Set("f"+strconv.Itoa(i), "v", false)
+		}
+		assert.True(t, h.SetExpireAt("f1", now.Add(time.Second)))
+		assert.True(t, h.SetExpireAt("f2", now.Add(2*time.Second)))
+		assert.True(t, h.SetExpireAt("f3", now.Add(3*time.Second)))
+		assert.False(t, h.SetExpireAt("missing", now))
+		assert.True(t, h.SetExpireAt("f3", time.Time{}))
+		assert.Equal(t, 2, h.volatile)
+
+		assert.False(t, h.Expiring(now))
+		assert.Nil(t, h.Expire(now))
+		cp := h.Copy()
+		assert.Equal(t, []string{"f1"}, h.Expire(now.Add(time.Second)))
+		assert.Equal(t, 9, h.Len())
+		assert.Equal(t, now.Add(2*time.Second), h.nextExpireAt)
+		assert.ElementsMatch(t, []string{"f1", "f2"}, cp.Expire(now.Add(time.Hour)))
+
+		h.Delete("f2")
+		assert.Equal(t, 0, h.volatile)
+		assert.False(t, h.Expiring(now.Add(time.Hour)))
+	}
+}
+
+// Expired fields are deleted without being looked up, replicas get HDEL
+func TestActiveExpireFields(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389", WithHz(100))
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	assert.Nil(t, s.handleCommand([]string{"HSET", "h", "a", "1", "b", "2"}, c))
+	assert.Nil(t, s.handleCommand([]string{"HSET", "gone", "a", "1"}, c))
+	assert.Nil(t, s.handleCommand([]string{"HPEXPIRE", "h", "10", "FIELDS", "1", "a"}, c))
+	assert.Nil(t, s.handleCommand([]string{"HPEXPIRE", "gone", "10", "FIELDS", "1", "a"}, c))
+	assert.Nil(t, s.handleCommand([]string{"RENAME", "gone", "renamed"}, c))
+	time.Sleep(20 * time.Millisecond)
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	s.replicas = map[string]Replica{"replica": {conn: conn}}
+	propagated := make(chan []string, 100)
+	go func() {
+		reader := resp.NewReader(peer)
+		for {
+			args, err := reader.ReadCommand()
+			if err != nil {
+				return
+			}
+			propagated <- args
+		}
+	}()
+
+	s.activeExpireCycle()
+	commands := [][]string{<-propagated, <-propagated}
+	assert.ElementsMatch(t, [][]string{{"HDEL", "h", "a"}, {"HDEL", "renamed", "a"}}, commands)
+	keys, _ := s.storage.Len()
+	assert.Equal(t, 1, keys)
+	e, _ := s.storage.data.Get("h")
+	assert.Equal(t, 1, e.value.(*hash).Len())
+	assert.Equal(t, 0, s.storage.volatileHashes.Len())
+	assert.Equal(t, int64(2), s.storage.expiredFields.Load())
+	assert.Contains(t, strings.Join(s.getInfo(), "\r\n"), "expired_subkeys:2\r\n")
+}
+
+func Test_Sets(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "tags:a", "tags:b", "tags:c", "tags:dst", "tags:big", "str")
+
+	n, err := c.SAdd(ctx, "tags:a", "go", "redis", "db", "go")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	c.SAdd(ctx, "tags:b", "redis", "db", "cache")
+	c.SAdd(ctx, "tags:c", "db", "sql")
+	typ, _ := c.Type(ctx, "tags:a")
+	assert.Equal(t, "set", typ)
+
+	members, err := c.SMembers(ctx, "tags:a")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"go", "redis", "db"}, members)
+	ok, _ := c.SIsMember(ctx, "tags:a", "go")
+	assert.True(t, ok)
+	flags, err := c.SMIsMember(ctx, "tags:a", "go", "sql", "db")
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true}, flags)
+	n, _ = c.SCard(ctx, "tags:a")
+	assert.Equal(t, int64(3), n)
+	n, _ = c.SRem(ctx, "tags:a", "go", "missing")
+	assert.Equal(t, int64(1), n)
+
+	// set algebra
+	c.SAdd(ctx, "tags:a", "go")
+	members, _ = c.SInter(ctx, "tags:a", "tags:b")
+	assert.ElementsMatch(t, []string{"redis", "db"}, members)
+	members, _ = c.SInter(ctx, "tags:a", "tags:b", "tags:c")
+	assert.Equal(t, []string{"db"}, members)
+	members, _ = c.SInter(ctx, "tags:a", "missing")
+	assert.Equal(t, []string{}, members)
+	members, _ = c.SUnion(ctx, "tags:a", "tags:c", "missing")
+	assert.ElementsMatch(t, []string{"go", "redis", "db", "sql"}, members)
+	members, _ = c.SDiff(ctx, "tags:a", "tags:b", "missing")
+	assert.Equal(t, []string{"go"}, members)
+	n, err = c.SInterCard(ctx, 0, "tags:a", "tags:b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, _ = c.SInterCard(ctx, 1, "tags:a", "tags:b")
+	assert.Equal(t, int64(1), n)
+	_, err = c.Do(ctx, "SINTERCARD", "0", "tags:a")
+	assert.Equal(t, client.Error("ERR numkeys should be greater than 0"), err)
+	_, err = c.Do(ctx, "SINTERCARD", "3", "tags:a", "tags:b")
+	assert.Equal(t, client.Error("ERR Number of keys can't be greater than number of args"), err)
+	_, err = c.Do(ctx, "SINTERCARD", "1", "tags:a", "LIMIT", "-1")
+	assert.Equal(t, client.Error("ERR LIMIT can't be negative"), err)
+	_, err = c.Do(ctx, "SINTERCARD", "1", "tags:a", "LIMITS", "1")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+
+	n, err = c.SUnionStore(ctx, "tags:dst", "tags:a", "tags:b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	n, _ = c.SInterStore(ctx, "tags:dst", "tags:dst", "tags:c")
+	assert.Equal(t, int64(1), n)
+	members, _ = c.SMembers(ctx, "tags:dst")
+	assert.Equal(t, []string{"db"}, members)
+	n, _ = c.SDiffStore(ctx, "tags:dst", "tags:c", "tags:c")
+	assert.Equal(t, int64(0), n)
+	n, _ = c.Exists(ctx, "tags:dst")
+	assert.Equal(t, int64(0), n)
+
+	// SMOVE
+	ok, err = c.SMove(ctx, "tags:c", "tags:dst", "sql")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = c.SMove(ctx, "tags:c", "tags:dst", "sql")
+	assert.False(t, ok)
+	ok, _ = c.SIsMember(ctx, "tags:dst", "sql")
+	assert.True(t, ok)
+
+	// random members
+	for i := range 100 {
+		c.SAdd(ctx, "tags:big", strconv.Itoa(i))
+	}
+	members, err = c.SRandMemberCount(ctx, "tags:big", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(members))
+	seen := map[string]bool{}
+	for _, m := range members {
+		assert.NotContains(t, seen, m)
+		seen[m] = true
+	}
+	members, _ = c.SRandMemberCount(ctx, "tags:big", 200)
+	assert.Equal(t, 100, len(members))
+	members, _ = c.SRandMemberCount(ctx, "tags:a", -10)
+	assert.Equal(t, 10, len(members))
+	m, err := c.SRandMember(ctx, "tags:a")
+	assert.Nil(t, err)
+	assert.Contains(t, []string{"go", "redis", "db"}, m)
+	_, err = c.SRandMember(ctx, "missing")
+	assert.Equal(t, client.Nil, err)
+
+	m, err = c.SPop(ctx, "tags:big")
+	assert.Nil(t, err)
+	ok, _ = c.SIsMember(ctx, "tags:big", m)
+	assert.False(t, ok)
+	members, err = c.SPopCount(ctx, "tags:big", 9)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(members))
+	n, _ = c.SCard(ctx, "tags:big")
+	assert.Equal(t, int64(90), n)
+	members, _ = c.SPopCount(ctx, "tags:big", 1000)
+	assert.Equal(t, 90, len(members))
+	n, _ = c.Exists(ctx, "tags:big")
+	assert.Equal(t, int64(0), n)
+	_, err = c.SPop(ctx, "missing")
+	assert.Equal(t, client.Nil, err)
+	_, err = c.SPopCount(ctx, "tags:a", -1)
+	assert.Equal(t, client.Error("ERR value is out of range, must be positive"), err)
+
+	// SSCAN
+	for i := range 300 {
+		c.SAdd(ctx, "tags:big", "m"+strconv.Itoa(i))
+	}
+	scanned := map[string]bool{}
+	for cursor := uint64(0); ; {
+		members, cursor, err = c.SScan(ctx, "tags:big", cursor, client.ScanArgs{Match: "m1*", Count: 20})
+		assert.Nil(t, err)
+		for _, m := range members {
+			scanned[m] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, 111, len(scanned))
+
+	// WRONGTYPE both ways
+	assert.Nil(t, c.Set(ctx, "str", "v", 0))
+	wrongType := client.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	_, err = c.SAdd(ctx, "str", "a")
+	assert.Equal(t, wrongType, err)
+	_, err = c.SInter(ctx, "missing", "str")
+	assert.Equal(t, wrongType, err)
+	_, err = c.SMove(ctx, "tags:a", "str", "go")
+	assert.Equal(t, wrongType, err)
+	ok, _ = c.SIsMember(ctx, "tags:a", "go")
+	assert.True(t, ok)
+	// a missing source moves nothing, whatever the destination holds
+	ok, err = c.SMove(ctx, "missing", "str", "go")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, err = c.HGet(ctx, "tags:a", "go")
+	assert.Equal(t, wrongType, err)
+}
+
+// Sets of integers are kept sorted in an intset until they get too big or get other members
+func Test_Set(t *testing.T) {
+
+	ss := newSet(4)
+	for _, n := range []string{"5", "-1", "3", "5"} {
+		ss.Add(n)
+	}
+	assert.Equal(t, "intset", ss.Encoding())
+	assert.Equal(t, []string{"-1", "3", "5"}, ss.Members())
+	assert.True(t, ss.Contains("3"))
+	assert.False(t, ss.Contains("03"))
+	assert.False(t, ss.Contains("x"))
+	assert.False(t, ss.Remove("x"))
+
+	// not canonical integers are strings
+	ss.Add("007")
+	assert.Equal(t, "hashtable", ss.Encoding())
+	assert.ElementsMatch(t, []string{"-1", "3", "5", "007"}, ss.Members())
+	assert.True(t, ss.Contains("5"))
+	assert.False(t, ss.Contains("7"))
+
+	ss = newSet(4)
+	for i := range 4 {
+		ss.Add(strconv.Itoa(i))
+	}
+	cp := ss.Copy()
+	assert.Equal(t, "intset", ss.Encoding())
+	ss.Add("4")
+	assert.Equal(t, "hashtable", ss.Encoding())
+	assert.Equal(t, 5, ss.Len())
+	assert.Equal(t, 4, cp.Len())
+	assert.True(t, cp.Remove("0"))
+	assert.Equal(t, []string{"1", "2", "3"}, cp.Members())
+	for cp.Len() > 0 {
+		assert.True(t, ss.Contains(cp.Pop()))
+	}
+
+	s := NewServer("0.0.0.0:6389", WithSetMaxIntsetEntries(2))
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	assert.Nil(t, s.handleCommand([]string{"SADD", "s", "1", "2"}, c))
+	ss, _ = s.getSet("s")
+	assert.Equal(t, "intset", ss.Encoding())
+	assert.Nil(t, s.handleCommand([]string{"SADD", "s", "3"}, c))
+	assert.Equal(t, "hashtable", ss.Encoding())
+}
+
+func Test_SortedSets(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "board", "board:2", "board:dst", "lex", "zbig", "zset:tags", "str")
+
+	n, err := c.ZAdd(ctx, "board", client.Z{Member: "alice", Score: 10}, client.Z{Member: "bob", Score: 20},
+		client.Z{Member: "carol", Score: 20}, client.Z{Member: "dave", Score: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	typ, _ := c.Type(ctx, "board")
+	assert.Equal(t, "zset", typ)
+	n, _ = c.ZCard(ctx, "board")
+	assert.Equal(t, int64(4), n)
+	members, err := c.ZRange(ctx, "board", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dave", "alice", "bob", "carol"}, members)
+	score, err := c.ZScore(ctx, "board", "bob")
+	assert.Nil(t, err)
+	assert.Equal(t, 20.0, score)
+	_, err = c.ZScore(ctx, "board", "nobody")
+	assert.Equal(t, client.Nil, err)
+	res, _ := c.Do(ctx, "ZMSCORE", "board", "dave", "nobody")
+	scores, _ := client.Strings(res)
+	assert.Equal(t, []string{"5", ""}, scores)
+
+	// ZADD flags
+	n, _ = c.ZAddArgs(ctx, "board", client.ZAddArgs{NX: true}, client.Z{Member: "alice", Score: 1}, client.Z{Member: "erin", Score: 1})
+	assert.Equal(t, int64(1), n)
+	n, _ = c.ZAddArgs(ctx, "board", client.ZAddArgs{XX: true, CH: true}, client.Z{Member: "alice", Score: 11}, client.Z{Member: "frank", Score: 1})
+	assert.Equal(t, int64(1), n)
+	n, _ = c.ZAddArgs(ctx, "board", client.ZAddArgs{GT: true, CH: true}, client.Z{Member: "alice", Score: 3}, client.Z{Member: "bob", Score: 30})
+	assert.Equal(t, int64(1), n)
+	n, _ = c.ZAddArgs(ctx, "board", client.ZAddArgs{LT: true, CH: true}, client.Z{Member: "alice", Score: 12}, client.Z{Member: "dave", Score: 4})
+	assert.Equal(t, int64(1), n)
+	zs, _ := c.ZRangeWithScores(ctx, "board", 0, -1)
+	assert.Equal(t, []client.Z{{Member: "erin", Score: 1}, {Member: "dave", Score: 4}, {Member: "alice", Score: 11}, {Member: "carol", Score: 20}, {Member: "bob", Score: 30}}, zs)
+	res, err = c.Do(ctx, "ZADD", "board", "INCR", "2.5", "erin")
+	assert.Nil(t, err)
+	assert.Equal(t, "3.5", res.Str)
+	res, _ = c.Do(ctx, "ZADD", "board", "NX", "INCR", "1", "erin")
+	assert.True(t, res.Null)
+	res, _ = c.Do(ctx, "ZADD", "board", "GT", "INCR", "-1", "erin")
+	assert.True(t, res.Null)
+	_, err = c.Do(ctx, "ZADD", "board", "NX", "XX", "1", "a")
+	assert.Equal(t, client.Error("ERR XX and NX options at the same time are not compatible"), err)
+	_, err = c.Do(ctx, "ZADD", "board", "NX", "GT", "1", "a")
+	assert.Equal(t, client.Error("ERR GT, LT, and/or NX options at the same time are not compatible"), err)
+	_, err = c.Do(ctx, "ZADD", "board", "INCR", "1", "a", "2", "b")
+	assert.Equal(t, client.Error("ERR INCR option supports a single increment-element pair"), err)
+	_, err = c.Do(ctx, "ZADD", "board", "1", "a", "2")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZADD", "board", "one", "a")
+	assert.Equal(t, client.Error("ERR value is not a valid float"), err)
+	_, err = c.Do(ctx, "ZADD", "board", "nan", "a")
+	assert.Equal(t, client.Error("ERR value is not a valid float"), err)
+	n, _ = c.ZAddArgs(ctx, "board:2", client.ZAddArgs{XX: true}, client.Z{Member: "a", Score: 1})
+	assert.Equal(t, int64(0), n)
+	n, _ = c.Exists(ctx, "board:2")
+	assert.Equal(t, int64(0), n)
+
+	// ZINCRBY
+	score, err = c.ZIncrBy(ctx, "board", 0.5, "erin")
+	assert.Nil(t, err)
+	assert.Equal(t, 4.0, score)
+	score, _ = c.ZIncrBy(ctx, "board", 7, "gina")
+	assert.Equal(t, 7.0, score)
+	c.ZIncrBy(ctx, "board", math.Inf(1), "gina")
+	_, err = c.ZIncrBy(ctx, "board", math.Inf(-1), "gina")
+	assert.Equal(t, client.Error("ERR resulting score is not a number (NaN)"), err)
+	score, _ = c.ZScore(ctx, "board", "gina")
+	assert.True(t, math.IsInf(score, 1))
+	c.ZRem(ctx, "board", "gina")
+
+	// ranks and counts: erin 4, dave 4, alice 11, carol 20, bob 30
+	rank, err := c.ZRank(ctx, "board", "erin")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rank)
+	rank, _ = c.ZRevRank(ctx, "board", "erin")
+	assert.Equal(t, int64(3), rank)
+	_, err = c.ZRank(ctx, "board", "nobody")
+	assert.Equal(t, client.Nil, err)
+	res, _ = c.Do(ctx, "ZRANK", "board", "alice", "WITHSCORE")
+	ranked, _ := client.Strings(res)
+	assert.Equal(t, []string{"2", "11"}, ranked)
+	n, _ = c.ZCount(ctx, "board", "4", "20")
+	assert.Equal(t, int64(4), n)
+	n, _ = c.ZCount(ctx, "board", "(4", "(20")
+	assert.Equal(t, int64(1), n)
+	n, _ = c.ZCount(ctx, "board", "-inf", "+inf")
+	assert.Equal(t, int64(5), n)
+	n, _ = c.ZCount(ctx, "board", "20", "4")
+	assert.Equal(t, int64(0), n)
+	_, err = c.ZCount(ctx, "board", "x", "4")
+	assert.Equal(t, client.Error("ERR min or max is not a float"), err)
+
+	// ranges by rank, score and lex
+	members, _ = c.ZRange(ctx, "board", -2, -1)
+	assert.Equal(t, []string{"carol", "bob"}, members)
+	members, _ = c.ZRange(ctx, "board", 3, 100)
+	assert.Equal(t, []string{"carol", "bob"}, members)
+	members, _ = c.ZRange(ctx, "board", 3, 1)
+	assert.Equal(t, []string{}, members)
+	members, _ = c.ZRangeArgs(ctx, "board", client.ZRangeArgs{Start: "0", Stop: "1", Rev: true})
+	assert.Equal(t, []string{"bob", "carol"}, members)
+	res, _ = c.Do(ctx, "ZREVRANGE", "board", "0", "1")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"bob", "carol"}, members)
+	members, _ = c.ZRangeArgs(ctx, "board", client.ZRangeArgs{Start: "(4", Stop: "+inf", ByScore: true})
+	assert.Equal(t, []string{"alice", "carol", "bob"}, members)
+	zs, _ = c.ZRangeArgsWithScores(ctx, "board", client.ZRangeArgs{Start: "+inf", Stop: "-inf", ByScore: true, Rev: true, Offset: 1, Count: 2})
+	assert.Equal(t, []client.Z{{Member: "carol", Score: 20}, {Member: "alice", Score: 11}}, zs)
+	members, _ = c.ZRangeArgs(ctx, "board", client.ZRangeArgs{Start: "-inf", Stop: "+inf", ByScore: true, Offset: 3, Count: -1})
+	assert.Equal(t, []string{"carol", "bob"}, members)
+	members, _ = c.ZRangeArgs(ctx, "board", client.ZRangeArgs{Start: "-inf", Stop: "+inf", ByScore: true, Offset: -1, Count: 1})
+	assert.Equal(t, []string{}, members)
+	res, _ = c.Do(ctx, "ZRANGEBYSCORE", "board", "4", "11", "WITHSCORES", "LIMIT", "0", "2")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"dave", "4", "erin", "4"}, members)
+	res, _ = c.Do(ctx, "ZREVRANGEBYSCORE", "board", "(30", "11")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"carol", "alice"}, members)
+	_, err = c.Do(ctx, "ZRANGE", "board", "0", "1", "LIMIT", "0", "1")
+	assert.Equal(t, client.Error("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"), err)
+	_, err = c.Do(ctx, "ZRANGE", "board", "-", "+", "BYLEX", "WITHSCORES")
+	assert.Equal(t, client.Error("ERR syntax error, WITHSCORES not supported in combination with BYLEX"), err)
+	_, err = c.Do(ctx, "ZREVRANGE", "board", "0", "1", "LIMIT", "0", "1")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZRANGE", "board", "a", "1")
+	assert.Equal(t, client.Error("ERR value is not an integer or out of range"), err)
+
+	c.ZAdd(ctx, "lex", client.Z{Member: "a"}, client.Z{Member: "b"}, client.Z{Member: "c"}, client.Z{Member: "d"}, client.Z{Member: "e"})
+	members, _ = c.ZRangeArgs(ctx, "lex", client.ZRangeArgs{Start: "[b", Stop: "(d", ByLex: true})
+	assert.Equal(t, []string{"b", "c"}, members)
+	members, _ = c.ZRangeArgs(ctx, "lex", client.ZRangeArgs{Start: "+", Stop: "(c", ByLex: true, Rev: true, Count: 1})
+	assert.Equal(t, []string{"e"}, members)
+	res, _ = c.Do(ctx, "ZRANGEBYLEX", "lex", "-", "[bb", "LIMIT", "1", "5")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"b"}, members)
+	res, _ = c.Do(ctx, "ZREVRANGEBYLEX", "lex", "[c", "-")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"c", "b", "a"}, members)
+	n, _ = c.ZLexCount(ctx, "lex", "(a", "+")
+	assert.Equal(t, int64(4), n)
+	n, _ = c.ZLexCount(ctx, "lex", "+", "-")
+	assert.Equal(t, int64(0), n)
+	_, err = c.ZLexCount(ctx, "lex", "a", "+")
+	assert.Equal(t, client.Error("ERR min or max not valid string range item"), err)
+
+	// removals
+	res, _ = c.Do(ctx, "ZREMRANGEBYLEX", "lex", "[b", "[c")
+	assert.Equal(t, int64(2), res.Int)
+	res, _ = c.Do(ctx, "ZREMRANGEBYRANK", "lex", "-1", "-1")
+	assert.Equal(t, int64(1), res.Int)
+	res, _ = c.Do(ctx, "ZREMRANGEBYSCORE", "lex", "-inf", "+inf")
+	assert.Equal(t, int64(2), res.Int)
+	n, _ = c.Exists(ctx, "lex")
+	assert.Equal(t, int64(0), n)
+
+	// ZRANGESTORE
+	n, err = c.ZRangeStore(ctx, "board:dst", "board", client.ZRangeArgs{Start: "10", Stop: "+inf", ByScore: true})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	zs, _ = c.ZRangeWithScores(ctx, "board:dst", 0, -1)
+	assert.Equal(t, []client.Z{{Member: "alice", Score: 11}, {Member: "carol", Score: 20}, {Member: "bob", Score: 30}}, zs)
+	n, _ = c.ZRangeStore(ctx, "board:dst", "board", client.ZRangeArgs{Start: "100", Stop: "+inf", ByScore: true})
+	assert.Equal(t, int64(0), n)
+	n, _ = c.Exists(ctx, "board:dst")
+	assert.Equal(t, int64(0), n)
+
+	// set operations, plain sets count with score 1
+	c.ZAdd(ctx, "board:2", client.Z{Member: "alice", Score: 1}, client.Z{Member: "bob", Score: 2}, client.Z{Member: "zoe", Score: 3})
+	c.SAdd(ctx, "zset:tags", "alice", "zoe")
+	zs, err = c.ZUnion(ctx, client.ZStore{Keys: []string{"board", "board:2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []client.Z{{Member: "zoe", Score: 3}, {Member: "dave", Score: 4}, {Member: "erin", Score: 4}, {Member: "alice", Score: 12}, {Member: "carol", Score: 20}, {Member: "bob", Score: 32}}, zs)
+	zs, _ = c.ZInter(ctx, client.ZStore{Keys: []string{"board", "board:2"}, Weights: []float64{1, 10}, Aggregate: "MAX"})
+	assert.Equal(t, []client.Z{{Member: "alice", Score: 11}, {Member: "bob", Score: 30}}, zs)
+	zs, _ = c.ZInter(ctx, client.ZStore{Keys: []string{"board", "board:2", "zset:tags"}, Aggregate: "MIN"})
+	assert.Equal(t, []client.Z{{Member: "alice", Score: 1}}, zs)
+	res, _ = c.Do(ctx, "ZDIFF", "2", "board", "board:2", "WITHSCORES")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"dave", "4", "erin", "4", "carol", "20"}, members)
+	n, err = c.ZUnionStore(ctx, "board:dst", client.ZStore{Keys: []string{"board:2", "zset:tags"}, Weights: []float64{2, 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	zs, _ = c.ZRangeWithScores(ctx, "board:dst", 0, -1)
+	assert.Equal(t, []client.Z{{Member: "alice", Score: 3}, {Member: "bob", Score: 4}, {Member: "zoe", Score: 7}}, zs)
+	n, _ = c.ZInterStore(ctx, "board:dst", client.ZStore{Keys: []string{"board:dst", "missing"}})
+	assert.Equal(t, int64(0), n)
+	n, _ = c.Exists(ctx, "board:dst")
+	assert.Equal(t, int64(0), n)
+	res, _ = c.Do(ctx, "ZDIFFSTORE", "board:dst", "1", "board:2")
+	assert.Equal(t, int64(3), res.Int)
+	res, _ = c.Do(ctx, "ZINTERCARD", "2", "board", "board:2", "LIMIT", "1")
+	assert.Equal(t, int64(1), res.Int)
+	res, _ = c.Do(ctx, "ZINTERCARD", "2", "board", "board:2")
+	assert.Equal(t, int64(2), res.Int)
+	_, err = c.Do(ctx, "ZUNIONSTORE", "board:dst", "0", "board")
+	assert.Equal(t, client.Error("ERR at least 1 input key is needed for 'zunionstore' command"), err)
+	_, err = c.Do(ctx, "ZUNION", "3", "board", "board:2")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZUNIONSTORE", "board:dst", "1", "board", "WITHSCORES")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZINTER", "2", "board", "board:2", "WEIGHTS", "1", "x")
+	assert.Equal(t, client.Error("ERR weight value is not a float"), err)
+	_, err = c.Do(ctx, "ZDIFF", "2", "board", "board:2", "AGGREGATE", "MIN")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZINTER", "1", "board", "AGGREGATE", "AVG")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+
+	// pops
+	zs, err = c.ZPopMin(ctx, "board", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []client.Z{{Member: "dave", Score: 4}, {Member: "erin", Score: 4}}, zs)
+	zs, _ = c.ZPopMax(ctx, "board", 1)
+	assert.Equal(t, []client.Z{{Member: "bob", Score: 30}}, zs)
+	res, _ = c.Do(ctx, "ZPOPMIN", "board")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"alice", "11"}, members)
+	zs, _ = c.ZPopMax(ctx, "board", 10)
+	assert.Equal(t, []client.Z{{Member: "carol", Score: 20}}, zs)
+	n, _ = c.Exists(ctx, "board")
+	assert.Equal(t, int64(0), n)
+	zs, _ = c.ZPopMin(ctx, "board", 1)
+	assert.Equal(t, []client.Z{}, zs)
+	_, err = c.ZPopMin(ctx, "board:2", -1)
+	assert.Equal(t, client.Error("ERR value is out of range, must be positive"), err)
+
+	// a big sorted set is a skiplist, ZSCAN goes through it in steps
+	for i := range 300 {
+		c.ZAdd(ctx, "zbig", client.Z{Member: "m" + strconv.Itoa(i), Score: float64(i)})
+	}
+	rank, _ = c.ZRank(ctx, "zbig", "m150")
+	assert.Equal(t, int64(150), rank)
+	members, _ = c.ZRangeArgs(ctx, "zbig", client.ZRangeArgs{Start: "(100", Stop: "103", ByScore: true})
+	assert.Equal(t, []string{"m101", "m102", "m103"}, members)
+	scanned := map[string]string{}
+	for cursor := uint64(0); ; {
+		pairs, next, err := c.ZScan(ctx, "zbig", cursor, client.ScanArgs{Match: "m1*", Count: 20})
+		assert.Nil(t, err)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			scanned[pairs[i]] = pairs[i+1]
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, 111, len(scanned))
+	assert.Equal(t, "123", scanned["m123"])
+
+	// integral scores are formatted without an exponent, like in Redis
+	c.ZAdd(ctx, "zbig", client.Z{Member: "million", Score: 1000000})
+	res, _ = c.Do(ctx, "ZSCORE", "zbig", "million")
+	assert.Equal(t, "1000000", res.Str)
+	res, _ = c.Do(ctx, "ZINCRBY", "zbig", "1", "million")
+	assert.Equal(t, "1000001", res.Str)
+	res, _ = c.Do(ctx, "ZRANGE", "zbig", "-1", "-1", "WITHSCORES")
+	members, _ = client.Strings(res)
+	assert.Equal(t, []string{"million", "1000001"}, members)
+	res, _ = c.Do(ctx, "ZINCRBY", "zbig", "0.1", "million")
+	assert.Equal(t, "1000001.1", res.Str)
+
+	// WRONGTYPE both ways
+	assert.Nil(t, c.Set(ctx, "str", "v", 0))
+	wrongType := client.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	_, err = c.ZAdd(ctx, "str", client.Z{Member: "a", Score: 1})
+	assert.Equal(t, wrongType, err)
+	_, err = c.ZUnion(ctx, client.ZStore{Keys: []string{"zbig", "str"}})
+	assert.Equal(t, wrongType, err)
+	_, err = c.ZRange(ctx, "str", 0, -1)
+	assert.Equal(t, wrongType, err)
+	_, err = c.SAdd(ctx, "zbig", "a")
+	assert.Equal(t, wrongType, err)
+}
+
+// The skiplist keeps members ordered by score and member, with correct ranks, through random changes
+func Test_Zset(t *testing.T) {
+
+	zs := newZset(8, 16)
+	ref := map[string]float64{}
+	check := func() {
+		expected := make([]zsetMember, 0, len(ref))
+		for member, score := range ref {
+			expected = append(expected, zsetMember{member: member, score: score})
+		}
+		slices.SortFunc(expected, func(a, b zsetMember) int {
+			if zsetLess(a.score, a.member, b.score, b.member) {
+				return -1
+			}
+			return 1
+		})
+		got := []zsetMember{}
+		zs.Range(func(member string, score float64) bool {
+			got = append(got, zsetMember{member: member, score: score})
+			return true
+		})
+		assert.Equal(t, expected, got)
+		for i, m := range expected {
+			rank, ok := zs.Rank(m.member)
+			assert.True(t, ok)
+			assert.Equal(t, i, rank)
+		}
+		// backwards too
+		got = got[:0]
+		zs.RangeByRank(0, zs.Len()-1, true, func(member string, score float64) bool {
+			got = append(got, zsetMember{member: member, score: score})
+			return true
+		})
+		slices.Reverse(got)
+		assert.Equal(t, expected, got)
+	}
+
+	for i := range 2000 {
+		member := "m" + strconv.Itoa(rand.Intn(300))
+		if rand.Intn(3) == 0 {
+			_, ok := ref[member]
+			assert.Equal(t, ok, zs.Delete(member))
+			delete(ref, member)
+		} else {
+			score := float64(rand.Intn(50))
+			_, ok := ref[member]
+			assert.Equal(t, !ok, zs.Set(member, score))
+			ref[member] = score
+		}
+		if i%200 == 0 {
+			check()
+		}
+	}
+	check()
+	assert.Equal(t, "skiplist", zs.Encoding())
+	assert.Equal(t, len(ref), zs.Len())
+
+	cp := zs.Copy()
+	zs.Set("new", -1)
+	assert.Equal(t, len(ref), cp.Len())
+	_, ok := cp.Score("new")
+	assert.False(t, ok)
+
+	zs = newZset(4, 8)
+	for i := range 4 {
+		zs.Set(strconv.Itoa(i), float64(-i))
+	}
+	assert.Equal(t, "listpack", zs.Encoding())
+	rank, _ := zs.Rank("3")
+	assert.Equal(t, 0, rank)
+	zs.Set("4", 0)
+	assert.Equal(t, "skiplist", zs.Encoding())
+	zs = newZset(4, 8)
+	zs.Set("too long a member", 1)
+	assert.Equal(t, "skiplist", zs.Encoding())
+
+	s := NewServer("0.0.0.0:6389", WithZsetMaxListpack(2, 64))
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	assert.Nil(t, s.handleCommand([]string{"ZADD", "z", "1", "a", "2", "b"}, c))
+	zs, _ = s.getZset("z")
+	assert.Equal(t, "listpack", zs.Encoding())
+	assert.Nil(t, s.handleCommand([]string{"ZADD", "z", "3", "c"}, c))
+	assert.Equal(t, "skiplist", zs.Encoding())
+}
+
+func Test_BlockingZpop(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379", PoolSize: 10})
+	defer c.Close()
+	ctx := context.Background()
+	defer c.Del(ctx, "prio", "prio2")
+
+	// members are there already
+	c.ZAdd(ctx, "prio", client.Z{Member: "low", Score: 1}, client.Z{Member: "high", Score: 9}, client.Z{Member: "mid", Score: 5})
+	key, m, err := c.BZPopMin(ctx, time.Second, "prio-missing", "prio")
+	assert.Nil(t, err)
+	assert.Equal(t, "prio", key)
+	assert.Equal(t, client.Z{Member: "low", Score: 1}, m)
+	_, m, _ = c.BZPopMax(ctx, time.Second, "prio")
+	assert.Equal(t, client.Z{Member: "high", Score: 9}, m)
+	key, zs, err := c.ZMPop(ctx, "MIN", 5, "prio-missing", "prio")
+	assert.Nil(t, err)
+	assert.Equal(t, "prio", key)
+	assert.Equal(t, []client.Z{{Member: "mid", Score: 5}}, zs)
+	_, _, err = c.ZMPop(ctx, "MIN", 1, "prio")
+	assert.Equal(t, client.Nil, err)
+	_, err = c.Do(ctx, "ZMPOP", "0", "prio", "MIN")
+	assert.Equal(t, client.Error("ERR numkeys should be greater than 0"), err)
+	_, err = c.Do(ctx, "ZMPOP", "2", "prio", "MIN")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZMPOP", "1", "prio", "MIDDLE")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "ZMPOP", "1", "prio", "MAX", "COUNT", "0")
+	assert.Equal(t, client.Error("ERR count should be greater than 0"), err)
+	_, err = c.Do(ctx, "BZMPOP", "-1", "1", "prio", "MAX")
+	assert.Equal(t, client.Error("ERR timeout is negative"), err)
+
+	// timeout
+	start := time.Now()
+	_, _, err = c.BZPopMin(ctx, 100*time.Millisecond, "prio")
+	assert.Equal(t, client.Nil, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	_, _, err = c.BZMPop(ctx, 50*time.Millisecond, "MAX", 1, "prio", "prio2")
+	assert.Equal(t, client.Nil, err)
+
+	// clients are served in the order they blocked, each with the lowest score left
+	results := make([]chan client.Z, 3)
+	for i := range results {
+		results[i] = make(chan client.Z, 1)
+		go func() {
+			_, m, err := c.BZPopMin(ctx, 0, "prio2", "prio")
+			assert.Nil(t, err)
+			results[i] <- m
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	n, err := c.ZAdd(ctx, "prio", client.Z{Member: "c", Score: 3}, client.Z{Member: "a", Score: 1},
+		client.Z{Member: "d", Score: 4}, client.Z{Member: "b", Score: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), n)
+	for i, expected := range []string{"a", "b", "c"} {
+		assert.Equal(t, client.Z{Member: expected, Score: float64(i + 1)}, <-results[i])
+	}
+	members, _ := c.ZRange(ctx, "prio", 0, -1)
+	assert.Equal(t, []string{"d"}, members)
+
+	// BZMPOP takes up to count members
+	popped := make(chan []client.Z, 1)
+	go func() {
+		key, zs, err := c.BZMPop(ctx, 0, "MAX", 2, "prio2")
+		assert.Nil(t, err)
+		assert.Equal(t, "prio2", key)
+		popped <- zs
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.ZAdd(ctx, "prio2", client.Z{Member: "x", Score: 1}, client.Z{Member: "y", Score: 2}, client.Z{Member: "z", Score: 3})
+	assert.Equal(t, []client.Z{{Member: "z", Score: 3}, {Member: "y", Score: 2}}, <-popped)
+
+	// a list doesn't unblock
+	blocked := make(chan error, 1)
+	go func() {
+		_, _, err := c.BZPopMax(ctx, 300*time.Millisecond, "prio3")
+		blocked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.RPush(ctx, "prio3", "job")
+	defer c.Del(ctx, "prio3")
+	assert.Equal(t, client.Nil, <-blocked)
+}
+
+// Generic keyspace commands
+func Test_Keyspace(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, key := range []string{"ks1", "ks2", "ks3"} {
+		assert.Nil(t, c.Set(ctx, key, key, 0))
+	}
+
+	n, err := c.Exists(ctx, "ks1", "ks1", "ks-missing", "ks2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = c.Touch(ctx, "ks1", "ks-missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	typ, err := c.Type(ctx, "ks1")
+	assert.Nil(t, err)
+	assert.Equal(t, "string", typ)
+	typ, err = c.Type(ctx, "ks-missing")
+	assert.Nil(t, err)
+	assert.Equal(t, "none", typ)
+
+	// RENAME keeps the deadline
+	assert.Nil(t, c.Set(ctx, "ks-ttl", "v", time.Hour))
+	expireAt, _ := s.storage.ExpireAt("ks-ttl")
+	assert.Nil(t, c.Rename(ctx, "ks-ttl", "ks-renamed"))
+	renamedAt, err := s.storage.ExpireAt("ks-renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, expireAt, renamedAt)
+	assert.Equal(t, client.Error("ERR no such key"), c.Rename(ctx, "ks-ttl", "ks-renamed"))
+	assert.Nil(t, c.Rename(ctx, "ks-renamed", "ks-renamed"))
+
+	ok, err := c.RenameNX(ctx, "ks-renamed", "ks1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = c.RenameNX(ctx, "ks-renamed", "ks-ttl")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// COPY
+	ok, err = c.Copy(ctx, "ks1", "ks2", false)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = c.Copy(ctx, "ks1", "ks2", true)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	v, err := c.Get(ctx, "ks2")
+	assert.Nil(t, err)
+	assert.Equal(t, "ks1", v)
+	_, err = c.Do(ctx, "COPY", "ks1", "ks1")
+	assert.Equal(t, client.Error("ERR source and destination objects are the same"), err)
+	_, err = c.Do(ctx, "COPY", "ks1", "ks4", "DB", "1")
+	assert.Equal(t, client.Error("ERR DB index is out of range"), err)
+
+	key, err := c.RandomKey(ctx)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, key)
+
+	n, err = c.Del(ctx, "ks1", "ks2", "ks-missing")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = c.Unlink(ctx, "ks3", "ks-ttl")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = c.Exists(ctx, "ks1", "ks2", "ks3", "ks-ttl")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+// Expiration commands and their options
+func Test_Expire(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	ttl, err := c.TTL(ctx, "exp")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-2), ttl)
+	ok, err := c.Expire(ctx, "exp", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, c.Set(ctx, "exp", "v", 0))
+	ttl, err = c.TTL(ctx, "exp")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	tbl := []struct {
+		args  []string
+		reply int64
+	}{
+		{[]string{"EXPIRE", "exp", "100", "XX"}, 0},
+		{[]string{"EXPIRE", "exp", "100", "GT"}, 0},
+		{[]string{"EXPIRE", "exp", "100", "NX"}, 1},
+		{[]string{"TTL", "exp"}, 100},
+		{[]string{"EXPIRE", "exp", "200", "NX"}, 0},
+		{[]string{"EXPIRE", "exp", "50", "GT"}, 0},
+		{[]string{"EXPIRE", "exp", "200", "gt"}, 1},
+		{[]string{"EXPIRE", "exp", "300", "LT"}, 0},
+		{[]string{"PEXPIRE", "exp", "150000", "LT", "XX"}, 1},
+		{[]string{"TTL", "exp"}, 150},
+		{[]string{"EXPIREAT", "exp", "4102444800"}, 1},
+		{[]string{"EXPIRETIME", "exp"}, 4102444800},
+		{[]string{"PEXPIRETIME", "exp"}, 4102444800000},
+		{[]string{"PERSIST", "exp"}, 1},
+		{[]string{"PERSIST", "exp"}, 0},
+		{[]string{"EXPIRETIME", "exp"}, -1},
+		{[]string{"EXPIRE", "exp", "100", "LT"}, 1},
+		{[]string{"PEXPIREAT", "exp", "1"}, 1},
+		{[]string{"EXISTS", "exp"}, 0},
+		{[]string{"PEXPIRETIME", "exp"}, -2},
+	}
+	for _, tt := range tbl {
+		v, err := c.Do(ctx, tt.args...)
+		assert.Nil(t, err, tt.args)
+		assert.Equal(t, tt.reply, v.Int, tt.args)
+	}
+
+	assert.Nil(t, c.Set(ctx, "exp", "v", 0))
+	errs := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"EXPIRE", "exp", "10", "NX", "GT"}, "ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "exp", "10", "GT", "LT"}, "ERR GT and LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "exp", "10", "YY"}, "ERR Unsupported option YY"},
+		{[]string{"EXPIRE", "exp", "ten"}, "ERR value is not an integer or out of range"},
+		{[]string{"EXPIRE", "exp", "9223372036854775807"}, "ERR invalid expire time in 'expire' command"},
+		{[]string{"PEXPIRE", "exp", "9223372036854775807"}, "ERR invalid expire time in 'pexpire' command"},
+	}
+	for _, tt := range errs {
+		_, err := c.Do(ctx, tt.args...)
+		assert.Equal(t, client.Error(tt.err), err, tt.args)
+	}
+	ttl, err = c.TTL(ctx, "exp")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+}
+
+// replicaStream registers a fake replica on the server, and returns the commands propagated to it
+func replicaStream(t *testing.T, s *Server) *propagated {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	s.replicas[peer.LocalAddr().String()] = Replica{conn: conn}
+	p := &propagated{s: s, cmds: make(chan []string, 100)}
+	go func() {
+		r := resp.NewReader(peer)
+		for {
+			args, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			p.cmds <- args
+		}
+	}()
+	return p
+}
+
+// propagated are the commands a fake replica receives
+type propagated struct {
+	s    *Server
+	cmds chan []string
+}
+
+// Take returns the commands propagated so far
+func (p *propagated) Take() [][]string {
+	// the stream is in order, everything before the marker is there once the marker is
+	p.s.propagate([]string{"PING"})
+	var res [][]string
+	for args := range p.cmds {
+		if args[0] == "PING" {
+			break
+		}
+		res = append(res, args)
+	}
+	return res
+}
+
+// deadline stands for an absolute time in milliseconds in the commands a replica receives,
+// relative deadlines are sent as absolute ones
+const deadline = "<deadline>"
+
+// Replicas get what changed: commands changing nothing are not propagated, commands depending
+// on the time or on chance are rewritten, and the pops serving blocked clients follow the pushes
+func TestPropagation(t *testing.T) {
+
+	type step struct {
+		by   string // the client sending the command, blocked clients need their own
+		args []string
+		ttl  time.Duration // for the deadlines in want
+		want [][]string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"set", []step{
+			{args: []string{"SET", "k", "v", "EX", "10"}, ttl: 10 * time.Second, want: [][]string{{"SET", "k", "v", "PXAT", deadline}}},
+			{args: []string{"SET", "k", "v", "NX"}},
+			{args: []string{"SET", "k", "w", "GET"}, want: [][]string{{"SET", "k", "w"}}},
+		}},
+		{"incrbyfloat", []step{
+			{args: []string{"INCRBYFLOAT", "f", "1.5"}, want: [][]string{{"SET", "f", "1.5", "KEEPTTL"}}},
+			{args: []string{"SETRANGE", "f", "0", ""}},
+		}},
+		{"multi key strings", []step{
+			{args: []string{"MSET", "a", "1", "b", "2"}, want: [][]string{{"MSET", "a", "1", "b", "2"}}},
+			{args: []string{"MSETNX", "a", "1", "c", "3"}},
+			{args: []string{"GETEX", "a"}},
+			{args: []string{"GETEX", "a", "EX", "100"}, ttl: 100 * time.Second, want: [][]string{{"PEXPIREAT", "a", deadline}}},
+			{args: []string{"GETEX", "a", "PERSIST"}, want: [][]string{{"PERSIST", "a"}}},
+			{args: []string{"GETEX", "a", "PXAT", "1"}, want: [][]string{{"DEL", "a"}}},
+			{args: []string{"GETSET", "b", "3"}, want: [][]string{{"SET", "b", "3"}}},
+			{args: []string{"GETDEL", "b"}, want: [][]string{{"DEL", "b"}}},
+			{args: []string{"GETDEL", "b"}},
+		}},
+		{"keyspace", []step{
+			{args: []string{"DEL", "missing"}},
+			{args: []string{"COPY", "missing", "k"}},
+			{args: []string{"SET", "k", "v"}, want: [][]string{{"SET", "k", "v"}}},
+			{args: []string{"DEL", "k", "missing"}, want: [][]string{{"DEL", "k", "missing"}}},
+		}},
+		{"expire", []step{
+			{args: []string{"SET", "k", "v"}, want: [][]string{{"SET", "k", "v"}}},
+			{args: []string{"EXPIRE", "k", "10"}, ttl: 10 * time.Second, want: [][]string{{"PEXPIREAT", "k", deadline}}},
+			{args: []string{"EXPIRE", "k", "10", "NX"}},
+			{args: []string{"EXPIRE", "k", "-1"}, want: [][]string{{"DEL", "k"}}},
+		}},
+		{"blocking lists", []step{
+			{by: "blocked", args: []string{"BLPOP", "q", "0"}},
+			{by: "mover", args: []string{"BLMOVE", "q2", "q", "LEFT", "LEFT", "0"}},
+			// q2 feeds q through the BLMOVE
+			{args: []string{"RPUSH", "q2", "a"}, want: [][]string{{"RPUSH", "q2", "a"}, {"LMOVE", "q2", "q", "LEFT", "LEFT"}, {"LPOP", "q"}}},
+			{args: []string{"LPOP", "q"}},
+		}},
+		{"hashes", []step{
+			{args: []string{"HSET", "h", "a", "1"}, want: [][]string{{"HSET", "h", "a", "1"}}},
+			{args: []string{"HINCRBYFLOAT", "h", "a", "0.5"}, want: [][]string{{"HSET", "h", "a", "1.5"}}},
+			{args: []string{"HSETNX", "h", "a", "2"}},
+			{args: []string{"HDEL", "h", "missing"}},
+			{args: []string{"HDEL", "h", "a"}, want: [][]string{{"HDEL", "h", "a"}}},
+		}},
+		{"hash expire", []step{
+			{args: []string{"HSET", "h", "a", "1", "b", "2", "c", "3"}, want: [][]string{{"HSET", "h", "a", "1", "b", "2", "c", "3"}}},
+			{args: []string{"HEXPIRE", "h", "10", "FIELDS", "3", "a", "b", "x"}, ttl: 10 * time.Second,
+				want: [][]string{{"HPEXPIREAT", "h", deadline, "FIELDS", "2", "a", "b"}}},
+			{args: []string{"HINCRBYFLOAT", "h", "a", "0.5"}, ttl: 10 * time.Second,
+				want: [][]string{{"HSET", "h", "a", "1.5"}, {"HPEXPIREAT", "h", deadline, "FIELDS", "1", "a"}}},
+			{args: []string{"HEXPIRE", "h", "10", "NX", "FIELDS", "1", "a"}},
+			{args: []string{"HPERSIST", "h", "FIELDS", "2", "b", "c"}, want: [][]string{{"HPERSIST", "h", "FIELDS", "1", "b"}}},
+			{args: []string{"HEXPIREAT", "h", "1", "FIELDS", "2", "a", "b"}, want: [][]string{{"HDEL", "h", "a", "b"}}},
+		}},
+		{"sets", []step{
+			{args: []string{"SADD", "s", "a"}, want: [][]string{{"SADD", "s", "a"}}},
+			{args: []string{"SADD", "s", "a"}},
+			{args: []string{"SPOP", "s", "0"}},
+			{args: []string{"SPOP", "s"}, want: [][]string{{"SREM", "s", "a"}}},
+			{args: []string{"SADD", "s", "a", "b"}, want: [][]string{{"SADD", "s", "a", "b"}}},
+			{args: []string{"SPOP", "s", "5"}, want: [][]string{{"DEL", "s"}}},
+			{args: []string{"SADD", "s", "a"}, want: [][]string{{"SADD", "s", "a"}}},
+			{args: []string{"SRANDMEMBER", "s", "-3"}},
+			{args: []string{"SMOVE", "s", "d", "x"}},
+			{args: []string{"SMOVE", "s", "d", "a"}, want: [][]string{{"SMOVE", "s", "d", "a"}}},
+		}},
+		{"zsets", []step{
+			{args: []string{"ZADD", "z", "1", "a", "2", "b", "3", "c"}, want: [][]string{{"ZADD", "z", "1", "a", "2", "b", "3", "c"}}},
+			{args: []string{"ZADD", "z", "1", "a"}},
+			{args: []string{"ZADD", "z", "XX", "1", "d"}},
+			{args: []string{"ZADD", "z", "GT", "0", "a"}},
+			{args: []string{"ZADD", "z", "XX", "5", "a"}, want: [][]string{{"ZADD", "z", "XX", "5", "a"}}},
+			{args: []string{"ZREM", "z", "x"}},
+			{args: []string{"ZREMRANGEBYSCORE", "z", "10", "20"}},
+			{args: []string{"ZPOPMIN", "z"}, want: [][]string{{"ZPOPMIN", "z"}}},
+			{args: []string{"ZPOPMIN", "missing"}},
+			{args: []string{"ZRANGE", "z", "0", "-1"}},
+			{args: []string{"ZUNIONSTORE", "dst", "1", "z"}, want: [][]string{{"ZUNIONSTORE", "dst", "1", "z"}}},
+		}},
+		{"blocking zsets", []step{
+			{by: "first", args: []string{"BZPOPMAX", "z", "0"}},
+			{by: "second", args: []string{"BZMPOP", "0", "2", "other", "z", "MIN", "COUNT", "5"}},
+			{args: []string{"ZADD", "z", "1", "a", "2", "b", "3", "c"}, want: [][]string{{"ZADD", "z", "1", "a", "2", "b", "3", "c"}, {"ZPOPMAX", "z"}, {"ZPOPMIN", "z", "2"}}},
+			{args: []string{"ZMPOP", "1", "z", "MAX"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("0.0.0.0:6389")
+			replica := replicaStream(t, s)
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			clients := map[string]*Client{}
+			start := time.Now()
+			for _, step := range tt.steps {
+				c := clients[step.by]
+				if c == nil {
+					c = &Client{conn: conn, w: resp.NewWriter(io.Discard)}
+					clients[step.by] = c
+				}
+				assert.Nil(t, s.handleCommand(step.args, c))
+				end := time.Now()
+				got := replica.Take()
+				for i, cmd := range step.want {
+					for j, arg := range cmd {
+						if arg != deadline || i >= len(got) || j >= len(got[i]) {
+							continue
+						}
+						ms, err := strconv.ParseInt(got[i][j], 10, 64)
+						assert.Nil(t, err)
+						assert.GreaterOrEqual(t, ms, start.Add(step.ttl).UnixMilli())
+						assert.LessOrEqual(t, ms, end.Add(step.ttl).UnixMilli())
+						got[i][j] = deadline
+					}
+				}
+				assert.Equal(t, step.want, got, "%q", step.args)
+			}
+		})
+	}
+}
+
+// Keys and hash fields expired on access reach replicas as DEL and HDEL, before the command that found them
+func TestLazyExpirePropagation(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	replica := replicaStream(t, s)
+	c := &Client{w: resp.NewWriter(io.Discard)}
+	past := time.Now().Add(-time.Millisecond)
+
+	s.storage.Set("k", []byte("v"), past)
+	assert.Nil(t, s.handleCommand([]string{"GET", "k"}, c))
+	assert.Equal(t, [][]string{{"DEL", "k"}}, replica.Take())
+
+	s.storage.Set("k", []byte("v"), past)
+	assert.Nil(t, s.handleCommand([]string{"APPEND", "k", "w"}, c))
+	assert.Equal(t, [][]string{{"DEL", "k"}, {"APPEND", "k", "w"}}, replica.Take())
+
+	s.storage.Set("k", []byte("v"), past)
+	assert.Nil(t, s.handleCommand([]string{"RANDOMKEY"}, c))
+	assert.Equal(t, [][]string{{"DEL", "k"}}, replica.Take())
+
+	assert.Nil(t, s.handleCommand([]string{"HSET", "h", "a", "1", "b", "2"}, c))
+	assert.Nil(t, s.handleCommand([]string{"HPEXPIRE", "h", "1", "FIELDS", "1", "a"}, c))
+	replica.Take()
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, s.handleCommand([]string{"HGET", "h", "b"}, c))
+	assert.Equal(t, [][]string{{"HDEL", "h", "a"}}, replica.Take())
+}
+
+// Replicas hide expired keys and fields from their clients, but keep them until the master deletes them.
+// The commands of the master see them as they are
+func TestReplicaExpire(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	s.role = RoleSlave
+	master := &Client{w: resp.NewWriter(io.Discard), master: true}
+	buf := &strings.Builder{}
+	c := &Client{w: resp.NewWriter(buf)}
+	past := time.Now().Add(-time.Millisecond)
+
+	s.storage.Set("k", []byte("v"), past)
+	assert.Nil(t, s.handleCommand([]string{"GET", "k"}, c))
+	assert.Nil(t, s.handleCommand([]string{"EXISTS", "k"}, c))
+	assert.Nil(t, s.handleCommand([]string{"RANDOMKEY"}, c))
+	c.w.Flush()
+	assert.Equal(t, "$-1\r\n:0\r\n$-1\r\n", buf.String())
+	keys, _ := s.storage.Len()
+	assert.Equal(t, 1, keys)
+
+	assert.Nil(t, s.handleCommand([]string{"APPEND", "k", "w"}, master))
+	e, _ := s.storage.data.Get("k")
+	assert.Equal(t, []byte("vw"), e.value)
+	assert.Nil(t, s.handleCommand([]string{"DEL", "k"}, master))
+	keys, _ = s.storage.Len()
+	assert.Equal(t, 0, keys)
+
+	assert.Nil(t, s.handleCommand([]string{"HSET", "h", "a", "1", "b", "2"}, master))
+	assert.Nil(t, s.handleCommand([]string{"HPEXPIREAT", "h", "1", "FIELDS", "1", "a"}, master))
+	buf.Reset()
+	assert.Nil(t, s.handleCommand([]string{"HGETALL", "h"}, c))
+	assert.Nil(t, s.handleCommand([]string{"HLEN", "h"}, c))
+	c.w.Flush()
+	assert.Equal(t, "*2\r\n$1\r\nb\r\n$1\r\n2\r\n:1\r\n", buf.String())
+	e, _ = s.storage.data.Get("h")
+	assert.Equal(t, 2, e.value.(*hash).Len())
+	assert.Nil(t, s.handleCommand([]string{"HDEL", "h", "a"}, master))
+	assert.Equal(t, 1, e.value.(*hash).Len())
+}
+
+// Expired keys are deleted without being looked up
+func Test_ScanKeys(t *testing.T) {
+
+	c := client.New(client.Options{Addr: "0.0.0.0:6379"})
+	defer c.Close()
+	ctx := context.Background()
+
+	for i := range 50 {
+		assert.Nil(t, c.Set(ctx, "scan:"+strconv.Itoa(i), "v", 0))
+	}
+	defer func() {
+		for i := range 50 {
+			c.Del(ctx, "scan:"+strconv.Itoa(i))
+		}
+	}()
+
+	keys, err := c.Keys(ctx, "scan:1?")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"scan:10", "scan:11", "scan:12", "scan:13", "scan:14",
+		"scan:15", "scan:16", "scan:17", "scan:18", "scan:19"}, keys)
+	keys, err = c.Keys(ctx, "scan:[2-3]")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"scan:2", "scan:3"}, keys)
+
+	found := map[string]bool{}
+	cursor := uint64(0)
+	for {
+		keys, cursor, err = c.Scan(ctx, cursor, client.ScanArgs{Match: "scan:*", Count: 7, Type: "string"})
+		assert.Nil(t, err)
+		for _, key := range keys {
+			found[key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, 50, len(found))
+
+	keys, cursor, err = c.Scan(ctx, 0, client.ScanArgs{Match: "scan:*", Count: 1000, Type: "list"})
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, uint64(0), cursor)
+
+	_, err = c.Do(ctx, "SCAN", "0", "COUNT", "0")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+	_, err = c.Do(ctx, "SCAN", "x")
+	assert.Equal(t, client.Error("ERR invalid cursor"), err)
+}
+
+func Test_Glob(t *testing.T) {
+
+	for _, tt := range []struct {
+		pattern, str  string
+		nocase, match bool
+	}{
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"HELLO", "hello", false, false},
+		{"h[A-Z]llo", "hello", true, true},
+		{"a*b*c", "axxbyyc", false, true},
+		{"a*b*c", "axxbyy", false, false},
+		{"[abc", "a", false, true},
+		{strings.Repeat("*a", 50) + "b", strings.Repeat("a", 100), false, false},
+	} {
+		assert.Equal(t, tt.match, globMatch(tt.pattern, tt.str, tt.nocase), "%q %q", tt.pattern, tt.str)
+	}
+}
+
+// Every key present for the whole scan is returned while the dict grows and shrinks
+func Test_DictScan(t *testing.T) {
+
+	d := newDict[int]()
+	for i := range 100 {
+		d.Set("k"+strconv.Itoa(i), i)
+	}
+
+	seen := map[string]bool{}
+	cursor, step := uint64(0), 0
+	for {
+		cursor = d.Scan(cursor, func(key string, _ int) {
+			seen[key] = true
+		})
+		if cursor == 0 {
+			break
+		}
+		// the first 50 keys stay, the others come and go for a while
+		step++
+		switch {
+		case step > 50:
+		case step%7 == 0:
+			for i := range 500 {
+				d.Set("tmp"+strconv.Itoa(step)+"-"+strconv.Itoa(i), i)
+			}
+		case step%5 == 0:
+			for i := 50; i < 100; i++ {
+				d.Delete("k" + strconv.Itoa(i))
+			}
+			for i := range 500 {
+				d.Delete("tmp" + strconv.Itoa(step-step%7) + "-" + strconv.Itoa(i))
+			}
+		}
+	}
+	for i := range 50 {
+		assert.True(t, seen["k"+strconv.Itoa(i)], "k%d", i)
+	}
+
+	key, value, ok := d.RandomKey()
+	assert.True(t, ok)
+	v, _ := d.Get(key)
+	assert.Equal(t, v, value)
+}
+
+func TestActiveExpire(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389", WithHz(100))
+	now := time.Now()
+	for i := range 1000 {
+		s.storage.Set("stale"+strconv.Itoa(i), []byte("v"), now.Add(-time.Millisecond))
+	}
+	for i := range 100 {
+		s.storage.Set("live"+strconv.Itoa(i), []byte("v"), now.Add(time.Hour))
+		s.storage.Set("persistent"+strconv.Itoa(i), []byte("v"), time.Time{})
+	}
+
+	// every cycle stops in time, many cycles get all the stale keys
+	for range 100 {
+		start := time.Now()
+		s.activeExpireCycle()
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		if _, volatile := s.storage.Len(); volatile == 100 {
+			break
+		}
+	}
+	keys, volatile := s.storage.Len()
+	assert.Equal(t, 200, keys)
+	assert.Equal(t, 100, volatile)
+	assert.Equal(t, int64(1000), s.storage.expired.Load())
+
+	info := strings.Join(s.getInfo(), "\r\n")
+	assert.Contains(t, info, "expired_keys:1000\r\n")
+	assert.Greater(t, s.expireStats.stalePerc, 0.0)
+	assert.NotContains(t, info, "expired_stale_perc:0.00\r\n")
+
+	// the sampled keys are not stale anymore, the average goes down
+	stalePerc := s.expireStats.stalePerc
+	s.activeExpireCycle()
+	assert.Less(t, s.expireStats.stalePerc, stalePerc)
+
+	// replicas wait for DEL from the master
+	s.storage.Set("stale", []byte("v"), now.Add(-time.Millisecond))
+	s.role = RoleSlave
+	s.activeExpireCycle()
+	_, volatile = s.storage.Len()
+	assert.Equal(t, 101, volatile)
+}
 
+// Replicas accept write commands only from the master
+func TestReadonlyReplica(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	s.role = RoleSlave
+	buf := &strings.Builder{}
+	c := &Client{w: resp.NewWriter(buf)}
+
+	assert.Error(t, s.handleCommand([]string{"SET", "k", "v"}, c))
+	assert.Nil(t, s.handleCommand([]string{"GET", "k"}, c))
+	c.w.Flush()
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n$-1\r\n", buf.String())
+
+	buf.Reset()
+	c.master = true
+	assert.Nil(t, s.handleCommand([]string{"SET", "k", "v"}, c))
+	c.w.Flush()
+	assert.Equal(t, "+OK\r\n", buf.String())
+	v, err := s.storage.Get("k")
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
 }
 
 func TestServer(t *testing.T) {
@@ -337,6 +2961,59 @@ func TestReplicas(t *testing.T) {
 
 }
 
+// The rewritten commands leave a real replica with the same data as its master,
+// the relative deadline included
+func TestReplicaRewrites(t *testing.T) {
+
+	m := NewServer("127.0.0.1:6397")
+	go m.ListenAndServe()
+	time.Sleep(100 * time.Millisecond)
+	r := NewServer("127.0.0.1:6398")
+	assert.Nil(t, r.AsSlaveOf("127.0.0.1:6397"))
+
+	c := client.New(client.Options{Addr: "127.0.0.1:6397"})
+	defer c.Close()
+	ctx := context.Background()
+	assert.Nil(t, c.Set(ctx, "k", "v", 100*time.Second))
+	_, err := c.IncrByFloat(ctx, "f", 1.5)
+	assert.Nil(t, err)
+	_, err = c.HSet(ctx, "h", "a", "1", "b", "2")
+	assert.Nil(t, err)
+	_, err = c.HIncrByFloat(ctx, "h", "a", 0.5)
+	assert.Nil(t, err)
+	_, err = c.SAdd(ctx, "s", "a", "b")
+	assert.Nil(t, err)
+	popped, err := c.SPop(ctx, "s")
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set(ctx, "done", "1", 0))
+
+	assert.Eventually(t, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.storage.Exists("done")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	v, err := r.storage.Get("k")
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
+	want, _ := m.storage.ExpireAt("k")
+	got, _ := r.storage.ExpireAt("k")
+	assert.Equal(t, want.UnixMilli(), got.UnixMilli())
+	v, err = r.storage.Get("f")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.5", v)
+	h, err := r.getHash("h")
+	assert.Nil(t, err)
+	v, _ = h.Get("a")
+	assert.Equal(t, "1.5", v)
+	ss, err := r.getSet("s")
+	assert.Nil(t, err)
+	assert.False(t, ss.Contains(popped))
+	assert.Equal(t, 1, ss.Len())
+}
+
 //
 // Testing functions separately
 //
@@ -362,6 +3039,64 @@ func TestInfoSlave(t *testing.T) {
 	assert.Equal(t, "role:slave", info[1])
 }
 
+// Clients exceeding protocol limits are disconnected and counted
+func TestLimits(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389",
+		WithProtoMaxBulkLen(4),
+		WithMaxMultibulkLen(3),
+		WithClientQueryBufferLimit(10),
+	)
+
+	srv, cli := net.Pipe()
+	go s.handleConnection(srv, false)
+	go cli.Write([]byte("*2\r\n$4\r\nECHO\r\n$100\r\n"))
+
+	reader := bufio.NewReader(cli)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", line)
+	_, err = reader.ReadByte()
+	assert.Error(t, err)
+
+	assert.Contains(t, s.getInfo(), "proto_max_bulk_len_disconnections:1")
+	assert.Contains(t, s.getInfo(), "max_multibulk_len_disconnections:0")
+}
+
+// countingConn counts writes to the underlying connection
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// Replies to pipelined commands are sent in batches, not one by one
+func TestPipelineFlush(t *testing.T) {
+
+	s := NewServer("0.0.0.0:6389")
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	conn := &countingConn{Conn: srv}
+	go s.handleConnection(conn, false)
+
+	const n = 10000
+	go func() {
+		cli.Write([]byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", n)))
+	}()
+
+	reader := bufio.NewReader(cli)
+	for range n {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "+PONG\r\n", line)
+	}
+	assert.Less(t, conn.writes.Load(), int64(50))
+}
+
 func TestReplConf(t *testing.T) {
 
 	s := NewServer("0.0.0.0:6389")
@@ -382,6 +3117,70 @@ func TestReplConf(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// readReplies reads n simple string or bulk string replies
+func readReplies(b *testing.B, reader *bufio.Reader, n int) {
+	for range n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			b.Fatal(err)
+		}
+		if line[0] == resp.TypeBulkString && line != "$-1\r\n" {
+			if _, err = reader.ReadString('\n'); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+const (
+	benchSet = "*3\r\n$3\r\nSET\r\n$5\r\nbench\r\n$5\r\nvalue\r\n"
+	benchGet = "*2\r\n$3\r\nGET\r\n$5\r\nbench\r\n"
+)
+
+// SET and GET waiting for each reply before sending the next command
+func BenchmarkSetGet(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	b.ResetTimer()
+	for range b.N {
+		conn.Write([]byte(benchSet))
+		readReplies(b, reader, 1)
+		conn.Write([]byte(benchGet))
+		readReplies(b, reader, 1)
+	}
+}
+
+// SET and GET pipelined in batches of 1000 pairs
+func BenchmarkPipelinedSetGet(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	conn, err := net.Dial("tcp", "0.0.0.0:6379")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	const batch = 1000
+	pipeline := []byte(strings.Repeat(benchSet+benchGet, batch))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		n := min(batch, b.N-i)
+		go conn.Write(pipeline[:n*len(benchSet+benchGet)])
+		readReplies(b, reader, n*2)
+	}
+}
+
 // // sendACK sends REPLCONF GETACK * from server to replica
 // func (s *Server) sendACK(conn net.Conn) (string, error) {
 // 	// REPLCONF GETACK *
@@ -0,0 +1,175 @@
+package main
+
+// Set: the set value type, a sorted array of integers while all the members are integers, like in Redis
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+)
+
+// Default limit of the intset encoding of sets, set-max-intset-entries
+const setMaxIntsetEntries = 512
+
+// set is a set of strings. While all the members are integers in their canonical form,
+// and there are at most maxIntsetEntries of them, they are kept sorted in a slice of integers.
+// Otherwise the set is converted to a dict, and is never converted back. Not safe for concurrent use
+type set struct {
+	intset []int64
+	dict   *dict[struct{}] // nil while the intset encoding is used
+
+	maxIntsetEntries int
+}
+
+func newSet(maxIntsetEntries int) *set {
+	return &set{maxIntsetEntries: maxIntsetEntries}
+}
+
+// Encoding returns the name of the encoding, as reported by OBJECT ENCODING in Redis
+func (ss *set) Encoding() string {
+	if ss.dict != nil {
+		return "hashtable"
+	}
+	return "intset"
+}
+
+// Len returns the number of members
+func (ss *set) Len() int {
+	if ss.dict != nil {
+		return ss.dict.Len()
+	}
+	return len(ss.intset)
+}
+
+// Contains tells if the value is a member
+func (ss *set) Contains(member string) bool {
+	if ss.dict != nil {
+		_, ok := ss.dict.Get(member)
+		return ok
+	}
+	n, err := parseInt(member)
+	if err != nil {
+		return false
+	}
+	_, ok := slices.BinarySearch(ss.intset, n)
+	return ok
+}
+
+// Add adds the member, returns false if it is a member already
+func (ss *set) Add(member string) bool {
+	if ss.dict != nil {
+		return ss.dict.Set(member, struct{}{})
+	}
+	n, err := parseInt(member)
+	if err != nil {
+		ss.convert()
+		return ss.dict.Set(member, struct{}{})
+	}
+	i, ok := slices.BinarySearch(ss.intset, n)
+	if ok {
+		return false
+	}
+	ss.intset = slices.Insert(ss.intset, i, n)
+	if len(ss.intset) > ss.maxIntsetEntries {
+		ss.convert()
+	}
+	return true
+}
+
+// Remove removes the member, returns false if it is not a member
+func (ss *set) Remove(member string) bool {
+	if ss.dict != nil {
+		return ss.dict.Delete(member)
+	}
+	n, err := parseInt(member)
+	if err != nil {
+		return false
+	}
+	i, ok := slices.BinarySearch(ss.intset, n)
+	if !ok {
+		return false
+	}
+	ss.intset = slices.Delete(ss.intset, i, i+1)
+	return true
+}
+
+// convert moves the members to a dict
+func (ss *set) convert() {
+	ss.dict = newDict[struct{}]()
+	for _, n := range ss.intset {
+		ss.dict.Set(strconv.FormatInt(n, 10), struct{}{})
+	}
+	ss.intset = nil
+}
+
+// Range calls fn for all the members until fn returns false, the set must not be changed meanwhile.
+// Members of an intset come in ascending order
+func (ss *set) Range(fn func(member string) bool) {
+	if ss.dict != nil {
+		ss.dict.Range(func(member string, _ struct{}) bool {
+			return fn(member)
+		})
+		return
+	}
+	for _, n := range ss.intset {
+		if !fn(strconv.FormatInt(n, 10)) {
+			return
+		}
+	}
+}
+
+// Members returns all the members
+func (ss *set) Members() []string {
+	members := make([]string, 0, ss.Len())
+	ss.Range(func(member string) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+// Scan calls fn for the members starting from the cursor, until there are at least count of them,
+// and returns the cursor to continue from, 0 when the scan is complete.
+// An intset is small, it is returned whole at once, like in Redis
+func (ss *set) Scan(cursor uint64, count int, fn func(member string)) uint64 {
+	if ss.dict == nil {
+		for _, n := range ss.intset {
+			fn(strconv.FormatInt(n, 10))
+		}
+		return 0
+	}
+	return ss.dict.ScanCount(cursor, count, func(member string, _ struct{}) {
+		fn(member)
+	})
+}
+
+// Random returns a random member, the set must not be empty
+func (ss *set) Random() string {
+	if ss.dict != nil {
+		member, _, _ := ss.dict.RandomKey()
+		return member
+	}
+	return strconv.FormatInt(ss.intset[rand.Intn(len(ss.intset))], 10)
+}
+
+// Pop removes and returns a random member, the set must not be empty
+func (ss *set) Pop() string {
+	member := ss.Random()
+	ss.Remove(member)
+	return member
+}
+
+// Copy returns a deep copy of the set
+func (ss *set) Copy() *set {
+	res := newSet(ss.maxIntsetEntries)
+	if ss.dict == nil {
+		res.intset = slices.Clone(ss.intset)
+		return res
+	}
+	res.dict = newDict[struct{}]()
+	ss.dict.Range(func(member string, _ struct{}) bool {
+		res.dict.Set(member, struct{}{})
+		return true
+	})
+	return res
+}
@@ -0,0 +1,501 @@
+package main
+
+// Set commands
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "sadd", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).saddCommand,
+			Group: "set", Summary: "Adds one or more members to a set. Creates the key if it doesn't exist.", Since: "1.0.0", Complexity: "O(1) for each element added, so O(N) to add N elements when the command is called with multiple arguments."},
+		&Command{Name: "srem", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).sremCommand,
+			Group: "set", Summary: "Removes one or more members from a set. Deletes the set if the last member was removed.", Since: "1.0.0", Complexity: "O(N) where N is the number of members to be removed."},
+		&Command{Name: "smembers", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).smembersCommand,
+			Group: "set", Summary: "Returns all members of a set.", Since: "1.0.0", Complexity: "O(N) where N is the set cardinality."},
+		&Command{Name: "sismember", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).sismemberCommand,
+			Group: "set", Summary: "Determines whether a member belongs to a set.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "smismember", Arity: -3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).sismemberCommand,
+			Group: "set", Summary: "Determines whether multiple members belong to a set.", Since: "6.2.0", Complexity: "O(N) where N is the number of elements being checked for membership"},
+		&Command{Name: "scard", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).scardCommand,
+			Group: "set", Summary: "Returns the number of members in a set.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "spop", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).spopCommand,
+			Group: "set", Summary: "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped.", Since: "1.0.0", Complexity: "Without the count argument O(1), otherwise O(N) where N is the value of the passed count."},
+		&Command{Name: "srandmember", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).srandmemberCommand,
+			Group: "set", Summary: "Get one or multiple random members from a set", Since: "1.0.0", Complexity: "Without the count argument O(1), otherwise O(N) where N is the absolute value of the passed count."},
+		&Command{Name: "smove", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).smoveCommand,
+			Group: "set", Summary: "Moves a member from one set to another.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "sinter", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Returns the intersect of multiple sets.", Since: "1.0.0", Complexity: "O(N*M) worst case where N is the cardinality of the smallest set and M is the number of sets."},
+		&Command{Name: "sintercard", Arity: -3, Flags: FlagReadonly | FlagMovableKeys, Handler: (*Server).sintercardCommand,
+			Group: "set", Summary: "Returns the number of members of the intersect of multiple sets.", Since: "7.0.0", Complexity: "O(N*M) worst case where N is the cardinality of the smallest set and M is the number of sets."},
+		&Command{Name: "sinterstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Stores the intersect of multiple sets in a key.", Since: "1.0.0", Complexity: "O(N*M) worst case where N is the cardinality of the smallest set and M is the number of sets."},
+		&Command{Name: "sunion", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Returns the union of multiple sets.", Since: "1.0.0", Complexity: "O(N) where N is the total number of elements in all given sets."},
+		&Command{Name: "sunionstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Stores the union of multiple sets in a key.", Since: "1.0.0", Complexity: "O(N) where N is the total number of elements in all given sets."},
+		&Command{Name: "sdiff", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Returns the difference of multiple sets.", Since: "1.0.0", Complexity: "O(N) where N is the total number of elements in all given sets."},
+		&Command{Name: "sdiffstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).setopCommand,
+			Group: "set", Summary: "Stores the difference of multiple sets in a key.", Since: "1.0.0", Complexity: "O(N) where N is the total number of elements in all given sets."},
+		&Command{Name: "sscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).sscanCommand,
+			Group: "set", Summary: "Iterates over members of a set.", Since: "2.8.0", Complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection."},
+	)
+}
+
+// getSet returns the set of the key, nil if there is no such key.
+// Sets are changed in place, commands are executed one at a time
+func (s *Server) getSet(key string) (*set, error) {
+	e, ok := s.storage.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	ss, ok := e.value.(*set)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return ss, nil
+}
+
+// getSets returns the sets of the keys, nil for missing keys. The types of all the keys are checked
+func (s *Server) getSets(keys []string) ([]*set, error) {
+	sets := make([]*set, len(keys))
+	for i, key := range keys {
+		ss, err := s.getSet(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = ss
+	}
+	return sets, nil
+}
+
+// getOrCreateSet returns the set of the key, storing a new empty one if there is no such key.
+// The caller must not leave the new set empty
+func (s *Server) getOrCreateSet(key string) (*set, error) {
+	ss, err := s.getSet(key)
+	if err != nil || ss != nil {
+		return ss, err
+	}
+	ss = newSet(s.setMaxIntsetEntries)
+	s.storage.Set(key, ss, time.Time{})
+	return ss, nil
+}
+
+// deleteEmptySet deletes the key of the set if the set is empty, keys never hold empty sets
+func (s *Server) deleteEmptySet(key string, ss *set) {
+	if ss.Len() == 0 {
+		s.storage.Del(key)
+	}
+}
+
+// SADD key member [member ...]
+func (s *Server) saddCommand(c *Client, args []string) error {
+	ss, err := s.getOrCreateSet(args[1])
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, member := range args[2:] {
+		if ss.Add(member) {
+			added++
+		}
+	}
+	if added == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(added))
+	return nil
+}
+
+// SREM key member [member ...]
+func (s *Server) sremCommand(c *Client, args []string) error {
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+	removed := 0
+	if ss != nil {
+		for _, member := range args[2:] {
+			if ss.Remove(member) {
+				removed++
+			}
+		}
+		s.deleteEmptySet(args[1], ss)
+	}
+	if removed == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(removed))
+	return nil
+}
+
+// SMEMBERS key
+// Replies with a set, RESP2 clients get an array
+func (s *Server) smembersCommand(c *Client, args []string) error {
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+	if ss == nil {
+		c.w.WriteSetHeader(0)
+		return nil
+	}
+	c.w.WriteSetHeader(ss.Len())
+	ss.Range(func(member string) bool {
+		c.w.WriteBulkString(member)
+		return true
+	})
+	return nil
+}
+
+// SISMEMBER key member, SMISMEMBER key member [member ...]
+// SISMEMBER replies with an integer, SMISMEMBER with an array of them
+func (s *Server) sismemberCommand(c *Client, args []string) error {
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(args[0]) == "smismember" {
+		c.w.WriteArrayHeader(len(args) - 2)
+	}
+	for _, member := range args[2:] {
+		if ss != nil && ss.Contains(member) {
+			c.w.WriteInteger(1)
+		} else {
+			c.w.WriteInteger(0)
+		}
+	}
+	return nil
+}
+
+// SCARD key
+func (s *Server) scardCommand(c *Client, args []string) error {
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+	if ss == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	c.w.WriteInteger(int64(ss.Len()))
+	return nil
+}
+
+// SPOP key [count]
+// Replicas get SREM with the members popped, or DEL if the whole set is popped
+func (s *Server) spopCommand(c *Client, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := int64(-1)
+	if len(args) == 3 {
+		var err error
+		if count, err = parseInt(args[2]); err != nil || count < 0 {
+			return fmt.Errorf("value is out of range, must be positive")
+		}
+	}
+	key := args[1]
+	ss, err := s.getSet(key)
+	if err != nil {
+		return err
+	}
+
+	if count < 0 {
+		if ss == nil {
+			c.rewriteCommand()
+			c.w.WriteNull()
+			return nil
+		}
+		member := ss.Pop()
+		s.deleteEmptySet(key, ss)
+		c.rewriteCommand([]string{"SREM", key, member})
+		c.w.WriteBulkString(member)
+		return nil
+	}
+
+	if ss == nil || count == 0 {
+		c.rewriteCommand()
+		c.w.WriteSetHeader(0)
+		return nil
+	}
+	var members []string
+	if count >= int64(ss.Len()) {
+		members = ss.Members()
+		s.storage.Del(key)
+		c.rewriteCommand([]string{"DEL", key})
+	} else {
+		for range count {
+			members = append(members, ss.Pop())
+		}
+		c.rewriteCommand(append([]string{"SREM", key}, members...))
+	}
+	c.w.WriteSetHeader(len(members))
+	for _, member := range members {
+		c.w.WriteBulkString(member)
+	}
+	return nil
+}
+
+// SRANDMEMBER key [count]
+// A positive count returns distinct members, up to the size of the set,
+// a negative count returns exactly -count members, possibly repeated
+func (s *Server) srandmemberCommand(c *Client, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if ss == nil {
+			c.w.WriteNull()
+			return nil
+		}
+		c.w.WriteBulkString(ss.Random())
+		return nil
+	}
+
+	count, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if count == math.MinInt64 {
+		return fmt.Errorf("value is out of range")
+	}
+	if ss == nil || count == 0 {
+		c.w.WriteArray([]string{})
+		return nil
+	}
+
+	var members []string
+	switch {
+	case count < 0:
+		for range -count {
+			members = append(members, ss.Random())
+		}
+	case count >= int64(ss.Len()):
+		members = ss.Members()
+	case count*3 > int64(ss.Len()):
+		// a large part of the set: shuffle the beginning of all the members
+		members = ss.Members()
+		for i := range int(count) {
+			j := i + rand.Intn(len(members)-i)
+			members[i], members[j] = members[j], members[i]
+		}
+		members = members[:count]
+	default:
+		// a small part of the set: random members until enough distinct ones
+		seen := map[string]bool{}
+		for int64(len(members)) < count {
+			member := ss.Random()
+			if !seen[member] {
+				seen[member] = true
+				members = append(members, member)
+			}
+		}
+	}
+	c.w.WriteArray(members)
+	return nil
+}
+
+// SMOVE source destination member
+func (s *Server) smoveCommand(c *Client, args []string) error {
+	src, dst, member := args[1], args[2], args[3]
+	srcSet, err := s.getSet(src)
+	if err != nil {
+		return err
+	}
+	if srcSet == nil {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	// the destination must be checked before anything is changed
+	dstSet, err := s.getSet(dst)
+	if err != nil {
+		return err
+	}
+	if !srcSet.Contains(member) {
+		c.rewriteCommand()
+		c.w.WriteInteger(0)
+		return nil
+	}
+	if src == dst {
+		c.rewriteCommand()
+		c.w.WriteInteger(1)
+		return nil
+	}
+
+	srcSet.Remove(member)
+	s.deleteEmptySet(src, srcSet)
+	if dstSet == nil {
+		dstSet, _ = s.getOrCreateSet(dst)
+	}
+	dstSet.Add(member)
+	c.w.WriteInteger(1)
+	return nil
+}
+
+// setOperation returns the intersection, the union or the difference of the sets, nil ones are empty.
+// The intersection stops growing at limit members, unless limit is 0
+func (s *Server) setOperation(op string, sets []*set, limit int) *set {
+	res := newSet(s.setMaxIntsetEntries)
+	switch op {
+	case "inter":
+		if slices.Contains(sets, nil) {
+			return res
+		}
+		// members of the smallest set are looked up in the others
+		sets = slices.Clone(sets)
+		slices.SortFunc(sets, func(a, b *set) int {
+			return a.Len() - b.Len()
+		})
+		sets[0].Range(func(member string) bool {
+			for _, other := range sets[1:] {
+				if !other.Contains(member) {
+					return true
+				}
+			}
+			res.Add(member)
+			return limit == 0 || res.Len() < limit
+		})
+	case "union":
+		for _, ss := range sets {
+			if ss == nil {
+				continue
+			}
+			ss.Range(func(member string) bool {
+				res.Add(member)
+				return true
+			})
+		}
+	case "diff":
+		if sets[0] == nil {
+			return res
+		}
+		sets[0].Range(func(member string) bool {
+			for _, other := range sets[1:] {
+				if other != nil && other.Contains(member) {
+					return true
+				}
+			}
+			res.Add(member)
+			return true
+		})
+	}
+	return res
+}
+
+// SINTER key [key ...], SUNION key [key ...], SDIFF key [key ...],
+// SINTERSTORE destination key [key ...], SUNIONSTORE destination key [key ...], SDIFFSTORE destination key [key ...]
+// The STORE variants replace the destination with the result, or delete it if the result is empty
+func (s *Server) setopCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	op := strings.TrimSuffix(strings.TrimPrefix(name, "s"), "store")
+	store := strings.HasSuffix(name, "store")
+	keys := args[1:]
+	if store {
+		keys = args[2:]
+	}
+	sets, err := s.getSets(keys)
+	if err != nil {
+		return err
+	}
+	res := s.setOperation(op, sets, 0)
+
+	if !store {
+		c.w.WriteSetHeader(res.Len())
+		res.Range(func(member string) bool {
+			c.w.WriteBulkString(member)
+			return true
+		})
+		return nil
+	}
+	if res.Len() == 0 {
+		s.storage.Del(args[1])
+	} else {
+		s.storage.Set(args[1], res, time.Time{})
+	}
+	c.w.WriteInteger(int64(res.Len()))
+	return nil
+}
+
+// parseIntercard parses the arguments of SINTERCARD and ZINTERCARD: numkeys key [key ...] [LIMIT limit].
+// Returns the keys and the limit, 0 if there is none
+func parseIntercard(args []string) ([]string, int, error) {
+	numKeys, err := parseInt(args[1])
+	if err != nil || numKeys < 1 {
+		return nil, 0, fmt.Errorf("numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, 0, fmt.Errorf("Number of keys can't be greater than number of args")
+	}
+	keys := args[2 : 2+numKeys]
+	limit := int64(0)
+	for i := 2 + int(numKeys); i < len(args); i += 2 {
+		if strings.ToUpper(args[i]) != "LIMIT" || i+1 >= len(args) {
+			return nil, 0, errSyntax
+		}
+		if limit, err = parseInt(args[i+1]); err != nil || limit < 0 {
+			return nil, 0, fmt.Errorf("LIMIT can't be negative")
+		}
+	}
+	return keys, int(limit), nil
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func (s *Server) sintercardCommand(c *Client, args []string) error {
+	keys, limit, err := parseIntercard(args)
+	if err != nil {
+		return err
+	}
+	sets, err := s.getSets(keys)
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(s.setOperation("inter", sets, limit).Len()))
+	return nil
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *Server) sscanCommand(c *Client, args []string) error {
+	cursor, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern, count, _, err := parseScanOptions(args[3:], false)
+	if err != nil {
+		return err
+	}
+	ss, err := s.getSet(args[1])
+	if err != nil {
+		return err
+	}
+
+	members := []string{}
+	if ss != nil {
+		cursor = ss.Scan(cursor, count, func(member string) {
+			if pattern == "*" || globMatch(pattern, member, false) {
+				members = append(members, member)
+			}
+		})
+	} else {
+		cursor = 0
+	}
+
+	c.w.WriteArrayHeader(2)
+	c.w.WriteBulkString(strconv.FormatUint(cursor, 10))
+	c.w.WriteArray(members)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+// Skiplist: members ordered by score and member, with spans to find ranks in O(log N), like in Redis
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 32   // enough for 2^64 elements
+	skiplistP        = 0.25 // probability of a node to have one more level
+)
+
+// skiplist is a list of members ordered by score, members with the same score are ordered lexicographically.
+// Every level of a node links to the next node of that level, and counts the nodes it skips over,
+// so ranks are known while searching. Not safe for concurrent use
+type skiplist struct {
+	header *skiplistNode // sentinel of all the levels, holds no member
+	tail   *skiplistNode
+	length int
+	level  int // number of levels in use
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode // previous node on level 0, nil for the first node
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int // number of nodes from this node to forward, counting forward
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+// randomLevel returns the number of levels of a new node, higher ones being less likely
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// zsetLess tells if the member with the score is ordered before the other one
+func zsetLess(score float64, member string, otherScore float64, otherMember string) bool {
+	return score < otherScore || score == otherScore && member < otherMember
+}
+
+// Len returns the number of nodes
+func (sl *skiplist) Len() int {
+	return sl.length
+}
+
+// Insert adds the member with the score, the member must not be in the list already
+func (sl *skiplist) Insert(member string, score float64) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.score, x.level[i].forward.member, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := range level {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// the levels above the new node skip over it
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+}
+
+// Delete removes the member with the score, returns false if there is no such node
+func (sl *skiplist) Delete(member string, score float64) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.score, x.level[i].forward.member, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := range sl.level {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// Count returns the number of the leading nodes for which fn returns true,
+// fn must be true for a prefix of the list and false for the rest of it
+func (sl *skiplist) Count(fn func(score float64, member string) bool) int {
+	n := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && fn(x.level[i].forward.score, x.level[i].forward.member) {
+			n += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	return n
+}
+
+// ByRank returns the node of the 0-based rank, nil if the rank is out of the list
+func (sl *skiplist) ByRank(rank int) *skiplistNode {
+	if rank < 0 || rank >= sl.length {
+		return nil
+	}
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank+1 {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
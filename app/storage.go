@@ -0,0 +1,405 @@
+package main
+
+// Keyspace storage: values of any type with optional expiration deadlines
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Storage errors
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrWrongType   = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// typeName returns the name of the value type, as reported by TYPE
+func typeName(value any) string {
+	switch value.(type) {
+	case []byte:
+		return "string"
+	case *quicklist:
+		return "list"
+	case *hash:
+		return "hash"
+	case *set:
+		return "set"
+	case *zset:
+		return "zset"
+	}
+	panic(fmt.Sprintf("unknown value type %T", value))
+}
+
+// copyValue returns a deep copy of the value, so the copy can be changed independently
+func copyValue(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return bytes.Clone(v)
+	case *quicklist:
+		return v.Copy()
+	case *hash:
+		return v.Copy()
+	case *set:
+		return v.Copy()
+	case *zset:
+		return v.Copy()
+	}
+	panic(fmt.Sprintf("unknown value type %T", value))
+}
+
+// entry is a value stored under a key
+type entry struct {
+	value    any       // []byte, *quicklist, *hash, *set or *zset
+	expireAt time.Time // zero if the key never expires
+}
+
+// expired tells if the deadline of the entry has passed
+func (e *entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// expireMode tells how lookups treat expired keys and fields
+type expireMode int32
+
+const (
+	expireDelete expireMode = iota // deleted, and kept for propagation, on masters
+	expireHide                     // reported missing but kept until the master deletes them, on replicas
+	expireKeep                     // reported as they are, for the commands of the master on replicas
+)
+
+// Storage is the keyspace. Expired keys are deleted lazily, when they are looked up,
+// and actively, by sampling the keys with deadlines. Expired fields of hashes are deleted the same way.
+// Single operations are safe for concurrent use, commands combining several of them
+// are made atomic by the server executing one command at a time
+type Storage struct {
+	mx       sync.RWMutex
+	data     *dict[*entry]
+	volatile *dict[struct{}] // keys with deadlines
+	// keys of hashes with field deadlines, some of them may have none left
+	volatileHashes *dict[struct{}]
+
+	expireCursor       uint64       // where the active expiration continues sampling volatile
+	expireFieldsCursor uint64       // where the active expiration continues sampling volatileHashes
+	expired            atomic.Int64 // number of keys deleted because of their deadlines
+	expiredFields      atomic.Int64 // number of hash fields deleted because of their deadlines
+
+	mode atomic.Int32 // expireMode of the lookups
+	// keys and fields deleted by lookups because of their deadlines, until they are taken for propagation
+	lazyExpired []expiredFields
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		data:           newDict[*entry](),
+		volatile:       newDict[struct{}](),
+		volatileHashes: newDict[struct{}](),
+	}
+}
+
+// put stores the entry under the key, the write lock must be held
+func (st *Storage) put(key string, e *entry) {
+	st.data.Set(key, e)
+	if h, ok := e.value.(*hash); ok && h.volatile > 0 {
+		st.volatileHashes.Set(key, struct{}{})
+	} else {
+		st.volatileHashes.Delete(key)
+	}
+	if e.expireAt.IsZero() {
+		st.volatile.Delete(key)
+		return
+	}
+	st.volatile.Set(key, struct{}{})
+}
+
+// remove deletes the key, the write lock must be held
+func (st *Storage) remove(key string) {
+	st.data.Delete(key)
+	st.volatile.Delete(key)
+	st.volatileHashes.Delete(key)
+}
+
+// SetExpireMode sets how the following lookups treat expired keys and fields
+func (st *Storage) SetExpireMode(mode expireMode) {
+	st.mode.Store(int32(mode))
+}
+
+// lookup returns the entry of the key, deleting it if it is expired.
+// Expired fields of a hash are deleted too, and the key if no fields are left.
+// Unless the mode says otherwise: replicas only hide expired keys and fields, the master sees them all
+func (st *Storage) lookup(key string) (*entry, bool) {
+	st.mx.RLock()
+	e, ok := st.data.Get(key)
+	st.mx.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	mode := expireMode(st.mode.Load())
+	if mode == expireKeep {
+		return e, true
+	}
+	now := time.Now()
+	if e.expired(now) {
+		if mode == expireHide {
+			return nil, false
+		}
+		st.mx.Lock()
+		if current, _ := st.data.Get(key); current == e {
+			st.remove(key)
+			st.expired.Add(1)
+			st.lazyExpired = append(st.lazyExpired, expiredFields{key: key})
+		}
+		st.mx.Unlock()
+		return nil, false
+	}
+	if h, ok := e.value.(*hash); ok && h.Expiring(now) {
+		if mode == expireHide {
+			// replica clients only read, the fields are hidden from a copy
+			h = h.Copy()
+			h.Expire(now)
+			if h.Len() == 0 {
+				return nil, false
+			}
+			return &entry{value: h, expireAt: e.expireAt}, true
+		}
+		st.mx.Lock()
+		defer st.mx.Unlock()
+		if fields := h.Expire(now); len(fields) > 0 {
+			st.expiredFields.Add(int64(len(fields)))
+			st.lazyExpired = append(st.lazyExpired, expiredFields{key, fields})
+		}
+		if h.Len() == 0 {
+			st.remove(key)
+			return nil, false
+		}
+	}
+	return e, true
+}
+
+// TakeExpired returns the keys and the hash fields deleted by lookups because of their deadlines
+// since the last call, no fields means the whole key
+func (st *Storage) TakeExpired() []expiredFields {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	expired := st.lazyExpired
+	st.lazyExpired = nil
+	return expired
+}
+
+// Get returns a copy of the string value of the key
+func (st *Storage) Get(key string) (string, error) {
+	e, ok := st.lookup(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	value, ok := e.value.([]byte)
+	if !ok {
+		return "", ErrWrongType
+	}
+	return string(value), nil
+}
+
+// Set stores the value under the key, replacing any value of any type.
+// Strings are stored as byte buffers, so they can be changed in place.
+// The key expires at expireAt unless it is zero
+func (st *Storage) Set(key string, value any, expireAt time.Time) {
+	st.mx.Lock()
+	st.put(key, &entry{value: value, expireAt: expireAt})
+	st.mx.Unlock()
+}
+
+// ExpireAt returns the deadline of the key, zero if the key never expires
+func (st *Storage) ExpireAt(key string) (time.Time, error) {
+	e, ok := st.lookup(key)
+	if !ok {
+		return time.Time{}, ErrKeyNotFound
+	}
+	return e.expireAt, nil
+}
+
+// SetExpireAt sets the deadline of the key, zero removes it
+func (st *Storage) SetExpireAt(key string, expireAt time.Time) error {
+	e, ok := st.lookup(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	st.mx.Lock()
+	// entries are replaced, not changed, so lookups don't race with the change
+	st.put(key, &entry{value: e.value, expireAt: expireAt})
+	st.mx.Unlock()
+	return nil
+}
+
+// WatchFields makes the active expiration look at the hash of the key, once its fields get deadlines
+func (st *Storage) WatchFields(key string) {
+	st.mx.Lock()
+	st.volatileHashes.Set(key, struct{}{})
+	st.mx.Unlock()
+}
+
+// Del deletes the key, returns false if there was no such key
+func (st *Storage) Del(key string) bool {
+	if _, ok := st.lookup(key); !ok {
+		return false
+	}
+	st.mx.Lock()
+	st.remove(key)
+	st.mx.Unlock()
+	return true
+}
+
+// Exists tells if the key exists
+func (st *Storage) Exists(key string) bool {
+	_, ok := st.lookup(key)
+	return ok
+}
+
+// Rename moves the value and the deadline of the key to the new key, replacing it
+func (st *Storage) Rename(key, newKey string) error {
+	e, ok := st.lookup(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	st.mx.Lock()
+	st.remove(key)
+	st.put(newKey, e)
+	st.mx.Unlock()
+	return nil
+}
+
+// RandomKey returns a random key that is not expired, the expired keys met are deleted like by lookups
+func (st *Storage) RandomKey() (string, bool) {
+	now := time.Now()
+	mode := expireMode(st.mode.Load())
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	// all the keys may be expired, give up at some point
+	for range 100 {
+		key, e, ok := st.data.RandomKey()
+		if !ok {
+			return "", false
+		}
+		if mode == expireKeep || !e.expired(now) {
+			return key, true
+		}
+		if mode == expireDelete {
+			st.remove(key)
+			st.expired.Add(1)
+			st.lazyExpired = append(st.lazyExpired, expiredFields{key: key})
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of keys and the number of keys with deadlines, expired ones included
+func (st *Storage) Len() (int, int) {
+	st.mx.RLock()
+	defer st.mx.RUnlock()
+	return st.data.Len(), st.volatile.Len()
+}
+
+// Scan returns the keys of the buckets starting from the cursor, until there are at least count keys,
+// and the cursor to continue from, 0 when the scan is complete. Expired keys are skipped.
+// Every key present for the whole scan is returned, some may be returned more than once
+func (st *Storage) Scan(cursor uint64, count int) ([]string, uint64) {
+	now := time.Now()
+	st.mx.RLock()
+	defer st.mx.RUnlock()
+
+	keys := []string{}
+	// empty buckets are visited too, they are limited as well
+	for maxIterations := count * 10; maxIterations > 0 && len(keys) < count; maxIterations-- {
+		cursor = st.data.Scan(cursor, func(key string, e *entry) {
+			if !e.expired(now) {
+				keys = append(keys, key)
+			}
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	return keys, cursor
+}
+
+// ExpireSample looks at about n keys with deadlines and deletes the expired ones.
+// Sampling continues from where the previous one stopped, so all the keys are looked at in turn.
+// Returns the number of keys sampled and the keys deleted
+func (st *Storage) ExpireSample(n int, now time.Time) (int, []string) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	sampled := []string{}
+	for len(sampled) < n {
+		st.expireCursor = st.volatile.Scan(st.expireCursor, func(key string, _ struct{}) {
+			sampled = append(sampled, key)
+		})
+		if st.expireCursor == 0 {
+			break
+		}
+	}
+
+	deleted := []string{}
+	for _, key := range sampled {
+		if e, _ := st.data.Get(key); e.expired(now) {
+			st.remove(key)
+			deleted = append(deleted, key)
+		}
+	}
+	st.expired.Add(int64(len(deleted)))
+	return len(sampled), deleted
+}
+
+// expiredFields are the fields of the hash of the key deleted because of their deadlines
+type expiredFields struct {
+	key    string
+	fields []string
+}
+
+// ExpireFieldsSample looks at about n hashes with field deadlines and deletes their expired fields,
+// and the keys of the hashes left empty. Sampling continues from where the previous one stopped.
+// Returns the number of hashes sampled and the fields deleted
+func (st *Storage) ExpireFieldsSample(n int, now time.Time) (int, []expiredFields) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	sampled := []string{}
+	for len(sampled) < n {
+		st.expireFieldsCursor = st.volatileHashes.Scan(st.expireFieldsCursor, func(key string, _ struct{}) {
+			sampled = append(sampled, key)
+		})
+		if st.expireFieldsCursor == 0 {
+			break
+		}
+	}
+
+	deleted := []expiredFields{}
+	for _, key := range sampled {
+		e, ok := st.data.Get(key)
+		var h *hash
+		if ok {
+			h, _ = e.value.(*hash)
+		}
+		if h == nil || h.volatile == 0 {
+			// the key is gone, holds something else, or the deadlines were removed
+			st.volatileHashes.Delete(key)
+			continue
+		}
+		if e.expired(now) {
+			// the key itself is expired, it is deleted as a whole
+			continue
+		}
+		fields := h.Expire(now)
+		if len(fields) == 0 {
+			continue
+		}
+		deleted = append(deleted, expiredFields{key, fields})
+		st.expiredFields.Add(int64(len(fields)))
+		if h.Len() == 0 {
+			st.remove(key)
+		}
+	}
+	return len(sampled), deleted
+}
@@ -0,0 +1,552 @@
+package main
+
+// String commands
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "set", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).setCommand,
+			Group: "string", Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "get", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getCommand,
+			Group: "string", Summary: "Returns the string value of a key.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "mget", Arity: -2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: -1, Step: 1, Handler: (*Server).mgetCommand,
+			Group: "string", Summary: "Atomically returns the string values of one or more keys.", Since: "1.0.0", Complexity: "O(N) where N is the number of keys to retrieve."},
+		&Command{Name: "mset", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 2, Handler: (*Server).msetCommand,
+			Group: "string", Summary: "Atomically creates or modifies the string values of one or more keys.", Since: "1.0.1", Complexity: "O(N) where N is the number of keys to set."},
+		&Command{Name: "msetnx", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 2, Handler: (*Server).msetCommand,
+			Group: "string", Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist.", Since: "1.0.1", Complexity: "O(N) where N is the number of keys to set."},
+		&Command{Name: "getdel", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getdelCommand,
+			Group: "string", Summary: "Returns the string value of a key after deleting the key.", Since: "6.2.0", Complexity: "O(1)"},
+		&Command{Name: "getex", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getexCommand,
+			Group: "string", Summary: "Returns the string value of a key after setting its expiration time.", Since: "6.2.0", Complexity: "O(1)"},
+		&Command{Name: "getset", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getsetCommand,
+			Group: "string", Summary: "Returns the previous string value of a key after setting it to a new value.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "incr", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).incrCommand,
+			Group: "string", Summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "decr", Arity: 2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).incrCommand,
+			Group: "string", Summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "incrby", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).incrCommand,
+			Group: "string", Summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "decrby", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).incrCommand,
+			Group: "string", Summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0", Complexity: "O(1)"},
+		&Command{Name: "incrbyfloat", Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).incrbyfloatCommand,
+			Group: "string", Summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "2.6.0", Complexity: "O(1)"},
+		&Command{Name: "append", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).appendCommand,
+			Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.", Since: "2.0.0", Complexity: "O(1). The amortized time complexity is O(1) assuming the appended value is small and the already present value is of any size, since the dynamic string library used by Redis will double the free space available on every reallocation."},
+		&Command{Name: "strlen", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).strlenCommand,
+			Group: "string", Summary: "Returns the length of a string value.", Since: "2.2.0", Complexity: "O(1)"},
+		&Command{Name: "getrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).getrangeCommand,
+			Group: "string", Summary: "Returns a substring of the string stored at a key.", Since: "2.4.0", Complexity: "O(N) where N is the length of the returned string. The complexity is ultimately determined by the returned length, but because creating a substring from an existing string is very cheap, it can be considered O(1) for small strings."},
+		&Command{Name: "setrange", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).setrangeCommand,
+			Group: "string", Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.", Since: "2.2.0", Complexity: "O(1), not counting the time taken to copy the new string in place. Usually, this string is very small so the amortized complexity is O(1). Otherwise, complexity is O(M) with M being the length of the value argument."},
+	)
+}
+
+// Errors shared by the commands parsing numbers and expiration times
+var (
+	errNotInteger = fmt.Errorf("value is not an integer or out of range")
+	errSyntax     = fmt.Errorf("syntax error")
+	errNotFloat   = fmt.Errorf("value is not a valid float")
+)
+
+// parseInt parses an integer the way Redis does: no signs other than a leading minus, no leading zeros, no spaces
+func parseInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+// parseFloat parses a floating point number, rejecting NaN
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatFloat formats a number the shortest way, without an exponent, like INCRBYFLOAT does
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// expiration is a parsed EX, PX, EXAT, PXAT or KEEPTTL option
+type expiration struct {
+	option   string    // upper case name of the option, empty if none was given
+	expireAt time.Time // deadline of the key, zero for KEEPTTL
+}
+
+// parseExpiration parses the value of an expiration option into a deadline,
+// relative times are counted from now
+func parseExpiration(option, value, command string, now time.Time) (time.Time, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errNotInteger
+	}
+	invalid := fmt.Errorf("invalid expire time in '%s' command", command)
+	if n <= 0 {
+		return time.Time{}, invalid
+	}
+
+	ms := n
+	if option == "EX" || option == "EXAT" {
+		if n > math.MaxInt64/1000 {
+			return time.Time{}, invalid
+		}
+		ms = n * 1000
+	}
+	if option == "EX" || option == "PX" {
+		if ms > math.MaxInt64-now.UnixMilli() {
+			return time.Time{}, invalid
+		}
+		ms += now.UnixMilli()
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func (s *Server) setCommand(c *Client, args []string) error {
+	key, value := args[1], args[2]
+	var nx, xx, get bool
+	var exp expiration
+
+	now := time.Now()
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX", "XX":
+			if nx || xx {
+				return errSyntax
+			}
+			nx, xx = option == "NX", option == "XX"
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if exp.option != "" {
+				return errSyntax
+			}
+			exp.option = option
+		case "EX", "PX", "EXAT", "PXAT":
+			if exp.option != "" || i+1 >= len(args) {
+				return errSyntax
+			}
+			expireAt, err := parseExpiration(option, args[i+1], "set", now)
+			if err != nil {
+				return err
+			}
+			exp = expiration{option: option, expireAt: expireAt}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	old, err := s.storage.Get(key)
+	exists := err == nil
+	if err != nil && err != ErrKeyNotFound {
+		// the old value of another type is only a problem if it has to be returned
+		if get {
+			return err
+		}
+		exists = true
+	}
+
+	if (nx && exists) || (xx && !exists) {
+		c.rewriteCommand()
+		if get && exists {
+			c.w.WriteBulkString(old)
+			return nil
+		}
+		c.w.WriteNull()
+		return nil
+	}
+
+	if exp.option == "KEEPTTL" {
+		exp.expireAt, _ = s.storage.ExpireAt(key)
+	}
+	log.Printf("[DEBUG] [%s] Setting key %s with value %s and expiration %v\n", s.role, key, value, exp.expireAt)
+	s.storage.Set(key, []byte(value), exp.expireAt)
+
+	// relative times would be counted from a different now on replicas
+	switch {
+	case !exp.expireAt.IsZero():
+		c.rewriteCommand([]string{"SET", key, value, "PXAT", strconv.FormatInt(exp.expireAt.UnixMilli(), 10)})
+	case exp.option == "KEEPTTL":
+		c.rewriteCommand([]string{"SET", key, value, "KEEPTTL"})
+	default:
+		c.rewriteCommand([]string{"SET", key, value})
+	}
+
+	switch {
+	case !get:
+		c.w.WriteSimpleString("OK")
+	case exists:
+		c.w.WriteBulkString(old)
+	default:
+		c.w.WriteNull()
+	}
+	return nil
+}
+
+// GET key
+func (s *Server) getCommand(c *Client, args []string) error {
+	value, err := s.storage.Get(args[1])
+	if err == ErrKeyNotFound {
+		c.w.WriteNull()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// getString returns the string value of the key and its entry, nil if there is no such key.
+// The value is the stored buffer itself: changing it changes the key
+func (s *Server) getString(key string) ([]byte, *entry, error) {
+	e, ok := s.storage.lookup(key)
+	if !ok {
+		return nil, nil, nil
+	}
+	value, ok := e.value.([]byte)
+	if !ok {
+		return nil, nil, ErrWrongType
+	}
+	return value, e, nil
+}
+
+// setString stores the string value of the key, keeping the deadline of the entry if any.
+// Values changed in place only need it if they were reallocated while growing
+func (s *Server) setString(key string, value []byte, e *entry) {
+	expireAt := time.Time{}
+	if e != nil {
+		expireAt = e.expireAt
+	}
+	s.storage.Set(key, value, expireAt)
+}
+
+// INCR key, DECR key, INCRBY key increment, DECRBY key decrement
+func (s *Server) incrCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	incr := int64(1)
+	if len(args) == 3 {
+		var err error
+		if incr, err = parseInt(args[2]); err != nil {
+			return err
+		}
+	}
+	if name == "decr" || name == "decrby" {
+		if incr == math.MinInt64 {
+			return fmt.Errorf("decrement would overflow")
+		}
+		incr = -incr
+	}
+
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	n := int64(0)
+	if e != nil {
+		if n, err = parseInt(string(old)); err != nil {
+			return err
+		}
+	}
+	if (incr < 0 && n < math.MinInt64-incr) || (incr > 0 && n > math.MaxInt64-incr) {
+		return fmt.Errorf("increment or decrement would overflow")
+	}
+	n += incr
+
+	s.setString(args[1], []byte(strconv.FormatInt(n, 10)), e)
+	c.w.WriteInteger(n)
+	return nil
+}
+
+// INCRBYFLOAT key increment
+// Replicas get SET with the result, so they don't depend on their floating point rounding
+func (s *Server) incrbyfloatCommand(c *Client, args []string) error {
+	incr, err := parseFloat(args[2])
+	if err != nil {
+		return err
+	}
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	f := 0.0
+	if e != nil {
+		if f, err = parseFloat(string(old)); err != nil {
+			return err
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("increment would produce NaN or Infinity")
+	}
+
+	value := formatFloat(f)
+	s.setString(args[1], []byte(value), e)
+	c.rewriteCommand([]string{"SET", args[1], value, "KEEPTTL"})
+	c.w.WriteBulkString(value)
+	return nil
+}
+
+// checkStringLength fails if a string of the given length plus appended bytes can't be stored
+func (s *Server) checkStringLength(n, appended int64) error {
+	if n > s.limits.MaxBulkLen-appended {
+		return fmt.Errorf("string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	return nil
+}
+
+// APPEND key value
+// The value is appended in place, append leaves spare room when it reallocates, so appends are amortized O(1)
+func (s *Server) appendCommand(c *Client, args []string) error {
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	if err := s.checkStringLength(int64(len(old)), int64(len(args[2]))); err != nil {
+		return err
+	}
+	value := append(old, args[2]...)
+	s.setString(args[1], value, e)
+	c.w.WriteInteger(int64(len(value)))
+	return nil
+}
+
+// STRLEN key
+func (s *Server) strlenCommand(c *Client, args []string) error {
+	value, _, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(len(value)))
+	return nil
+}
+
+// GETRANGE key start end
+// Negative offsets count from the end, the range is clamped to the string
+func (s *Server) getrangeCommand(c *Client, args []string) error {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	end, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	value, _, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+
+	n := int64(len(value))
+	if start < 0 && end < 0 && start > end {
+		c.w.WriteBulkString("")
+		return nil
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		c.w.WriteBulkString("")
+		return nil
+	}
+	c.w.WriteBulkString(string(value[start : end+1]))
+	return nil
+}
+
+// SETRANGE key offset value
+// The string is changed in place, padded with zero bytes up to the offset
+func (s *Server) setrangeCommand(c *Client, args []string) error {
+	offset, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return fmt.Errorf("offset is out of range")
+	}
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+
+	patch := args[3]
+	// an empty patch changes nothing and doesn't create the key
+	if len(patch) == 0 {
+		c.rewriteCommand()
+		c.w.WriteInteger(int64(len(old)))
+		return nil
+	}
+	if err := s.checkStringLength(offset, int64(len(patch))); err != nil {
+		return err
+	}
+
+	value := old
+	if need := int(offset) + len(patch); need > len(value) {
+		value = append(value, make([]byte, need-len(value))...)
+	}
+	copy(value[offset:], patch)
+	if e == nil || len(value) != len(old) {
+		s.setString(args[1], value, e)
+	}
+	c.w.WriteInteger(int64(len(value)))
+	return nil
+}
+
+// MGET key [key ...]
+// Missing keys and keys of other types are null
+func (s *Server) mgetCommand(c *Client, args []string) error {
+	c.w.WriteArrayHeader(len(args) - 1)
+	for _, key := range args[1:] {
+		value, err := s.storage.Get(key)
+		if err != nil {
+			c.w.WriteNull()
+			continue
+		}
+		c.w.WriteBulkString(value)
+	}
+	return nil
+}
+
+// MSET key value [key value ...], MSETNX key value [key value ...]
+// MSETNX sets all the keys or none of them, if any of them exists
+func (s *Server) msetCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	if len(args)%2 == 0 {
+		return fmt.Errorf("wrong number of arguments for '%s' command", name)
+	}
+
+	if name == "msetnx" {
+		for i := 1; i < len(args); i += 2 {
+			if s.storage.Exists(args[i]) {
+				c.rewriteCommand()
+				c.w.WriteInteger(0)
+				return nil
+			}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		s.storage.Set(args[i], []byte(args[i+1]), time.Time{})
+	}
+
+	if name == "msetnx" {
+		c.w.WriteInteger(1)
+		return nil
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// GETDEL key
+// Replicas get DEL
+func (s *Server) getdelCommand(c *Client, args []string) error {
+	value, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		c.rewriteCommand()
+		c.w.WriteNull()
+		return nil
+	}
+	s.storage.Del(args[1])
+	c.rewriteCommand([]string{"DEL", args[1]})
+	c.w.WriteBulkString(string(value))
+	return nil
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// Replicas get PEXPIREAT, PERSIST, or DEL if the deadline has already passed
+func (s *Server) getexCommand(c *Client, args []string) error {
+	key := args[1]
+	var exp expiration
+
+	now := time.Now()
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "PERSIST":
+			if exp.option != "" {
+				return errSyntax
+			}
+			exp.option = option
+		case "EX", "PX", "EXAT", "PXAT":
+			if exp.option != "" || i+1 >= len(args) {
+				return errSyntax
+			}
+			expireAt, err := parseExpiration(option, args[i+1], "getex", now)
+			if err != nil {
+				return err
+			}
+			exp = expiration{option: option, expireAt: expireAt}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	value, e, err := s.getString(key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		c.rewriteCommand()
+		c.w.WriteNull()
+		return nil
+	}
+
+	switch {
+	case exp.option == "":
+		c.rewriteCommand()
+	case exp.option == "PERSIST":
+		if e.expireAt.IsZero() {
+			c.rewriteCommand()
+			break
+		}
+		s.storage.SetExpireAt(key, time.Time{})
+		c.rewriteCommand([]string{"PERSIST", key})
+	case !exp.expireAt.After(now) && !c.master:
+		// same as EXPIRE with a deadline in the past
+		s.storage.Del(key)
+		c.rewriteCommand([]string{"DEL", key})
+	default:
+		s.storage.SetExpireAt(key, exp.expireAt)
+		c.rewriteCommand([]string{"PEXPIREAT", key, strconv.FormatInt(exp.expireAt.UnixMilli(), 10)})
+	}
+	c.w.WriteBulkString(string(value))
+	return nil
+}
+
+// GETSET key value
+// The deadline of the key is removed, replicas get SET
+func (s *Server) getsetCommand(c *Client, args []string) error {
+	old, e, err := s.getString(args[1])
+	if err != nil {
+		return err
+	}
+	s.storage.Set(args[1], []byte(args[2]), time.Time{})
+	c.rewriteCommand([]string{"SET", args[1], args[2]})
+	if e == nil {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulkString(string(old))
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+// Sorted set: the sorted set value type, a compact listpack while it's small and a skiplist with a dict
+// once it grows, like in Redis
+
+import (
+	"slices"
+	"sort"
+)
+
+// Default limits of the listpack encoding of sorted sets, zset-max-listpack-entries and zset-max-listpack-value
+const (
+	zsetMaxListpackEntries = 128
+	zsetMaxListpackValue   = 64
+)
+
+// zset is a set of members ordered by score, members with the same score are ordered lexicographically.
+// Small sorted sets keep their members in a sorted slice. A sorted set is converted to a skiplist,
+// with a dict of the scores by member, once it has more than maxEntries members or a member
+// longer than maxValue bytes, and is never converted back. Not safe for concurrent use
+type zset struct {
+	listpack []zsetMember
+	skiplist *skiplist
+	dict     *dict[float64] // nil while the listpack encoding is used
+
+	maxEntries, maxValue int
+}
+
+// zsetMember is a member with its score
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+func newZset(maxEntries, maxValue int) *zset {
+	return &zset{maxEntries: maxEntries, maxValue: maxValue}
+}
+
+// Encoding returns the name of the encoding, as reported by OBJECT ENCODING in Redis
+func (zs *zset) Encoding() string {
+	if zs.dict != nil {
+		return "skiplist"
+	}
+	return "listpack"
+}
+
+// Len returns the number of members
+func (zs *zset) Len() int {
+	if zs.dict != nil {
+		return zs.dict.Len()
+	}
+	return len(zs.listpack)
+}
+
+// find returns the index of the member in the listpack, -1 if there is no such member
+func (zs *zset) find(member string) int {
+	for i, m := range zs.listpack {
+		if m.member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+// Score returns the score of the member
+func (zs *zset) Score(member string) (float64, bool) {
+	if zs.dict != nil {
+		return zs.dict.Get(member)
+	}
+	if i := zs.find(member); i >= 0 {
+		return zs.listpack[i].score, true
+	}
+	return 0, false
+}
+
+// Set sets the score of the member, returns true if the member is new
+func (zs *zset) Set(member string, score float64) bool {
+	if zs.dict == nil && len(member) > zs.maxValue {
+		zs.convert()
+	}
+	if zs.dict != nil {
+		old, ok := zs.dict.Get(member)
+		if ok && old == score {
+			return false
+		}
+		if ok {
+			zs.skiplist.Delete(member, old)
+		}
+		zs.skiplist.Insert(member, score)
+		zs.dict.Set(member, score)
+		return !ok
+	}
+
+	i := zs.find(member)
+	if i >= 0 {
+		zs.listpack = slices.Delete(zs.listpack, i, i+1)
+	}
+	j := zs.Count(func(s float64, m string) bool {
+		return zsetLess(s, m, score, member)
+	})
+	zs.listpack = slices.Insert(zs.listpack, j, zsetMember{member: member, score: score})
+	if len(zs.listpack) > zs.maxEntries {
+		zs.convert()
+	}
+	return i < 0
+}
+
+// Delete deletes the member, returns false if there was no such member
+func (zs *zset) Delete(member string) bool {
+	if zs.dict != nil {
+		score, ok := zs.dict.Get(member)
+		if !ok {
+			return false
+		}
+		zs.skiplist.Delete(member, score)
+		return zs.dict.Delete(member)
+	}
+	i := zs.find(member)
+	if i < 0 {
+		return false
+	}
+	zs.listpack = slices.Delete(zs.listpack, i, i+1)
+	return true
+}
+
+// convert moves the members to a skiplist and a dict
+func (zs *zset) convert() {
+	zs.skiplist = newSkiplist()
+	zs.dict = newDict[float64]()
+	for _, m := range zs.listpack {
+		zs.skiplist.Insert(m.member, m.score)
+		zs.dict.Set(m.member, m.score)
+	}
+	zs.listpack = nil
+}
+
+// Count returns the number of the leading members for which fn returns true,
+// fn must be true for the lowest members and false for the rest of them
+func (zs *zset) Count(fn func(score float64, member string) bool) int {
+	if zs.dict != nil {
+		return zs.skiplist.Count(fn)
+	}
+	return sort.Search(len(zs.listpack), func(i int) bool {
+		return !fn(zs.listpack[i].score, zs.listpack[i].member)
+	})
+}
+
+// Rank returns the 0-based rank of the member, from the lowest score
+func (zs *zset) Rank(member string) (int, bool) {
+	score, ok := zs.Score(member)
+	if !ok {
+		return 0, false
+	}
+	return zs.Count(func(s float64, m string) bool {
+		return !zsetLess(score, member, s, m)
+	}) - 1, true
+}
+
+// RangeByRank calls fn for the members from the start rank to the end rank, inclusive, until fn returns false.
+// Members come from the lowest score, or from the highest one if rev is set.
+// The ranks must be in the set, the set must not be changed meanwhile
+func (zs *zset) RangeByRank(start, end int, rev bool, fn func(member string, score float64) bool) {
+	if start > end {
+		return
+	}
+	if zs.dict == nil {
+		for i := range end - start + 1 {
+			m := zs.listpack[start+i]
+			if rev {
+				m = zs.listpack[end-i]
+			}
+			if !fn(m.member, m.score) {
+				return
+			}
+		}
+		return
+	}
+
+	x := zs.skiplist.ByRank(start)
+	if rev {
+		x = zs.skiplist.ByRank(end)
+	}
+	for range end - start + 1 {
+		if !fn(x.member, x.score) {
+			return
+		}
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+}
+
+// Range calls fn for all the members from the lowest score until fn returns false, the set must not be changed meanwhile
+func (zs *zset) Range(fn func(member string, score float64) bool) {
+	zs.RangeByRank(0, zs.Len()-1, false, fn)
+}
+
+// Scan calls fn for the members starting from the cursor, until there are at least count of them,
+// and returns the cursor to continue from, 0 when the scan is complete.
+// A listpack is small, it is returned whole at once, like in Redis
+func (zs *zset) Scan(cursor uint64, count int, fn func(member string, score float64)) uint64 {
+	if zs.dict == nil {
+		for _, m := range zs.listpack {
+			fn(m.member, m.score)
+		}
+		return 0
+	}
+	return zs.dict.ScanCount(cursor, count, fn)
+}
+
+// Copy returns a deep copy of the sorted set
+func (zs *zset) Copy() *zset {
+	res := newZset(zs.maxEntries, zs.maxValue)
+	if zs.dict == nil {
+		res.listpack = slices.Clone(zs.listpack)
+		return res
+	}
+	res.skiplist = newSkiplist()
+	res.dict = newDict[float64]()
+	zs.Range(func(member string, score float64) bool {
+		res.skiplist.Insert(member, score)
+		res.dict.Set(member, score)
+		return true
+	})
+	return res
+}
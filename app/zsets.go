@@ -0,0 +1,1075 @@
+package main
+
+// Sorted set commands
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+func init() {
+	registerCommands(
+		&Command{Name: "zadd", Arity: -4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zaddCommand,
+			Group: "sorted-set", Summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.", Since: "1.2.0", Complexity: "O(log(N)) for each item added, where N is the number of elements in the sorted set."},
+		&Command{Name: "zincrby", Arity: 4, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zincrbyCommand,
+			Group: "sorted-set", Summary: "Increments the score of a member in a sorted set.", Since: "1.2.0", Complexity: "O(log(N)) where N is the number of elements in the sorted set."},
+		&Command{Name: "zrem", Arity: -3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zremCommand,
+			Group: "sorted-set", Summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.", Since: "1.2.0", Complexity: "O(M*log(N)) with N being the number of elements in the sorted set and M the number of elements to be removed."},
+		&Command{Name: "zcard", Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zcardCommand,
+			Group: "sorted-set", Summary: "Returns the number of members in a sorted set.", Since: "1.2.0", Complexity: "O(1)"},
+		&Command{Name: "zscore", Arity: 3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zscoreCommand,
+			Group: "sorted-set", Summary: "Returns the score of a member in a sorted set.", Since: "1.2.0", Complexity: "O(1)"},
+		&Command{Name: "zmscore", Arity: -3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zscoreCommand,
+			Group: "sorted-set", Summary: "Returns the score of one or more members in a sorted set.", Since: "6.2.0", Complexity: "O(N) where N is the number of members being requested."},
+		&Command{Name: "zcount", Arity: 4, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zcountCommand,
+			Group: "sorted-set", Summary: "Returns the count of members in a sorted set that have scores within a range.", Since: "2.0.0", Complexity: "O(log(N)) with N being the number of elements in the sorted set."},
+		&Command{Name: "zlexcount", Arity: 4, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zcountCommand,
+			Group: "sorted-set", Summary: "Returns the number of members in a sorted set within a lexicographical range.", Since: "2.8.9", Complexity: "O(log(N)) with N being the number of elements in the sorted set."},
+		&Command{Name: "zrank", Arity: -3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrankCommand,
+			Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by ascending scores.", Since: "2.0.0", Complexity: "O(log(N))"},
+		&Command{Name: "zrevrank", Arity: -3, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrankCommand,
+			Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by descending scores.", Since: "2.0.0", Complexity: "O(log(N))"},
+		&Command{Name: "zrange", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a range of indexes.", Since: "1.2.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements returned."},
+		&Command{Name: "zrangestore", Arity: -5, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1, Handler: (*Server).zrangestoreCommand,
+			Group: "sorted-set", Summary: "Stores a range of members from sorted set in a key.", Since: "6.2.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements stored into the destination key."},
+		&Command{Name: "zrevrange", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a range of indexes in reverse order.", Since: "1.2.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements returned."},
+		&Command{Name: "zrangebyscore", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a range of scores.", Since: "1.0.5", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements being returned."},
+		&Command{Name: "zrevrangebyscore", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a range of scores in reverse order.", Since: "2.2.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements being returned."},
+		&Command{Name: "zrangebylex", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a lexicographical range.", Since: "2.8.9", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements being returned."},
+		&Command{Name: "zrevrangebylex", Arity: -4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zrangeCommand,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a lexicographical range in reverse order.", Since: "2.8.9", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements being returned."},
+		&Command{Name: "zremrangebyrank", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zremrangeCommand,
+			Group: "sorted-set", Summary: "Removes members in a sorted set within a range of indexes. Deletes the sorted set if all members were removed.", Since: "2.0.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements removed by the operation."},
+		&Command{Name: "zremrangebyscore", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zremrangeCommand,
+			Group: "sorted-set", Summary: "Removes members in a sorted set within a range of scores. Deletes the sorted set if all members were removed.", Since: "1.2.0", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements removed by the operation."},
+		&Command{Name: "zremrangebylex", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zremrangeCommand,
+			Group: "sorted-set", Summary: "Removes members in a sorted set within a lexicographical range. Deletes the sorted set if all members were removed.", Since: "2.8.9", Complexity: "O(log(N)+M) with N being the number of elements in the sorted set and M the number of elements removed by the operation."},
+		&Command{Name: "zpopmin", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zpopCommand,
+			Group: "sorted-set", Summary: "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.", Since: "5.0.0", Complexity: "O(log(N)*M) with N being the number of elements in the sorted set, and M being the number of elements popped."},
+		&Command{Name: "zpopmax", Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zpopCommand,
+			Group: "sorted-set", Summary: "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.", Since: "5.0.0", Complexity: "O(log(N)*M) with N being the number of elements in the sorted set, and M being the number of elements popped."},
+		&Command{Name: "zmpop", Arity: -4, Flags: FlagWrite | FlagMovableKeys, Handler: (*Server).zmpopCommand,
+			Group: "sorted-set", Summary: "Returns the highest- or lowest-scoring members from one or more sorted sets after removing them. Deletes the sorted set if the last member was popped.", Since: "7.0.0", Complexity: "O(K) + O(M*log(N)) where K is the number of provided keys, N being the number of elements in the sorted set, and M being the number of elements popped."},
+		&Command{Name: "bzpopmin", Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, Step: 1, Handler: (*Server).bzpopCommand,
+			Group: "sorted-set", Summary: "Removes and returns the member with the lowest score from one or more sorted sets. Blocks until a member is available otherwise. Deletes the sorted set if the last element was popped.", Since: "5.0.0", Complexity: "O(log(N)) with N being the number of elements in the sorted set."},
+		&Command{Name: "bzpopmax", Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, Step: 1, Handler: (*Server).bzpopCommand,
+			Group: "sorted-set", Summary: "Removes and returns the member with the highest score from one or more sorted sets. Blocks until a member is available otherwise. Deletes the sorted set if the last element was popped.", Since: "5.0.0", Complexity: "O(log(N)) with N being the number of elements in the sorted set."},
+		&Command{Name: "bzmpop", Arity: -5, Flags: FlagWrite | FlagBlocking | FlagMovableKeys, Handler: (*Server).bzmpopCommand,
+			Group: "sorted-set", Summary: "Removes and returns a member by score from one or more sorted sets. Blocks until a member is available otherwise. Deletes the sorted set if the last element was popped.", Since: "7.0.0", Complexity: "O(K) + O(M*log(N)) where K is the number of provided keys, N being the number of elements in the sorted set, and M being the number of elements popped."},
+		&Command{Name: "zunion", Arity: -3, Flags: FlagReadonly | FlagMovableKeys, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Returns the union of multiple sorted sets.", Since: "6.2.0", Complexity: "O(N)+O(M*log(M)) with N being the sum of the sizes of the input sorted sets, and M being the number of elements in the resulting sorted set."},
+		&Command{Name: "zunionstore", Arity: -4, Flags: FlagWrite | FlagMovableKeys, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Stores the union of multiple sorted sets in a key.", Since: "2.0.0", Complexity: "O(N)+O(M log(M)) with N being the sum of the sizes of the input sorted sets, and M being the number of elements in the resulting sorted set."},
+		&Command{Name: "zinter", Arity: -3, Flags: FlagReadonly | FlagMovableKeys, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Returns the intersect of multiple sorted sets.", Since: "6.2.0", Complexity: "O(N*K)+O(M*log(M)) worst case with N being the smallest input sorted set, K being the number of input sorted sets and M being the number of elements in the resulting sorted set."},
+		&Command{Name: "zinterstore", Arity: -4, Flags: FlagWrite | FlagMovableKeys, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Stores the intersect of multiple sorted sets in a key.", Since: "2.0.0", Complexity: "O(N*K)+O(M*log(M)) worst case with N being the smallest input sorted set, K being the number of input sorted sets and M being the number of elements in the resulting sorted set."},
+		&Command{Name: "zintercard", Arity: -3, Flags: FlagReadonly | FlagMovableKeys, Handler: (*Server).zintercardCommand,
+			Group: "sorted-set", Summary: "Returns the number of members of the intersect of multiple sorted sets.", Since: "7.0.0", Complexity: "O(N*K) worst case with N being the smallest input sorted set, K being the number of input sorted sets."},
+		&Command{Name: "zdiff", Arity: -3, Flags: FlagReadonly | FlagMovableKeys, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Returns the difference between multiple sorted sets.", Since: "6.2.0", Complexity: "O(L + (N-K)log(N)) worst case where L is the total number of elements in all the sets, N is the size of the first set, and K is the size of the result set."},
+		&Command{Name: "zdiffstore", Arity: -4, Flags: FlagWrite | FlagMovableKeys, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zsetopCommand,
+			Group: "sorted-set", Summary: "Stores the difference of multiple sorted sets in a key.", Since: "6.2.0", Complexity: "O(L + (N-K)log(N)) worst case where L is the total number of elements in all the sets, N is the size of the first set, and K is the size of the result set."},
+		&Command{Name: "zscan", Arity: -3, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, Step: 1, Handler: (*Server).zscanCommand,
+			Group: "sorted-set", Summary: "Iterates over members and scores of a sorted set.", Since: "2.8.0", Complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection."},
+	)
+}
+
+var errScoreNaN = fmt.Errorf("resulting score is not a number (NaN)")
+
+// getZset returns the sorted set of the key, nil if there is no such key.
+// Sorted sets are changed in place, commands are executed one at a time
+func (s *Server) getZset(key string) (*zset, error) {
+	e, ok := s.storage.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	zs, ok := e.value.(*zset)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return zs, nil
+}
+
+// getOrCreateZset returns the sorted set of the key, storing a new empty one if there is no such key.
+// The caller must not leave the new sorted set empty
+func (s *Server) getOrCreateZset(key string) (*zset, error) {
+	zs, err := s.getZset(key)
+	if err != nil || zs != nil {
+		return zs, err
+	}
+	zs = newZset(s.zsetMaxListpackEntries, s.zsetMaxListpackValue)
+	s.storage.Set(key, zs, time.Time{})
+	return zs, nil
+}
+
+// deleteEmptyZset deletes the key of the sorted set if it is empty, keys never hold empty sorted sets
+func (s *Server) deleteEmptyZset(key string, zs *zset) {
+	if zs.Len() == 0 {
+		s.storage.Del(key)
+	}
+}
+
+// writeZsetMembers writes the members, with their scores if withScores is set:
+// RESP3 clients get an array of member score pairs, RESP2 clients get a flat array
+func writeZsetMembers(c *Client, members []zsetMember, withScores bool) {
+	n := len(members)
+	if withScores && c.proto < resp.RESP3 {
+		n *= 2
+	}
+	c.w.WriteArrayHeader(n)
+	for _, m := range members {
+		if withScores && c.proto >= resp.RESP3 {
+			c.w.WriteArrayHeader(2)
+		}
+		c.w.WriteBulkString(m.member)
+		if withScores {
+			c.w.WriteDouble(m.score)
+		}
+	}
+}
+
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+// Replies with the number of members added, or changed too with CH.
+// With INCR the score is incremented and the new score is replied, null if the member is left alone
+func (s *Server) zaddCommand(c *Client, args []string) error {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return fmt.Errorf("XX and NX options at the same time are not compatible")
+	}
+	if gt && lt || nx && (gt || lt) {
+		return fmt.Errorf("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return fmt.Errorf("INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		var err error
+		if scores[j], err = parseFloat(pairs[2*j]); err != nil {
+			return err
+		}
+	}
+
+	key := args[1]
+	zs, err := s.getOrCreateZset(key)
+	if err != nil {
+		return err
+	}
+	added, changed := 0, 0
+	updated := false
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, exists := zs.Score(member)
+		if exists && nx || !exists && xx {
+			continue
+		}
+		if incr && exists {
+			if score += old; math.IsNaN(score) {
+				return errScoreNaN
+			}
+		}
+		if exists && (gt && score <= old || lt && score >= old) {
+			continue
+		}
+		switch {
+		case !exists:
+			added++
+		case score != old:
+			changed++
+		}
+		zs.Set(member, score)
+		scores[j], updated = score, true
+	}
+	s.deleteEmptyZset(key, zs)
+
+	if added+changed == 0 {
+		c.rewriteCommand()
+	}
+	switch {
+	case incr && !updated:
+		c.w.WriteNull()
+	case incr:
+		c.w.WriteDouble(scores[0])
+	case ch:
+		c.w.WriteInteger(int64(added + changed))
+	default:
+		c.w.WriteInteger(int64(added))
+	}
+	return nil
+}
+
+// ZINCRBY key increment member
+func (s *Server) zincrbyCommand(c *Client, args []string) error {
+	incr, err := parseFloat(args[2])
+	if err != nil {
+		return err
+	}
+	zs, err := s.getOrCreateZset(args[1])
+	if err != nil {
+		return err
+	}
+	// a new member starts from 0, only an existing score may make NaN
+	old, _ := zs.Score(args[3])
+	score := old + incr
+	if math.IsNaN(score) {
+		return errScoreNaN
+	}
+	zs.Set(args[3], score)
+	c.w.WriteDouble(score)
+	return nil
+}
+
+// ZREM key member [member ...]
+func (s *Server) zremCommand(c *Client, args []string) error {
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	removed := 0
+	if zs != nil {
+		for _, member := range args[2:] {
+			if zs.Delete(member) {
+				removed++
+			}
+		}
+		s.deleteEmptyZset(args[1], zs)
+	}
+	if removed == 0 {
+		c.rewriteCommand()
+	}
+	c.w.WriteInteger(int64(removed))
+	return nil
+}
+
+// ZCARD key
+func (s *Server) zcardCommand(c *Client, args []string) error {
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	if zs == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	c.w.WriteInteger(int64(zs.Len()))
+	return nil
+}
+
+// ZSCORE key member, ZMSCORE key member [member ...]
+// ZSCORE replies with a score, ZMSCORE with an array of them, null for missing members
+func (s *Server) zscoreCommand(c *Client, args []string) error {
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(args[0]) == "zmscore" {
+		c.w.WriteArrayHeader(len(args) - 2)
+	}
+	for _, member := range args[2:] {
+		var score float64
+		ok := false
+		if zs != nil {
+			score, ok = zs.Score(member)
+		}
+		if ok {
+			c.w.WriteDouble(score)
+		} else {
+			c.w.WriteNull()
+		}
+	}
+	return nil
+}
+
+// zrange is a range of members of a sorted set, by score or lexicographically.
+// Both functions are true for the lowest members: beforeMin for the members below the range,
+// upToMax for the members below the range and in it
+type zrange struct {
+	beforeMin, upToMax func(score float64, member string) bool
+}
+
+// ranks returns the ranks of the first and the last members of the sorted set in the range,
+// the first is greater than the last if the range is empty
+func (r zrange) ranks(zs *zset) (int, int) {
+	return zs.Count(r.beforeMin), zs.Count(r.upToMax) - 1
+}
+
+// parseScoreRange parses a range of scores: the bounds are inclusive unless prefixed with "(",
+// -inf and +inf are the lowest and the highest scores
+func parseScoreRange(minArg, maxArg string) (zrange, error) {
+	errInvalid := fmt.Errorf("min or max is not a float")
+	parse := func(arg string) (float64, bool, error) {
+		exclusive := strings.HasPrefix(arg, "(")
+		f, err := parseFloat(strings.TrimPrefix(arg, "("))
+		if err != nil {
+			return 0, false, errInvalid
+		}
+		return f, exclusive, nil
+	}
+	lo, loExclusive, err := parse(minArg)
+	if err != nil {
+		return zrange{}, err
+	}
+	hi, hiExclusive, err := parse(maxArg)
+	if err != nil {
+		return zrange{}, err
+	}
+	return zrange{
+		beforeMin: func(score float64, _ string) bool {
+			return score < lo || loExclusive && score == lo
+		},
+		upToMax: func(score float64, _ string) bool {
+			return score < hi || !hiExclusive && score == hi
+		},
+	}, nil
+}
+
+// parseLexRange parses a lexicographical range: the bounds are prefixed with "[" if inclusive,
+// "(" if exclusive, "-" and "+" are the lowest and the highest strings.
+// Members are only ordered lexicographically if they all have the same score
+func parseLexRange(minArg, maxArg string) (zrange, error) {
+	errInvalid := fmt.Errorf("min or max not valid string range item")
+	// below tells if the member is below the bound, or equal to it if inclusive is set
+	parse := func(arg string) (func(member string, inclusive bool) bool, error) {
+		switch {
+		case arg == "-":
+			return func(string, bool) bool { return false }, nil
+		case arg == "+":
+			return func(string, bool) bool { return true }, nil
+		case strings.HasPrefix(arg, "[") || strings.HasPrefix(arg, "("):
+			value, exclusive := arg[1:], arg[0] == '('
+			return func(member string, inclusive bool) bool {
+				return member < value || member == value && (inclusive != exclusive)
+			}, nil
+		}
+		return nil, errInvalid
+	}
+	lo, err := parse(minArg)
+	if err != nil {
+		return zrange{}, err
+	}
+	hi, err := parse(maxArg)
+	if err != nil {
+		return zrange{}, err
+	}
+	return zrange{
+		beforeMin: func(_ float64, member string) bool {
+			return lo(member, false)
+		},
+		upToMax: func(_ float64, member string) bool {
+			return hi(member, true)
+		},
+	}, nil
+}
+
+// zrangeQuery is a parsed range of ZRANGE, ZRANGESTORE and the older range commands
+type zrangeQuery struct {
+	start, stop   int64   // ranks of a range by rank, negative ones count from the highest score
+	r             *zrange // range by score or lexicographically, nil for a range by rank
+	rev           bool    // ranks count from the highest score, members come from the highest score
+	offset, count int64   // LIMIT, a negative count means no limit
+	withScores    bool
+}
+
+// newZrangeQuery parses the bounds of a range "by" rank, score or lex.
+// The bounds are given in the order of the reply, the highest first if rev is set
+func newZrangeQuery(by string, rev bool, start, stop string) (*zrangeQuery, error) {
+	q := &zrangeQuery{rev: rev, count: -1}
+	if rev && by != "rank" {
+		start, stop = stop, start
+	}
+	var err error
+	var r zrange
+	switch by {
+	case "rank":
+		if q.start, err = parseInt(start); err != nil {
+			return nil, err
+		}
+		if q.stop, err = parseInt(stop); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case "score":
+		r, err = parseScoreRange(start, stop)
+	case "lex":
+		r, err = parseLexRange(start, stop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.r = &r
+	return q, nil
+}
+
+// parseZrangeQuery parses the arguments of the range commands after the key: start stop [options]
+func parseZrangeQuery(name string, args []string) (*zrangeQuery, error) {
+	by, rev := "rank", false
+	switch name {
+	case "zrevrange":
+		rev = true
+	case "zrangebyscore", "zrevrangebyscore":
+		by, rev = "score", name == "zrevrangebyscore"
+	case "zrangebylex", "zrevrangebylex":
+		by, rev = "lex", name == "zrevrangebylex"
+	}
+	unified := name == "zrange" || name == "zrangestore"
+
+	var offset, count int64 = 0, -1
+	limit, withScores := false, false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "WITHSCORES" && name != "zrangestore" && !strings.HasSuffix(name, "bylex"):
+			withScores = true
+		case opt == "LIMIT" && name != "zrevrange" && i+2 < len(args):
+			var err error
+			if offset, err = parseInt(args[i+1]); err != nil {
+				return nil, err
+			}
+			if count, err = parseInt(args[i+2]); err != nil {
+				return nil, err
+			}
+			limit = true
+			i += 2
+		case unified && opt == "BYSCORE":
+			by = "score"
+		case unified && opt == "BYLEX":
+			by = "lex"
+		case unified && opt == "REV":
+			rev = true
+		default:
+			return nil, errSyntax
+		}
+	}
+	if limit && by == "rank" {
+		return nil, fmt.Errorf("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && by == "lex" {
+		return nil, fmt.Errorf("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	q, err := newZrangeQuery(by, rev, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	q.offset, q.count, q.withScores = offset, count, withScores
+	return q, nil
+}
+
+// members returns the members of the sorted set in the range, in the order of the reply
+func (q *zrangeQuery) members(zs *zset) []zsetMember {
+	res := []zsetMember{}
+	if zs == nil {
+		return res
+	}
+	var first, last int
+	if q.r == nil {
+		first, last = listRange(q.start, q.stop, zs.Len())
+		if q.rev {
+			first, last = zs.Len()-1-last, zs.Len()-1-first
+		}
+	} else {
+		first, last = q.r.ranks(zs)
+	}
+
+	// LIMIT skips members from the beginning of the reply
+	n := int64(last - first + 1)
+	if n <= 0 || q.offset < 0 || q.offset >= n {
+		return res
+	}
+	n -= q.offset
+	if q.count >= 0 {
+		n = min(n, q.count)
+	}
+	if q.rev {
+		last -= int(q.offset)
+		first = last - int(n) + 1
+	} else {
+		first += int(q.offset)
+		last = first + int(n) - 1
+	}
+
+	zs.RangeByRank(first, last, q.rev, func(member string, score float64) bool {
+		res = append(res, zsetMember{member: member, score: score})
+		return true
+	})
+	return res
+}
+
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES],
+// ZREVRANGE key start stop [WITHSCORES],
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count], ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count],
+// ZRANGEBYLEX key min max [LIMIT offset count], ZREVRANGEBYLEX key max min [LIMIT offset count]
+func (s *Server) zrangeCommand(c *Client, args []string) error {
+	q, err := parseZrangeQuery(strings.ToLower(args[0]), args[2:])
+	if err != nil {
+		return err
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	writeZsetMembers(c, q.members(zs), q.withScores)
+	return nil
+}
+
+// ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+// The destination is replaced with the range, or deleted if the range is empty
+func (s *Server) zrangestoreCommand(c *Client, args []string) error {
+	q, err := parseZrangeQuery("zrangestore", args[3:])
+	if err != nil {
+		return err
+	}
+	src, err := s.getZset(args[2])
+	if err != nil {
+		return err
+	}
+	res := newZset(s.zsetMaxListpackEntries, s.zsetMaxListpackValue)
+	for _, m := range q.members(src) {
+		res.Set(m.member, m.score)
+	}
+	if res.Len() == 0 {
+		s.storage.Del(args[1])
+	} else {
+		s.storage.Set(args[1], res, time.Time{})
+	}
+	c.w.WriteInteger(int64(res.Len()))
+	return nil
+}
+
+// ZCOUNT key min max, ZLEXCOUNT key min max
+func (s *Server) zcountCommand(c *Client, args []string) error {
+	by := "score"
+	if strings.ToLower(args[0]) == "zlexcount" {
+		by = "lex"
+	}
+	q, err := newZrangeQuery(by, false, args[2], args[3])
+	if err != nil {
+		return err
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	if zs == nil {
+		c.w.WriteInteger(0)
+		return nil
+	}
+	first, last := q.r.ranks(zs)
+	c.w.WriteInteger(int64(max(last-first+1, 0)))
+	return nil
+}
+
+// ZRANK key member [WITHSCORE], ZREVRANK key member [WITHSCORE]
+// Replies with the rank, or an array of the rank and the score, null if there is no such member
+func (s *Server) zrankCommand(c *Client, args []string) error {
+	withScore := false
+	switch {
+	case len(args) == 4 && strings.ToUpper(args[3]) == "WITHSCORE":
+		withScore = true
+	case len(args) > 3:
+		return errSyntax
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	rank, ok := 0, false
+	if zs != nil {
+		rank, ok = zs.Rank(args[2])
+	}
+	switch {
+	case !ok && withScore:
+		c.w.WriteNullArray()
+		return nil
+	case !ok:
+		c.w.WriteNull()
+		return nil
+	}
+
+	if strings.ToLower(args[0]) == "zrevrank" {
+		rank = zs.Len() - 1 - rank
+	}
+	if withScore {
+		score, _ := zs.Score(args[2])
+		c.w.WriteArrayHeader(2)
+		c.w.WriteInteger(int64(rank))
+		c.w.WriteDouble(score)
+		return nil
+	}
+	c.w.WriteInteger(int64(rank))
+	return nil
+}
+
+// ZREMRANGEBYRANK key start stop, ZREMRANGEBYSCORE key min max, ZREMRANGEBYLEX key min max
+func (s *Server) zremrangeCommand(c *Client, args []string) error {
+	by := strings.TrimPrefix(strings.ToLower(args[0]), "zremrangeby")
+	q, err := newZrangeQuery(by, false, args[2], args[3])
+	if err != nil {
+		return err
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	members := q.members(zs)
+	for _, m := range members {
+		zs.Delete(m.member)
+	}
+	if len(members) == 0 {
+		c.rewriteCommand()
+	} else {
+		s.deleteEmptyZset(args[1], zs)
+	}
+	c.w.WriteInteger(int64(len(members)))
+	return nil
+}
+
+// popZset pops up to count members of the sorted set of the key, with the lowest scores or the highest ones if highest is set,
+// and deletes the key if the sorted set is left empty. The sorted set must not be empty
+func (s *Server) popZset(key string, zs *zset, count int64, highest bool) []zsetMember {
+	q := &zrangeQuery{start: 0, stop: min(count, int64(zs.Len())) - 1, rev: highest, count: -1}
+	members := q.members(zs)
+	for _, m := range members {
+		zs.Delete(m.member)
+	}
+	s.deleteEmptyZset(key, zs)
+	return members
+}
+
+// ZPOPMIN key [count], ZPOPMAX key [count]
+// Without count a member and its score are replied, with count an array of them
+func (s *Server) zpopCommand(c *Client, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := int64(-1)
+	if len(args) == 3 {
+		var err error
+		if count, err = parseInt(args[2]); err != nil || count < 0 {
+			return fmt.Errorf("value is out of range, must be positive")
+		}
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+	if zs == nil || count == 0 {
+		c.rewriteCommand()
+		c.w.WriteArray([]string{})
+		return nil
+	}
+
+	members := s.popZset(args[1], zs, max(count, 1), strings.ToLower(args[0]) == "zpopmax")
+	if count < 0 {
+		c.w.WriteArrayHeader(2)
+		c.w.WriteBulkString(members[0].member)
+		c.w.WriteDouble(members[0].score)
+		return nil
+	}
+	writeZsetMembers(c, members, true)
+	return nil
+}
+
+// parseZmpop parses the arguments of ZMPOP and BZMPOP from numkeys on: numkeys key [key ...] <MIN | MAX> [COUNT count].
+// Returns the keys, whether to pop the highest scores and the count, 1 if there is none
+func parseZmpop(args []string) ([]string, bool, int64, error) {
+	numKeys, err := parseInt(args[0])
+	if err != nil || numKeys < 1 {
+		return nil, false, 0, fmt.Errorf("numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, false, 0, errSyntax
+	}
+	keys := args[1 : 1+numKeys]
+	var highest bool
+	switch strings.ToUpper(args[1+numKeys]) {
+	case "MIN":
+	case "MAX":
+		highest = true
+	default:
+		return nil, false, 0, errSyntax
+	}
+	count := int64(1)
+	switch rest := args[2+numKeys:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "COUNT":
+		if count, err = parseInt(rest[1]); err != nil || count < 1 {
+			return nil, false, 0, fmt.Errorf("count should be greater than 0")
+		}
+	default:
+		return nil, false, 0, errSyntax
+	}
+	return keys, highest, count, nil
+}
+
+// zmpop pops up to count members from the first non empty sorted set of the keys, and replies with its key
+// and the members with their scores. Replicas get ZPOPMIN or ZPOPMAX. Returns false if all the sorted sets are empty
+func (s *Server) zmpop(c *Client, keys []string, highest bool, count int64) (bool, error) {
+	for _, key := range keys {
+		zs, err := s.getZset(key)
+		if err != nil {
+			return false, err
+		}
+		if zs == nil {
+			continue
+		}
+
+		members := s.popZset(key, zs, count, highest)
+		name := "ZPOPMIN"
+		if highest {
+			name = "ZPOPMAX"
+		}
+		c.rewriteCommand([]string{name, key, strconv.Itoa(len(members))})
+		// the pairs are nested with RESP2 too
+		c.w.WriteArrayHeader(2)
+		c.w.WriteBulkString(key)
+		c.w.WriteArrayHeader(len(members))
+		for _, m := range members {
+			c.w.WriteArrayHeader(2)
+			c.w.WriteBulkString(m.member)
+			c.w.WriteDouble(m.score)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// ZMPOP numkeys key [key ...] <MIN | MAX> [COUNT count]
+// Pops from the first non empty sorted set, replies with null if all of them are empty
+func (s *Server) zmpopCommand(c *Client, args []string) error {
+	keys, highest, count, err := parseZmpop(args[1:])
+	if err != nil {
+		return err
+	}
+	ok, err := s.zmpop(c, keys, highest, count)
+	if err != nil || ok {
+		return err
+	}
+	c.rewriteCommand()
+	c.w.WriteNullArray()
+	return nil
+}
+
+// BZPOPMIN key [key ...] timeout, BZPOPMAX key [key ...] timeout
+// Pops from the first non empty sorted set, or blocks until one of the sorted sets gets members.
+// Replies with the key, the member and its score. Replicas get ZPOPMIN or ZPOPMAX, never the blocking command
+func (s *Server) bzpopCommand(c *Client, args []string) error {
+	highest := strings.ToLower(args[0]) == "bzpopmax"
+	keys := args[1 : len(args)-1]
+	deadline, err := parseTimeout(args[len(args)-1], time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		zs, err := s.getZset(key)
+		if err != nil {
+			return err
+		}
+		if zs == nil {
+			continue
+		}
+
+		m := s.popZset(key, zs, 1, highest)[0]
+		if highest {
+			c.rewriteCommand([]string{"ZPOPMAX", key})
+		} else {
+			c.rewriteCommand([]string{"ZPOPMIN", key})
+		}
+		c.w.WriteArrayHeader(3)
+		c.w.WriteBulkString(key)
+		c.w.WriteBulkString(m.member)
+		c.w.WriteDouble(m.score)
+		return nil
+	}
+	return s.block(c, args, "zset", keys, deadline)
+}
+
+// BZMPOP timeout numkeys key [key ...] <MIN | MAX> [COUNT count]
+// Pops like ZMPOP, or blocks until one of the sorted sets gets members
+func (s *Server) bzmpopCommand(c *Client, args []string) error {
+	deadline, err := parseTimeout(args[1], time.Now())
+	if err != nil {
+		return err
+	}
+	keys, highest, count, err := parseZmpop(args[2:])
+	if err != nil {
+		return err
+	}
+	ok, err := s.zmpop(c, keys, highest, count)
+	if err != nil || ok {
+		return err
+	}
+	return s.block(c, args, "zset", keys, deadline)
+}
+
+// getZsetSources returns the sorted sets of the keys for the set operations, nil for missing keys.
+// Keys may hold sets too, their members score 1
+func (s *Server) getZsetSources(keys []string) ([]*zset, error) {
+	zsets := make([]*zset, len(keys))
+	for i, key := range keys {
+		e, ok := s.storage.lookup(key)
+		if !ok {
+			continue
+		}
+		switch v := e.value.(type) {
+		case *zset:
+			zsets[i] = v
+		case *set:
+			zs := newZset(s.zsetMaxListpackEntries, s.zsetMaxListpackValue)
+			v.Range(func(member string) bool {
+				zs.Set(member, 1)
+				return true
+			})
+			zsets[i] = zs
+		default:
+			return nil, ErrWrongType
+		}
+	}
+	return zsets, nil
+}
+
+// zsetAggregate combines the scores of a member found in several sorted sets by "sum", "min" or "max"
+func zsetAggregate(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "min":
+		return min(a, b)
+	case "max":
+		return max(a, b)
+	}
+	// inf + -inf is 0, like in Redis
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// zsetWeight multiplies the score by the weight, 0 * inf is 0, like in Redis
+func zsetWeight(score, weight float64) float64 {
+	if res := score * weight; !math.IsNaN(res) {
+		return res
+	}
+	return 0
+}
+
+// zsetOperation returns the intersection, the union or the difference of the sorted sets, nil ones are empty.
+// Scores are multiplied by the weights and combined by the aggregate, the difference keeps the scores of the first set.
+// The intersection stops growing at limit members, unless limit is 0
+func (s *Server) zsetOperation(op string, zsets []*zset, weights []float64, aggregate string, limit int) *zset {
+	res := newZset(s.zsetMaxListpackEntries, s.zsetMaxListpackValue)
+	switch op {
+	case "inter":
+		if slices.Contains(zsets, nil) {
+			return res
+		}
+		// members of the smallest set are looked up in the others
+		order := make([]int, len(zsets))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortFunc(order, func(a, b int) int {
+			return zsets[a].Len() - zsets[b].Len()
+		})
+		zsets[order[0]].Range(func(member string, score float64) bool {
+			score = zsetWeight(score, weights[order[0]])
+			for _, i := range order[1:] {
+				other, ok := zsets[i].Score(member)
+				if !ok {
+					return true
+				}
+				score = zsetAggregate(aggregate, score, zsetWeight(other, weights[i]))
+			}
+			res.Set(member, score)
+			return limit == 0 || res.Len() < limit
+		})
+	case "union":
+		for i, zs := range zsets {
+			if zs == nil {
+				continue
+			}
+			zs.Range(func(member string, score float64) bool {
+				score = zsetWeight(score, weights[i])
+				if old, ok := res.Score(member); ok {
+					score = zsetAggregate(aggregate, old, score)
+				}
+				res.Set(member, score)
+				return true
+			})
+		}
+	case "diff":
+		if zsets[0] == nil {
+			return res
+		}
+		zsets[0].Range(func(member string, score float64) bool {
+			for _, other := range zsets[1:] {
+				if other == nil {
+					continue
+				}
+				if _, ok := other.Score(member); ok {
+					return true
+				}
+			}
+			res.Set(member, score)
+			return true
+		})
+	}
+	return res
+}
+
+// ZUNION numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX] [WITHSCORES],
+// ZINTER numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX] [WITHSCORES],
+// ZDIFF numkeys key [key ...] [WITHSCORES],
+// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX],
+// ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX],
+// ZDIFFSTORE destination numkeys key [key ...]
+// The STORE variants replace the destination with the result, or delete it if the result is empty
+func (s *Server) zsetopCommand(c *Client, args []string) error {
+	name := strings.ToLower(args[0])
+	op := strings.TrimSuffix(strings.TrimPrefix(name, "z"), "store")
+	store := strings.HasSuffix(name, "store")
+	i := 1
+	if store {
+		i = 2
+	}
+	numKeys, err := parseInt(args[i])
+	if err != nil {
+		return err
+	}
+	if numKeys < 1 {
+		return fmt.Errorf("at least 1 input key is needed for '%s' command", name)
+	}
+	if numKeys > int64(len(args)-i-1) {
+		return errSyntax
+	}
+	keys := args[i+1 : i+1+int(numKeys)]
+
+	weights := make([]float64, len(keys))
+	for j := range weights {
+		weights[j] = 1
+	}
+	aggregate, withScores := "sum", false
+	for j := i + 1 + len(keys); j < len(args); j++ {
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "WEIGHTS" && op != "diff" && j+len(keys) < len(args):
+			for k := range weights {
+				if weights[k], err = parseFloat(args[j+1+k]); err != nil {
+					return fmt.Errorf("weight value is not a float")
+				}
+			}
+			j += len(keys)
+		case opt == "AGGREGATE" && op != "diff" && j+1 < len(args):
+			aggregate = strings.ToLower(args[j+1])
+			if aggregate != "sum" && aggregate != "min" && aggregate != "max" {
+				return errSyntax
+			}
+			j++
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		default:
+			return errSyntax
+		}
+	}
+
+	zsets, err := s.getZsetSources(keys)
+	if err != nil {
+		return err
+	}
+	res := s.zsetOperation(op, zsets, weights, aggregate, 0)
+
+	if !store {
+		q := &zrangeQuery{start: 0, stop: -1, count: -1}
+		writeZsetMembers(c, q.members(res), withScores)
+		return nil
+	}
+	if res.Len() == 0 {
+		s.storage.Del(args[1])
+	} else {
+		s.storage.Set(args[1], res, time.Time{})
+	}
+	c.w.WriteInteger(int64(res.Len()))
+	return nil
+}
+
+// ZINTERCARD numkeys key [key ...] [LIMIT limit]
+func (s *Server) zintercardCommand(c *Client, args []string) error {
+	keys, limit, err := parseIntercard(args)
+	if err != nil {
+		return err
+	}
+	zsets, err := s.getZsetSources(keys)
+	if err != nil {
+		return err
+	}
+	// only the members are counted, the scores don't matter
+	weights := make([]float64, len(keys))
+	c.w.WriteInteger(int64(s.zsetOperation("inter", zsets, weights, "sum", limit).Len()))
+	return nil
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+// Members are replied with their scores, as member score pairs
+func (s *Server) zscanCommand(c *Client, args []string) error {
+	cursor, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern, count, _, err := parseScanOptions(args[3:], false)
+	if err != nil {
+		return err
+	}
+	zs, err := s.getZset(args[1])
+	if err != nil {
+		return err
+	}
+
+	pairs := []string{}
+	if zs != nil {
+		cursor = zs.Scan(cursor, count, func(member string, score float64) {
+			if pattern == "*" || globMatch(pattern, member, false) {
+				pairs = append(pairs, member, resp.FormatDouble(score))
+			}
+		})
+	} else {
+		cursor = 0
+	}
+
+	c.w.WriteArrayHeader(2)
+	c.w.WriteBulkString(strconv.FormatUint(cursor, 10))
+	c.w.WriteArray(pairs)
+	return nil
+}
@@ -0,0 +1,314 @@
+// Package client is a Go client for byo-redis: a pool of connections,
+// typed command methods, pipelining and context based timeouts.
+// It speaks the protocol through the same resp package the server uses
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+// Nil is returned by typed commands when the server replies with null, e.g. GET of a missing key
+var Nil = errors.New("nil reply")
+
+// ErrClosed is returned by commands of a closed client
+var ErrClosed = errors.New("client is closed")
+
+// Error is an error reply of the server, like "ERR unknown command" or "WRONGTYPE ..."
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Options of the client, zero values are replaced with defaults
+type Options struct {
+	Addr        string        // host:port of the server, "127.0.0.1:6379" by default
+	PoolSize    int           // max number of open connections, 10 by default
+	DialTimeout time.Duration // 5s by default
+	MaxRetries  int           // retries of commands failed with a network error before being sent, 1 by default, -1 disables retries
+	Protocol    int           // resp.RESP2 or resp.RESP3, negotiated with HELLO on connect, RESP2 by default
+	ClientName  string        // set with HELLO SETNAME on connect
+}
+
+// Client is a pool of connections to a server, safe for concurrent use
+type Client struct {
+	opts   Options
+	idle   chan *conn    // connections ready to be used
+	tokens chan struct{} // a token per connection allowed to be open
+	mx     sync.Mutex
+	closed bool
+}
+
+// conn is a single connection to the server
+type conn struct {
+	nc   net.Conn
+	r    *resp.Reader
+	w    *resp.Writer
+	sent int64 // bytes written so far, commands of a failed round trip may have reached the server if it grew
+}
+
+// Write writes to the connection, counting the bytes sent
+func (cn *conn) Write(p []byte) (int, error) {
+	n, err := cn.nc.Write(p)
+	cn.sent += int64(n)
+	return n, err
+}
+
+// New makes a client, connections are opened lazily when commands are sent
+func New(opts Options) *Client {
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:6379"
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 1
+	}
+	if opts.Protocol == 0 {
+		opts.Protocol = resp.RESP2
+	}
+
+	c := &Client{
+		opts:   opts,
+		idle:   make(chan *conn, opts.PoolSize),
+		tokens: make(chan struct{}, opts.PoolSize),
+	}
+	for range opts.PoolSize {
+		c.tokens <- struct{}{}
+	}
+	return c
+}
+
+// Close closes all the idle connections, connections in use are closed when released
+func (c *Client) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.nc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get takes an idle connection or opens a new one, waiting for a free slot if the pool is full.
+// Idle connections closed by the server meanwhile are replaced
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mx.Lock()
+	closed := c.closed
+	c.mx.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	for {
+		cn, err := c.take(ctx)
+		if err != nil || connCheck(cn.nc) == nil {
+			return cn, err
+		}
+		c.put(cn, true)
+	}
+}
+
+// take takes an idle connection or opens a new one, waiting for a free slot if the pool is full
+func (c *Client) take(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case <-c.tokens:
+		cn, err := c.dial(ctx)
+		if err != nil {
+			c.tokens <- struct{}{}
+			return nil, ctxErr(ctx, err)
+		}
+		return cn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns the connection to the pool, broken connections are closed
+func (c *Client) put(cn *conn, broken bool) {
+	// Close must not miss a connection put back meanwhile. The send doesn't block,
+	// there are never more connections than the idle slots
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if broken || c.closed {
+		cn.nc.Close()
+		c.tokens <- struct{}{}
+		return
+	}
+	c.idle <- cn
+}
+
+// dial opens a new connection and negotiates the protocol
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, r: resp.NewReader(nc)}
+	cn.w = resp.NewWriter(cn)
+
+	if c.opts.Protocol == resp.RESP2 && c.opts.ClientName == "" {
+		return cn, nil
+	}
+	hello := []string{"HELLO", strconv.Itoa(c.opts.Protocol)}
+	if c.opts.ClientName != "" {
+		hello = append(hello, "SETNAME", c.opts.ClientName)
+	}
+	replies, err := cn.roundTrip(ctx, [][]string{hello})
+	if err == nil && replies[0].IsError() {
+		err = Error(replies[0].Str)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("can't negotiate protocol: %w", err)
+	}
+	return cn, nil
+}
+
+// roundTrip sends the commands at once and reads a reply for each of them.
+// The context deadline and cancellation are applied to the connection
+func (cn *conn) roundTrip(ctx context.Context, cmds [][]string) ([]resp.Value, error) {
+	deadline, _ := ctx.Deadline()
+	cn.nc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// unblock reads and writes right away
+		cn.nc.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	for _, args := range cmds {
+		cn.w.WriteArray(args)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	replies := make([]resp.Value, 0, len(cmds))
+	for range cmds {
+		v, err := cn.r.ReadValue()
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		replies = append(replies, v)
+	}
+	return replies, nil
+}
+
+// ctxErr prefers the context error over the network error it caused.
+// The connection deadline may fire a moment before the context is done
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// exec sends the commands over a pooled connection. Errors break the connection, and network errors
+// before anything was sent are retried over a new one up to MaxRetries times. Commands that may
+// have reached the server are never sent again, they could be executed twice
+func (c *Client) exec(ctx context.Context, cmds [][]string) ([]resp.Value, error) {
+	var err error
+	for attempt := 0; attempt <= max(c.opts.MaxRetries, 0); attempt++ {
+		var cn *conn
+		if cn, err = c.get(ctx); err != nil {
+			return nil, err
+		}
+		var replies []resp.Value
+		sent := cn.sent
+		replies, err = cn.roundTrip(ctx, cmds)
+		c.put(cn, err != nil)
+		if err == nil {
+			return replies, nil
+		}
+		if cn.sent != sent || ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || !isNetworkError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// isNetworkError tells if the error is a failure of the connection, not of the protocol
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Do sends a command and returns its reply, error replies are returned as Error
+func (c *Client) Do(ctx context.Context, args ...string) (resp.Value, error) {
+	replies, err := c.exec(ctx, [][]string{args})
+	if err != nil {
+		return resp.Value{}, err
+	}
+	if replies[0].IsError() {
+		return replies[0], Error(replies[0].Str)
+	}
+	return replies[0], nil
+}
+
+// Pipeline queues commands to be sent at once with a single round trip
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+}
+
+// Pipeline makes an empty pipeline
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues a command
+func (p *Pipeline) Do(args ...string) *Pipeline {
+	p.cmds = append(p.cmds, args)
+	return p
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns their replies in the same order,
+// error replies are returned as values, the error is only set when the pipeline
+// itself failed. The pipeline is empty after that and can be reused
+func (p *Pipeline) Exec(ctx context.Context) ([]resp.Value, error) {
+	if len(p.cmds) == 0 {
+		return nil, nil
+	}
+	cmds := p.cmds
+	p.cmds = nil
+	return p.c.exec(ctx, cmds)
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer speaks RESP with the resp package and keeps the keys in a map
+type fakeServer struct {
+	ln       net.Listener
+	mx       sync.Mutex
+	data     map[string]string
+	conns    map[net.Conn]struct{}
+	maxOpen  int // max number of connections open at once
+	accepted atomic.Int64
+	executed atomic.Int64      // number of DROP and GARBAGE commands received
+	replies  map[string]string // raw replies of commands, by command name
+	last     []string          // the last command received
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	fs := &fakeServer{ln: ln, data: map[string]string{}, conns: map[net.Conn]struct{}{}, replies: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return fs
+}
+
+// dropAll closes all the open connections
+func (fs *fakeServer) dropAll() {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	for conn := range fs.conns {
+		conn.Close()
+	}
+}
+
+// reply makes the server answer the command with the raw RESP reply
+func (fs *fakeServer) reply(cmd, raw string) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	fs.replies[cmd] = raw
+}
+
+// lastCommand returns the last command received
+func (fs *fakeServer) lastCommand() []string {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	return fs.last
+}
+
+func (fs *fakeServer) serve(conn net.Conn) {
+	fs.accepted.Add(1)
+	fs.mx.Lock()
+	fs.conns[conn] = struct{}{}
+	fs.maxOpen = max(fs.maxOpen, len(fs.conns))
+	fs.mx.Unlock()
+	defer func() {
+		fs.mx.Lock()
+		delete(fs.conns, conn)
+		fs.mx.Unlock()
+		conn.Close()
+	}()
+
+	r, w := resp.NewReader(conn), resp.NewWriter(conn)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			return
+		}
+		fs.mx.Lock()
+		fs.last = args
+		raw, ok := fs.replies[strings.ToUpper(args[0])]
+		fs.mx.Unlock()
+		if ok {
+			w.Flush()
+			conn.Write([]byte(raw))
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			w.WriteSimpleString("PONG")
+		case "ECHO":
+			w.WriteBulkString(args[1])
+		case "HELLO":
+			proto, _ := strconv.Atoi(args[1])
+			w.SetProto(proto)
+			w.WriteMapHeader(1)
+			w.WriteBulkString("proto")
+			w.WriteInteger(int64(proto))
+		case "SET":
+			fs.mx.Lock()
+			fs.data[args[1]] = args[2]
+			fs.mx.Unlock()
+			w.WriteSimpleString("OK")
+		case "GET":
+			fs.mx.Lock()
+			v, ok := fs.data[args[1]]
+			fs.mx.Unlock()
+			if !ok {
+				w.WriteNull()
+				break
+			}
+			w.WriteBulkString(v)
+		case "DROP":
+			// the command is executed, but the connection is lost before the reply
+			fs.executed.Add(1)
+			return
+		case "GARBAGE":
+			fs.executed.Add(1)
+			w.WriteSimpleString("OK")
+			w.Flush()
+			conn.Write([]byte("?\r\n"))
+			continue
+		case "SLEEP":
+			ms, _ := strconv.Atoi(args[1])
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			w.WriteSimpleString("OK")
+		default:
+			w.WriteError("ERR unknown command '" + args[0] + "'")
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	pong, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	echo, err := c.Echo(ctx, "a\r\nb")
+	assert.Nil(t, err)
+	assert.Equal(t, "a\r\nb", echo)
+
+	assert.Nil(t, c.Set(ctx, "k", "v", time.Second))
+	v, err := c.Get(ctx, "k")
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
+
+	_, err = c.Get(ctx, "missing")
+	assert.Equal(t, Nil, err)
+
+	_, err = c.Do(ctx, "NOPE")
+	assert.Equal(t, Error("ERR unknown command 'NOPE'"), err)
+
+	// the connection is reused
+	assert.Equal(t, int64(1), fs.accepted.Load())
+
+	assert.Nil(t, c.Close())
+	_, err = c.Ping(ctx)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestClientResp3(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), Protocol: resp.RESP3})
+	defer c.Close()
+
+	v, err := c.Do(context.Background(), "GET", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, byte(resp.TypeNull), v.Type)
+	_, err = String(v)
+	assert.Equal(t, Nil, err)
+}
+
+func TestPipeline(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+
+	p := c.Pipeline()
+	for i := range 100 {
+		p.Do("SET", "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	p.Do("NOPE")
+	for i := range 100 {
+		p.Do("GET", "k"+strconv.Itoa(i))
+	}
+	assert.Equal(t, 201, p.Len())
+
+	replies, err := p.Exec(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 201, len(replies))
+	assert.Equal(t, "OK", replies[0].Str)
+	assert.True(t, replies[100].IsError())
+	for i := range 100 {
+		assert.Equal(t, strconv.Itoa(i), replies[101+i].Str)
+	}
+	assert.Equal(t, 0, p.Len())
+}
+
+func TestPool(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), PoolSize: 3})
+	defer c.Close()
+
+	wg := sync.WaitGroup{}
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echo, err := c.Echo(context.Background(), strconv.Itoa(i))
+			assert.Nil(t, err)
+			assert.Equal(t, strconv.Itoa(i), echo)
+			_, err = c.Do(context.Background(), "SLEEP", "10")
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	assert.LessOrEqual(t, fs.maxOpen, 3)
+}
+
+func TestCloseConcurrently(t *testing.T) {
+	fs := newFakeServer(t)
+
+	for range 100 {
+		c := New(Options{Addr: fs.ln.Addr().String(), PoolSize: 3})
+		wg := sync.WaitGroup{}
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					_, err := c.Ping(context.Background())
+					if err == ErrClosed {
+						return
+					}
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		assert.Nil(t, c.Close())
+		wg.Wait()
+		// connections released during Close are closed too, none is left idle
+		assert.Equal(t, 0, len(c.idle))
+	}
+
+	assert.Eventually(t, func() bool {
+		fs.mx.Lock()
+		defer fs.mx.Unlock()
+		return len(fs.conns) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTimeout(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), PoolSize: 1})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Do(ctx, "SLEEP", "1000")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// cancellation without a deadline
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.Do(ctx, "SLEEP", "1000")
+	assert.Equal(t, context.Canceled, err)
+
+	// the broken connection is replaced
+	pong, err := c.Ping(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+}
+
+func TestReconnect(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	fs.dropAll()
+
+	pong, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+	assert.Equal(t, int64(2), fs.accepted.Load())
+
+	// idle connections closed by the server are replaced before sending anything, no retry is needed
+	noRetry := New(Options{Addr: fs.ln.Addr().String(), MaxRetries: -1})
+	defer noRetry.Close()
+	_, err = noRetry.Ping(ctx)
+	assert.Nil(t, err)
+	fs.dropAll()
+	time.Sleep(10 * time.Millisecond)
+	pong, err = noRetry.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+
+	// the server is gone
+	fs.ln.Close()
+	fs.dropAll()
+	_, err = c.Ping(ctx)
+	assert.Error(t, err)
+}
+
+// Commands that may have reached the server are not sent again, they could be executed twice
+func TestNoRetryAfterSend(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), MaxRetries: 3})
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Do(ctx, "DROP")
+	assert.Error(t, err)
+	var serverErr Error
+	assert.False(t, errors.As(err, &serverErr))
+	assert.Equal(t, int64(1), fs.executed.Load())
+
+	_, err = c.Pipeline().Do("SET", "k", "v").Do("DROP").Exec(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), fs.executed.Load())
+
+	// a broken reply is not a network failure, it is not retried either
+	_, err = c.Pipeline().Do("GARBAGE").Do("PING").Exec(ctx)
+	assert.Equal(t, resp.ProtocolError("unknown type '?'"), err)
+	assert.Equal(t, int64(3), fs.executed.Load())
+
+	pong, err := c.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", pong)
+}
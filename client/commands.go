@@ -0,0 +1,1163 @@
+package client
+
+// Typed methods of the commands supported by the server, and conversions of replies
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+// Ping checks the connection, returns "PONG"
+func (c *Client) Ping(ctx context.Context) (string, error) {
+	return c.str(ctx, "PING")
+}
+
+// Echo returns the message back
+func (c *Client) Echo(ctx context.Context, message string) (string, error) {
+	return c.str(ctx, "ECHO", message)
+}
+
+// Set sets the key to the value, the key expires after ttl if it is not zero
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.str(ctx, args...)
+	return err
+}
+
+// SetArgs are the options of SET, the zero value sets the key unconditionally without expiration
+type SetArgs struct {
+	Mode     string        // "NX" to set only a missing key, "XX" to set only an existing one
+	TTL      time.Duration // relative expiration, in milliseconds
+	ExpireAt time.Time     // absolute expiration, in milliseconds
+	KeepTTL  bool          // keep the expiration of the existing key
+	Get      bool          // return the old value
+}
+
+// SetWithArgs sets the key with the options of SET. It returns "OK", or the old value if Get is set.
+// Nil is returned if the key was not set because of Mode, or if there was no old value to return
+func (c *Client) SetWithArgs(ctx context.Context, key, value string, a SetArgs) (string, error) {
+	args := []string{"SET", key, value}
+	if a.Mode != "" {
+		args = append(args, a.Mode)
+	}
+	if a.Get {
+		args = append(args, "GET")
+	}
+	switch {
+	case a.TTL > 0:
+		args = append(args, "PX", strconv.FormatInt(a.TTL.Milliseconds(), 10))
+	case !a.ExpireAt.IsZero():
+		args = append(args, "PXAT", strconv.FormatInt(a.ExpireAt.UnixMilli(), 10))
+	case a.KeepTTL:
+		args = append(args, "KEEPTTL")
+	}
+	return c.str(ctx, args...)
+}
+
+// Get returns the value of the key, Nil if the key doesn't exist
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "GET", key)
+}
+
+// MGet returns the values of the keys, nil for missing keys and keys of other types
+func (c *Client) MGet(ctx context.Context, keys ...string) ([]*string, error) {
+	return c.strPtrs(ctx, append([]string{"MGET"}, keys...)...)
+}
+
+// MSet sets the keys to the values, given as key value pairs
+func (c *Client) MSet(ctx context.Context, pairs ...string) error {
+	_, err := c.str(ctx, append([]string{"MSET"}, pairs...)...)
+	return err
+}
+
+// MSetNX sets the keys to the values only if none of the keys exists, returns false if nothing was set
+func (c *Client) MSetNX(ctx context.Context, pairs ...string) (bool, error) {
+	return c.bool(ctx, append([]string{"MSETNX"}, pairs...)...)
+}
+
+// GetDel returns the value of the key and deletes the key, Nil if the key doesn't exist
+func (c *Client) GetDel(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "GETDEL", key)
+}
+
+// GetEx returns the value of the key and sets its time to live, zero ttl removes the deadline.
+// Nil if the key doesn't exist
+func (c *Client) GetEx(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if ttl == 0 {
+		return c.str(ctx, "GETEX", key, "PERSIST")
+	}
+	return c.str(ctx, "GETEX", key, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+// GetSet sets the key to the value and returns the old value, Nil if there was none
+func (c *Client) GetSet(ctx context.Context, key, value string) (string, error) {
+	return c.str(ctx, "GETSET", key, value)
+}
+
+// Incr increments the integer value of the key by one, returns the new value
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "INCR", key)
+}
+
+// Decr decrements the integer value of the key by one, returns the new value
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "DECR", key)
+}
+
+// IncrBy increments the integer value of the key, returns the new value
+func (c *Client) IncrBy(ctx context.Context, key string, incr int64) (int64, error) {
+	return c.int(ctx, "INCRBY", key, strconv.FormatInt(incr, 10))
+}
+
+// DecrBy decrements the integer value of the key, returns the new value
+func (c *Client) DecrBy(ctx context.Context, key string, decr int64) (int64, error) {
+	return c.int(ctx, "DECRBY", key, strconv.FormatInt(decr, 10))
+}
+
+// IncrByFloat increments the floating point value of the key, returns the new value
+func (c *Client) IncrByFloat(ctx context.Context, key string, incr float64) (float64, error) {
+	s, err := c.str(ctx, "INCRBYFLOAT", key, strconv.FormatFloat(incr, 'f', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Append appends the value to the string value of the key, returns the new length
+func (c *Client) Append(ctx context.Context, key, value string) (int64, error) {
+	return c.int(ctx, "APPEND", key, value)
+}
+
+// StrLen returns the length of the string value of the key, 0 if the key doesn't exist
+func (c *Client) StrLen(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "STRLEN", key)
+}
+
+// GetRange returns the substring between the offsets, both included, negative offsets count from the end
+func (c *Client) GetRange(ctx context.Context, key string, start, end int64) (string, error) {
+	return c.str(ctx, "GETRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(end, 10))
+}
+
+// SetRange overwrites the string value of the key from the offset, returns the new length
+func (c *Client) SetRange(ctx context.Context, key string, offset int64, value string) (int64, error) {
+	return c.int(ctx, "SETRANGE", key, strconv.FormatInt(offset, 10), value)
+}
+
+// SetBit sets the bit at the offset of the string value of the key, returns the old bit
+func (c *Client) SetBit(ctx context.Context, key string, offset int64, bit int) (int64, error) {
+	return c.int(ctx, "SETBIT", key, strconv.FormatInt(offset, 10), strconv.Itoa(bit))
+}
+
+// GetBit returns the bit at the offset of the string value of the key
+func (c *Client) GetBit(ctx context.Context, key string, offset int64) (int64, error) {
+	return c.int(ctx, "GETBIT", key, strconv.FormatInt(offset, 10))
+}
+
+// BitCount returns the number of set bits of the string value of the key
+func (c *Client) BitCount(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "BITCOUNT", key)
+}
+
+// BitCountRange returns the number of set bits between the offsets, both included,
+// counted in bytes, or in bits if unit is "BIT"
+func (c *Client) BitCountRange(ctx context.Context, key string, start, end int64, unit string) (int64, error) {
+	args := []string{"BITCOUNT", key, strconv.FormatInt(start, 10), strconv.FormatInt(end, 10)}
+	if unit != "" {
+		args = append(args, unit)
+	}
+	return c.int(ctx, args...)
+}
+
+// BitPos returns the position of the first bit set to the given bit, optionally from the start byte
+// and up to the end byte, -1 if there is none
+func (c *Client) BitPos(ctx context.Context, key string, bit int, startEnd ...int64) (int64, error) {
+	args := []string{"BITPOS", key, strconv.Itoa(bit)}
+	for _, n := range startEnd {
+		args = append(args, strconv.FormatInt(n, 10))
+	}
+	return c.int(ctx, args...)
+}
+
+// BitOp stores the result of the bitwise operation AND, OR, XOR or NOT of the keys in dest,
+// returns the length of the result
+func (c *Client) BitOp(ctx context.Context, op, dest string, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"BITOP", op, dest}, keys...)...)
+}
+
+// BitField runs the subcommands of BITFIELD, like "INCRBY", "u8", "0", "1", returns their results,
+// nil for the operations failed because of the FAIL overflow mode
+func (c *Client) BitField(ctx context.Context, key string, args ...string) ([]*int64, error) {
+	v, err := c.Do(ctx, append([]string{"BITFIELD", key}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsError() {
+		return nil, Error(v.Str)
+	}
+	res := make([]*int64, len(v.Elems))
+	for i, e := range v.Elems {
+		n, err := Int(e)
+		if err == Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[i] = &n
+	}
+	return res, nil
+}
+
+// LPush prepends the values to the list, returns the new length
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.int(ctx, append([]string{"LPUSH", key}, values...)...)
+}
+
+// RPush appends the values to the list, returns the new length
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.int(ctx, append([]string{"RPUSH", key}, values...)...)
+}
+
+// LPop removes and returns the first element of the list, Nil if the list doesn't exist
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "LPOP", key)
+}
+
+// RPop removes and returns the last element of the list, Nil if the list doesn't exist
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "RPOP", key)
+}
+
+// LPopCount removes and returns up to count first elements of the list, Nil if the list doesn't exist
+func (c *Client) LPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	return c.strs(ctx, "LPOP", key, strconv.Itoa(count))
+}
+
+// RPopCount removes and returns up to count last elements of the list, Nil if the list doesn't exist
+func (c *Client) RPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	return c.strs(ctx, "RPOP", key, strconv.Itoa(count))
+}
+
+// LLen returns the length of the list, 0 if it doesn't exist
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "LLEN", key)
+}
+
+// LRange returns the elements between the indexes, both included, negative indexes count from the tail
+func (c *Client) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.strs(ctx, "LRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+// LIndex returns the element at the index, Nil if the index is out of range
+func (c *Client) LIndex(ctx context.Context, key string, index int64) (string, error) {
+	return c.str(ctx, "LINDEX", key, strconv.FormatInt(index, 10))
+}
+
+// LSet replaces the element at the index
+func (c *Client) LSet(ctx context.Context, key string, index int64, value string) error {
+	_, err := c.str(ctx, "LSET", key, strconv.FormatInt(index, 10), value)
+	return err
+}
+
+// LRem removes count elements equal to the value, from the tail if count is negative, all of them if it is 0.
+// Returns the number of elements removed
+func (c *Client) LRem(ctx context.Context, key string, count int64, value string) (int64, error) {
+	return c.int(ctx, "LREM", key, strconv.FormatInt(count, 10), value)
+}
+
+// LTrim keeps only the elements between the indexes, both included
+func (c *Client) LTrim(ctx context.Context, key string, start, stop int64) error {
+	_, err := c.str(ctx, "LTRIM", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+	return err
+}
+
+// LInsert inserts the value "BEFORE" or "AFTER" the pivot, returns the new length,
+// -1 if the pivot is not found, 0 if the list doesn't exist
+func (c *Client) LInsert(ctx context.Context, key, where, pivot, value string) (int64, error) {
+	return c.int(ctx, "LINSERT", key, where, pivot, value)
+}
+
+// LMove pops an element from the "LEFT" or "RIGHT" of the source list and pushes it
+// to the "LEFT" or "RIGHT" of the destination list. Returns the element, Nil if the source doesn't exist
+func (c *Client) LMove(ctx context.Context, src, dst, from, to string) (string, error) {
+	return c.str(ctx, "LMOVE", src, dst, from, to)
+}
+
+// BLPop pops the first element of the first non empty list, waiting up to timeout for one, zero waits forever.
+// Returns the key and the element, Nil if the timeout passed. The ctx deadline must allow for the timeout
+func (c *Client) BLPop(ctx context.Context, timeout time.Duration, keys ...string) ([]string, error) {
+	return c.strs(ctx, append(append([]string{"BLPOP"}, keys...), seconds(timeout))...)
+}
+
+// BRPop pops the last element of the first non empty list like BLPop
+func (c *Client) BRPop(ctx context.Context, timeout time.Duration, keys ...string) ([]string, error) {
+	return c.strs(ctx, append(append([]string{"BRPOP"}, keys...), seconds(timeout))...)
+}
+
+// BLMove moves an element like LMove, waiting up to timeout for the source list, zero waits forever.
+// Nil is returned if the timeout passed
+func (c *Client) BLMove(ctx context.Context, src, dst, from, to string, timeout time.Duration) (string, error) {
+	return c.str(ctx, "BLMOVE", src, dst, from, to, seconds(timeout))
+}
+
+// seconds formats the duration in seconds, the timeout unit of the blocking commands
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// HSet sets the fields of the hash to the values, given as field value pairs. Returns the number of new fields
+func (c *Client) HSet(ctx context.Context, key string, fieldValues ...string) (int64, error) {
+	return c.int(ctx, append([]string{"HSET", key}, fieldValues...)...)
+}
+
+// HSetNX sets the field of the hash only if it doesn't exist, returns false if it exists
+func (c *Client) HSetNX(ctx context.Context, key, field, value string) (bool, error) {
+	return c.bool(ctx, "HSETNX", key, field, value)
+}
+
+// HGet returns the value of the field of the hash, Nil if there is no such field
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	return c.str(ctx, "HGET", key, field)
+}
+
+// HMGet returns the values of the fields of the hash, nil for missing fields
+func (c *Client) HMGet(ctx context.Context, key string, fields ...string) ([]*string, error) {
+	return c.strPtrs(ctx, append([]string{"HMGET", key}, fields...)...)
+}
+
+// HDel deletes the fields of the hash, returns the number of fields deleted
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	return c.int(ctx, append([]string{"HDEL", key}, fields...)...)
+}
+
+// HLen returns the number of fields of the hash
+func (c *Client) HLen(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "HLEN", key)
+}
+
+// HStrLen returns the length of the value of the field of the hash, 0 if there is no such field
+func (c *Client) HStrLen(ctx context.Context, key, field string) (int64, error) {
+	return c.int(ctx, "HSTRLEN", key, field)
+}
+
+// HExists tells if the field of the hash exists
+func (c *Client) HExists(ctx context.Context, key, field string) (bool, error) {
+	return c.bool(ctx, "HEXISTS", key, field)
+}
+
+// HKeys returns the fields of the hash
+func (c *Client) HKeys(ctx context.Context, key string) ([]string, error) {
+	return c.strs(ctx, "HKEYS", key)
+}
+
+// HVals returns the values of the hash
+func (c *Client) HVals(ctx context.Context, key string) ([]string, error) {
+	return c.strs(ctx, "HVALS", key)
+}
+
+// HGetAll returns the fields of the hash with their values
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	pairs, err := c.strs(ctx, "HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		res[pairs[i]] = pairs[i+1]
+	}
+	return res, nil
+}
+
+// HIncrBy increments the integer value of the field of the hash, returns the new value
+func (c *Client) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	return c.int(ctx, "HINCRBY", key, field, strconv.FormatInt(incr, 10))
+}
+
+// HIncrByFloat increments the floating point value of the field of the hash, returns the new value
+func (c *Client) HIncrByFloat(ctx context.Context, key, field string, incr float64) (float64, error) {
+	s, err := c.str(ctx, "HINCRBYFLOAT", key, field, strconv.FormatFloat(incr, 'f', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// HScan returns some fields with their values, as field value pairs, starting from the cursor,
+// and the cursor to continue from, 0 when the scan is complete. The Type of the options is not used
+func (c *Client) HScan(ctx context.Context, key string, cursor uint64, a ScanArgs) ([]string, uint64, error) {
+	args := []string{"HSCAN", key, strconv.FormatUint(cursor, 10)}
+	if a.Match != "" {
+		args = append(args, "MATCH", a.Match)
+	}
+	if a.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(a.Count))
+	}
+	return c.scan(ctx, args...)
+}
+
+// HRandField returns random fields of the hash: up to count distinct ones,
+// or exactly -count ones, possibly repeated, if count is negative
+func (c *Client) HRandField(ctx context.Context, key string, count int) ([]string, error) {
+	return c.strs(ctx, "HRANDFIELD", key, strconv.Itoa(count))
+}
+
+// HExpire sets the time to live of the fields of the hash. Returns for each field -2 if there is no such field,
+// 0 if the condition is not met, 1 if the deadline is set, 2 if the field is deleted right away.
+// The condition is "NX", "XX", "GT", "LT" or empty
+func (c *Client) HExpire(ctx context.Context, key string, ttl time.Duration, condition string, fields ...string) ([]int64, error) {
+	return c.hexpire(ctx, "HPEXPIRE", key, ttl.Milliseconds(), condition, fields)
+}
+
+// HExpireAt sets the deadline of the fields of the hash, replies like HExpire
+func (c *Client) HExpireAt(ctx context.Context, key string, at time.Time, condition string, fields ...string) ([]int64, error) {
+	return c.hexpire(ctx, "HPEXPIREAT", key, at.UnixMilli(), condition, fields)
+}
+
+// hexpire sends HPEXPIRE or HPEXPIREAT with the deadline in milliseconds
+func (c *Client) hexpire(ctx context.Context, cmd, key string, ms int64, condition string, fields []string) ([]int64, error) {
+	args := []string{cmd, key, strconv.FormatInt(ms, 10)}
+	if condition != "" {
+		args = append(args, condition)
+	}
+	args = append(args, "FIELDS", strconv.Itoa(len(fields)))
+	return c.ints(ctx, append(args, fields...)...)
+}
+
+// HTTL returns the time to live of the fields of the hash in milliseconds, -1 for fields without deadlines,
+// -2 for missing fields
+func (c *Client) HTTL(ctx context.Context, key string, fields ...string) ([]time.Duration, error) {
+	ms, err := c.ints(ctx, append([]string{"HPTTL", key, "FIELDS", strconv.Itoa(len(fields))}, fields...)...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]time.Duration, len(ms))
+	for i, n := range ms {
+		res[i] = time.Duration(n)
+		if n >= 0 {
+			res[i] *= time.Millisecond
+		}
+	}
+	return res, nil
+}
+
+// HPersist removes the deadlines of the fields of the hash. Returns for each field -2 if there is no such field,
+// -1 if it has no deadline, 1 if the deadline is removed
+func (c *Client) HPersist(ctx context.Context, key string, fields ...string) ([]int64, error) {
+	return c.ints(ctx, append([]string{"HPERSIST", key, "FIELDS", strconv.Itoa(len(fields))}, fields...)...)
+}
+
+// SAdd adds the members to the set, returns the number of new members
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.int(ctx, append([]string{"SADD", key}, members...)...)
+}
+
+// SRem removes the members from the set, returns the number of members removed
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.int(ctx, append([]string{"SREM", key}, members...)...)
+}
+
+// SMembers returns the members of the set
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return c.strs(ctx, "SMEMBERS", key)
+}
+
+// SIsMember tells if the value is a member of the set
+func (c *Client) SIsMember(ctx context.Context, key, member string) (bool, error) {
+	return c.bool(ctx, "SISMEMBER", key, member)
+}
+
+// SMIsMember tells for each value if it is a member of the set
+func (c *Client) SMIsMember(ctx context.Context, key string, members ...string) ([]bool, error) {
+	ns, err := c.ints(ctx, append([]string{"SMISMEMBER", key}, members...)...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]bool, len(ns))
+	for i, n := range ns {
+		res[i] = n == 1
+	}
+	return res, nil
+}
+
+// SCard returns the number of members of the set
+func (c *Client) SCard(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "SCARD", key)
+}
+
+// SPop removes and returns a random member of the set, Nil if the set doesn't exist
+func (c *Client) SPop(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "SPOP", key)
+}
+
+// SPopCount removes and returns up to count random members of the set
+func (c *Client) SPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	return c.strs(ctx, "SPOP", key, strconv.Itoa(count))
+}
+
+// SRandMember returns a random member of the set, Nil if the set doesn't exist
+func (c *Client) SRandMember(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "SRANDMEMBER", key)
+}
+
+// SRandMemberCount returns random members of the set: up to count distinct ones,
+// or exactly -count ones, possibly repeated, if count is negative
+func (c *Client) SRandMemberCount(ctx context.Context, key string, count int) ([]string, error) {
+	return c.strs(ctx, "SRANDMEMBER", key, strconv.Itoa(count))
+}
+
+// SMove moves the member from the source set to the destination set, returns false if it is not a member
+func (c *Client) SMove(ctx context.Context, src, dst, member string) (bool, error) {
+	return c.bool(ctx, "SMOVE", src, dst, member)
+}
+
+// SInter returns the intersection of the sets
+func (c *Client) SInter(ctx context.Context, keys ...string) ([]string, error) {
+	return c.strs(ctx, append([]string{"SINTER"}, keys...)...)
+}
+
+// SInterCard returns the size of the intersection of the sets, counting up to limit members unless it is 0
+func (c *Client) SInterCard(ctx context.Context, limit int, keys ...string) (int64, error) {
+	args := append([]string{"SINTERCARD", strconv.Itoa(len(keys))}, keys...)
+	if limit > 0 {
+		args = append(args, "LIMIT", strconv.Itoa(limit))
+	}
+	return c.int(ctx, args...)
+}
+
+// SUnion returns the union of the sets
+func (c *Client) SUnion(ctx context.Context, keys ...string) ([]string, error) {
+	return c.strs(ctx, append([]string{"SUNION"}, keys...)...)
+}
+
+// SDiff returns the members of the first set that are not in the others
+func (c *Client) SDiff(ctx context.Context, keys ...string) ([]string, error) {
+	return c.strs(ctx, append([]string{"SDIFF"}, keys...)...)
+}
+
+// SInterStore stores the intersection of the sets in the destination, returns its size
+func (c *Client) SInterStore(ctx context.Context, dst string, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"SINTERSTORE", dst}, keys...)...)
+}
+
+// SUnionStore stores the union of the sets in the destination, returns its size
+func (c *Client) SUnionStore(ctx context.Context, dst string, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"SUNIONSTORE", dst}, keys...)...)
+}
+
+// SDiffStore stores the difference of the sets in the destination, returns its size
+func (c *Client) SDiffStore(ctx context.Context, dst string, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"SDIFFSTORE", dst}, keys...)...)
+}
+
+// SScan returns some members of the set starting from the cursor, and the cursor to continue from,
+// 0 when the scan is complete. The Type of the options is not used
+func (c *Client) SScan(ctx context.Context, key string, cursor uint64, a ScanArgs) ([]string, uint64, error) {
+	args := []string{"SSCAN", key, strconv.FormatUint(cursor, 10)}
+	if a.Match != "" {
+		args = append(args, "MATCH", a.Match)
+	}
+	if a.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(a.Count))
+	}
+	return c.scan(ctx, args...)
+}
+
+// Z is a member of a sorted set with its score
+type Z struct {
+	Member string
+	Score  float64
+}
+
+// ZAddArgs are the conditions of ZADD, the zero value adds new members and updates existing ones
+type ZAddArgs struct {
+	NX, XX bool // only add new members, only update existing ones
+	GT, LT bool // only update existing members to greater or lower scores
+	CH     bool // count the updated members too
+}
+
+// ZAdd adds the members to the sorted set or updates their scores, returns the number of members added
+func (c *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	return c.ZAddArgs(ctx, key, ZAddArgs{}, members...)
+}
+
+// ZAddArgs adds the members to the sorted set or updates their scores under the conditions,
+// returns the number of members added, or changed too if CH is set
+func (c *Client) ZAddArgs(ctx context.Context, key string, a ZAddArgs, members ...Z) (int64, error) {
+	args := []string{"ZADD", key}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{{a.NX, "NX"}, {a.XX, "XX"}, {a.GT, "GT"}, {a.LT, "LT"}, {a.CH, "CH"}} {
+		if opt.set {
+			args = append(args, opt.name)
+		}
+	}
+	for _, m := range members {
+		args = append(args, formatScore(m.Score), m.Member)
+	}
+	return c.int(ctx, args...)
+}
+
+// ZIncrBy increments the score of the member of the sorted set, returns the new score
+func (c *Client) ZIncrBy(ctx context.Context, key string, incr float64, member string) (float64, error) {
+	return c.float(ctx, "ZINCRBY", key, formatScore(incr), member)
+}
+
+// ZRem removes the members from the sorted set, returns the number of members removed
+func (c *Client) ZRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.int(ctx, append([]string{"ZREM", key}, members...)...)
+}
+
+// ZCard returns the number of members of the sorted set
+func (c *Client) ZCard(ctx context.Context, key string) (int64, error) {
+	return c.int(ctx, "ZCARD", key)
+}
+
+// ZScore returns the score of the member of the sorted set, Nil if there is no such member
+func (c *Client) ZScore(ctx context.Context, key, member string) (float64, error) {
+	return c.float(ctx, "ZSCORE", key, member)
+}
+
+// ZCount returns the number of members of the sorted set with scores in the range,
+// bounds are like "1", "(1" for exclusive ones, "-inf" or "+inf"
+func (c *Client) ZCount(ctx context.Context, key, min, max string) (int64, error) {
+	return c.int(ctx, "ZCOUNT", key, min, max)
+}
+
+// ZLexCount returns the number of members of the sorted set in the lexicographical range,
+// bounds are like "[a", "(a" for exclusive ones, "-" or "+"
+func (c *Client) ZLexCount(ctx context.Context, key, min, max string) (int64, error) {
+	return c.int(ctx, "ZLEXCOUNT", key, min, max)
+}
+
+// ZRank returns the rank of the member of the sorted set from the lowest score, Nil if there is no such member
+func (c *Client) ZRank(ctx context.Context, key, member string) (int64, error) {
+	return c.int(ctx, "ZRANK", key, member)
+}
+
+// ZRevRank returns the rank of the member of the sorted set from the highest score, Nil if there is no such member
+func (c *Client) ZRevRank(ctx context.Context, key, member string) (int64, error) {
+	return c.int(ctx, "ZREVRANK", key, member)
+}
+
+// ZRange returns the members of the sorted set from the start rank to the stop rank, inclusive,
+// negative ranks count from the highest score
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.strs(ctx, "ZRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+// ZRangeWithScores returns the members of the sorted set with their scores, like ZRange
+func (c *Client) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return c.zs(ctx, "ZRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "WITHSCORES")
+}
+
+// ZRangeArgs are the options of the unified ZRANGE, the zero value is a range by rank
+type ZRangeArgs struct {
+	Start, Stop   string // ranks, scores or lexicographical bounds, from the highest with Rev
+	ByScore       bool
+	ByLex         bool
+	Rev           bool
+	Offset, Count int64 // LIMIT, used if Count is not 0, a negative Count means no limit
+}
+
+// args returns the arguments of ZRANGE or ZRANGESTORE after the key
+func (a ZRangeArgs) args() []string {
+	args := []string{a.Start, a.Stop}
+	switch {
+	case a.ByScore:
+		args = append(args, "BYSCORE")
+	case a.ByLex:
+		args = append(args, "BYLEX")
+	}
+	if a.Rev {
+		args = append(args, "REV")
+	}
+	if a.Count != 0 {
+		args = append(args, "LIMIT", strconv.FormatInt(a.Offset, 10), strconv.FormatInt(a.Count, 10))
+	}
+	return args
+}
+
+// ZRangeArgs returns the members of the sorted set in the range
+func (c *Client) ZRangeArgs(ctx context.Context, key string, a ZRangeArgs) ([]string, error) {
+	return c.strs(ctx, append([]string{"ZRANGE", key}, a.args()...)...)
+}
+
+// ZRangeArgsWithScores returns the members of the sorted set in the range with their scores
+func (c *Client) ZRangeArgsWithScores(ctx context.Context, key string, a ZRangeArgs) ([]Z, error) {
+	return c.zs(ctx, append(append([]string{"ZRANGE", key}, a.args()...), "WITHSCORES")...)
+}
+
+// ZRangeStore stores the members of the sorted set in the range in the destination, returns their number
+func (c *Client) ZRangeStore(ctx context.Context, dst, src string, a ZRangeArgs) (int64, error) {
+	return c.int(ctx, append([]string{"ZRANGESTORE", dst, src}, a.args()...)...)
+}
+
+// ZPopMin removes and returns up to count members of the sorted set with the lowest scores
+func (c *Client) ZPopMin(ctx context.Context, key string, count int) ([]Z, error) {
+	return c.zs(ctx, "ZPOPMIN", key, strconv.Itoa(count))
+}
+
+// ZPopMax removes and returns up to count members of the sorted set with the highest scores
+func (c *Client) ZPopMax(ctx context.Context, key string, count int) ([]Z, error) {
+	return c.zs(ctx, "ZPOPMAX", key, strconv.Itoa(count))
+}
+
+// ZMPop pops up to count members from the first non empty sorted set of the keys, with the lowest scores,
+// or the highest ones if order is "MAX". Returns the key and the members, Nil if all the sorted sets are empty
+func (c *Client) ZMPop(ctx context.Context, order string, count int, keys ...string) (string, []Z, error) {
+	args := append([]string{"ZMPOP", strconv.Itoa(len(keys))}, keys...)
+	return c.zmpop(ctx, append(args, order, "COUNT", strconv.Itoa(count))...)
+}
+
+// BZPopMin pops the member with the lowest score of the first non empty sorted set, waiting up to timeout for one,
+// zero waits forever. Returns the key and the member, Nil if the timeout passed. The ctx deadline must allow for the timeout
+func (c *Client) BZPopMin(ctx context.Context, timeout time.Duration, keys ...string) (string, Z, error) {
+	return c.bzpop(ctx, append(append([]string{"BZPOPMIN"}, keys...), seconds(timeout))...)
+}
+
+// BZPopMax pops the member with the highest score of the first non empty sorted set like BZPopMin
+func (c *Client) BZPopMax(ctx context.Context, timeout time.Duration, keys ...string) (string, Z, error) {
+	return c.bzpop(ctx, append(append([]string{"BZPOPMAX"}, keys...), seconds(timeout))...)
+}
+
+// BZMPop pops like ZMPop, waiting up to timeout for one of the sorted sets, zero waits forever.
+// Nil is returned if the timeout passed
+func (c *Client) BZMPop(ctx context.Context, timeout time.Duration, order string, count int, keys ...string) (string, []Z, error) {
+	args := append([]string{"BZMPOP", seconds(timeout), strconv.Itoa(len(keys))}, keys...)
+	return c.zmpop(ctx, append(args, order, "COUNT", strconv.Itoa(count))...)
+}
+
+// bzpop sends BZPOPMIN or BZPOPMAX and splits its reply to the key and the member
+func (c *Client) bzpop(ctx context.Context, args ...string) (string, Z, error) {
+	elems, err := c.strs(ctx, args...)
+	if err != nil {
+		return "", Z{}, err
+	}
+	if len(elems) != 3 {
+		return "", Z{}, fmt.Errorf("unexpected reply of %d elements", len(elems))
+	}
+	score, err := strconv.ParseFloat(elems[2], 64)
+	return elems[0], Z{Member: elems[1], Score: score}, err
+}
+
+// zmpop sends ZMPOP or BZMPOP and splits its reply to the key and the members
+func (c *Client) zmpop(ctx context.Context, args ...string) (string, []Z, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case v.IsError():
+		return "", nil, Error(v.Str)
+	case v.Null:
+		return "", nil, Nil
+	case len(v.Elems) != 2:
+		return "", nil, fmt.Errorf("unexpected reply of %d elements", len(v.Elems))
+	}
+	key, err := String(v.Elems[0])
+	if err != nil {
+		return "", nil, err
+	}
+	members, err := parseZ(v.Elems[1])
+	return key, members, err
+}
+
+// ZStore are the options of the sorted set operations. Weights multiply the scores of the keys,
+// Aggregate is "SUM", "MIN" or "MAX", the scores are summed if it's empty
+type ZStore struct {
+	Keys      []string
+	Weights   []float64
+	Aggregate string
+}
+
+// args returns the arguments of the sorted set operations from numkeys on
+func (z ZStore) args() []string {
+	args := append([]string{strconv.Itoa(len(z.Keys))}, z.Keys...)
+	if len(z.Weights) > 0 {
+		args = append(args, "WEIGHTS")
+		for _, w := range z.Weights {
+			args = append(args, formatScore(w))
+		}
+	}
+	if z.Aggregate != "" {
+		args = append(args, "AGGREGATE", z.Aggregate)
+	}
+	return args
+}
+
+// ZUnion returns the union of the sorted sets with the combined scores
+func (c *Client) ZUnion(ctx context.Context, z ZStore) ([]Z, error) {
+	return c.zs(ctx, append(append([]string{"ZUNION"}, z.args()...), "WITHSCORES")...)
+}
+
+// ZInter returns the intersection of the sorted sets with the combined scores
+func (c *Client) ZInter(ctx context.Context, z ZStore) ([]Z, error) {
+	return c.zs(ctx, append(append([]string{"ZINTER"}, z.args()...), "WITHSCORES")...)
+}
+
+// ZUnionStore stores the union of the sorted sets in the destination, returns its size
+func (c *Client) ZUnionStore(ctx context.Context, dst string, z ZStore) (int64, error) {
+	return c.int(ctx, append([]string{"ZUNIONSTORE", dst}, z.args()...)...)
+}
+
+// ZInterStore stores the intersection of the sorted sets in the destination, returns its size
+func (c *Client) ZInterStore(ctx context.Context, dst string, z ZStore) (int64, error) {
+	return c.int(ctx, append([]string{"ZINTERSTORE", dst}, z.args()...)...)
+}
+
+// ZScan returns some members with their scores, as member score pairs, starting from the cursor,
+// and the cursor to continue from, 0 when the scan is complete. The Type of the options is not used
+func (c *Client) ZScan(ctx context.Context, key string, cursor uint64, a ScanArgs) ([]string, uint64, error) {
+	args := []string{"ZSCAN", key, strconv.FormatUint(cursor, 10)}
+	if a.Match != "" {
+		args = append(args, "MATCH", a.Match)
+	}
+	if a.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(a.Count))
+	}
+	return c.scan(ctx, args...)
+}
+
+// Del deletes the keys, returns the number of keys deleted
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"DEL"}, keys...)...)
+}
+
+// Unlink deletes the keys like Del
+func (c *Client) Unlink(ctx context.Context, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"UNLINK"}, keys...)...)
+}
+
+// Exists returns the number of existing keys, keys are counted as many times as they are given
+func (c *Client) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"EXISTS"}, keys...)...)
+}
+
+// Touch returns the number of existing keys
+func (c *Client) Touch(ctx context.Context, keys ...string) (int64, error) {
+	return c.int(ctx, append([]string{"TOUCH"}, keys...)...)
+}
+
+// Type returns the type of the value of the key, "none" if the key doesn't exist
+func (c *Client) Type(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "TYPE", key)
+}
+
+// Rename renames the key, replacing the new key if it exists
+func (c *Client) Rename(ctx context.Context, key, newKey string) error {
+	_, err := c.str(ctx, "RENAME", key, newKey)
+	return err
+}
+
+// RenameNX renames the key only if the new key doesn't exist, returns false if it does
+func (c *Client) RenameNX(ctx context.Context, key, newKey string) (bool, error) {
+	return c.bool(ctx, "RENAMENX", key, newKey)
+}
+
+// Copy copies the value of the key, the destination is replaced only if replace is set.
+// Returns false if nothing was copied
+func (c *Client) Copy(ctx context.Context, src, dst string, replace bool) (bool, error) {
+	args := []string{"COPY", src, dst}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	return c.bool(ctx, args...)
+}
+
+// RandomKey returns a random key, Nil if there are no keys
+func (c *Client) RandomKey(ctx context.Context) (string, error) {
+	return c.str(ctx, "RANDOMKEY")
+}
+
+// Keys returns all the keys matching the glob pattern
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return c.strs(ctx, "KEYS", pattern)
+}
+
+// ScanArgs are the options of SCAN, the zero value returns keys of any type with the default count
+type ScanArgs struct {
+	Match string // glob pattern of the keys
+	Count int    // hint of the number of keys returned
+	Type  string // type of the keys, as reported by TYPE
+}
+
+// Scan returns some keys starting from the cursor and the cursor to continue from, 0 when the scan is complete
+func (c *Client) Scan(ctx context.Context, cursor uint64, a ScanArgs) ([]string, uint64, error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if a.Match != "" {
+		args = append(args, "MATCH", a.Match)
+	}
+	if a.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(a.Count))
+	}
+	if a.Type != "" {
+		args = append(args, "TYPE", a.Type)
+	}
+	return c.scan(ctx, args...)
+}
+
+// Expire sets the time to live of the key, returns false if the key doesn't exist
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return c.bool(ctx, "PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+// ExpireAt sets the deadline of the key, returns false if the key doesn't exist
+func (c *Client) ExpireAt(ctx context.Context, key string, at time.Time) (bool, error) {
+	return c.bool(ctx, "PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))
+}
+
+// TTL returns the time to live of the key in milliseconds, -1 if the key has no deadline,
+// -2 if the key doesn't exist
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := c.int(ctx, "PTTL", key)
+	if ms < 0 {
+		return time.Duration(ms), err
+	}
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// Persist removes the deadline of the key, returns false if it had none or doesn't exist
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	return c.bool(ctx, "PERSIST", key)
+}
+
+// Info returns the server information, of all sections if none are given
+func (c *Client) Info(ctx context.Context, sections ...string) (string, error) {
+	return c.str(ctx, append([]string{"INFO"}, sections...)...)
+}
+
+// CommandCount returns the number of commands supported by the server
+func (c *Client) CommandCount(ctx context.Context) (int64, error) {
+	return c.int(ctx, "COMMAND", "COUNT")
+}
+
+// CommandList returns the names of the commands supported by the server
+func (c *Client) CommandList(ctx context.Context) ([]string, error) {
+	return c.strs(ctx, "COMMAND", "LIST")
+}
+
+// str sends a command and converts its reply to a string
+func (c *Client) str(ctx context.Context, args ...string) (string, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	return String(v)
+}
+
+// int sends a command and converts its reply to an integer
+func (c *Client) int(ctx context.Context, args ...string) (int64, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return Int(v)
+}
+
+// bool sends a command and converts its integer reply to a boolean
+func (c *Client) bool(ctx context.Context, args ...string) (bool, error) {
+	n, err := c.int(ctx, args...)
+	return n == 1, err
+}
+
+// float sends a command and converts its reply to a floating point number
+func (c *Client) float(ctx context.Context, args ...string) (float64, error) {
+	s, err := c.str(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// strs sends a command and converts its reply to a slice of strings
+func (c *Client) strs(ctx context.Context, args ...string) ([]string, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return Strings(v)
+}
+
+// ints sends a command and converts its reply to a slice of integers
+func (c *Client) ints(ctx context.Context, args ...string) ([]int64, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsError() {
+		return nil, Error(v.Str)
+	}
+	res := make([]int64, len(v.Elems))
+	for i, e := range v.Elems {
+		if res[i], err = Int(e); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// strPtrs sends a command and converts its reply to a slice of strings, nil for null elements
+func (c *Client) strPtrs(ctx context.Context, args ...string) ([]*string, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsError() {
+		return nil, Error(v.Str)
+	}
+	res := make([]*string, len(v.Elems))
+	for i, e := range v.Elems {
+		s, err := String(e)
+		if err == Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[i] = &s
+	}
+	return res, nil
+}
+
+// zs sends a command and converts its reply of members and scores to a slice of Z
+func (c *Client) zs(ctx context.Context, args ...string) ([]Z, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsError() {
+		return nil, Error(v.Str)
+	}
+	return parseZ(v)
+}
+
+// parseZ converts a reply of members and scores to a slice of Z,
+// the pairs may be flat like in RESP2, or nested like in RESP3
+func parseZ(v resp.Value) ([]Z, error) {
+	var flat []resp.Value
+	for _, e := range v.Elems {
+		if e.IsAggregate() {
+			flat = append(flat, e.Elems...)
+		} else {
+			flat = append(flat, e)
+		}
+	}
+	res := make([]Z, 0, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		member, err := String(flat[i])
+		if err != nil {
+			return nil, err
+		}
+		score, err := String(flat[i+1])
+		if err != nil {
+			return nil, err
+		}
+		z := Z{Member: member}
+		if z.Score, err = strconv.ParseFloat(score, 64); err != nil {
+			return nil, err
+		}
+		res = append(res, z)
+	}
+	return res, nil
+}
+
+// formatScore formats a score of a sorted set in a form the server parses, infinities included
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// scan sends a scanning command and splits its reply to the elements and the next cursor
+func (c *Client) scan(ctx context.Context, args ...string) ([]string, uint64, error) {
+	v, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v.IsError() {
+		return nil, 0, Error(v.Str)
+	}
+	if len(v.Elems) != 2 {
+		return nil, 0, fmt.Errorf("unexpected scan reply of %d elements", len(v.Elems))
+	}
+	s, err := String(v.Elems[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid scan cursor %q", s)
+	}
+	elems, err := Strings(v.Elems[1])
+	return elems, cursor, err
+}
+
+// String converts a reply to a string, returns Nil for null replies and Error for error replies
+func String(v resp.Value) (string, error) {
+	switch {
+	case v.IsError():
+		return "", Error(v.Str)
+	case v.Null:
+		return "", Nil
+	}
+	switch v.Type {
+	case resp.TypeSimpleString, resp.TypeBulkString, resp.TypeVerbatimString, resp.TypeBigNumber, resp.TypeDouble:
+		return v.Str, nil
+	case resp.TypeInteger:
+		return strconv.FormatInt(v.Int, 10), nil
+	}
+	return "", fmt.Errorf("unexpected reply type %q for a string", v.Type)
+}
+
+// Int converts a reply to an integer, returns Nil for null replies and Error for error replies
+func Int(v resp.Value) (int64, error) {
+	switch {
+	case v.IsError():
+		return 0, Error(v.Str)
+	case v.Null:
+		return 0, Nil
+	}
+	switch v.Type {
+	case resp.TypeInteger:
+		return v.Int, nil
+	case resp.TypeBoolean:
+		if v.Bool {
+			return 1, nil
+		}
+		return 0, nil
+	case resp.TypeSimpleString, resp.TypeBulkString:
+		return strconv.ParseInt(v.Str, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected reply type %q for an integer", v.Type)
+}
+
+// Strings converts an aggregate reply to a slice of strings, null elements become empty strings.
+// Maps are flattened to keys and values
+func Strings(v resp.Value) ([]string, error) {
+	switch {
+	case v.IsError():
+		return nil, Error(v.Str)
+	case v.Null:
+		return nil, Nil
+	case !v.IsAggregate():
+		return nil, fmt.Errorf("unexpected reply type %q for an array", v.Type)
+	}
+	res := make([]string, 0, len(v.Elems))
+	for _, e := range v.Elems {
+		s, err := String(e)
+		if err == Nil {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringReplies(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("MGET", "*3\r\n$1\r\n1\r\n$-1\r\n$0\r\n\r\n")
+	values, err := c.MGet(ctx, "a", "missing", "empty")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(values))
+	assert.Equal(t, "1", *values[0])
+	assert.Nil(t, values[1])
+	assert.Equal(t, "", *values[2])
+
+	fs.reply("GETDEL", "$-1\r\n")
+	_, err = c.GetDel(ctx, "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("INCRBYFLOAT", "$3\r\n1.5\r\n")
+	f, err := c.IncrByFloat(ctx, "f", 1.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, f)
+
+	fs.reply("BITFIELD", "*2\r\n:255\r\n$-1\r\n")
+	fields, err := c.BitField(ctx, "b", "OVERFLOW", "FAIL", "INCRBY", "u8", "0", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(255), *fields[0])
+	assert.Nil(t, fields[1])
+
+	fs.reply("INCR", "-ERR value is not an integer or out of range\r\n")
+	_, err = c.Incr(ctx, "f")
+	assert.Equal(t, Error("ERR value is not an integer or out of range"), err)
+}
+
+func TestListReplies(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("BLPOP", "*2\r\n$1\r\nq\r\n$1\r\na\r\n")
+	popped, err := c.BLPop(ctx, 1500*time.Millisecond, "q", "other")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"q", "a"}, popped)
+	assert.Equal(t, []string{"BLPOP", "q", "other", "1.5"}, fs.lastCommand())
+
+	// the timeout passed
+	fs.reply("BLPOP", "*-1\r\n")
+	_, err = c.BLPop(ctx, time.Second, "q")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("LPOP", "*-1\r\n")
+	_, err = c.LPopCount(ctx, "missing", 2)
+	assert.Equal(t, Nil, err)
+
+	fs.reply("LINDEX", "$-1\r\n")
+	_, err = c.LIndex(ctx, "q", 10)
+	assert.Equal(t, Nil, err)
+}
+
+func TestHashReplies(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("HGETALL", "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n")
+	all, err := c.HGetAll(ctx, "h")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, all)
+
+	fs.reply("HGETALL", "*0\r\n")
+	all, err = c.HGetAll(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{}, all)
+
+	fs.reply("HGETALL", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	_, err = c.HGetAll(ctx, "s")
+	assert.Equal(t, Error("WRONGTYPE Operation against a key holding the wrong kind of value"), err)
+
+	fs.reply("HMGET", "*2\r\n$1\r\n1\r\n$-1\r\n")
+	values, err := c.HMGet(ctx, "h", "a", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", *values[0])
+	assert.Nil(t, values[1])
+
+	fs.reply("HGET", "$-1\r\n")
+	_, err = c.HGet(ctx, "h", "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("HINCRBYFLOAT", "$4\r\n10.5\r\n")
+	f, err := c.HIncrByFloat(ctx, "h", "a", 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10.5, f)
+
+	// milliseconds become durations, the negative codes are kept as they are
+	fs.reply("HPTTL", "*3\r\n:1500\r\n:-1\r\n:-2\r\n")
+	ttls, err := c.HTTL(ctx, "h", "a", "b", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{1500 * time.Millisecond, -1, -2}, ttls)
+	assert.Equal(t, []string{"HPTTL", "h", "FIELDS", "3", "a", "b", "missing"}, fs.lastCommand())
+
+	fs.reply("HPEXPIRE", "*2\r\n:1\r\n:-2\r\n")
+	res, err := c.HExpire(ctx, "h", 10*time.Second, "NX", "a", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, -2}, res)
+	assert.Equal(t, []string{"HPEXPIRE", "h", "10000", "NX", "FIELDS", "2", "a", "missing"}, fs.lastCommand())
+
+	fs.reply("HSCAN", "*2\r\n$2\r\n12\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n")
+	pairs, cursor, err := c.HScan(ctx, "h", 0, ScanArgs{Match: "a*", Count: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "1"}, pairs)
+	assert.Equal(t, uint64(12), cursor)
+	assert.Equal(t, []string{"HSCAN", "h", "0", "MATCH", "a*", "COUNT", "5"}, fs.lastCommand())
+}
+
+// RESP3 replies of hashes are maps, and nulls have their own type
+func TestHashRepliesResp3(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), Protocol: resp.RESP3})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("HGETALL", "%2\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n")
+	all, err := c.HGetAll(ctx, "h")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, all)
+
+	fs.reply("HMGET", "*2\r\n_\r\n$1\r\n2\r\n")
+	values, err := c.HMGet(ctx, "h", "missing", "b")
+	assert.Nil(t, err)
+	assert.Nil(t, values[0])
+	assert.Equal(t, "2", *values[1])
+
+	fs.reply("HGET", "_\r\n")
+	_, err = c.HGet(ctx, "h", "missing")
+	assert.Equal(t, Nil, err)
+}
+
+func TestSetReplies(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("SMISMEMBER", "*3\r\n:1\r\n:0\r\n:1\r\n")
+	members, err := c.SMIsMember(ctx, "s", "a", "x", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true}, members)
+
+	fs.reply("SMOVE", ":0\r\n")
+	moved, err := c.SMove(ctx, "s", "d", "x")
+	assert.Nil(t, err)
+	assert.False(t, moved)
+
+	fs.reply("SPOP", "$-1\r\n")
+	_, err = c.SPop(ctx, "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("SPOP", "*0\r\n")
+	popped, err := c.SPopCount(ctx, "missing", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, popped)
+
+	fs.reply("SRANDMEMBER", "$-1\r\n")
+	_, err = c.SRandMember(ctx, "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("SSCAN", "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n")
+	scanned, cursor, err := c.SScan(ctx, "s", 7, ScanArgs{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, scanned)
+	assert.Equal(t, uint64(0), cursor)
+	assert.Equal(t, []string{"SSCAN", "s", "7"}, fs.lastCommand())
+}
+
+// RESP3 replies of sets are sets, and the boolean replies are integers as in RESP2
+func TestSetRepliesResp3(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), Protocol: resp.RESP3})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("SMEMBERS", "~2\r\n$1\r\na\r\n$1\r\nb\r\n")
+	members, err := c.SMembers(ctx, "s")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, members)
+
+	fs.reply("SISMEMBER", ":1\r\n")
+	ok, err := c.SIsMember(ctx, "s", "a")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestZsetReplies(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("ZRANGE", "*4\r\n$1\r\na\r\n$3\r\n1.5\r\n$1\r\nb\r\n$3\r\ninf\r\n")
+	zs, err := c.ZRangeWithScores(ctx, "z", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Z{{Member: "a", Score: 1.5}, {Member: "b", Score: math.Inf(1)}}, zs)
+	assert.Equal(t, []string{"ZRANGE", "z", "0", "-1", "WITHSCORES"}, fs.lastCommand())
+
+	fs.reply("ZSCORE", "$-1\r\n")
+	_, err = c.ZScore(ctx, "z", "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("ZRANK", "$-1\r\n")
+	_, err = c.ZRank(ctx, "z", "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("ZPOPMIN", "*0\r\n")
+	zs, err = c.ZPopMin(ctx, "missing", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Z{}, zs)
+
+	fs.reply("ZMPOP", "*2\r\n$1\r\nz\r\n*2\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n")
+	key, zs, err := c.ZMPop(ctx, "MAX", 2, "other", "z")
+	assert.Nil(t, err)
+	assert.Equal(t, "z", key)
+	assert.Equal(t, []Z{{Member: "c", Score: 3}, {Member: "b", Score: 2}}, zs)
+	assert.Equal(t, []string{"ZMPOP", "2", "other", "z", "MAX", "COUNT", "2"}, fs.lastCommand())
+
+	fs.reply("ZMPOP", "*-1\r\n")
+	_, _, err = c.ZMPop(ctx, "MIN", 1, "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("BZPOPMIN", "*3\r\n$1\r\nz\r\n$1\r\na\r\n$2\r\n-1\r\n")
+	key, z, err := c.BZPopMin(ctx, time.Second, "z")
+	assert.Nil(t, err)
+	assert.Equal(t, "z", key)
+	assert.Equal(t, Z{Member: "a", Score: -1}, z)
+
+	// the timeout passed
+	fs.reply("BZPOPMIN", "*-1\r\n")
+	_, _, err = c.BZPopMin(ctx, time.Second, "z")
+	assert.Equal(t, Nil, err)
+	fs.reply("BZMPOP", "*-1\r\n")
+	_, _, err = c.BZMPop(ctx, time.Second, "MIN", 1, "z")
+	assert.Equal(t, Nil, err)
+}
+
+// RESP3 replies of sorted sets nest the members with their scores, and scores are doubles
+func TestZsetRepliesResp3(t *testing.T) {
+	fs := newFakeServer(t)
+	c := New(Options{Addr: fs.ln.Addr().String(), Protocol: resp.RESP3})
+	defer c.Close()
+	ctx := context.Background()
+
+	fs.reply("ZRANGE", "*2\r\n*2\r\n$1\r\na\r\n,1.5\r\n*2\r\n$1\r\nb\r\n,inf\r\n")
+	zs, err := c.ZRangeWithScores(ctx, "z", 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Z{{Member: "a", Score: 1.5}, {Member: "b", Score: math.Inf(1)}}, zs)
+
+	fs.reply("ZSCORE", ",2.5\r\n")
+	score, err := c.ZScore(ctx, "z", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, score)
+
+	fs.reply("ZSCORE", "_\r\n")
+	_, err = c.ZScore(ctx, "z", "missing")
+	assert.Equal(t, Nil, err)
+
+	fs.reply("ZMPOP", "*2\r\n$1\r\nz\r\n*1\r\n*2\r\n$1\r\na\r\n,1\r\n")
+	key, zs, err := c.ZMPop(ctx, "MIN", 1, "z")
+	assert.Nil(t, err)
+	assert.Equal(t, "z", key)
+	assert.Equal(t, []Z{{Member: "a", Score: 1}}, zs)
+
+	fs.reply("BZPOPMAX", "_\r\n")
+	_, _, err = c.BZPopMax(ctx, time.Second, "z")
+	assert.Equal(t, Nil, err)
+}
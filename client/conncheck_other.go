@@ -0,0 +1,11 @@
+//go:build !unix
+
+package client
+
+import "net"
+
+// connCheck tells if the idle connection is still usable, it can't be checked without blocking here:
+// connections closed by the server fail on use
+func connCheck(nc net.Conn) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+var errUnexpectedRead = errors.New("unexpected read from an idle connection")
+
+// connCheck tells if the idle connection is still usable, without blocking: nothing is expected
+// to be read between round trips, so a read finds nothing unless the server closed the connection,
+// e.g. on a restart. Sockets are non-blocking, the read returns at once
+func connCheck(nc net.Conn) error {
+	sc, ok := nc.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var checkErr error
+	err = rc.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, err := syscall.Read(int(fd), buf[:])
+		switch {
+		case n == 0 && err == nil:
+			checkErr = io.EOF
+		case n > 0:
+			checkErr = errUnexpectedRead
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
+			checkErr = nil
+		default:
+			checkErr = err
+		}
+		// done, don't wait for the socket to get readable
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return checkErr
+}
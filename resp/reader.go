@@ -0,0 +1,502 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Limits protect the reader from peers announcing values bigger than it is willing to allocate
+type Limits struct {
+	MaxBulkLen      int64 // max size of a single bulk string
+	MaxMultibulkLen int64 // max number of elements of a single aggregate
+	MaxQueryLen     int64 // max size of a single command, checked by ReadCommand
+}
+
+// Default limits, same as Redis defaults
+var DefaultLimits = Limits{
+	MaxBulkLen:      512 * 1024 * 1024,
+	MaxMultibulkLen: 1024 * 1024,
+	MaxQueryLen:     1024 * 1024 * 1024,
+}
+
+// Reader decodes values and commands from a buffered stream
+type Reader struct {
+	rd     *bufio.Reader
+	limits Limits
+}
+
+// NewReader makes a reader on top of r with default limits
+func NewReader(r io.Reader, options ...func(*Reader)) *Reader {
+	reader := &Reader{
+		rd:     bufio.NewReaderSize(r, IOBufLen),
+		limits: DefaultLimits,
+	}
+
+	for _, option := range options {
+		option(reader)
+	}
+
+	return reader
+}
+
+// WithLimits is a functional option for setting the reader limits
+func WithLimits(limits Limits) func(*Reader) {
+	return func(r *Reader) {
+		r.limits = limits
+	}
+}
+
+// Buffered returns the number of bytes already received but not decoded yet
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// Wait blocks until there is some input without consuming it, it returns the error of the stream if there is none
+func (r *Reader) Wait() error {
+	_, err := r.rd.Peek(1)
+	return err
+}
+
+// readLine reads a line terminated by \r\n and returns it without the terminator.
+// Lines are expected to be short, anything longer than MaxInlineLen is an error
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// slow path, the line doesn't fit the buffer
+		line = append([]byte{}, line...)
+		for err == bufio.ErrBufferFull {
+			var chunk []byte
+			chunk, err = r.rd.ReadSlice('\n')
+			line = append(line, chunk...)
+			if len(line) > MaxInlineLen {
+				return nil, ProtocolError("too big line")
+			}
+		}
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ProtocolError("line is not terminated by '\\r\\n'")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readLength reads a length header of a bulk string or an aggregate
+func (r *Reader) readLength() (int64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil || n < -1 {
+		return 0, ProtocolError("invalid length")
+	}
+	return n, nil
+}
+
+// readBulk reads exactly length bytes followed by \r\n, big buffers grow
+// as the data arrives instead of being allocated upfront
+func (r *Reader) readBulk(length int64) (string, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, min(length+2, IOBufLen)))
+	if _, err := io.CopyN(buf, r.rd, length+2); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	data := buf.Bytes()
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return "", ProtocolError("bulk string is not terminated by '\\r\\n'")
+	}
+	return string(data[:length]), nil
+}
+
+// ReadValue reads a single value of any type. Attributes are not returned
+// on their own, they are attached to the value that follows them
+func (r *Reader) ReadValue() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	t, err := r.rd.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+	v := Value{Type: t}
+
+	switch t {
+	case TypeSimpleString, TypeSimpleError, TypeBigNumber:
+		line, err := r.readLine()
+		if err != nil {
+			return v, err
+		}
+		v.Str = string(line)
+
+	case TypeInteger:
+		line, err := r.readLine()
+		if err != nil {
+			return v, err
+		}
+		if v.Int, err = strconv.ParseInt(string(line), 10, 64); err != nil {
+			return v, ProtocolError("invalid integer")
+		}
+
+	case TypeNull:
+		line, err := r.readLine()
+		if err != nil {
+			return v, err
+		}
+		if len(line) != 0 {
+			return v, ProtocolError("invalid null")
+		}
+		v.Null = true
+
+	case TypeBoolean:
+		line, err := r.readLine()
+		if err != nil {
+			return v, err
+		}
+		switch string(line) {
+		case "t":
+			v.Bool = true
+		case "f":
+		default:
+			return v, ProtocolError("invalid boolean")
+		}
+
+	case TypeDouble:
+		line, err := r.readLine()
+		if err != nil {
+			return v, err
+		}
+		v.Str = string(line)
+		switch v.Str {
+		case "inf":
+			v.Float = math.Inf(1)
+		case "-inf":
+			v.Float = math.Inf(-1)
+		case "nan":
+			v.Float = math.NaN()
+		default:
+			if v.Float, err = strconv.ParseFloat(v.Str, 64); err != nil {
+				return v, ProtocolError("invalid double")
+			}
+		}
+
+	case TypeBulkString, TypeBulkError, TypeVerbatimString:
+		length, err := r.readLength()
+		if err != nil {
+			return v, err
+		}
+		if length == -1 {
+			// only bulk strings can be null
+			if t != TypeBulkString {
+				return v, ProtocolError("invalid bulk length")
+			}
+			v.Null = true
+			break
+		}
+		if length > r.limits.MaxBulkLen {
+			return v, LimitError{LimitProtoMaxBulkLen, ProtocolError("invalid bulk length")}
+		}
+		if v.Str, err = r.readBulk(length); err != nil {
+			return v, err
+		}
+		if t == TypeVerbatimString {
+			if len(v.Str) < 4 || v.Str[3] != ':' {
+				return v, ProtocolError("invalid verbatim string")
+			}
+			v.Format, v.Str = v.Str[:3], v.Str[4:]
+		}
+
+	case TypeArray, TypeMap, TypeSet, TypePush, TypeAttribute:
+		if depth >= MaxNesting {
+			return v, ProtocolError("too deep nesting")
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return v, err
+		}
+		if length == -1 {
+			// only arrays can be null
+			if t != TypeArray {
+				return v, ProtocolError("invalid multibulk length")
+			}
+			v.Null = true
+			break
+		}
+		if t == TypeMap || t == TypeAttribute {
+			length *= 2
+		}
+		if length > r.limits.MaxMultibulkLen {
+			return v, LimitError{LimitMaxMultibulkLen, ProtocolError("invalid multibulk length")}
+		}
+		// the length comes from the peer, don't trust it with the allocation
+		v.Elems = make([]Value, 0, min(length, 1024))
+		for range length {
+			elem, err := r.readValue(depth + 1)
+			if err != nil {
+				return v, err
+			}
+			v.Elems = append(v.Elems, elem)
+		}
+		if t == TypeAttribute {
+			next, err := r.readValue(depth + 1)
+			if err != nil {
+				return v, err
+			}
+			next.Attrs = v.Elems
+			return next, nil
+		}
+
+	default:
+		return v, ProtocolError(fmt.Sprintf("unknown type '%c'", t))
+	}
+
+	return v, nil
+}
+
+// ReadCommand reads a client command: an array of bulk strings or, for anything
+// not starting with '*', an inline command (telnet style). Null and empty arrays,
+// as well as empty inline lines, are returned as empty commands.
+// Null bulk strings are not valid arguments, they are protocol errors
+func (r *Reader) ReadCommand() ([]string, error) {
+	t, err := r.rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if t == TypeArray {
+		return r.readCommandArray()
+	}
+
+	// anything else is an inline command, the first byte is a part of it
+	if err := r.rd.UnreadByte(); err != nil {
+		return nil, err
+	}
+	return r.readInline()
+}
+
+// readCommandArray reads an array of bulk strings, the leading '*' is expected to be consumed already.
+// The number of elements, the size of every element and the size of the whole array
+// are checked against the limits before anything is allocated
+func (r *Reader) readCommandArray() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	arrLen, err := strconv.ParseInt(string(line), 10, 64)
+	if err != nil || arrLen < -1 {
+		return nil, ProtocolError("invalid multibulk length")
+	}
+	if arrLen > r.limits.MaxMultibulkLen {
+		return nil, LimitError{LimitMaxMultibulkLen, ProtocolError("invalid multibulk length")}
+	}
+	if arrLen <= 0 {
+		return []string{}, nil
+	}
+
+	args := make([]string, 0, min(arrLen, 1024))
+	queryLen := int64(len(line))
+	for range arrLen {
+		// Every element is expected to be a bulk string ($<element length>)
+		t, err := r.rd.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if t != TypeBulkString {
+			return nil, ProtocolError(fmt.Sprintf("expected '%c', got '%c'", TypeBulkString, t))
+		}
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(string(line), 10, 64)
+		// a null bulk string is not an argument
+		if err != nil || length < 0 {
+			return nil, ProtocolError("invalid bulk length")
+		}
+		if length > r.limits.MaxBulkLen {
+			return nil, LimitError{LimitProtoMaxBulkLen, ProtocolError("invalid bulk length")}
+		}
+		queryLen += length
+		if queryLen > r.limits.MaxQueryLen {
+			return nil, LimitError{LimitClientQueryBufferLimit, ProtocolError("query buffer limit exceeded")}
+		}
+
+		arg, err := r.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// readInline reads an inline command - a line of space separated arguments,
+// terminated by \n or \r\n
+func (r *Reader) readInline() ([]string, error) {
+	line := []byte{}
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxInlineLen {
+			return nil, ProtocolError("too big inline request")
+		}
+		if int64(len(line)) > r.limits.MaxQueryLen {
+			return nil, LimitError{LimitClientQueryBufferLimit, ProtocolError("query buffer limit exceeded")}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return SplitArgs(string(line))
+}
+
+// ReadRawBulk reads a bulk string that is not followed by \r\n,
+// that's how RDB files are transferred to replicas
+func (r *Reader) ReadRawBulk() ([]byte, error) {
+	t, err := r.rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeBulkString {
+		return nil, ProtocolError(fmt.Sprintf("expected '%c', got '%c'", TypeBulkString, t))
+	}
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > r.limits.MaxBulkLen {
+		return nil, LimitError{LimitProtoMaxBulkLen, ProtocolError("invalid bulk length")}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, min(length, IOBufLen)))
+	if _, err := io.CopyN(buf, r.rd, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SplitArgs splits a line into arguments the way redis-cli and sdssplitargs do:
+// arguments are separated by spaces, can be "double quoted" with \n, \r, \t, \b, \a
+// and \xHH escapes or 'single quoted' where only \' is an escape
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+	for {
+		// skip blanks
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		arg := []byte{}
+		inDQ, inSQ := false, false
+		for done := false; !done; {
+			switch {
+			case inDQ:
+				if i == len(line) {
+					return nil, ProtocolError("unbalanced quotes in request")
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			case inSQ:
+				if i == len(line) {
+					return nil, ProtocolError("unbalanced quotes in request")
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			default:
+				if i == len(line) {
+					done = true
+					continue
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDQ = true
+				case '\'':
+					inSQ = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t' || b == '\v' || b == '\f' || b == 0
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
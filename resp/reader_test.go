@@ -0,0 +1,199 @@
+package resp
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCommand(t *testing.T) {
+
+	tbl := []struct {
+		input string
+		args  []string
+		err   error
+	}{
+		{"*2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n", []string{"ECHO", "hey"}, nil},
+		{"*2\r\n$4\r\nECHO\r\n$4\r\nh\r\ny\r\n", []string{"ECHO", "h\r\ny"}, nil},
+		{"*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", []string{"ECHO", ""}, nil},
+		{"*2\r\n$4\r\nECHO\r\n$-1\r\n", nil, ProtocolError("invalid bulk length")},
+		{"*-1\r\n", []string{}, nil},
+		{"*0\r\n", []string{}, nil},
+		{"PING\r\n", []string{"PING"}, nil},
+		{"ECHO \"a b\"\n", []string{"ECHO", "a b"}, nil},
+		{"\r\n", []string{}, nil},
+		{"*x\r\n", nil, ProtocolError("invalid multibulk length")},
+		{"*1\r\n:4\r\n", nil, ProtocolError("expected '$', got ':'")},
+		{"*1\r\n$-2\r\n", nil, ProtocolError("invalid bulk length")},
+		{"*1\r\n$3\r\nECHO\r\n", nil, ProtocolError("bulk string is not terminated by '\\r\\n'")},
+		{"*1\r\n$4\nECHO\r\n", nil, ProtocolError("line is not terminated by '\\r\\n'")},
+		{"*1\r\n$4\r\nEC", nil, io.ErrUnexpectedEOF},
+		{"*2\r\n$4\r\nECHO\r\n", nil, io.ErrUnexpectedEOF},
+		{"ECHO 'open\r\n", nil, ProtocolError("unbalanced quotes in request")},
+		{"PING", nil, io.ErrUnexpectedEOF},
+		{"", nil, io.EOF},
+	}
+
+	for _, tt := range tbl {
+		args, err := NewReader(strings.NewReader(tt.input)).ReadCommand()
+		if tt.err != nil {
+			assert.Equal(t, tt.err, err, tt.input)
+			continue
+		}
+		assert.Nil(t, err, tt.input)
+		assert.Equal(t, tt.args, args, tt.input)
+	}
+}
+
+func TestReadCommandPipelined(t *testing.T) {
+
+	r := NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	for _, expected := range [][]string{{"PING"}, {"PING"}, {"GET", "k"}} {
+		args, err := r.ReadCommand()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, args)
+	}
+	assert.Equal(t, 0, r.Buffered())
+	_, err := r.ReadCommand()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadValue(t *testing.T) {
+
+	tbl := []struct {
+		input string
+		value Value
+	}{
+		{"+OK\r\n", Value{Type: TypeSimpleString, Str: "OK"}},
+		{"-ERR bad\r\n", Value{Type: TypeSimpleError, Str: "ERR bad"}},
+		{":-42\r\n", Value{Type: TypeInteger, Int: -42}},
+		{"$5\r\na\r\nbc\r\n", Value{Type: TypeBulkString, Str: "a\r\nbc"}},
+		{"$-1\r\n", Value{Type: TypeBulkString, Null: true}},
+		{"*-1\r\n", Value{Type: TypeArray, Null: true}},
+		{"_\r\n", Value{Type: TypeNull, Null: true}},
+		{"#t\r\n", Value{Type: TypeBoolean, Bool: true}},
+		{",1.5\r\n", Value{Type: TypeDouble, Str: "1.5", Float: 1.5}},
+		{"(123456789012345678901234567890\r\n", Value{Type: TypeBigNumber, Str: "123456789012345678901234567890"}},
+		{"!3\r\nERR\r\n", Value{Type: TypeBulkError, Str: "ERR"}},
+		{"=6\r\ntxt:hi\r\n", Value{Type: TypeVerbatimString, Format: "txt", Str: "hi"}},
+		{"*2\r\n:1\r\n*1\r\n$1\r\na\r\n", Value{Type: TypeArray, Elems: []Value{
+			{Type: TypeInteger, Int: 1},
+			{Type: TypeArray, Elems: []Value{{Type: TypeBulkString, Str: "a"}}},
+		}}},
+		{"%1\r\n+k\r\n:1\r\n", Value{Type: TypeMap, Elems: []Value{
+			{Type: TypeSimpleString, Str: "k"},
+			{Type: TypeInteger, Int: 1},
+		}}},
+		{"~1\r\n#f\r\n", Value{Type: TypeSet, Elems: []Value{{Type: TypeBoolean}}}},
+		{">2\r\n+message\r\n+hi\r\n", Value{Type: TypePush, Elems: []Value{
+			{Type: TypeSimpleString, Str: "message"},
+			{Type: TypeSimpleString, Str: "hi"},
+		}}},
+		{"|1\r\n+ttl\r\n:3\r\n+v\r\n", Value{Type: TypeSimpleString, Str: "v", Attrs: []Value{
+			{Type: TypeSimpleString, Str: "ttl"},
+			{Type: TypeInteger, Int: 3},
+		}}},
+	}
+
+	for _, tt := range tbl {
+		v, err := NewReader(strings.NewReader(tt.input)).ReadValue()
+		assert.Nil(t, err, tt.input)
+		assert.Equal(t, tt.value, v, tt.input)
+	}
+
+	v, err := NewReader(strings.NewReader(",-inf\r\n")).ReadValue()
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(v.Float, -1))
+
+	for _, input := range []string{":x\r\n", "#x\r\n", ",x\r\n", "=2\r\nhi\r\n", "_x\r\n", "?\r\n", strings.Repeat("*1\r\n", MaxNesting+1)} {
+		_, err := NewReader(strings.NewReader(input)).ReadValue()
+		var protoErr ProtocolError
+		assert.ErrorAs(t, err, &protoErr, input)
+	}
+}
+
+func TestReadRawBulk(t *testing.T) {
+
+	r := NewReader(strings.NewReader("$5\r\nREDIS*1\r\n$4\r\nPING\r\n"))
+	data, err := r.ReadRawBulk()
+	assert.Nil(t, err)
+	assert.Equal(t, "REDIS", string(data))
+
+	args, err := r.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"PING"}, args)
+}
+
+func TestLimits(t *testing.T) {
+
+	limits := Limits{MaxBulkLen: 4, MaxMultibulkLen: 3, MaxQueryLen: 10}
+
+	tbl := []struct {
+		input string
+		limit string
+	}{
+		{"*3\r\n$4\r\nECHO\r\n$1\r\na\r\n$1\r\nb\r\n", ""},
+		{"*4\r\n$4\r\nECHO\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", LimitMaxMultibulkLen},
+		{"*2\r\n$4\r\nECHO\r\n$5\r\nhello\r\n", LimitProtoMaxBulkLen},
+		{"*3\r\n$4\r\nECHO\r\n$4\r\nabcd\r\n$4\r\nabcd\r\n", LimitClientQueryBufferLimit},
+		{"*9999999999\r\n", LimitMaxMultibulkLen},
+		{"ECHO abcdefghij\r\n", LimitClientQueryBufferLimit},
+	}
+
+	for _, tt := range tbl {
+		_, err := NewReader(strings.NewReader(tt.input), WithLimits(limits)).ReadCommand()
+		if tt.limit == "" {
+			assert.Nil(t, err, tt.input)
+			continue
+		}
+		var limitErr LimitError
+		assert.ErrorAs(t, err, &limitErr, tt.input)
+		assert.Equal(t, tt.limit, limitErr.Limit, tt.input)
+		var protoErr ProtocolError
+		assert.ErrorAs(t, err, &protoErr, tt.input)
+	}
+
+	_, err := NewReader(strings.NewReader("$5\r\nhello\r\n"), WithLimits(limits)).ReadValue()
+	assert.ErrorAs(t, err, &LimitError{})
+	_, err = NewReader(strings.NewReader("%2\r\n"), WithLimits(limits)).ReadValue()
+	assert.ErrorAs(t, err, &LimitError{})
+
+	// lines are never longer than MaxInlineLen
+	_, err = NewReader(strings.NewReader("*" + strings.Repeat("1", MaxInlineLen+1))).ReadCommand()
+	assert.Equal(t, ProtocolError("too big line"), err)
+	_, err = NewReader(strings.NewReader(strings.Repeat("a", MaxInlineLen+1))).ReadCommand()
+	assert.Equal(t, ProtocolError("too big inline request"), err)
+}
+
+func TestSplitArgs(t *testing.T) {
+
+	tbl := []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{"", []string{}, false},
+		{"  PING  ", []string{"PING"}, false},
+		{"SET foo bar", []string{"SET", "foo", "bar"}, false},
+		{"SET \"foo bar\" 'baz qux'", []string{"SET", "foo bar", "baz qux"}, false},
+		{"SET k \"a\\r\\n\\x00\\\"\"", []string{"SET", "k", "a\r\n\x00\""}, false},
+		{"SET k 'it\\'s'", []string{"SET", "k", "it's"}, false},
+		{"SET k \"\"", []string{"SET", "k", ""}, false},
+		{"SET k \"open", nil, true},
+		{"SET k 'open", nil, true},
+		{"SET k \"closed\"tail", nil, true},
+	}
+
+	for _, tt := range tbl {
+		args, err := SplitArgs(tt.line)
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		assert.Nil(t, err, tt.line)
+		assert.Equal(t, tt.args, args, tt.line)
+	}
+}
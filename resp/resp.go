@@ -0,0 +1,111 @@
+// Package resp implements the Redis serialization protocol, both RESP2 and RESP3:
+// Reader decodes values and client commands, Writer encodes them.
+// It is shared by the server, the replication client and the client library,
+// so all sides of a connection speak exactly the same protocol
+package resp
+
+// Data types, the first byte of every encoded value
+const (
+	TypeSimpleString = '+'
+	TypeSimpleError  = '-'
+	TypeInteger      = ':'
+	TypeBulkString   = '$'
+	TypeArray        = '*'
+
+	// RESP3 types
+	TypeNull           = '_'
+	TypeBoolean        = '#'
+	TypeDouble         = ','
+	TypeBigNumber      = '('
+	TypeBulkError      = '!'
+	TypeVerbatimString = '='
+	TypeMap            = '%'
+	TypeAttribute      = '|'
+	TypeSet            = '~'
+	TypePush           = '>'
+)
+
+// Protocol versions
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// Value is a single decoded value of any type
+type Value struct {
+	Type byte // one of the Type* constants
+
+	// Str is the data of strings, errors and big numbers, the text
+	// of verbatim strings (Format holds their three letters format)
+	// and the textual form of doubles
+	Str    string
+	Format string
+	Int    int64
+	Float  float64
+	Bool   bool
+
+	// Null is set for RESP3 null, and for RESP2 null bulk strings and null arrays
+	Null bool
+
+	// Elems are the elements of arrays, sets and pushes, keys and values
+	// of maps are interleaved: key, value, key, value...
+	Elems []Value
+
+	// Attrs are the interleaved keys and values of the attribute
+	// that came right before the value, if any
+	Attrs []Value
+}
+
+// IsError tells if the value is a simple or a bulk error
+func (v Value) IsError() bool {
+	return v.Type == TypeSimpleError || v.Type == TypeBulkError
+}
+
+// IsAggregate tells if the value has elements
+func (v Value) IsAggregate() bool {
+	switch v.Type {
+	case TypeArray, TypeMap, TypeSet, TypePush, TypeAttribute:
+		return true
+	}
+	return false
+}
+
+// ProtocolError is returned when the peer doesn't follow the protocol,
+// the rest of the stream can't be trusted after that and the connection should be closed
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// LimitError is a protocol error caused by exceeding one of the protocol safety limits,
+// Limit is the name of the exceeded limit
+type LimitError struct {
+	Limit string
+	Err   ProtocolError
+}
+
+func (e LimitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Protocol safety limits
+const (
+	LimitProtoMaxBulkLen        = "proto-max-bulk-len"
+	LimitMaxMultibulkLen        = "max-multibulk-len"
+	LimitClientQueryBufferLimit = "client-query-buffer-limit"
+)
+
+// MaxInlineLen is the maximum length of an inline command or a single protocol line,
+// same as PROTO_INLINE_MAX_SIZE in Redis
+const MaxInlineLen = 64 * 1024
+
+// MaxNesting is the maximum depth of nested aggregates accepted by the Reader
+const MaxNesting = 128
+
+// IOBufLen is the size of read and write buffers, same as PROTO_IOBUF_LEN in Redis
+const IOBufLen = 16 * 1024
@@ -0,0 +1,316 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Writer encodes values directly into a buffered writer, nothing is sent
+// to the underlying connection until Flush is called or the buffer is full.
+// Encoding depends on the protocol version: RESP3 types are replaced
+// with their closest RESP2 equivalents for RESP2 clients
+type Writer struct {
+	buf   *bufio.Writer
+	proto int
+	num   []byte // scratch space for number formatting
+}
+
+// NewWriter makes a RESP2 writer on top of w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		buf:   bufio.NewWriterSize(w, IOBufLen),
+		proto: RESP2,
+		num:   make([]byte, 0, 32),
+	}
+}
+
+// SetProto sets the protocol version used for encoding
+func (w *Writer) SetProto(proto int) {
+	w.proto = proto
+}
+
+// Flush sends everything buffered to the underlying writer
+func (w *Writer) Flush() error {
+	return w.buf.Flush()
+}
+
+// Buffered returns the number of bytes waiting to be flushed
+func (w *Writer) Buffered() int {
+	return w.buf.Buffered()
+}
+
+// writeLine writes type prefix, data and \r\n
+func (w *Writer) writeLine(t byte, data string) error {
+	w.buf.WriteByte(t)
+	w.buf.WriteString(data)
+	_, err := w.buf.WriteString("\r\n")
+	return err
+}
+
+// writeHeader writes type prefix, number and \r\n
+func (w *Writer) writeHeader(t byte, n int64) error {
+	w.buf.WriteByte(t)
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	w.buf.Write(w.num)
+	_, err := w.buf.WriteString("\r\n")
+	return err
+}
+
+// WriteSimpleString writes a simple string, it must not contain \r or \n
+func (w *Writer) WriteSimpleString(s string) error {
+	return w.writeLine(TypeSimpleString, s)
+}
+
+// WriteError writes a simple error, the message is expected to start
+// with an error code, like "ERR" or "WRONGTYPE"
+func (w *Writer) WriteError(msg string) error {
+	return w.writeLine(TypeSimpleError, msg)
+}
+
+// WriteBulkError writes a binary safe error, RESP2 uses simple error for that
+func (w *Writer) WriteBulkError(msg string) error {
+	if w.proto < RESP3 {
+		return w.WriteError(msg)
+	}
+	return w.writeBulk(TypeBulkError, msg)
+}
+
+// WriteInteger writes an integer
+func (w *Writer) WriteInteger(n int64) error {
+	return w.writeHeader(TypeInteger, n)
+}
+
+// writeBulk writes type prefix, length, data and \r\n
+func (w *Writer) writeBulk(t byte, s string) error {
+	w.writeHeader(t, int64(len(s)))
+	w.buf.WriteString(s)
+	_, err := w.buf.WriteString("\r\n")
+	return err
+}
+
+// WriteBulkString writes a binary safe bulk string
+func (w *Writer) WriteBulkString(s string) error {
+	return w.writeBulk(TypeBulkString, s)
+}
+
+// WriteNull writes a null, RESP2 uses null bulk string for that
+func (w *Writer) WriteNull() error {
+	if w.proto < RESP3 {
+		return w.writeHeader(TypeBulkString, -1)
+	}
+	return w.writeLine(TypeNull, "")
+}
+
+// WriteNullArray writes a null array, RESP3 has a single null type for that
+func (w *Writer) WriteNullArray() error {
+	if w.proto < RESP3 {
+		return w.writeHeader(TypeArray, -1)
+	}
+	return w.writeLine(TypeNull, "")
+}
+
+// WriteArrayHeader starts an array of n elements, the elements are written
+// with subsequent calls, they may be of any type including nested arrays
+func (w *Writer) WriteArrayHeader(n int) error {
+	return w.writeHeader(TypeArray, int64(n))
+}
+
+// WriteArray writes an array of bulk strings, that's how commands are sent
+func (w *Writer) WriteArray(arr []string) error {
+	err := w.WriteArrayHeader(len(arr))
+	for _, v := range arr {
+		err = w.WriteBulkString(v)
+	}
+	return err
+}
+
+// WriteMapHeader starts a map of n key-value pairs, RESP2 uses a flat array for that
+func (w *Writer) WriteMapHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(TypeArray, int64(n)*2)
+	}
+	return w.writeHeader(TypeMap, int64(n))
+}
+
+// WriteSetHeader starts a set of n elements, RESP2 uses an array for that
+func (w *Writer) WriteSetHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(TypeArray, int64(n))
+	}
+	return w.writeHeader(TypeSet, int64(n))
+}
+
+// WritePushHeader starts an out of band push message of n elements,
+// RESP2 uses an array for that
+func (w *Writer) WritePushHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(TypeArray, int64(n))
+	}
+	return w.writeHeader(TypePush, int64(n))
+}
+
+// WriteAttributeHeader starts an attribute of n key-value pairs, the value
+// it describes is expected right after it. RESP2 has no attributes, so
+// nothing is written in that case, and the pairs must not be written either
+func (w *Writer) WriteAttributeHeader(n int) error {
+	if w.proto < RESP3 {
+		return nil
+	}
+	return w.writeHeader(TypeAttribute, int64(n))
+}
+
+// FormatDouble formats a floating point number the way Redis sends it over the protocol:
+// integers within ±2^53 without an exponent, other numbers with 17 significant digits like %.17g
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == math.Trunc(f) && math.Abs(f) <= 1<<53:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// WriteDouble writes a floating point number, RESP2 uses bulk string for that
+func (w *Writer) WriteDouble(f float64) error {
+	data := FormatDouble(f)
+	if w.proto < RESP3 {
+		return w.WriteBulkString(data)
+	}
+	return w.writeLine(TypeDouble, data)
+}
+
+// WriteBoolean writes a boolean, RESP2 uses integers 1 and 0 for that
+func (w *Writer) WriteBoolean(b bool) error {
+	if w.proto < RESP3 {
+		if b {
+			return w.WriteInteger(1)
+		}
+		return w.WriteInteger(0)
+	}
+	if b {
+		return w.writeLine(TypeBoolean, "t")
+	}
+	return w.writeLine(TypeBoolean, "f")
+}
+
+// WriteBigNumber writes a big number given as a string of digits,
+// RESP2 uses bulk string for that
+func (w *Writer) WriteBigNumber(n string) error {
+	if w.proto < RESP3 {
+		return w.WriteBulkString(n)
+	}
+	return w.writeLine(TypeBigNumber, n)
+}
+
+// WriteVerbatimString writes a verbatim string with the given three letters
+// format (txt, mkd), RESP2 uses bulk string for that
+func (w *Writer) WriteVerbatimString(format string, s string) error {
+	if w.proto < RESP3 {
+		return w.WriteBulkString(s)
+	}
+	w.writeHeader(TypeVerbatimString, int64(len(s)+4))
+	w.buf.WriteString(format)
+	w.buf.WriteByte(':')
+	w.buf.WriteString(s)
+	_, err := w.buf.WriteString("\r\n")
+	return err
+}
+
+// WriteRawBulk writes a bulk string header followed by the data without
+// the trailing \r\n, that's how RDB files are transferred to replicas
+func (w *Writer) WriteRawBulk(data []byte) error {
+	w.writeHeader(TypeBulkString, int64(len(data)))
+	_, err := w.buf.Write(data)
+	return err
+}
+
+// WriteValue writes the value exactly as it is, with its own type
+// and no regard to the protocol version
+func (w *Writer) WriteValue(v Value) error {
+	if len(v.Attrs) > 0 {
+		w.writeHeader(TypeAttribute, int64(len(v.Attrs)/2))
+		for _, attr := range v.Attrs {
+			w.WriteValue(attr)
+		}
+	}
+
+	switch v.Type {
+	case TypeSimpleString, TypeSimpleError, TypeBigNumber:
+		return w.writeLine(v.Type, v.Str)
+	case TypeInteger:
+		return w.writeHeader(TypeInteger, v.Int)
+	case TypeNull:
+		return w.writeLine(TypeNull, "")
+	case TypeBoolean:
+		if v.Bool {
+			return w.writeLine(TypeBoolean, "t")
+		}
+		return w.writeLine(TypeBoolean, "f")
+	case TypeDouble:
+		return w.writeLine(TypeDouble, FormatDouble(v.Float))
+	case TypeBulkString, TypeBulkError:
+		if v.Null {
+			return w.writeHeader(v.Type, -1)
+		}
+		return w.writeBulk(v.Type, v.Str)
+	case TypeVerbatimString:
+		return w.writeBulk(TypeVerbatimString, v.Format+":"+v.Str)
+	case TypeArray, TypeSet, TypePush, TypeMap:
+		if v.Null {
+			// RESP2 null array, the other aggregates can't be null
+			return w.writeHeader(v.Type, -1)
+		}
+		n := len(v.Elems)
+		if v.Type == TypeMap {
+			n /= 2
+		}
+		err := w.writeHeader(v.Type, int64(n))
+		for _, elem := range v.Elems {
+			err = w.WriteValue(elem)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown type '%c'", v.Type)
+}
+
+// AppendCommand appends the command encoded as an array of bulk strings to dst
+func AppendCommand(dst []byte, args []string) []byte {
+	dst = append(dst, TypeArray)
+	dst = strconv.AppendInt(dst, int64(len(args)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, arg := range args {
+		dst = append(dst, TypeBulkString)
+		dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+		dst = append(dst, '\r', '\n')
+		dst = append(dst, arg...)
+		dst = append(dst, '\r', '\n')
+	}
+	return dst
+}
+
+// CommandLen returns the size of the command encoded as an array of bulk strings
+func CommandLen(args []string) int {
+	n := 1 + digits(len(args)) + 2
+	for _, arg := range args {
+		n += 1 + digits(len(arg)) + 2 + len(arg) + 2
+	}
+	return n
+}
+
+// digits returns the number of decimal digits of a non-negative n
+func digits(n int) int {
+	d := 1
+	for n >= 10 {
+		n /= 10
+		d++
+	}
+	return d
+}
@@ -0,0 +1,100 @@
+package resp
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	// mixed and nested array: [1, "two", [null array], -3]
+	w.WriteArrayHeader(4)
+	w.WriteInteger(1)
+	w.WriteBulkString("two")
+	w.WriteArrayHeader(1)
+	w.WriteNullArray()
+	w.WriteInteger(-3)
+	assert.Equal(t, 0, buf.Len(), "nothing is written before Flush")
+	w.Flush()
+	assert.Equal(t, "*4\r\n:1\r\n$3\r\ntwo\r\n*1\r\n*-1\r\n:-3\r\n", buf.String())
+
+	// RESP3 types fall back to RESP2
+	buf.Reset()
+	w.WriteNull()
+	w.WriteBoolean(true)
+	w.WriteDouble(1.5)
+	w.WriteMapHeader(1)
+	w.WriteVerbatimString("txt", "hi")
+	w.WriteBulkString("")
+	w.WriteAttributeHeader(1)
+	w.WriteBulkError("ERR bad")
+	w.Flush()
+	assert.Equal(t, "$-1\r\n:1\r\n$3\r\n1.5\r\n*2\r\n$2\r\nhi\r\n$0\r\n\r\n-ERR bad\r\n", buf.String())
+
+	buf.Reset()
+	w.SetProto(RESP3)
+	w.WriteNull()
+	w.WriteBoolean(true)
+	w.WriteDouble(1.5)
+	w.WriteMapHeader(1)
+	w.WriteVerbatimString("txt", "hi")
+	w.WriteSetHeader(0)
+	w.WriteBigNumber("12345678901234567890")
+	w.WritePushHeader(0)
+	w.WriteBulkError("ERR bad")
+	w.Flush()
+	assert.Equal(t, "_\r\n#t\r\n,1.5\r\n%1\r\n=6\r\ntxt:hi\r\n~0\r\n(12345678901234567890\r\n>0\r\n!7\r\nERR bad\r\n", buf.String())
+}
+
+func TestFormatDouble(t *testing.T) {
+
+	for f, expected := range map[float64]string{
+		1.5:         "1.5",
+		1000000:     "1000000",
+		-1000001:    "-1000001",
+		1 << 53:     "9007199254740992",
+		1 << 54:     "18014398509481984",
+		1e20:        "1e+20",
+		0.1:         "0.10000000000000001",
+		math.Inf(1): "inf",
+	} {
+		assert.Equal(t, expected, FormatDouble(f))
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	// values are written with their own types regardless of the protocol version
+	w.WriteValue(Value{Type: TypeMap, Elems: []Value{
+		{Type: TypeSimpleString, Str: "k"},
+		{Type: TypeSet, Elems: []Value{{Type: TypeNull, Null: true}, {Type: TypeDouble, Float: 2}}},
+	}, Attrs: []Value{{Type: TypeBulkString, Str: "a"}, {Type: TypeBoolean, Bool: false}}})
+	w.WriteValue(Value{Type: TypeBulkString, Null: true})
+	w.Flush()
+	assert.Equal(t, "|1\r\n$1\r\na\r\n#f\r\n%1\r\n+k\r\n~2\r\n_\r\n,2\r\n$-1\r\n", buf.String())
+
+	assert.Error(t, w.WriteValue(Value{Type: '?'}))
+}
+
+func TestAppendCommand(t *testing.T) {
+
+	for _, args := range [][]string{{}, {"PING"}, {"SET", "k", "a\r\nb"}, {"ECHO", string(make([]byte, 12345))}} {
+		cmd := AppendCommand(nil, args)
+		assert.Equal(t, len(cmd), CommandLen(args))
+
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		w.WriteArray(args)
+		w.Flush()
+		assert.Equal(t, buf.Bytes(), cmd)
+	}
+}